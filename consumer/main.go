@@ -2,9 +2,8 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"flag"
+	"lambda/urls"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -29,9 +28,9 @@ const (
 	stateFailed     = "failed"
 )
 
+// hashURL returns the url_hash the producer and crawler key u's item by
 func hashURL(u string) string {
-	h := sha256.Sum256([]byte(u))
-	return hex.EncodeToString(h[:])
+	return urls.Hash(urls.Canonicalize(u))
 }
 
 func generateWorkerID() string {
@@ -78,6 +77,8 @@ func main() {
 	logFormat := flag.String("log-format", "console", "Log format: console (colored) or json")
 	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn, error")
 	batchSize := flag.Int("batch-size", 1, "Number of messages to fetch per poll (1-10)")
+	maxMessages := flag.Int("max-messages", 0, "Stop after processing N messages in continuous mode (0 = unlimited)")
+	maxRuntime := flag.Duration("max-runtime", 0, "Stop continuous mode after this long, e.g. 30m (0 = unlimited)")
 	flag.Parse()
 
 	// Validate batch size
@@ -100,6 +101,10 @@ func main() {
 		log.Fatal().Msg("QUEUE_URL and TABLE_NAME must be set")
 	}
 
+	// Items are keyed as the producer keys them, which depends on PRESERVE_FRAGMENTS
+	preserveFragments, _ := strconv.ParseBool(os.Getenv("PRESERVE_FRAGMENTS"))
+	urls.SetPreserveFragments(preserveFragments)
+
 	// Load AWS config before context setup to avoid exitAfterDefer issue
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
@@ -122,43 +127,94 @@ func main() {
 	ddb := dynamodb.NewFromConfig(cfg)
 
 	if *continuous {
-		log.Info().Int("batch_size", *batchSize).Msg("Starting continuous polling (Ctrl+C to stop)")
-		runLoop(ctx, sqsClient, ddb, queueURL, tableName, *fail, *batchSize, &log)
+		limits := runLimits{maxMessages: *maxMessages, maxRuntime: *maxRuntime}
+		log.Info().Int("batch_size", *batchSize).Int("max_messages", *maxMessages).Dur("max_runtime", *maxRuntime).Msg("Starting continuous polling (Ctrl+C to stop)")
+		runLoop(ctx, sqsClient, ddb, queueURL, tableName, *fail, *batchSize, limits, time.Now, &log)
 	} else {
-		pollOnce(ctx, sqsClient, ddb, queueURL, tableName, *fail, *batchSize, &log)
+		pollOnce(ctx, ctx, sqsClient, ddb, queueURL, tableName, *fail, *batchSize, &log)
+	}
+}
+
+// runLimits bounds a continuous run; zero values mean unlimited
+type runLimits struct {
+	maxMessages int           // Messages to process before stopping
+	maxRuntime  time.Duration // Time to poll before stopping
+}
+
+// stopReason returns why a run that has processed messages over elapsed should stop,
+// or "" to keep polling
+func (l runLimits) stopReason(processed int, elapsed time.Duration) string {
+	switch {
+	case l.maxMessages > 0 && processed >= l.maxMessages:
+		return "max messages"
+	case l.maxRuntime > 0 && elapsed >= l.maxRuntime:
+		return "max runtime"
 	}
+	return ""
 }
 
-func runLoop(ctx context.Context, sqsClient *sqs.Client, ddb *dynamodb.Client, queueURL, tableName string, simulateFail bool, batchSize int, log *zerolog.Logger) {
+// runLoop polls until the context is cancelled or a limit is reached, checking the limits
+// against now before each poll. Returns the total number of messages processed.
+// maxRuntime also bounds each long poll, so a run never waits out a receive past its time, but
+// never the messages already received: they are claimed, finished and acked in full.
+func runLoop(ctx context.Context, sqsClient SQSAPI, ddb DynamoDBAPI, queueURL, tableName string, simulateFail bool, batchSize int, limits runLimits, now func() time.Time, log *zerolog.Logger) int {
+	receiveCtx := ctx
+	if limits.maxRuntime > 0 {
+		var stop context.CancelFunc
+		receiveCtx, stop = context.WithTimeout(ctx, limits.maxRuntime)
+		defer stop()
+	}
+
+	started := now()
+	processed := 0
 	for {
 		select {
 		case <-ctx.Done():
-			log.Info().Msg("Stopped")
-			return
+			log.Info().Int("processed", processed).Msg("Stopped")
+			return processed
 		default:
 		}
 
-		pollOnce(ctx, sqsClient, ddb, queueURL, tableName, simulateFail, batchSize, log)
+		reason := limits.stopReason(processed, now().Sub(started))
+		if reason == "" && receiveCtx.Err() != nil {
+			reason = "max runtime"
+		}
+		if reason != "" {
+			log.Info().Int("processed", processed).Str("reason", reason).Msg("Reached run limit, stopping")
+			return processed
+		}
+
+		processed += pollOnce(receiveCtx, ctx, sqsClient, ddb, queueURL, tableName, simulateFail, remainingBatch(batchSize, limits.maxMessages, processed), log)
+	}
+}
+
+// remainingBatch shrinks the receive size so a bounded run never pulls more messages than it will process
+func remainingBatch(batchSize, maxMessages, processed int) int {
+	if maxMessages <= 0 {
+		return batchSize
 	}
+	return min(batchSize, maxMessages-processed)
 }
 
-func pollOnce(ctx context.Context, sqsClient *sqs.Client, ddb *dynamodb.Client, queueURL, tableName string, simulateFail bool, batchSize int, log *zerolog.Logger) {
-	out, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+// pollOnce receives up to batchSize messages under receiveCtx and processes them all under ctx.
+// Returns the number processed.
+func pollOnce(receiveCtx, ctx context.Context, sqsClient SQSAPI, ddb DynamoDBAPI, queueURL, tableName string, simulateFail bool, batchSize int, log *zerolog.Logger) int {
+	out, err := sqsClient.ReceiveMessage(receiveCtx, &sqs.ReceiveMessageInput{
 		QueueUrl:            &queueURL,
 		MaxNumberOfMessages: int32(batchSize),
 		WaitTimeSeconds:     20, // Long polling (max)
 	})
 	if err != nil {
-		if ctx.Err() != nil {
-			return // Shutdown requested
+		if receiveCtx.Err() != nil {
+			return 0 // Shutdown requested or out of time
 		}
 		log.Error().Err(err).Msg("Poll error")
-		return
+		return 0
 	}
 
 	if len(out.Messages) == 0 {
 		log.Debug().Msg("No messages")
-		return
+		return 0
 	}
 
 	log.Debug().Int("count", len(out.Messages)).Msg("Received batch")
@@ -166,9 +222,10 @@ func pollOnce(ctx context.Context, sqsClient *sqs.Client, ddb *dynamodb.Client,
 	for _, msg := range out.Messages {
 		processMessage(ctx, sqsClient, ddb, queueURL, tableName, msg, simulateFail, log)
 	}
+	return len(out.Messages)
 }
 
-func processMessage(ctx context.Context, sqsClient *sqs.Client, ddb *dynamodb.Client, queueURL, tableName string, msg sqstypes.Message, simulateFail bool, log *zerolog.Logger) {
+func processMessage(ctx context.Context, sqsClient SQSAPI, ddb DynamoDBAPI, queueURL, tableName string, msg sqstypes.Message, simulateFail bool, log *zerolog.Logger) {
 	url := *msg.Body
 	urlHash := hashURL(url)
 
@@ -261,7 +318,7 @@ func processMessage(ctx context.Context, sqsClient *sqs.Client, ddb *dynamodb.Cl
 	log.Info().Str("url", url).Msg("Processed successfully")
 }
 
-func ack(ctx context.Context, client *sqs.Client, queueURL string, receipt *string) {
+func ack(ctx context.Context, client SQSAPI, queueURL string, receipt *string) {
 	_, _ = client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
 		QueueUrl:      &queueURL,
 		ReceiptHandle: receipt,
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+)
+
+func TestRunLoopStopsAfterMaxMessages(t *testing.T) {
+	tests := []struct {
+		name         string
+		batchSize    int
+		maxMessages  int
+		wantReceives []int32
+	}{
+		{"single batch", 10, 5, []int32{5}},
+		{"exact multiple of batch", 5, 10, []int32{5, 5}},
+		{"partial last batch", 10, 12, []int32{10, 2}},
+		{"batch size one", 1, 3, []int32{1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := zerolog.New(io.Discard)
+			sqsClient := &mockSQS{backlog: 100}
+
+			got := runLoop(context.Background(), sqsClient, lostRaceDynamoDB(), "queue", "table", false, tt.batchSize, runLimits{maxMessages: tt.maxMessages}, time.Now, &log)
+			if got != tt.maxMessages {
+				t.Errorf("runLoop() processed = %d, want %d", got, tt.maxMessages)
+			}
+			if sqsClient.deleteCalls != tt.maxMessages {
+				t.Errorf("expected %d acks, got %d", tt.maxMessages, sqsClient.deleteCalls)
+			}
+			if fmt.Sprint(sqsClient.received) != fmt.Sprint(tt.wantReceives) {
+				t.Errorf("receive sizes = %v, want %v", sqsClient.received, tt.wantReceives)
+			}
+		})
+	}
+}
+
+func TestRunLoopCountsAcrossEmptyPolls(t *testing.T) {
+	log := zerolog.New(io.Discard)
+	sqsClient := &mockSQS{backlog: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if sqsClient.backlog == 0 {
+				cancel()
+			}
+			return nil, fmt.Errorf("ConditionalCheckFailedException")
+		},
+	}
+
+	got := runLoop(ctx, sqsClient, ddb, "queue", "table", false, 2, runLimits{maxMessages: 10}, time.Now, &log)
+	if got != 3 {
+		t.Errorf("runLoop() processed = %d, want 3", got)
+	}
+}
+
+func TestRunLoopStopsAfterMaxRuntime(t *testing.T) {
+	log := zerolog.New(io.Discard)
+	sqsClient := &mockSQS{backlog: 100}
+
+	// Each reading of the clock is a minute later, so polls happen at 1m, 2m and 3m and the 4m check stops
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := func() time.Time {
+		t := clock
+		clock = clock.Add(time.Minute)
+		return t
+	}
+
+	got := runLoop(context.Background(), sqsClient, lostRaceDynamoDB(), "queue", "table", false, 2, runLimits{maxRuntime: 4 * time.Minute}, now, &log)
+	if got != 6 {
+		t.Errorf("runLoop() processed = %d, want 6 (three polls of 2)", got)
+	}
+	if len(sqsClient.received) != 3 {
+		t.Errorf("polls = %d, want 3", len(sqsClient.received))
+	}
+}
+
+// TestRunLoopFinishesMessageWhenMaxRuntimeExpires checks that a message in flight when the run's
+// time is up is still claimed, marked and acked rather than left processing and unacked
+func TestRunLoopFinishesMessageWhenMaxRuntimeExpires(t *testing.T) {
+	log := zerolog.New(io.Discard)
+	sqsClient := &mockSQS{backlog: 1}
+
+	var updates, cancelled int
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(ctx context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			updates++
+			if updates == 1 {
+				time.Sleep(100 * time.Millisecond) // The claim outlasts the run
+			}
+			if ctx.Err() != nil {
+				cancelled++
+				return nil, ctx.Err()
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	got := runLoop(context.Background(), sqsClient, ddb, "queue", "table", true, 10, runLimits{maxRuntime: 20 * time.Millisecond}, time.Now, &log)
+	if got != 1 {
+		t.Errorf("runLoop() processed = %d, want 1", got)
+	}
+	if updates != 2 || cancelled != 0 {
+		t.Errorf("UpdateItem calls = %d (%d cancelled), want the claim and the failed mark, none cancelled", updates, cancelled)
+	}
+	if sqsClient.deleteCalls != 1 || sqsClient.cancelledDeletes != 0 {
+		t.Errorf("acks = %d (%d cancelled), want 1 that goes through", sqsClient.deleteCalls, sqsClient.cancelledDeletes)
+	}
+	if len(sqsClient.received) != 1 {
+		t.Errorf("polls = %d, want 1: the run is out of time after the first", len(sqsClient.received))
+	}
+}
+
+func TestRunLimitsStopReason(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    runLimits
+		processed int
+		elapsed   time.Duration
+		want      string
+	}{
+		{"unlimited", runLimits{}, 1000, 24 * time.Hour, ""},
+		{"under both limits", runLimits{maxMessages: 10, maxRuntime: time.Minute}, 9, 59 * time.Second, ""},
+		{"max messages reached", runLimits{maxMessages: 10}, 10, 0, "max messages"},
+		{"max runtime reached", runLimits{maxRuntime: time.Minute}, 3, time.Minute, "max runtime"},
+		{"runtime limit ignores message count", runLimits{maxRuntime: time.Minute}, 1000, time.Second, ""},
+		{"both reached reports messages", runLimits{maxMessages: 5, maxRuntime: time.Minute}, 5, time.Hour, "max messages"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.stopReason(tt.processed, tt.elapsed); got != tt.want {
+				t.Errorf("stopReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemainingBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		batchSize   int
+		maxMessages int
+		processed   int
+		want        int
+	}{
+		{"unlimited", 10, 0, 50, 10},
+		{"plenty remaining", 10, 100, 50, 10},
+		{"fewer remaining than batch", 10, 100, 97, 3},
+		{"one remaining", 5, 10, 9, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remainingBatch(tt.batchSize, tt.maxMessages, tt.processed); got != tt.want {
+				t.Errorf("remainingBatch() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
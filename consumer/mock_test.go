@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// mockDynamoDB implements DynamoDBAPI for testing
+type mockDynamoDB struct {
+	updateItemFunc func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+func (m *mockDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if m.updateItemFunc != nil {
+		return m.updateItemFunc(ctx, params, optFns...)
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// mockSQS serves messages from an in-memory backlog
+type mockSQS struct {
+	backlog          int
+	received         []int32
+	deleteCalls      int
+	cancelledDeletes int // Deletes made with an already cancelled context, which SQS would not see
+	nextMessageN     int
+}
+
+func (m *mockSQS) ReceiveMessage(_ context.Context, params *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	m.received = append(m.received, params.MaxNumberOfMessages)
+	n := min(int(params.MaxNumberOfMessages), m.backlog)
+	m.backlog -= n
+
+	msgs := make([]sqstypes.Message, n)
+	for i := range msgs {
+		body := "https://example.com/" + strconv.Itoa(m.nextMessageN)
+		receipt := "receipt-" + strconv.Itoa(m.nextMessageN)
+		m.nextMessageN++
+		msgs[i] = sqstypes.Message{Body: &body, ReceiptHandle: &receipt}
+	}
+	return &sqs.ReceiveMessageOutput{Messages: msgs}, nil
+}
+
+func (m *mockSQS) DeleteMessage(ctx context.Context, _ *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	m.deleteCalls++
+	if ctx.Err() != nil {
+		m.cancelledDeletes++
+		return nil, ctx.Err()
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// lostRaceDynamoDB fails every claim so processMessage acks immediately without simulated work
+func lostRaceDynamoDB() *mockDynamoDB {
+	return &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			return nil, fmt.Errorf("ConditionalCheckFailedException")
+		},
+	}
+}
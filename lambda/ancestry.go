@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// ancestryKey is the context key for the discovery path of the message being processed
+type ancestryKey struct{}
+
+// withAncestry returns ctx carrying the URLs a message's page was discovered through, parent first.
+// Requeues keep it, and saveFetchResult stores it on the item.
+func withAncestry(ctx context.Context, ancestry []string) context.Context {
+	return context.WithValue(ctx, ancestryKey{}, ancestry)
+}
+
+// ancestryFor returns the ancestry carried by ctx, or nil for a seed
+func ancestryFor(ctx context.Context) []string {
+	ancestry, _ := ctx.Value(ancestryKey{}).([]string)
+	return ancestry
+}
+
+// childAncestry returns the ancestry of links found on sourceURL: sourceURL followed by its own
+// ancestry, capped at maxStoredAncestry entries so the oldest hops fall off a deep crawl
+func childAncestry(ctx context.Context, sourceURL string) []string {
+	parent := ancestryFor(ctx)
+	ancestry := make([]string, 0, min(len(parent)+1, maxStoredAncestry))
+	ancestry = append(ancestry, sourceURL)
+	return append(ancestry, parent[:min(len(parent), maxStoredAncestry-1)]...)
+}
+
+// addAncestryAttrs sets parent_url and ancestry (newline-separated, parent first) on a message,
+// or nothing for an empty ancestry
+func addAncestryAttrs(attrs map[string]sqstypes.MessageAttributeValue, ancestry []string) {
+	if len(ancestry) == 0 {
+		return
+	}
+	attrs["parent_url"] = sqstypes.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(ancestry[0]),
+	}
+	attrs["ancestry"] = sqstypes.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(strings.Join(ancestry, "\n")),
+	}
+}
+
+// ancestryAttr returns ancestry as a DynamoDB list, which keeps hop order
+func ancestryAttr(ancestry []string) dynamodbtypes.AttributeValue {
+	hops := make([]dynamodbtypes.AttributeValue, len(ancestry))
+	for i, u := range ancestry {
+		hops[i] = &dynamodbtypes.AttributeValueMemberS{Value: u}
+	}
+	return &dynamodbtypes.AttributeValueMemberL{Value: hops}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestExtractAncestry(t *testing.T) {
+	c := newTestCrawler()
+	deep := make([]string, maxStoredAncestry+5)
+	for i := range deep {
+		deep[i] = fmt.Sprintf("https://example.com/%d", i)
+	}
+
+	tests := []struct {
+		name  string
+		attrs map[string]events.SQSMessageAttribute
+		want  []string
+	}{
+		{"seed", nil, nil},
+		{"parent only", map[string]events.SQSMessageAttribute{"parent_url": {StringValue: aws.String("https://example.com/")}}, []string{"https://example.com/"}},
+		{"ancestry", map[string]events.SQSMessageAttribute{
+			"parent_url": {StringValue: aws.String("https://example.com/a")},
+			"ancestry":   {StringValue: aws.String("https://example.com/a\nhttps://example.com/")},
+		}, []string{"https://example.com/a", "https://example.com/"}},
+		{"capped", map[string]events.SQSMessageAttribute{"ancestry": {StringValue: aws.String(strings.Join(deep, "\n"))}}, deep[:maxStoredAncestry]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.extractAncestry(&events.SQSMessage{MessageAttributes: tt.attrs}); !slices.Equal(got, tt.want) {
+				t.Errorf("extractAncestry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChildAncestry(t *testing.T) {
+	if got := childAncestry(context.Background(), "https://example.com/"); !slices.Equal(got, []string{"https://example.com/"}) {
+		t.Errorf("childAncestry() of a seed = %v, want just the seed", got)
+	}
+
+	ctx := withAncestry(context.Background(), []string{"https://example.com/a", "https://example.com/"})
+	want := []string{"https://example.com/a/b", "https://example.com/a", "https://example.com/"}
+	if got := childAncestry(ctx, "https://example.com/a/b"); !slices.Equal(got, want) {
+		t.Errorf("childAncestry() = %v, want %v", got, want)
+	}
+
+	full := make([]string, maxStoredAncestry)
+	for i := range full {
+		full[i] = fmt.Sprintf("https://example.com/%d", i)
+	}
+	got := childAncestry(withAncestry(context.Background(), full), "https://example.com/next")
+	if len(got) != maxStoredAncestry || got[0] != "https://example.com/next" || got[len(got)-1] != full[maxStoredAncestry-2] {
+		t.Errorf("childAncestry() of a full chain = %v, want the newest %d hops", got, maxStoredAncestry)
+	}
+}
+
+// TestProcessMessagePropagatesAncestry follows a page's discovery path onto its item and on to
+// the links found on it
+func TestProcessMessagePropagatesAncestry(t *testing.T) {
+	ddb := authItemDDB(nil)
+	var saved map[string]dynamodbtypes.AttributeValue
+	ddb.updateItemFunc = func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		if _, ok := in.ExpressionAttributeValues[":failure_kind"]; ok {
+			saved = in.ExpressionAttributeValues
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	var batch *sqs.SendMessageBatchInput
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			batch = in
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><body><a href="/a/b">B</a></body></html>`)
+	}))
+
+	record := &events.SQSMessage{
+		Body: "https://example.com/a",
+		MessageAttributes: map[string]events.SQSMessageAttribute{
+			"parent_url": {StringValue: aws.String("https://example.com/"), DataType: "String"},
+			"ancestry":   {StringValue: aws.String("https://example.com/"), DataType: "String"},
+		},
+	}
+	if _, err := c.processMessage(context.Background(), record); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+
+	if saved == nil {
+		t.Fatal("fetch result not saved")
+	}
+	if got := saved[":parent_url"].(*dynamodbtypes.AttributeValueMemberS).Value; got != "https://example.com/" {
+		t.Errorf("parent_url = %q, want https://example.com/", got)
+	}
+	if got := saved[":ancestry"].(*dynamodbtypes.AttributeValueMemberL).Value; len(got) != 1 {
+		t.Errorf("ancestry = %v, want the one parent", got)
+	}
+
+	if batch == nil || len(batch.Entries) != 1 {
+		t.Fatalf("batch = %+v, want 1 child link", batch)
+	}
+	attrs := batch.Entries[0].MessageAttributes
+	if got := *attrs["parent_url"].StringValue; got != "https://example.com/a" {
+		t.Errorf("child parent_url = %q, want https://example.com/a", got)
+	}
+	if got := *attrs["ancestry"].StringValue; got != "https://example.com/a\nhttps://example.com/" {
+		t.Errorf("child ancestry = %q, want the page then its parent", got)
+	}
+}
+
+func TestSaveFetchResultSeedHasNoParent(t *testing.T) {
+	var update *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if in.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value == "abc123" { // Not the domain stats update
+				update = in
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	if err := c.saveFetchResult(context.Background(), "https://example.com/", "abc123", &FetchResult{Success: true, StatusCode: 200}, 0); err != nil {
+		t.Fatalf("saveFetchResult() error = %v", err)
+	}
+	if strings.Contains(*update.UpdateExpression, "parent_url") {
+		t.Errorf("seed update sets parent_url: %q", *update.UpdateExpression)
+	}
+}
+
+func TestRequeueWithDelayKeepsAncestry(t *testing.T) {
+	var sent *sqs.SendMessageInput
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, in *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			sent = in
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
+	ctx := withAncestry(context.Background(), []string{"https://example.com/a", "https://example.com/"})
+	if err := c.requeueWithDelay(ctx, "https://example.com/a/b", "hash", 2, priorityNormal, 10); err != nil {
+		t.Fatalf("requeueWithDelay() error = %v", err)
+	}
+	if got := *sent.MessageAttributes["parent_url"].StringValue; got != "https://example.com/a" {
+		t.Errorf("parent_url = %q, want the message's own parent", got)
+	}
+	if got := *sent.MessageAttributes["ancestry"].StringValue; got != "https://example.com/a\nhttps://example.com/" {
+		t.Errorf("ancestry = %q, want it unchanged", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// errBudgetExhausted means the crawl#budget counter has reached MAX_TOTAL_URLS
+var errBudgetExhausted = errors.New("crawl budget exhausted")
+
+// reserveBudget atomically counts one more discovered URL against MAX_TOTAL_URLS.
+// The conditional ADD never lets the counter pass the limit, however many Lambdas race.
+// Returns errBudgetExhausted once the limit is reached; a no-op when the budget is disabled.
+func (c *Crawler) reserveBudget(ctx context.Context) error {
+	if c.maxTotalURLs <= 0 {
+		return nil
+	}
+
+	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: crawlBudgetKey},
+		},
+		UpdateExpression:    aws.String("ADD url_count :one"),
+		ConditionExpression: aws.String("attribute_not_exists(url_count) OR url_count < :max"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":one": &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+			":max": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(c.maxTotalURLs, 10)},
+		},
+	})
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return errBudgetExhausted
+	}
+	return err
+}
+
+// refundBudget gives back a slot reserved for a link that turned out to be a duplicate
+func (c *Crawler) refundBudget(ctx context.Context) {
+	if c.maxTotalURLs <= 0 {
+		return
+	}
+
+	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: crawlBudgetKey},
+		},
+		UpdateExpression: aws.String("ADD url_count :refund"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":refund": &dynamodbtypes.AttributeValueMemberN{Value: "-1"},
+		},
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Msg("Failed to refund crawl budget")
+	}
+}
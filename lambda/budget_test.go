@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog"
+)
+
+// budgetDDB simulates the crawl#budget counter, honouring the conditional ADD.
+// Every allowlist lookup is active and PutItem fails for URLs listed in known.
+func budgetDDB(count *int64, known map[string]bool) *mockDynamoDB {
+	ddb := authItemDDB(nil)
+	ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		if key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value; key != crawlBudgetKey {
+			return nil, fmt.Errorf("unexpected update of %s", key)
+		}
+		if maxAttr, ok := input.ExpressionAttributeValues[":max"].(*dynamodbtypes.AttributeValueMemberN); ok {
+			limit, _ := strconv.ParseInt(maxAttr.Value, 10, 64)
+			if *count >= limit {
+				return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+			}
+			*count++
+			return &dynamodb.UpdateItemOutput{}, nil
+		}
+		*count-- // refund
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	ddb.putItemFunc = func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		if u, ok := input.Item["url"].(*dynamodbtypes.AttributeValueMemberS); ok && known[u.Value] {
+			return nil, errConditionalCheckFailed
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}
+	return ddb
+}
+
+func TestReserveBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int64
+		count   int64
+		wantErr error
+		want    int64
+	}{
+		{"disabled", 0, 100, nil, 100},
+		{"first url", 10, 0, nil, 1},
+		{"below limit", 10, 8, nil, 9},
+		{"last slot", 10, 9, nil, 10},
+		{"at limit", 10, 10, errBudgetExhausted, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count := tt.count
+			c := newTestCrawlerWithMocks(budgetDDB(&count, nil), &mockSQS{}, &mockS3{})
+			c.maxTotalURLs = tt.max
+
+			if err := c.reserveBudget(context.Background()); !errors.Is(err, tt.wantErr) {
+				t.Errorf("reserveBudget() error = %v, want %v", err, tt.wantErr)
+			}
+			if count != tt.want {
+				t.Errorf("counter = %d, want %d", count, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserveBudgetConditionExpression(t *testing.T) {
+	var input *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			input = in
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.maxTotalURLs = 500
+	if err := c.reserveBudget(context.Background()); err != nil {
+		t.Fatalf("reserveBudget() error = %v", err)
+	}
+
+	if *input.UpdateExpression != "ADD url_count :one" {
+		t.Errorf("UpdateExpression = %q", *input.UpdateExpression)
+	}
+	if *input.ConditionExpression != "attribute_not_exists(url_count) OR url_count < :max" {
+		t.Errorf("ConditionExpression = %q", *input.ConditionExpression)
+	}
+	if got := input.ExpressionAttributeValues[":max"].(*dynamodbtypes.AttributeValueMemberN).Value; got != "500" {
+		t.Errorf(":max = %s, want 500", got)
+	}
+}
+
+func TestReserveBudgetOtherErrorNotExhausted(t *testing.T) {
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			return nil, fmt.Errorf("ProvisionedThroughputExceededException")
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.maxTotalURLs = 10
+	err := c.reserveBudget(context.Background())
+	if err == nil || errors.Is(err, errBudgetExhausted) {
+		t.Errorf("reserveBudget() error = %v, want a non-budget error", err)
+	}
+}
+
+func TestEnqueueLinksStopsWhenBudgetHitMidBatch(t *testing.T) {
+	count := int64(7)
+	var buf bytes.Buffer
+	var sent []string
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			for _, e := range input.Entries {
+				sent = append(sent, *e.MessageBody)
+			}
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	// /dup is already known: its slot is refunded and does not count toward the budget
+	c := newTestCrawlerWithMocks(budgetDDB(&count, map[string]bool{"https://example.com/dup": true}), sqsClient, &mockS3{})
+	c.maxTotalURLs = 10
+	c.log = zerolog.New(&buf)
+
+	links := []string{
+		"https://example.com/a",
+		"https://example.com/dup",
+		"https://example.com/b",
+		"https://example.com/c",
+		"https://example.com/d",
+		"https://example.com/e",
+	}
+	enqueued := c.enqueueLinks(context.Background(), links, 1, "https://example.com")
+
+	want := []string{"https://example.com/a", "https://example.com/b", "https://example.com/c"}
+	if enqueued != len(want) || strings.Join(sent, " ") != strings.Join(want, " ") {
+		t.Errorf("enqueueLinks() = %d, sent %v, want %v", enqueued, sent, want)
+	}
+	if count != 10 {
+		t.Errorf("counter = %d, want 10", count)
+	}
+	if n := strings.Count(buf.String(), "Crawl budget reached"); n != 1 {
+		t.Errorf("budget warnings = %d, want 1", n)
+	}
+}
+
+func TestEnqueueLinksBudgetDisabledSkipsCounter(t *testing.T) {
+	count := int64(0)
+	c := newTestCrawlerWithMocks(budgetDDB(&count, nil), &mockSQS{}, &mockS3{})
+
+	enqueued := c.enqueueLinks(context.Background(), []string{"https://example.com/a", "https://example.com/b"}, 1, "https://example.com")
+	if enqueued != 2 {
+		t.Errorf("enqueueLinks() = %d, want 2", enqueued)
+	}
+	if count != 0 {
+		t.Errorf("counter = %d, want 0 when MAX_TOTAL_URLS is unset", count)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// recordFetchFailure counts a retriable failure (5xx, timeout, connection error) against domain's
+// item. The count lives in failures and restarts once failures_since is older than breakerWindow.
+// When it reaches CIRCUIT_FAILURE_THRESHOLD the breaker trips: circuit_open_until is set on host's
+// allowlist item, so its links stop being enqueued and queued URLs wait until the cooldown ends.
+func (c *Crawler) recordFetchFailure(ctx context.Context, domain, host string) {
+	if c.breakerMax <= 0 {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	key := map[string]dynamodbtypes.AttributeValue{
+		"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: domainKeyPrefix + domain},
+	}
+	cutoff := strconv.FormatInt(now-c.breakerWindow.Milliseconds(), 10)
+
+	failures := 1
+	result, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &c.tableName,
+		Key:                 key,
+		UpdateExpression:    aws.String("ADD failures :one"),
+		ConditionExpression: aws.String("failures_since >= :cutoff"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":one":    &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+			":cutoff": &dynamodbtypes.AttributeValueMemberN{Value: cutoff},
+		},
+		ReturnValues: dynamodbtypes.ReturnValueUpdatedNew,
+	})
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	switch {
+	case err == nil:
+		if v, ok := result.Attributes["failures"].(*dynamodbtypes.AttributeValueMemberN); ok {
+			failures, _ = strconv.Atoi(v.Value)
+		}
+	case errors.As(err, &condErr):
+		// No window yet, or the last one has expired: this failure starts a new one
+		_, err = c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           &c.tableName,
+			Key:                 key,
+			UpdateExpression:    aws.String("SET failures = :one, failures_since = :now"),
+			ConditionExpression: aws.String("attribute_not_exists(failures_since) OR failures_since < :cutoff"),
+			ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+				":one":    &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+				":now":    &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+				":cutoff": &dynamodbtypes.AttributeValueMemberN{Value: cutoff},
+			},
+		})
+		if err != nil {
+			// Another invocation started the window first; this failure goes uncounted
+			c.log.Debug().Err(err).Str("domain", domain).Msg("Failed to start failure window")
+			return
+		}
+	default:
+		c.log.Warn().Err(err).Str("domain", domain).Msg("Failed to record fetch failure")
+		return
+	}
+
+	if failures >= c.breakerMax {
+		c.tripCircuit(ctx, domain, host, failures)
+	}
+}
+
+// tripCircuit opens host's circuit for breakerCool and clears domain's failure count, so the
+// breaker needs a full CIRCUIT_FAILURE_THRESHOLD of new failures to trip again after the cooldown.
+// Hosts without an allowlist item are not paused; their links are never enqueued anyway.
+func (c *Crawler) tripCircuit(ctx context.Context, domain, host string, failures int) {
+	scope := c.scopeHost(host)
+	until := time.Now().Add(c.breakerCool)
+	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + scope},
+		},
+		UpdateExpression:    aws.String("SET circuit_open_until = :until"),
+		ConditionExpression: aws.String("attribute_exists(url_hash)"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":until": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(until.UnixMilli(), 10)},
+		},
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Str("domain", scope).Msg("Failed to open circuit")
+		return
+	}
+	c.log.Warn().Str("domain", scope).Int("failures", failures).Dur("window", c.breakerWindow).Time("open_until", until).Msg("Circuit opened after repeated failures")
+	c.resetFailures(ctx, domain)
+}
+
+// resetFailures clears domain's failure count after a successful fetch. The condition skips the
+// write for the common case of a healthy domain with nothing to clear.
+func (c *Crawler) resetFailures(ctx context.Context, domain string) {
+	if c.breakerMax <= 0 {
+		return
+	}
+
+	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: domainKeyPrefix + domain},
+		},
+		UpdateExpression:    aws.String("REMOVE failures, failures_since"),
+		ConditionExpression: aws.String("attribute_exists(failures)"),
+	})
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condErr) {
+		c.log.Warn().Err(err).Str("domain", domain).Msg("Failed to reset failure count")
+	}
+}
+
+// circuitOpenFor returns how long host's circuit stays open, or 0 when it is closed,
+// the breaker is disabled or the allowlist item cannot be read
+func (c *Crawler) circuitOpenFor(ctx context.Context, host string) time.Duration {
+	if c.breakerMax <= 0 {
+		return 0
+	}
+
+	result, err := c.ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + c.scopeHost(host)},
+		},
+		ProjectionExpression: aws.String("circuit_open_until"),
+	})
+	if err != nil || result.Item == nil {
+		return 0
+	}
+	return circuitRemaining(result.Item)
+}
+
+// circuitRemaining returns the time left until an allowlist item's circuit_open_until, or 0 when
+// the attribute is missing or already past
+func circuitRemaining(item map[string]dynamodbtypes.AttributeValue) time.Duration {
+	v, ok := item["circuit_open_until"].(*dynamodbtypes.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	until, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return max(time.Until(time.UnixMilli(until)), 0)
+}
+
+// handleCircuitOpen resets a URL whose host's circuit is open to queued and re-queues it for
+// when the cooldown ends (or SQS's 15 minute maximum delay, if that comes first)
+func (c *Crawler) handleCircuitOpen(ctx context.Context, targetURL, urlHash string, depth int, priority string, remaining time.Duration) error {
+	c.log.Info().Str("url", targetURL).Dur("open_for", remaining).Msg("Circuit open, re-queuing")
+
+	c.releaseClaim(ctx, urlHash, false)
+	delaySeconds := max(int(remaining.Seconds()+0.5), 1)
+	return c.requeueWithDelay(ctx, targetURL, urlHash, depth, priority, delaySeconds)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// breaker is the failure count on a domain item and circuit_open_until on its allowlist item
+type breaker struct {
+	failures  int64
+	since     int64
+	counting  bool // failures / failures_since are set
+	openUntil int64
+}
+
+// breakerDDB simulates the circuit breaker attributes, honouring the conditions of
+// recordFetchFailure, tripCircuit and resetFailures. The allowlist item always exists and is
+// active; every other update (claims, rate limits) succeeds.
+func breakerDDB(b *breaker) *mockDynamoDB {
+	return &mockDynamoDB{
+		getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+			if !strings.HasPrefix(key, allowedDomainKeyPrefix) {
+				return &dynamodb.GetItemOutput{}, nil
+			}
+			item := map[string]dynamodbtypes.AttributeValue{
+				"status": &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+			}
+			if b.openUntil > 0 {
+				item["circuit_open_until"] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(b.openUntil, 10)}
+			}
+			return &dynamodb.GetItemOutput{Item: item}, nil
+		},
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			num := func(name string) int64 {
+				v, _ := strconv.ParseInt(input.ExpressionAttributeValues[name].(*dynamodbtypes.AttributeValueMemberN).Value, 10, 64)
+				return v
+			}
+			if input.ConditionExpression == nil {
+				return &dynamodb.UpdateItemOutput{}, nil
+			}
+
+			switch *input.ConditionExpression {
+			case "failures_since >= :cutoff":
+				if !b.counting || b.since < num(":cutoff") {
+					return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+				}
+				b.failures++
+				return &dynamodb.UpdateItemOutput{Attributes: map[string]dynamodbtypes.AttributeValue{
+					"failures": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(b.failures, 10)},
+				}}, nil
+			case "attribute_not_exists(failures_since) OR failures_since < :cutoff":
+				if b.counting && b.since >= num(":cutoff") {
+					return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+				}
+				b.failures, b.since, b.counting = 1, num(":now"), true
+			case "attribute_exists(url_hash)":
+				if strings.Contains(*input.UpdateExpression, "circuit_open_until") {
+					b.openUntil = num(":until")
+				}
+			case "attribute_exists(failures)":
+				if !b.counting {
+					return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+				}
+				b.failures, b.since, b.counting = 0, 0, false
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+}
+
+func TestRecordFetchFailureTripsCircuit(t *testing.T) {
+	var b breaker
+	c := newTestCrawlerWithMocks(breakerDDB(&b), &mockSQS{}, &mockS3{})
+	c.breakerMax = 3
+
+	for i := 1; i < 3; i++ {
+		c.recordFetchFailure(context.Background(), "https://example.com", "example.com")
+		if b.failures != int64(i) || b.openUntil != 0 {
+			t.Fatalf("after %d failures: failures = %d, open_until = %d", i, b.failures, b.openUntil)
+		}
+	}
+
+	c.recordFetchFailure(context.Background(), "https://example.com", "example.com")
+	if b.openUntil == 0 {
+		t.Fatal("circuit not opened at the threshold")
+	}
+	if remaining := time.Until(time.UnixMilli(b.openUntil)); remaining < defaultCircuitCooldown-time.Minute || remaining > defaultCircuitCooldown {
+		t.Errorf("circuit open for %v, want about %v", remaining, defaultCircuitCooldown)
+	}
+	if b.counting {
+		t.Errorf("failures = %d after tripping, want the count cleared", b.failures)
+	}
+	if c.isDomainAllowed(context.Background(), "example.com") {
+		t.Error("isDomainAllowed() = true while the circuit is open")
+	}
+}
+
+func TestRecordFetchFailureExpiredWindowRestarts(t *testing.T) {
+	b := breaker{failures: 2, since: time.Now().Add(-2 * defaultCircuitWindow).UnixMilli(), counting: true}
+	c := newTestCrawlerWithMocks(breakerDDB(&b), &mockSQS{}, &mockS3{})
+	c.breakerMax = 3
+
+	c.recordFetchFailure(context.Background(), "https://example.com", "example.com")
+	if b.failures != 1 {
+		t.Errorf("failures = %d, want 1 in a fresh window", b.failures)
+	}
+	if b.openUntil != 0 {
+		t.Error("circuit opened by failures spread over more than the window")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	calls := 0
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			calls++
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+		getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			calls++
+			return &dynamodb.GetItemOutput{}, nil
+		},
+	}
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+
+	c.recordFetchFailure(context.Background(), "https://example.com", "example.com")
+	c.resetFailures(context.Background(), "https://example.com")
+	if c.circuitOpenFor(context.Background(), "example.com") != 0 {
+		t.Error("circuitOpenFor() > 0 with the breaker disabled")
+	}
+	if calls != 0 {
+		t.Errorf("DynamoDB calls = %d, want none with the breaker disabled", calls)
+	}
+}
+
+func TestIsDomainAllowedCircuit(t *testing.T) {
+	tests := []struct {
+		name      string
+		openUntil time.Time
+		want      bool
+	}{
+		{"never tripped", time.Time{}, true},
+		{"cooling down", time.Now().Add(5 * time.Minute), false},
+		{"cooldown elapsed", time.Now().Add(-time.Second), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b breaker
+			if !tt.openUntil.IsZero() {
+				b.openUntil = tt.openUntil.UnixMilli()
+			}
+			c := newTestCrawlerWithMocks(breakerDDB(&b), &mockSQS{}, &mockS3{})
+
+			if got := c.isDomainAllowed(context.Background(), "example.com"); got != tt.want {
+				t.Errorf("isDomainAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessMessageRequeuesWhenCircuitOpen(t *testing.T) {
+	b := breaker{openUntil: time.Now().Add(2 * time.Minute).UnixMilli()}
+	fetched := false
+	var requeued *sqs.SendMessageInput
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			requeued = input
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(breakerDDB(&b), sqsClient, &mockS3{})
+	c.breakerMax = 3
+	c.requeueJitter = 0
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			fetched = true
+		}
+	}))
+
+	got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+	if err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+	if got != outcomeRateLimited {
+		t.Errorf("outcome = %v, want outcomeRateLimited", got)
+	}
+	if fetched {
+		t.Error("page fetched while the circuit was open")
+	}
+	if requeued == nil {
+		t.Fatal("URL not re-queued")
+	}
+	if requeued.DelaySeconds < 115 || requeued.DelaySeconds > 120 {
+		t.Errorf("DelaySeconds = %d, want the remaining cooldown (~120)", requeued.DelaySeconds)
+	}
+}
+
+func TestProcessMessageCircuitFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantFailures int64
+	}{
+		{"success resets the count", http.StatusOK, 0},
+		{"server error counts", http.StatusServiceUnavailable, 3},
+		{"not found does not count", http.StatusNotFound, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := breaker{failures: 2, since: time.Now().UnixMilli(), counting: true}
+			c := newTestCrawlerWithMocks(breakerDDB(&b), &mockSQS{}, &mockS3{})
+			c.breakerMax = 5
+			c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(tt.status)
+			}))
+
+			_, _ = c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+			if b.failures != tt.wantFailures {
+				t.Errorf("failures = %d, want %d", b.failures, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestRecordFetchFailureOtherErrorDoesNotTrip(t *testing.T) {
+	calls := 0
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			calls++
+			return nil, fmt.Errorf("ProvisionedThroughputExceededException")
+		},
+	}
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.breakerMax = 1
+
+	c.recordFetchFailure(context.Background(), "https://example.com", "example.com")
+	if calls != 1 {
+		t.Errorf("UpdateItem calls = %d, want 1 (no new window, no trip)", calls)
+	}
+}
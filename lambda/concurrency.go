@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// acquireHostSlot counts one more in-flight fetch against domain's item, failing once
+// MAX_PER_HOST_CONCURRENCY fetches are already running. Rate limiting spaces out requests but is
+// not atomic with the fetch, so without this a burst of invocations can still hit a host at once.
+// A counter left behind by a crashed invocation is reset once it has not moved for staleAfter.
+// Returns true when a slot was taken (always, when the cap is disabled).
+func (c *Crawler) acquireHostSlot(ctx context.Context, domain string) bool {
+	if c.maxPerHost <= 0 {
+		return true
+	}
+
+	now := time.Now().UnixMilli()
+	key := map[string]dynamodbtypes.AttributeValue{
+		"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: domainKeyPrefix + domain},
+	}
+	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &c.tableName,
+		Key:                 key,
+		UpdateExpression:    aws.String("SET in_flight_at = :now ADD in_flight :one"),
+		ConditionExpression: aws.String("attribute_not_exists(in_flight) OR in_flight < :max"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":now": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+			":one": &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+			":max": &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(c.maxPerHost)},
+		},
+	})
+	if err == nil {
+		return true
+	}
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	if !errors.As(err, &condErr) {
+		c.log.Warn().Err(err).Str("domain", domain).Msg("Failed to take host concurrency slot")
+		return false
+	}
+
+	// At the cap. Every acquire and release touches in_flight_at, so a counter that has not
+	// moved for staleAfter only holds slots leaked by invocations that never released them
+	_, err = c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &c.tableName,
+		Key:                 key,
+		UpdateExpression:    aws.String("SET in_flight = :one, in_flight_at = :now"),
+		ConditionExpression: aws.String("in_flight_at < :stale"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":now":   &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+			":one":   &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+			":stale": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now-c.staleAfter.Milliseconds(), 10)},
+		},
+	})
+	if err != nil {
+		c.log.Debug().Str("domain", domain).Int("max_per_host", c.maxPerHost).Msg("Host at concurrency cap")
+		return false
+	}
+	c.log.Warn().Str("domain", domain).Msg("Reset stale in-flight counter")
+	return true
+}
+
+// releaseHostSlot gives back a slot taken by acquireHostSlot. It must run whatever the fetch
+// outcome, so it ignores cancellation of ctx; the condition keeps a reset counter from going negative.
+func (c *Crawler) releaseHostSlot(ctx context.Context, domain string) {
+	if c.maxPerHost <= 0 {
+		return
+	}
+
+	_, err := c.ddb.UpdateItem(context.WithoutCancel(ctx), &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: domainKeyPrefix + domain},
+		},
+		UpdateExpression:    aws.String("SET in_flight_at = :now ADD in_flight :release"),
+		ConditionExpression: aws.String("in_flight > :zero"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":now":     &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().UnixMilli(), 10)},
+			":release": &dynamodbtypes.AttributeValueMemberN{Value: "-1"},
+			":zero":    &dynamodbtypes.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condErr) {
+		c.log.Warn().Err(err).Str("domain", domain).Msg("Failed to release host concurrency slot")
+	}
+}
+
+// handleHostBusy resets a URL whose host is at its concurrency cap to queued and re-queues it
+func (c *Crawler) handleHostBusy(ctx context.Context, targetURL, urlHash string, depth int, priority string) error {
+	c.log.Info().Str("url", targetURL).Str("domain", c.rateLimitDomain(targetURL)).Msg("Host at concurrency cap, re-queuing")
+
+	c.releaseClaim(ctx, urlHash, false)
+	return c.requeueWithDelay(ctx, targetURL, urlHash, depth, priority, hostBusyDelay)
+}
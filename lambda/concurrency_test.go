@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// hostSlot is the in_flight / in_flight_at state of one domain item
+type hostSlot struct {
+	inFlight   int64
+	updatedAt  int64
+	exists     bool
+	increments int
+	decrements int
+}
+
+// hostSlotDDB simulates the in_flight counter on domain items, honouring the conditions of
+// acquireHostSlot and releaseHostSlot. Every other update (claims, rate limits) succeeds.
+func hostSlotDDB(slot *hostSlot) *mockDynamoDB {
+	ddb := authItemDDB(nil)
+	ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+		if !strings.HasPrefix(key, domainKeyPrefix) || !strings.Contains(*input.UpdateExpression, "in_flight") {
+			return &dynamodb.UpdateItemOutput{}, nil
+		}
+		num := func(name string) int64 {
+			v, _ := strconv.ParseInt(input.ExpressionAttributeValues[name].(*dynamodbtypes.AttributeValueMemberN).Value, 10, 64)
+			return v
+		}
+
+		switch *input.ConditionExpression {
+		case "attribute_not_exists(in_flight) OR in_flight < :max":
+			if slot.exists && slot.inFlight >= num(":max") {
+				return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+			}
+			slot.inFlight++
+			slot.increments++
+		case "in_flight_at < :stale":
+			if !slot.exists || slot.updatedAt >= num(":stale") {
+				return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+			}
+			slot.inFlight = 1
+		case "in_flight > :zero":
+			if !slot.exists || slot.inFlight <= 0 {
+				return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+			}
+			slot.inFlight--
+			slot.decrements++
+		default:
+			return nil, fmt.Errorf("unexpected condition %q", *input.ConditionExpression)
+		}
+		slot.exists = true
+		slot.updatedAt = num(":now")
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	return ddb
+}
+
+func TestAcquireHostSlot(t *testing.T) {
+	now := time.Now().UnixMilli()
+	stale := now - defaultProcessingTimeout.Milliseconds() - 1000
+
+	tests := []struct {
+		name         string
+		max          int
+		slot         hostSlot
+		want         bool
+		wantInFlight int64
+	}{
+		{"disabled", 0, hostSlot{inFlight: 7, updatedAt: now, exists: true}, true, 7},
+		{"first fetch for host", 2, hostSlot{}, true, 1},
+		{"below cap", 2, hostSlot{inFlight: 1, updatedAt: now, exists: true}, true, 2},
+		{"at cap", 2, hostSlot{inFlight: 2, updatedAt: now, exists: true}, false, 2},
+		{"at cap with stale counter resets", 2, hostSlot{inFlight: 2, updatedAt: stale, exists: true}, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot := tt.slot
+			c := newTestCrawlerWithMocks(hostSlotDDB(&slot), &mockSQS{}, &mockS3{})
+			c.maxPerHost = tt.max
+
+			if got := c.acquireHostSlot(context.Background(), "https://example.com"); got != tt.want {
+				t.Errorf("acquireHostSlot() = %v, want %v", got, tt.want)
+			}
+			if slot.inFlight != tt.wantInFlight {
+				t.Errorf("in_flight = %d, want %d", slot.inFlight, tt.wantInFlight)
+			}
+		})
+	}
+}
+
+func TestAcquireHostSlotConditionExpression(t *testing.T) {
+	var input *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			input = in
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.maxPerHost = 3
+	if !c.acquireHostSlot(context.Background(), "https://example.com") {
+		t.Fatal("acquireHostSlot() = false, want true")
+	}
+
+	if key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value; key != "domain#https://example.com" {
+		t.Errorf("key = %q, want the rate limit domain item", key)
+	}
+	if *input.UpdateExpression != "SET in_flight_at = :now ADD in_flight :one" {
+		t.Errorf("UpdateExpression = %q", *input.UpdateExpression)
+	}
+	if *input.ConditionExpression != "attribute_not_exists(in_flight) OR in_flight < :max" {
+		t.Errorf("ConditionExpression = %q", *input.ConditionExpression)
+	}
+	if got := input.ExpressionAttributeValues[":max"].(*dynamodbtypes.AttributeValueMemberN).Value; got != "3" {
+		t.Errorf(":max = %s, want 3", got)
+	}
+}
+
+func TestAcquireHostSlotOtherErrorNotAcquired(t *testing.T) {
+	calls := 0
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			calls++
+			return nil, fmt.Errorf("ProvisionedThroughputExceededException")
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.maxPerHost = 2
+	if c.acquireHostSlot(context.Background(), "https://example.com") {
+		t.Error("acquireHostSlot() = true, want false on a DynamoDB error")
+	}
+	if calls != 1 {
+		t.Errorf("UpdateItem calls = %d, want 1 (no stale reset attempt)", calls)
+	}
+}
+
+func TestReleaseHostSlot(t *testing.T) {
+	tests := []struct {
+		name         string
+		slot         hostSlot
+		wantInFlight int64
+	}{
+		{"decrements", hostSlot{inFlight: 2, exists: true}, 1},
+		{"never below zero", hostSlot{inFlight: 0, exists: true}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot := tt.slot
+			c := newTestCrawlerWithMocks(hostSlotDDB(&slot), &mockSQS{}, &mockS3{})
+			c.maxPerHost = 2
+
+			c.releaseHostSlot(context.Background(), "https://example.com")
+			if slot.inFlight != tt.wantInFlight {
+				t.Errorf("in_flight = %d, want %d", slot.inFlight, tt.wantInFlight)
+			}
+		})
+	}
+}
+
+func TestReleaseHostSlotIgnoresCancellation(t *testing.T) {
+	var released bool
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(ctx context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			released = true
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.maxPerHost = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.releaseHostSlot(ctx, "https://example.com")
+	if !released {
+		t.Error("releaseHostSlot() did not run after the context was cancelled")
+	}
+}
+
+func TestProcessMessageReleasesHostSlot(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		client  *http.Client
+	}{
+		{"success", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+		}), nil},
+		{"retriable failure", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}), nil},
+		{"permanent failure", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}), nil},
+		{"fetch error", nil, &http.Client{Transport: errRoundTripper{err: fmt.Errorf("connection reset by peer")}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var slot hostSlot
+			c := newTestCrawlerWithMocks(hostSlotDDB(&slot), &mockSQS{}, &mockS3{})
+			c.maxPerHost = 1
+			c.crawlDelayMs = 0
+			c.httpClient = tt.client
+			if tt.handler != nil {
+				c.httpClient = testHTTPClientWith(tt.handler)
+			}
+
+			_, _ = c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+
+			// robots.txt is not cached yet, so its fetch holds the slot before the page's
+			if slot.increments != 2 || slot.decrements != 2 {
+				t.Errorf("increments = %d, decrements = %d, want 2 and 2", slot.increments, slot.decrements)
+			}
+			if slot.inFlight != 0 {
+				t.Errorf("in_flight = %d after processing, want 0", slot.inFlight)
+			}
+		})
+	}
+}
+
+func TestProcessMessageRequeuesWhenHostBusy(t *testing.T) {
+	slot := hostSlot{inFlight: 2, updatedAt: time.Now().UnixMilli(), exists: true}
+	fetched := false
+	var requeued *sqs.SendMessageInput
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			requeued = input
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(hostSlotDDB(&slot), sqsClient, &mockS3{})
+	c.maxPerHost = 2
+	c.crawlDelayMs = 0
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			fetched = true
+		}
+	}))
+
+	if _, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"}); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+	if fetched {
+		t.Error("host at its cap was fetched anyway")
+	}
+	if requeued == nil || requeued.DelaySeconds != hostBusyDelay {
+		t.Fatalf("expected a requeue with %ds delay, got %+v", hostBusyDelay, requeued)
+	}
+	if slot.inFlight != 2 || slot.decrements != 0 {
+		t.Errorf("in_flight = %d, decrements = %d; a slot that was never taken must not be released", slot.inFlight, slot.decrements)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// maxDepthKey is the context key for a message's max_depth override
+type maxDepthKey struct{}
+
+// withMaxDepth returns ctx carrying a message's max_depth override, which the depth gate on
+// enqueueing links, requeues and the links the message discovers all pick up, so a seed's
+// whole subtree keeps the reach it was seeded with
+func withMaxDepth(ctx context.Context, maxDepth int) context.Context {
+	return context.WithValue(ctx, maxDepthKey{}, maxDepth)
+}
+
+// maxDepthOverride returns the max_depth override carried by ctx, if any
+func maxDepthOverride(ctx context.Context) (int, bool) {
+	maxDepth, ok := ctx.Value(maxDepthKey{}).(int)
+	return maxDepth, ok
+}
+
+// maxDepthFor returns the depth below which the page being processed enqueues its links: the
+// message's max_depth override, falling back to MAX_DEPTH
+func (c *Crawler) maxDepthFor(ctx context.Context) int {
+	if maxDepth, ok := maxDepthOverride(ctx); ok {
+		return maxDepth
+	}
+	return c.maxDepth
+}
+
+// addMaxDepthAttr copies the max_depth override carried by ctx, if any, into a message's attributes
+func addMaxDepthAttr(ctx context.Context, attrs map[string]sqstypes.MessageAttributeValue) {
+	if maxDepth, ok := maxDepthOverride(ctx); ok {
+		attrs["max_depth"] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(maxDepth)),
+		}
+	}
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"lambda/urls"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -9,12 +14,21 @@ import (
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-// isDomainAllowed checks if a domain is in the allowed list
+// scopeHost returns the host allowlist items are keyed by: the host itself, or its registrable
+// domain when SCOPE_BY_REGISTRABLE_DOMAIN is set so blog.example.com shares example.com's item
+func (c *Crawler) scopeHost(host string) string {
+	if c.regScope {
+		return urls.RegistrableDomain(host)
+	}
+	return host
+}
+
+// isDomainAllowed checks if a domain is in the allowed list and its circuit breaker is not open
 func (c *Crawler) isDomainAllowed(ctx context.Context, host string) bool {
 	result, err := c.ddb.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: &c.tableName,
 		Key: map[string]dynamodbtypes.AttributeValue{
-			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + host},
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + c.scopeHost(host)},
 		},
 	})
 	if err != nil || result.Item == nil {
@@ -24,21 +38,111 @@ func (c *Crawler) isDomainAllowed(ctx context.Context, host string) bool {
 	if !ok {
 		return false
 	}
-	return statusAttr.Value == domainStatusActive
+	return statusAttr.Value == domainStatusActive && circuitRemaining(result.Item) == 0
+}
+
+// linkScope returns the key SAME_DOMAIN_ONLY compares between a link and its source page:
+// the host itself, or its registrable domain when SAME_DOMAIN_REGISTRABLE is set
+func (c *Crawler) linkScope(host string) string {
+	if c.sameRegDomain {
+		return urls.RegistrableDomain(host)
+	}
+	return strings.ToLower(host)
+}
+
+// domainAuth holds optional credentials from an allowlist item, applied to every fetch for that host,
+// and whether the host's TLS certificate is trusted without verification.
+// Values are secrets: never log them, only whether they are set.
+type domainAuth struct {
+	headerName  string // From auth_header "Name: value"
+	headerValue string
+	basicUser   string // From basic_auth_user / basic_auth_pass
+	basicPass   string
+	insecureTLS bool // From insecure_tls; see Crawler.clientFor
+}
+
+// apply sets the configured credentials on req
+func (a *domainAuth) apply(req *http.Request) {
+	if a == nil {
+		return
+	}
+	if a.headerName != "" {
+		req.Header.Set(a.headerName, a.headerValue)
+	}
+	if a.basicUser != "" {
+		req.SetBasicAuth(a.basicUser, a.basicPass)
+	}
+}
+
+// clientFor returns the client to fetch the host auth was loaded for: insecureHTTP when its
+// allowlist item sets insecure_tls, else httpClient. A crawler without insecureHTTP (the
+// fetchone CLI) always verifies.
+func (c *Crawler) clientFor(auth *domainAuth) *http.Client {
+	if auth != nil && auth.insecureTLS && c.insecureHTTP != nil {
+		return c.insecureHTTP
+	}
+	return c.httpClient
+}
+
+// getDomainAuth loads optional fetch credentials and the insecure_tls flag from the host's allowlist item.
+// Returns nil when the item is missing or carries neither.
+func (c *Crawler) getDomainAuth(ctx context.Context, host string) *domainAuth {
+	result, err := c.ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + c.scopeHost(host)},
+		},
+		ProjectionExpression: aws.String("auth_header, basic_auth_user, basic_auth_pass, insecure_tls"),
+	})
+	if err != nil || result.Item == nil {
+		return nil
+	}
+
+	str := func(name string) string {
+		if v, ok := result.Item[name].(*dynamodbtypes.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+
+	var auth domainAuth
+	if header := str("auth_header"); header != "" {
+		name, value, ok := strings.Cut(header, ":")
+		if ok && strings.TrimSpace(name) != "" {
+			auth.headerName = strings.TrimSpace(name)
+			auth.headerValue = strings.TrimSpace(value)
+		} else {
+			c.log.Warn().Str("domain", host).Msg("Ignoring malformed auth_header, expected \"Name: value\"")
+		}
+	}
+	auth.basicUser = str("basic_auth_user")
+	auth.basicPass = str("basic_auth_pass")
+	if v, ok := result.Item["insecure_tls"].(*dynamodbtypes.AttributeValueMemberBOOL); ok {
+		auth.insecureTLS = v.Value
+	}
+
+	if auth.headerName == "" && auth.basicUser == "" && !auth.insecureTLS {
+		return nil
+	}
+	c.log.Debug().Str("domain", host).Bool("auth_header", auth.headerName != "").Bool("basic_auth", auth.basicUser != "").Bool("insecure_tls", auth.insecureTLS).Msg("Using domain credentials")
+	return &auth
 }
 
 // maybeAddDomain auto-discovers a new domain and adds it to the allowlist
 // Returns true if domain was added (new), false if already exists
 func (c *Crawler) maybeAddDomain(ctx context.Context, host, discoveredFrom string) bool {
+	host = c.scopeHost(host)
+	item := map[string]dynamodbtypes.AttributeValue{
+		"url_hash":        &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + host},
+		"domain":          &dynamodbtypes.AttributeValueMemberS{Value: host},
+		"status":          &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+		"discovered_from": &dynamodbtypes.AttributeValueMemberS{Value: discoveredFrom},
+		"created_at":      &dynamodbtypes.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+	}
+	c.addJobIDItem(ctx, item)
 	_, err := c.ddb.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: &c.tableName,
-		Item: map[string]dynamodbtypes.AttributeValue{
-			"url_hash":        &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + host},
-			"domain":          &dynamodbtypes.AttributeValueMemberS{Value: host},
-			"status":          &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
-			"discovered_from": &dynamodbtypes.AttributeValueMemberS{Value: discoveredFrom},
-			"created_at":      &dynamodbtypes.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
-		},
+		TableName:           &c.tableName,
+		Item:                item,
 		ConditionExpression: aws.String("attribute_not_exists(url_hash)"),
 	})
 	if err != nil {
@@ -47,3 +151,60 @@ func (c *Crawler) maybeAddDomain(ctx context.Context, host, discoveredFrom strin
 	c.log.Info().Str("domain", host).Str("discovered_from", discoveredFrom).Msg("Auto-discovered new domain")
 	return true
 }
+
+// recordDomainStats adds a finished fetch to the per-domain counters on host's allowlist item:
+// pages_crawled or pages_failed by status, plus bytes_downloaded. ADD is atomic, so concurrent
+// invocations roll up without a scan. Skipped URLs were never downloaded and are not counted,
+// and hosts without an allowlist item (DISABLE_DOMAIN_ALLOWLIST) get none rather than a stub item.
+func (c *Crawler) recordDomainStats(ctx context.Context, host, status string, bytes int64) {
+	counter := "pages_crawled"
+	switch status {
+	case stateFailed:
+		counter = "pages_failed"
+	case stateSkipped:
+		return
+	}
+
+	scope := c.scopeHost(host)
+	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + scope},
+		},
+		UpdateExpression:    aws.String("ADD " + counter + " :one, bytes_downloaded :bytes"),
+		ConditionExpression: aws.String("attribute_exists(url_hash)"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":one":   &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+			":bytes": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(max(bytes, 0), 10)},
+		},
+	})
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condErr) {
+		c.log.Warn().Err(err).Str("domain", scope).Msg("Failed to update domain stats")
+	}
+}
+
+// domainFull reports whether host's allowlist item has counted MAX_PAGES_PER_DOMAIN crawled pages,
+// so one sprawling site cannot take over the crawl. Pages still queued are not counted, so the
+// cap can be overshot by what was already enqueued. A missing item or failed read is not full.
+func (c *Crawler) domainFull(ctx context.Context, host string) bool {
+	if c.domainPageCap <= 0 {
+		return false
+	}
+	result, err := c.ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + c.scopeHost(host)},
+		},
+		ProjectionExpression: aws.String("pages_crawled"),
+	})
+	if err != nil || result.Item == nil {
+		return false
+	}
+	n, ok := result.Item["pages_crawled"].(*dynamodbtypes.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	crawled, err := strconv.Atoi(n.Value)
+	return err == nil && crawled >= c.domainPageCap
+}
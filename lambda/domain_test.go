@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"lambda/internal/ssrf"
+	"lambda/urls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog"
 )
 
 func TestIsDomainAllowed(t *testing.T) {
@@ -160,3 +171,676 @@ func TestMaybeAddDomainSetsCorrectAttributes(t *testing.T) {
 		t.Errorf("expected discovered_from https://example.com/page, got %q", capturedSource)
 	}
 }
+
+// authItemDDB serves allowlist items carrying the given credential attributes
+func authItemDDB(attrs map[string]string) *mockDynamoDB {
+	return &mockDynamoDB{
+		getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+			if !strings.HasPrefix(key, allowedDomainKeyPrefix) {
+				return &dynamodb.GetItemOutput{}, nil
+			}
+			item := map[string]dynamodbtypes.AttributeValue{
+				"status": &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+			}
+			for k, v := range attrs {
+				item[k] = &dynamodbtypes.AttributeValueMemberS{Value: v}
+			}
+			return &dynamodb.GetItemOutput{Item: item}, nil
+		},
+	}
+}
+
+func TestGetDomainAuth(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs map[string]string
+		want  *domainAuth
+	}{
+		{"no credentials", nil, nil},
+		{"auth header", map[string]string{"auth_header": "X-Api-Key: k123"}, &domainAuth{headerName: "X-Api-Key", headerValue: "k123"}},
+		{"bearer token keeps value spacing", map[string]string{"auth_header": "Authorization: Bearer t0k"}, &domainAuth{headerName: "Authorization", headerValue: "Bearer t0k"}},
+		{"malformed header ignored", map[string]string{"auth_header": "just-a-token"}, nil},
+		{"basic auth", map[string]string{"basic_auth_user": "stage", "basic_auth_pass": "pw"}, &domainAuth{basicUser: "stage", basicPass: "pw"}},
+		{
+			"header and basic auth",
+			map[string]string{"auth_header": "X-Api-Key: k", "basic_auth_user": "u", "basic_auth_pass": "p"},
+			&domainAuth{headerName: "X-Api-Key", headerValue: "k", basicUser: "u", basicPass: "p"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawlerWithMocks(authItemDDB(tt.attrs), &mockSQS{}, &mockS3{})
+			got := c.getDomainAuth(context.Background(), "example.com")
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("getDomainAuth() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDomainAuthInsecureTLS(t *testing.T) {
+	for _, flagged := range []bool{true, false} {
+		ddb := &mockDynamoDB{
+			getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				return &dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+					"status":       &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+					"insecure_tls": &dynamodbtypes.AttributeValueMemberBOOL{Value: flagged},
+				}}, nil
+			},
+		}
+		c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+		got := c.getDomainAuth(context.Background(), "legacy.example.com")
+		if flagged && (got == nil || !got.insecureTLS) {
+			t.Errorf("getDomainAuth() = %+v, want insecureTLS", got)
+		}
+		if !flagged && got != nil {
+			t.Errorf("getDomainAuth() with insecure_tls false = %+v, want nil", got)
+		}
+	}
+}
+
+// TestFetchURLInsecureTLSOnlyForFlaggedHost checks which client serves each hop: the insecure one
+// only for the flagged host, never for a host without the flag or a redirect target elsewhere
+func TestFetchURLInsecureTLSOnlyForFlaggedHost(t *testing.T) {
+	var used []string
+	serve := func(name string) *http.Client {
+		return testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			used = append(used, name+" "+r.URL.Host)
+			if r.URL.Path == "/moved" {
+				w.Header().Set("Location", "https://www.example.com/page")
+				w.WriteHeader(http.StatusMovedPermanently)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+
+	c := newTestCrawler()
+	c.httpClient, c.insecureHTTP = serve("verified"), serve("insecure")
+	flagged := &domainAuth{insecureTLS: true}
+
+	tests := []struct {
+		name string
+		url  string
+		auth *domainAuth
+		want []string
+	}{
+		{"flagged host", "https://example.com/page", flagged, []string{"insecure example.com"}},
+		{"unflagged host", "https://example.com/page", nil, []string{"verified example.com"}},
+		{"credentials only", "https://example.com/page", &domainAuth{basicUser: "u"}, []string{"verified example.com"}},
+		{"redirect off the flagged host", "https://example.com/moved", flagged, []string{"insecure example.com", "verified www.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used = nil
+			if result := c.fetchURL(context.Background(), tt.url, tt.auth); !result.Success {
+				t.Fatalf("fetchURL() failed: %s", result.Error)
+			}
+			if !slices.Equal(used, tt.want) {
+				t.Errorf("clients used = %v, want %v", used, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewInsecureHTTPClientKeepsSSRFDialer(t *testing.T) {
+	if cfg := newHTTPClient(ssrf.Timeouts{}).Transport.(*http.Transport).TLSClientConfig; cfg != nil && cfg.InsecureSkipVerify {
+		t.Fatal("newHTTPClient() skips certificate verification")
+	}
+	client := newInsecureHTTPClient(ssrf.Timeouts{})
+	if cfg := client.Transport.(*http.Transport).TLSClientConfig; cfg == nil || !cfg.InsecureSkipVerify {
+		t.Fatal("newInsecureHTTPClient() verifies certificates")
+	}
+
+	// A self-signed server on loopback: the certificate would be accepted, the address is not
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	resp, err := client.Get(srv.URL)
+	if err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("insecure client reached a loopback server")
+	}
+	if !strings.Contains(err.Error(), "SSRF") {
+		t.Errorf("error = %v, want the SSRF dialer to refuse it", err)
+	}
+
+	// fetchURL refuses the address before dialing, flagged or not
+	c := newTestCrawler()
+	c.httpClient, c.insecureHTTP = newHTTPClient(ssrf.Timeouts{}), client
+	if result := c.fetchURL(context.Background(), srv.URL, &domainAuth{insecureTLS: true}); result.Success || result.FailureKind != FailureSSRF {
+		t.Errorf("fetchURL() = %+v, want an SSRF failure", result)
+	}
+}
+
+func TestGetDomainAuthMissingItem(t *testing.T) {
+	c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, &mockS3{})
+	if got := c.getDomainAuth(context.Background(), "example.com"); got != nil {
+		t.Errorf("getDomainAuth() = %+v, want nil", got)
+	}
+}
+
+func TestProcessMessageAppliesDomainAuthWithoutLoggingIt(t *testing.T) {
+	const (
+		apiKey   = "sekrit-api-key-123"
+		password = "hunter2-pass"
+	)
+
+	tests := []struct {
+		name       string
+		attrs      map[string]string
+		wantHeader string
+		wantBasic  bool
+	}{
+		{"header configured", map[string]string{"auth_header": "X-Api-Key: " + apiKey}, apiKey, false},
+		{"basic auth configured", map[string]string{"basic_auth_user": "stage", "basic_auth_pass": password}, "", true},
+		{"nothing configured", nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotHeader string
+			var gotBasic bool
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				gotHeader = r.Header.Get("X-Api-Key")
+				user, pass, ok := r.BasicAuth()
+				gotBasic = ok && user == "stage" && pass == password
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = fmt.Fprint(w, "ok")
+			})
+
+			var logs bytes.Buffer
+			c := newTestCrawlerWithMocks(authItemDDB(tt.attrs), &mockSQS{}, &mockS3{})
+			c.httpClient = testHTTPClientWith(handler)
+			c.crawlDelayMs = 0
+			c.log = zerolog.New(&logs).Level(zerolog.TraceLevel)
+
+			if _, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"}); err != nil {
+				t.Fatalf("processMessage() error = %v", err)
+			}
+
+			if gotHeader != tt.wantHeader {
+				t.Errorf("X-Api-Key = %q, want %q", gotHeader, tt.wantHeader)
+			}
+			if gotBasic != tt.wantBasic {
+				t.Errorf("basic auth applied = %v, want %v", gotBasic, tt.wantBasic)
+			}
+			for _, secret := range []string{apiKey, password} {
+				if strings.Contains(logs.String(), secret) {
+					t.Errorf("credential %q leaked into logs:\n%s", secret, logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEnqueueLinksSameDomainOnly(t *testing.T) {
+	links := []string{
+		"https://example.com/a",
+		"https://blog.example.com/post",
+		"https://other.com/page",
+	}
+
+	tests := []struct {
+		name        string
+		sameDomain  bool
+		registrable bool
+		inactive    string // allowlist item present but not active
+		want        []string
+		wantAdded   []string // hosts auto-discovered via maybeAddDomain
+	}{
+		{
+			name:      "off follows every allowed host",
+			want:      links,
+			wantAdded: []string{"blog.example.com", "example.com", "other.com"},
+		},
+		{
+			name:       "strict host drops cross-domain and subdomain links",
+			sameDomain: true,
+			want:       []string{"https://example.com/a"},
+			wantAdded:  []string{"example.com"},
+		},
+		{
+			name:        "strict registrable keeps subdomains",
+			sameDomain:  true,
+			registrable: true,
+			want:        []string{"https://example.com/a", "https://blog.example.com/post"},
+			wantAdded:   []string{"blog.example.com", "example.com"},
+		},
+		{
+			name:        "allowlist still applies in scope",
+			sameDomain:  true,
+			registrable: true,
+			inactive:    "blog.example.com",
+			want:        []string{"https://example.com/a"},
+			wantAdded:   []string{"example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var added []string
+			ddb := &mockDynamoDB{
+				getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+					if key == allowedDomainKeyPrefix+tt.inactive {
+						return &dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+							"status": &dynamodbtypes.AttributeValueMemberS{Value: "blocked"},
+						}}, nil
+					}
+					return &dynamodb.GetItemOutput{}, nil // not on the allowlist yet
+				},
+				putItemFunc: func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+					key := input.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+					if host, ok := strings.CutPrefix(key, allowedDomainKeyPrefix); ok {
+						if host == tt.inactive {
+							return nil, errConditionalCheckFailed
+						}
+						added = append(added, host)
+					}
+					return &dynamodb.PutItemOutput{}, nil
+				},
+			}
+
+			var sent []string
+			sqsClient := &mockSQS{
+				sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+					for _, e := range input.Entries {
+						sent = append(sent, *e.MessageBody)
+					}
+					return &sqs.SendMessageBatchOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.autoDiscover = true
+			c.sameDomain = tt.sameDomain
+			c.sameRegDomain = tt.registrable
+			c.enqueueLinks(context.Background(), links, 1, "https://Example.com:443/index")
+
+			if strings.Join(sent, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("enqueued %v, want %v", sent, tt.want)
+			}
+			slices.Sort(added)
+			if strings.Join(added, " ") != strings.Join(tt.wantAdded, " ") {
+				t.Errorf("auto-discovered %v, want %v", added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func TestEnqueueLinksAutoDiscoverDomains(t *testing.T) {
+	links := []string{
+		"https://example.com/a",
+		"https://blog.example.com/post",
+		"https://other.com/page",
+	}
+
+	tests := []struct {
+		name         string
+		autoDiscover bool
+		blocked      string // allowlist item present but not active
+		want         []string
+		wantAdded    []string
+	}{
+		{
+			name:      "off allows only the source host",
+			want:      []string{"https://example.com/a"},
+			wantAdded: []string{"example.com"},
+		},
+		{
+			name:         "on adds third-party hosts",
+			autoDiscover: true,
+			want:         links,
+			wantAdded:    []string{"blog.example.com", "example.com", "other.com"},
+		},
+		{
+			name:    "a blocked source host stays blocked",
+			blocked: "example.com",
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var added []string
+			ddb := &mockDynamoDB{
+				getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+					if key == allowedDomainKeyPrefix+tt.blocked {
+						return &dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+							"status": &dynamodbtypes.AttributeValueMemberS{Value: "blocked"},
+						}}, nil
+					}
+					return &dynamodb.GetItemOutput{}, nil // Cold start: nothing allowlisted yet
+				},
+				putItemFunc: func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+					key := input.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+					if host, ok := strings.CutPrefix(key, allowedDomainKeyPrefix); ok {
+						if host == tt.blocked {
+							return nil, errConditionalCheckFailed
+						}
+						added = append(added, host)
+					}
+					return &dynamodb.PutItemOutput{}, nil
+				},
+			}
+
+			var sent []string
+			sqsClient := &mockSQS{
+				sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+					for _, e := range input.Entries {
+						sent = append(sent, *e.MessageBody)
+					}
+					return &sqs.SendMessageBatchOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.autoDiscover = tt.autoDiscover
+			c.enqueueLinks(context.Background(), links, 1, "https://example.com/")
+
+			if strings.Join(sent, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("enqueued %v, want %v", sent, tt.want)
+			}
+			slices.Sort(added)
+			if strings.Join(added, " ") != strings.Join(tt.wantAdded, " ") {
+				t.Errorf("allowlisted %v, want %v", added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+// TestEnqueueLinksDiscoveryOffDropsUnknownHosts checks that with AUTO_DISCOVER_DOMAINS off a link
+// to an unknown host leaves no trace: no allowlist item, no URL item, no message
+func TestEnqueueLinksDiscoveryOffDropsUnknownHosts(t *testing.T) {
+	ddb := &mockDynamoDB{
+		getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			if input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value == allowedDomainKeyPrefix+"example.com" {
+				return &dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+					"status": &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+				}}, nil
+			}
+			return &dynamodb.GetItemOutput{}, nil
+		},
+	}
+	var puts []string
+	ddb.putItemFunc = func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		puts = append(puts, input.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value)
+		return &dynamodb.PutItemOutput{}, nil
+	}
+	var sent []string
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			for _, e := range input.Entries {
+				sent = append(sent, *e.MessageBody)
+			}
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	got := c.enqueueLinks(context.Background(), []string{"https://unknown.org/x", "https://example.com/a", "https://unknown.org/y"}, 1, "https://example.com/")
+
+	if got != 1 || len(sent) != 1 || sent[0] != "https://example.com/a" {
+		t.Errorf("enqueueLinks() = %d, sent %v; want only https://example.com/a", got, sent)
+	}
+	if len(puts) != 1 || puts[0] != urls.Hash("https://example.com/a") {
+		t.Errorf("items put = %v, want only the example.com link", puts)
+	}
+}
+
+// TestEnqueueLinksAllowlistDisabled checks that DISABLE_DOMAIN_ALLOWLIST enqueues links to any host
+// without reading or writing allowlist items, while the other link filters still apply
+func TestEnqueueLinksAllowlistDisabled(t *testing.T) {
+	var reads []string
+	var puts []string
+	ddb := &mockDynamoDB{
+		getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			reads = append(reads, input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value)
+			return &dynamodb.GetItemOutput{}, nil
+		},
+		putItemFunc: func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			puts = append(puts, input.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value)
+			return &dynamodb.PutItemOutput{}, nil
+		},
+	}
+	var sent []string
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			for _, e := range input.Entries {
+				sent = append(sent, *e.MessageBody)
+			}
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.noAllowlist = true
+	links := []string{"https://unknown.org/x", "https://example.com/a", "http://other.net/y", "https://unknown.org/setup.exe"}
+	got := c.enqueueLinks(context.Background(), links, 1, "https://example.com/")
+
+	want := []string{"https://unknown.org/x", "https://example.com/a", "http://other.net/y"}
+	if got != len(want) || !slices.Equal(sent, want) {
+		t.Errorf("enqueueLinks() = %d, sent %v; want %v", got, sent, want)
+	}
+	for _, key := range append(reads, puts...) {
+		if strings.HasPrefix(key, allowedDomainKeyPrefix) {
+			t.Errorf("allowlist item %s touched with the allowlist disabled", key)
+		}
+	}
+	if len(puts) != len(want) {
+		t.Errorf("items put = %v, want one per enqueued link", puts)
+	}
+}
+
+func TestScopeByRegistrableDomainAllowlist(t *testing.T) {
+	tests := []struct {
+		name     string
+		regScope bool
+		host     string
+		wantKey  string
+	}{
+		{"full host by default", false, "blog.example.co.uk", allowedDomainKeyPrefix + "blog.example.co.uk"},
+		{"co.uk subdomain collapses", true, "blog.example.co.uk", allowedDomainKeyPrefix + "example.co.uk"},
+		{"www collapses", true, "www.example.com", allowedDomainKeyPrefix + "example.com"},
+		{"plain hostname unchanged", true, "intranet", allowedDomainKeyPrefix + "intranet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var getKey, putKey string
+			ddb := &mockDynamoDB{
+				getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					getKey = input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+					return &dynamodb.GetItemOutput{}, nil
+				},
+				putItemFunc: func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+					putKey = input.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+					return &dynamodb.PutItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.regScope = tt.regScope
+
+			c.isDomainAllowed(context.Background(), tt.host)
+			if getKey != tt.wantKey {
+				t.Errorf("isDomainAllowed read %q, want %q", getKey, tt.wantKey)
+			}
+			c.maybeAddDomain(context.Background(), tt.host, "https://example.com")
+			if putKey != tt.wantKey {
+				t.Errorf("maybeAddDomain wrote %q, want %q", putKey, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestRateLimitDomain(t *testing.T) {
+	tests := []struct {
+		name     string
+		regScope bool
+		url      string
+		want     string
+	}{
+		{"full host by default", false, "https://blog.example.co.uk/post", "https://blog.example.co.uk"},
+		{"port kept by default", false, "https://example.com:8443/a", "https://example.com:8443"},
+		{"co.uk subdomain collapses", true, "https://blog.example.co.uk/post", "https://example.co.uk"},
+		{"subdomains share a key", true, "https://www.example.com/a", "https://example.com"},
+		{"plain hostname unchanged", true, "http://intranet/page", "http://intranet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.regScope = tt.regScope
+			if got := c.rateLimitDomain(tt.url); got != tt.want {
+				t.Errorf("rateLimitDomain(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveFetchResultUpdatesDomainStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   FetchResult
+		wantExpr string // "" = no stats update
+	}{
+		{"success", FetchResult{Success: true, StatusCode: 200, ContentLength: 2048}, "ADD pages_crawled :one, bytes_downloaded :bytes"},
+		{"failure", FetchResult{StatusCode: 404, ContentLength: 512, FailureKind: FailureHTTPStatus}, "ADD pages_failed :one, bytes_downloaded :bytes"},
+		{"skipped", FetchResult{StatusCode: 200, ContentLength: 1 << 30, FailureKind: FailureTooLarge}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if strings.HasPrefix(in.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value, allowedDomainKeyPrefix) {
+						stats = in
+					}
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			if err := c.saveFetchResult(context.Background(), "https://Example.com/page", "abc123", &tt.result, 0); err != nil {
+				t.Fatalf("saveFetchResult() error = %v", err)
+			}
+
+			if tt.wantExpr == "" {
+				if stats != nil {
+					t.Errorf("unexpected stats update %q", *stats.UpdateExpression)
+				}
+				return
+			}
+			if stats == nil {
+				t.Fatal("no stats update on the allowlist item")
+			}
+			if got := stats.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value; got != allowedDomainKeyPrefix+"example.com" {
+				t.Errorf("key = %q, want %q", got, allowedDomainKeyPrefix+"example.com")
+			}
+			if *stats.UpdateExpression != tt.wantExpr {
+				t.Errorf("UpdateExpression = %q, want %q", *stats.UpdateExpression, tt.wantExpr)
+			}
+			if got := *stats.ConditionExpression; got != "attribute_exists(url_hash)" {
+				t.Errorf("ConditionExpression = %q, want the update to skip hosts without an item", got)
+			}
+			if got := stats.ExpressionAttributeValues[":bytes"].(*dynamodbtypes.AttributeValueMemberN).Value; got != strconv.FormatInt(tt.result.ContentLength, 10) {
+				t.Errorf(":bytes = %s, want %d", got, tt.result.ContentLength)
+			}
+		})
+	}
+}
+
+// domainCountDDB allowlists example.com with pages_crawled set to crawled
+func domainCountDDB(crawled int) *mockDynamoDB {
+	return &mockDynamoDB{
+		getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			if input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value != allowedDomainKeyPrefix+"example.com" {
+				return &dynamodb.GetItemOutput{}, nil
+			}
+			return &dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+				"status":        &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+				"pages_crawled": &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(crawled)},
+			}}, nil
+		},
+	}
+}
+
+func TestEnqueueLinksMaxPagesPerDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		cap     int
+		crawled int
+		want    int
+	}{
+		{"disabled", 0, 5000, 2},
+		{"under the cap", 10, 9, 2},
+		{"at the cap", 10, 10, 0},
+		{"over the cap", 10, 11, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := domainCountDDB(tt.crawled)
+			reads := 0
+			getItem := ddb.getItemFunc
+			ddb.getItemFunc = func(ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				if input.ProjectionExpression != nil && *input.ProjectionExpression == "pages_crawled" {
+					reads++
+				}
+				return getItem(ctx, input, opts...)
+			}
+			sent := 0
+			sqsClient := &mockSQS{
+				sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+					sent += len(input.Entries)
+					return &sqs.SendMessageBatchOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.domainPageCap = tt.cap
+			got := c.enqueueLinks(context.Background(), []string{"https://example.com/a", "https://example.com/b"}, 1, "https://example.com/")
+
+			if got != tt.want || sent != tt.want {
+				t.Errorf("enqueueLinks() = %d (%d sent), want %d", got, sent, tt.want)
+			}
+			if wantReads := min(tt.cap, 1); reads != wantReads {
+				t.Errorf("pages_crawled reads = %d, want %d (one per host)", reads, wantReads)
+			}
+		})
+	}
+}
+
+func TestProcessMessageSkipsDomainAtPageCap(t *testing.T) {
+	ddb := domainCountDDB(10)
+	var status string
+	ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		if v, ok := input.ExpressionAttributeValues[":status"].(*dynamodbtypes.AttributeValueMemberS); ok {
+			status = v.Value
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.domainPageCap = 10
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("fetched %s for a domain at its page cap", r.URL)
+	}))
+
+	got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+	if err != nil || got != outcomeSkipped {
+		t.Fatalf("processMessage() = %v, %v, want skipped", got, err)
+	}
+	if status != stateSkipped {
+		t.Errorf("status = %q, want %q", status, stateSkipped)
+	}
+}
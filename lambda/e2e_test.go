@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"lambda/urls"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// newFakeCrawler returns a test crawler over empty fakes with example.com allowlisted and no
+// crawl delay, fetching from handler
+func newFakeCrawler(handler http.Handler) (*Crawler, *fakeDynamoDB, *fakeSQS, *fakeS3) {
+	ddb, queue, bucket := newFakeDynamoDB(), &fakeSQS{}, newFakeS3()
+	ddb.items[allowedDomainKeyPrefix+"example.com"] = map[string]dynamodbtypes.AttributeValue{
+		"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + "example.com"},
+		"domain":   &dynamodbtypes.AttributeValueMemberS{Value: "example.com"},
+		"status":   &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+	}
+	c := newTestCrawlerWithMocks(ddb, queue, bucket)
+	c.httpClient = testHTTPClientWith(handler)
+	c.crawlDelayMs = 0
+	return c, ddb, queue, bucket
+}
+
+// seed records and queues rawURL as the producer does for a seed
+func seed(t *testing.T, c *Crawler, rawURL string) string {
+	t.Helper()
+	canonical := urls.Canonicalize(rawURL)
+	u := QueuedURL{URL: rawURL, Canonical: canonical, Hash: urls.Hash(canonical), Priority: priorityHigh}
+	if !c.queue().Add(context.Background(), u) || c.queue().Enqueue(context.Background(), []QueuedURL{u}) != 1 {
+		t.Fatalf("seeding %s failed", rawURL)
+	}
+	return u.Hash
+}
+
+// sitePages serves HTML pages by path, 404 for anything else (robots.txt included), and counts
+// the requests for each path
+type sitePages struct {
+	mu    sync.Mutex
+	pages map[string]string
+	hits  map[string]int
+}
+
+func newSitePages(pages map[string]string) *sitePages {
+	return &sitePages{pages: pages, hits: make(map[string]int)}
+}
+
+func (s *sitePages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.hits[r.URL.Path]++
+	page, ok := s.pages[r.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	_, _ = fmt.Fprint(w, page)
+}
+
+func TestE2EClaimFetchUploadEnqueue(t *testing.T) {
+	site := newSitePages(map[string]string{
+		"/": `<html><head><title>Home</title></head><body><p>Welcome to the example site.</p>
+<a href="/a">A</a> <a href="/b">B</a> <a href="https://elsewhere.example.net/x">Off site</a></body></html>`,
+	})
+	c, ddb, queue, bucket := newFakeCrawler(site)
+	hash := seed(t, c, "https://example.com/")
+
+	record, ok := queue.receive()
+	if !ok {
+		t.Fatal("seed was not queued")
+	}
+	if got, err := c.processMessage(context.Background(), &record); err != nil || got != outcomeSucceeded {
+		t.Fatalf("processMessage() = %v, %v, want succeeded", got, err)
+	}
+
+	if got := ddb.str(hash, "status"); got != stateDone {
+		t.Errorf("status = %q, want %q", got, stateDone)
+	}
+	if got := ddb.str(hash, "attempts"); got != "1" {
+		t.Errorf("attempts = %q, want 1", got)
+	}
+	if got := ddb.str(hash, "page_title"); got != "Home" {
+		t.Errorf("page_title = %q, want Home", got)
+	}
+	for _, attr := range []string{"s3_raw_key", "s3_text_key"} {
+		key := ddb.str(hash, attr)
+		if key == "" {
+			t.Errorf("%s not saved", attr)
+			continue
+		}
+		if _, ok := bucket.object("test-bucket", key); !ok {
+			t.Errorf("%s %q is not in the bucket", attr, key)
+		}
+	}
+
+	var bodies []string
+	for _, m := range queue.pending() {
+		bodies = append(bodies, m.body)
+		if m.queueURL != testQueueURL || *m.attrs["priority"].StringValue != priorityNormal || *m.attrs["depth"].StringValue != "1" {
+			t.Errorf("%s queued to %s with %s priority at depth %s, want the main queue, normal, depth 1",
+				m.body, m.queueURL, *m.attrs["priority"].StringValue, *m.attrs["depth"].StringValue)
+		}
+		if got := ddb.str(*m.attrs["url_hash"].StringValue, "status"); got != stateQueued {
+			t.Errorf("%s item status = %q, want queued", m.body, got)
+		}
+	}
+	if want := []string{"https://example.com/a", "https://example.com/b"}; !slices.Equal(bodies, want) {
+		t.Errorf("queued %v, want %v", bodies, want)
+	}
+	if item := ddb.item(urls.Hash(urls.Canonicalize("https://elsewhere.example.net/x"))); item != nil {
+		t.Errorf("off-site link recorded: %v", item)
+	}
+}
+
+func TestE2ECrawlFetchesEachPageOnce(t *testing.T) {
+	site := newSitePages(map[string]string{
+		"/":  `<html><body><a href="/a">A</a> <a href="/b">B</a></body></html>`,
+		"/a": `<html><body><a href="/">Home</a> <a href="/b">B</a></body></html>`,
+		"/b": `<html><body><a href="/a#top">A</a> <a href="/missing">Gone</a></body></html>`,
+	})
+	c, ddb, queue, _ := newFakeCrawler(site)
+	seed(t, c, "https://example.com/")
+
+	for range 20 {
+		record, ok := queue.receive()
+		if !ok {
+			break
+		}
+		if _, err := c.processMessage(context.Background(), &record); err != nil {
+			t.Fatalf("processMessage(%s) error = %v", record.Body, err)
+		}
+	}
+	if left := queue.pending(); len(left) != 0 {
+		t.Fatalf("%d messages left after 20 deliveries", len(left))
+	}
+
+	for path, want := range map[string]string{"/": stateDone, "/a": stateDone, "/b": stateDone, "/missing": stateFailed} {
+		if got := site.hits[path]; got != 1 {
+			t.Errorf("%s fetched %d times, want once", path, got)
+		}
+		if got := ddb.str(urls.Hash(urls.Canonicalize("https://example.com"+path)), "status"); got != want {
+			t.Errorf("%s status = %q, want %q", path, got, want)
+		}
+	}
+
+	// A redelivery of a finished URL loses the claim and fetches nothing
+	record := queueRecord(t, c, "https://example.com/")
+	if got, err := c.processMessage(context.Background(), &record); err != nil || got != outcomeSkipped {
+		t.Errorf("processMessage() of a redelivery = %v, %v, want skipped", got, err)
+	}
+	if got := site.hits["/"]; got != 1 {
+		t.Errorf("/ fetched %d times after a redelivery, want once", got)
+	}
+}
+
+func TestE2ERetriableFailureRequeues(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	c, ddb, queue, _ := newFakeCrawler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/robots.txt":
+			w.WriteHeader(http.StatusNotFound)
+		case down:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = fmt.Fprint(w, `<html><body><p>Back up.</p></body></html>`)
+		}
+	}))
+	hash := seed(t, c, "https://example.com/")
+
+	record, _ := queue.receive()
+	if got, err := c.processMessage(context.Background(), &record); err != nil || got != outcomeRetried {
+		t.Fatalf("processMessage() = %v, %v, want retried", got, err)
+	}
+	if got := ddb.str(hash, "status"); got != stateQueued {
+		t.Errorf("status after a 503 = %q, want queued", got)
+	}
+	pending := queue.pending()
+	if len(pending) != 1 || pending[0].delay <= 0 || *pending[0].attrs["url_hash"].StringValue != hash {
+		t.Fatalf("pending = %+v, want the URL requeued once with a delay", pending)
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	record, _ = queue.receive()
+	if got, err := c.processMessage(context.Background(), &record); err != nil || got != outcomeSucceeded {
+		t.Fatalf("processMessage() of the requeue = %v, %v, want succeeded", got, err)
+	}
+	if got := ddb.str(hash, "status"); got != stateDone {
+		t.Errorf("status = %q, want %q", got, stateDone)
+	}
+	if got := ddb.str(hash, "attempts"); got != "2" {
+		t.Errorf("attempts = %q, want 2", got)
+	}
+}
+
+func TestE2ELinkPolicySamplesShallowPages(t *testing.T) {
+	site := newSitePages(map[string]string{
+		"/": `<html><body><a href="/a">A</a> <a href="/b">B</a> <a href="/c">C</a> <a href="/d">D</a></body></html>`,
+	})
+	c, _, queue, _ := newFakeCrawler(site)
+	c.linkPolicy, c.linksPerPage = linkPolicyDepth, 2
+	seed(t, c, "https://example.com/")
+
+	record, _ := queue.receive()
+	if got, err := c.processMessage(context.Background(), &record); err != nil || got != outcomeSucceeded {
+		t.Fatalf("processMessage() = %v, %v, want succeeded", got, err)
+	}
+	var bodies []string
+	for _, m := range queue.pending() {
+		bodies = append(bodies, m.body)
+	}
+	if want := []string{"https://example.com/a", "https://example.com/c"}; !slices.Equal(bodies, want) {
+		t.Errorf("queued %v, want the sample %v", bodies, want)
+	}
+}
+
+// queueRecord sends rawURL's message again, as a redelivery would, and receives it
+func queueRecord(t *testing.T, c *Crawler, rawURL string) events.SQSMessage {
+	t.Helper()
+	canonical := urls.Canonicalize(rawURL)
+	if c.queue().Enqueue(context.Background(), []QueuedURL{{URL: rawURL, Canonical: canonical, Hash: urls.Hash(canonical), Priority: priorityHigh}}) != 1 {
+		t.Fatalf("queueing %s failed", rawURL)
+	}
+	record, ok := c.sqs.(*fakeSQS).receive()
+	if !ok {
+		t.Fatalf("%s was not queued", rawURL)
+	}
+	return record
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"lambda/urls"
+	"maps"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -205,3 +209,403 @@ func TestEnqueueLinksBatchPartialFailure(t *testing.T) {
 		t.Errorf("enqueueLinks() = %d, want 2 (one batch failure)", enqueued)
 	}
 }
+
+func TestEnqueueLinksUsesNormalPriority(t *testing.T) {
+	var captured *sqs.SendMessageBatchInput
+	ddb := &mockDynamoDB{
+		getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{
+				Item: map[string]dynamodbtypes.AttributeValue{
+					"status": &dynamodbtypes.AttributeValueMemberS{Value: "active"},
+				},
+			}, nil
+		},
+	}
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			captured = input
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.highQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789/high-queue"
+
+	c.enqueueLinks(context.Background(), []string{"https://example.com/a"}, 1, "https://example.com")
+
+	if *captured.QueueUrl != testQueueURL {
+		t.Errorf("expected discovered links on main queue, got %s", *captured.QueueUrl)
+	}
+	if got := *captured.Entries[0].MessageAttributes["priority"].StringValue; got != priorityNormal {
+		t.Errorf("expected priority %q, got %q", priorityNormal, got)
+	}
+}
+
+func TestEnqueueLinksPropagatesCrawlDelay(t *testing.T) {
+	var captured *sqs.SendMessageBatchInput
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			captured = input
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(authItemDDB(nil), sqsClient, &mockS3{})
+	ctx := withCrawlDelay(context.Background(), 3000)
+	c.enqueueLinks(ctx, []string{"https://example.com/a", "https://example.com/b"}, 1, "https://example.com")
+
+	for _, e := range captured.Entries {
+		if got := e.MessageAttributes["crawl_delay_ms"]; got.StringValue == nil || *got.StringValue != "3000" {
+			t.Errorf("%s crawl_delay_ms = %+v, want 3000 inherited from the parent", *e.MessageBody, got)
+		}
+	}
+}
+
+func TestEnqueueLinksPropagatesMaxDepth(t *testing.T) {
+	var captured *sqs.SendMessageBatchInput
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			captured = input
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(authItemDDB(nil), sqsClient, &mockS3{})
+	ctx := withMaxDepth(context.Background(), 7)
+	c.enqueueLinks(ctx, []string{"https://example.com/a", "https://example.com/b"}, 1, "https://example.com")
+
+	for _, e := range captured.Entries {
+		if got := e.MessageAttributes["max_depth"]; got.StringValue == nil || *got.StringValue != "7" {
+			t.Errorf("%s max_depth = %+v, want 7 inherited from the parent", *e.MessageBody, got)
+		}
+	}
+}
+
+func TestEnqueueLinksSetsDomain(t *testing.T) {
+	var domains []string
+	ddb := &mockDynamoDB{
+		putItemFunc: func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			if d, ok := input.Item["domain"].(*dynamodbtypes.AttributeValueMemberS); ok {
+				domains = append(domains, d.Value)
+			}
+			return &dynamodb.PutItemOutput{}, nil
+		},
+		getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{
+				Item: map[string]dynamodbtypes.AttributeValue{
+					"status": &dynamodbtypes.AttributeValueMemberS{Value: "active"},
+				},
+			}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.enqueueLinks(context.Background(), []string{"https://Example.com/a", "https://blog.example.com/b"}, 1, "https://example.com")
+
+	if len(domains) != 2 || domains[0] != "example.com" || domains[1] != "blog.example.com" {
+		t.Errorf("domain attributes = %v, want [example.com blog.example.com]", domains)
+	}
+}
+
+func TestEnqueueLinksDedupsCanonicalEquivalents(t *testing.T) {
+	var putURLs []string
+	ddb := &mockDynamoDB{
+		putItemFunc: func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			putURLs = append(putURLs, input.Item["url"].(*dynamodbtypes.AttributeValueMemberS).Value)
+			return &dynamodb.PutItemOutput{}, nil
+		},
+		getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{
+				Item: map[string]dynamodbtypes.AttributeValue{
+					"status": &dynamodbtypes.AttributeValueMemberS{Value: "active"},
+				},
+			}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	links := []string{
+		"https://example.com/page?id=1",
+		"https://example.com/page?id=1&utm_source=newsletter",
+		"https://EXAMPLE.com:443/page?gclid=abc&id=1",
+		"https://example.com/page?id=1#comments",
+	}
+
+	enqueued := c.enqueueLinks(context.Background(), links, 1, "https://example.com")
+	if enqueued != 1 {
+		t.Errorf("enqueueLinks() = %d, want 1", enqueued)
+	}
+	if len(putURLs) != 1 || putURLs[0] != "https://example.com/page?id=1" {
+		t.Errorf("PutItem URLs = %v, want one canonical https://example.com/page?id=1", putURLs)
+	}
+}
+
+func TestEnqueueLinksKeepsOriginalURLCasing(t *testing.T) {
+	items := make(map[string]map[string]dynamodbtypes.AttributeValue)
+	ddb := authItemDDB(nil)
+	ddb.putItemFunc = func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		hash := input.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+		if _, exists := items[hash]; exists {
+			return nil, errConditionalCheckFailed
+		}
+		items[hash] = input.Item
+		return &dynamodb.PutItemOutput{}, nil
+	}
+
+	var sent []sqstypes.SendMessageBatchRequestEntry
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			sent = append(sent, input.Entries...)
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	const original = "https://Example.COM/Docs/ReadMe"
+	const canonical = "https://example.com/Docs/ReadMe"
+
+	// Discovered on two different pages, differing only in host case
+	c.enqueueLinks(context.Background(), []string{original}, 1, "https://example.com/a")
+	c.enqueueLinks(context.Background(), []string{"https://example.com/Docs/ReadMe"}, 1, "https://example.com/b")
+
+	if len(items) != 1 {
+		t.Fatalf("stored %d items, want 1", len(items))
+	}
+	item, ok := items[urls.Hash(canonical)]
+	if !ok {
+		t.Fatalf("item not keyed by the canonical hash")
+	}
+	if got := item["url"].(*dynamodbtypes.AttributeValueMemberS).Value; got != original {
+		t.Errorf("url = %q, want original %q", got, original)
+	}
+	if got := item["canonical_url"].(*dynamodbtypes.AttributeValueMemberS).Value; got != canonical {
+		t.Errorf("canonical_url = %q, want %q", got, canonical)
+	}
+
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	if *sent[0].MessageBody != original {
+		t.Errorf("MessageBody = %q, want original %q", *sent[0].MessageBody, original)
+	}
+	if got := *sent[0].MessageAttributes["url_hash"].StringValue; got != urls.Hash(canonical) {
+		t.Errorf("url_hash attribute = %q, want the canonical hash", got)
+	}
+}
+
+func TestOversizedURL(t *testing.T) {
+	deep := "https://example.com" + strings.Repeat("/a", defaultMaxPathSegments+1)
+	manyParams := "https://example.com/search?" + strings.TrimPrefix(strings.Repeat("&p=1", defaultMaxQueryParams+1), "&")
+
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{"normal url", "https://example.com/blog/2024/post?page=2&sort=new", ""},
+		{"at length limit", "https://example.com/" + strings.Repeat("x", defaultMaxURLLength-len("https://example.com/")), ""},
+		{"over length limit", "https://example.com/?session=" + strings.Repeat("x", defaultMaxURLLength), "length"},
+		{"at path depth limit", "https://example.com" + strings.Repeat("/a", defaultMaxPathSegments), ""},
+		{"excessive path depth", deep, "path_segments"},
+		{"empty segments not counted", "https://example.com" + strings.Repeat("/", 2*defaultMaxPathSegments) + "a", ""},
+		{"excessive query params", manyParams, "query_params"},
+	}
+
+	c := newTestCrawler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.oversizedURL(tt.link, urls.Canonicalize(tt.link)); got != tt.want {
+				t.Errorf("oversizedURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOversizedURLDisabled(t *testing.T) {
+	c := newTestCrawler()
+	c.maxURLLength, c.maxPathSegs, c.maxParams = 0, 0, 0
+
+	link := "https://example.com" + strings.Repeat("/a", 1000) + "?" + strings.Repeat("p=1&", 100)
+	if got := c.oversizedURL(link, urls.Canonicalize(link)); got != "" {
+		t.Errorf("oversizedURL() = %q with all limits disabled, want \"\"", got)
+	}
+}
+
+func TestSelectLinks(t *testing.T) {
+	links := []string{"/0", "/1", "/2", "/3", "/4", "/5", "/6", "/7", "/8", "/9"}
+	sample := []string{"/0", "/3", "/6"}
+
+	tests := []struct {
+		name    string
+		policy  string
+		perPage int
+		depth   int
+		want    []string
+	}{
+		{"all keeps every link", linkPolicyAll, 3, 2, links},
+		{"breadth above sample depth", linkPolicyBreadth, 3, 0, links},
+		{"breadth at sample depth", linkPolicyBreadth, 3, 1, sample},
+		{"breadth below sample depth", linkPolicyBreadth, 3, 4, sample},
+		{"depth above sample depth", linkPolicyDepth, 3, 0, sample},
+		{"depth at sample depth", linkPolicyDepth, 3, 1, links},
+		{"depth below sample depth", linkPolicyDepth, 3, 4, links},
+		{"no per-page limit", linkPolicyBreadth, 0, 4, links},
+		{"fewer links than the limit", linkPolicyBreadth, 20, 4, links},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.linkPolicy, c.linksPerPage, c.sampleDepth = tt.policy, tt.perPage, defaultLinkSampleDepth
+			if got := c.selectLinks(links, tt.depth); !slices.Equal(got, tt.want) {
+				t.Errorf("selectLinks(depth %d) = %v, want %v", tt.depth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSampleLinksSpreadsOverPage(t *testing.T) {
+	links := make([]string, 100)
+	for i := range links {
+		links[i] = "/" + strings.Repeat("x", i)
+	}
+	got := sampleLinks(links, 4)
+	want := []string{links[0], links[25], links[50], links[75]}
+	if !slices.Equal(got, want) {
+		t.Errorf("sampleLinks() picked %d links, want every 25th", len(got))
+	}
+}
+
+func TestEnqueueLinksSkipsOversizedURLs(t *testing.T) {
+	var stored []string
+	ddb := authItemDDB(nil)
+	ddb.putItemFunc = func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		stored = append(stored, input.Item["url"].(*dynamodbtypes.AttributeValueMemberS).Value)
+		return &dynamodb.PutItemOutput{}, nil
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.maxURLLength = 100
+	c.maxPathSegs = 4
+
+	links := []string{
+		"https://example.com/ok",
+		"https://example.com/?sid=" + strings.Repeat("9", 100),
+		"https://example.com/a/b/a/b/a",
+		"https://example.com/a/b/c/d",
+	}
+	enqueued := c.enqueueLinks(context.Background(), links, 1, "https://example.com")
+
+	want := []string{"https://example.com/ok", "https://example.com/a/b/c/d"}
+	if enqueued != len(want) || strings.Join(stored, " ") != strings.Join(want, " ") {
+		t.Errorf("enqueueLinks() = %d, stored %v, want %v", enqueued, stored, want)
+	}
+}
+
+func TestEnqueueLinksSkipsCrawlerTraps(t *testing.T) {
+	var stored []string
+	ddb := authItemDDB(nil)
+	ddb.putItemFunc = func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		stored = append(stored, input.Item["url"].(*dynamodbtypes.AttributeValueMemberS).Value)
+		return &dynamodb.PutItemOutput{}, nil
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+
+	links := []string{
+		"https://example.com/events/2024/05",
+		"https://example.com/events/next/next/next/next",
+		"https://example.com/shop?color=red&color=blue&color=green&color=black&color=white&color=grey",
+		"https://example.com/docs/guide/install/linux/debian",
+	}
+	enqueued := c.enqueueLinks(context.Background(), links, 1, "https://example.com")
+
+	want := []string{"https://example.com/events/2024/05", "https://example.com/docs/guide/install/linux/debian"}
+	if enqueued != len(want) || strings.Join(stored, " ") != strings.Join(want, " ") {
+		t.Errorf("enqueueLinks() = %d, stored %v, want %v", enqueued, stored, want)
+	}
+}
+
+func TestEnqueueLinksSkipsExtensions(t *testing.T) {
+	var stored []string
+	ddb := authItemDDB(nil)
+	ddb.putItemFunc = func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		stored = append(stored, input.Item["url"].(*dynamodbtypes.AttributeValueMemberS).Value)
+		return &dynamodb.PutItemOutput{}, nil
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+
+	links := []string{
+		"https://example.com/downloads/setup.exe",
+		"https://example.com/media/Trailer.MP4",
+		"https://example.com/backup.tar.gz?v=2",
+		"https://example.com/download?file=setup.zip",
+		"https://example.com/docs/index.html",
+		"https://example.com/blog/post",
+	}
+	enqueued := c.enqueueLinks(context.Background(), links, 1, "https://example.com")
+
+	want := []string{"https://example.com/download?file=setup.zip", "https://example.com/docs/index.html", "https://example.com/blog/post"}
+	if enqueued != len(want) || strings.Join(stored, " ") != strings.Join(want, " ") {
+		t.Errorf("enqueueLinks() = %d, stored %v, want %v", enqueued, stored, want)
+	}
+}
+
+func TestEnqueueLinksIncludePrefixes(t *testing.T) {
+	links := []string{
+		"https://example.com/docs/intro",
+		"https://example.com/api/v1/users",
+		"https://example.com/blog/post",
+		"https://example.com/docs",
+		"https://other.example.org/docs/guide",
+	}
+	tests := []struct {
+		name     string
+		prefixes []string
+		want     []string
+	}{
+		{"disabled", nil, links},
+		{"single prefix", []string{"/docs/"}, []string{"https://example.com/docs/intro", "https://other.example.org/docs/guide"}},
+		{"multiple prefixes", []string{"/docs/", "/api/"}, []string{"https://example.com/docs/intro", "https://example.com/api/v1/users", "https://other.example.org/docs/guide"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored []string
+			ddb := authItemDDB(nil)
+			ddb.putItemFunc = func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+				stored = append(stored, input.Item["url"].(*dynamodbtypes.AttributeValueMemberS).Value)
+				return &dynamodb.PutItemOutput{}, nil
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.includes = tt.prefixes
+
+			enqueued := c.enqueueLinks(context.Background(), links, 1, "https://example.com")
+			if enqueued != len(tt.want) || strings.Join(stored, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("enqueueLinks() = %d, stored %v, want %v", enqueued, stored, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	if got, want := parsePrefixes(" /docs/, api/ ,,/"), []string{"/docs/", "/api/", "/"}; !slices.Equal(got, want) {
+		t.Errorf("parsePrefixes() = %v, want %v", got, want)
+	}
+	if got := parsePrefixes(""); got != nil {
+		t.Errorf("parsePrefixes(\"\") = %v, want nil (filter disabled)", got)
+	}
+}
+
+func TestParseExtensions(t *testing.T) {
+	got := parseExtensions(" ZIP, .Mp4,,.,pdf ")
+	want := map[string]bool{".zip": true, ".mp4": true, ".pdf": true}
+	if !maps.Equal(got, want) {
+		t.Errorf("parseExtensions() = %v, want %v", got, want)
+	}
+	if len(parseExtensions("")) != 0 {
+		t.Error("parseExtensions(\"\") should skip nothing")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"lambda/urls"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// pageCrawledEvent is published to EVENT_TOPIC_ARN after a page is saved as done
+type pageCrawledEvent struct {
+	URL           string `json:"url"`
+	Host          string `json:"host"`
+	Status        int    `json:"status"`
+	ContentLength int64  `json:"content_length"`
+	S3TextKey     string `json:"s3_text_key,omitempty"`
+}
+
+// publishPageCrawled notifies downstream consumers that targetURL was crawled.
+// A no-op unless EVENT_TOPIC_ARN is set. Failures are logged, never returned:
+// the page is already saved, and retrying the message would refetch it.
+func (c *Crawler) publishPageCrawled(ctx context.Context, targetURL string, result *FetchResult, textKey string) {
+	if c.eventTopicARN == "" {
+		return
+	}
+
+	body, err := json.Marshal(pageCrawledEvent{
+		URL:           targetURL,
+		Host:          urls.GetHost(targetURL),
+		Status:        result.StatusCode,
+		ContentLength: result.ContentLength,
+		S3TextKey:     textKey,
+	})
+	if err != nil {
+		c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to encode page crawled event")
+		return
+	}
+
+	_, err = c.sns.Publish(ctx, &sns.PublishInput{
+		TopicArn: &c.eventTopicARN,
+		Message:  aws.String(string(body)),
+	})
+	if err != nil {
+		c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to publish page crawled event")
+	}
+}
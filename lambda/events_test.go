@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"lambda/urls"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/rs/zerolog"
+)
+
+const testTopicARN = "arn:aws:sns:us-east-1:123456789:page-crawled"
+
+func TestProcessMessagePublishesPageCrawled(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		topic       string
+		wantPublish bool
+	}{
+		{"success publishes", http.StatusOK, testTopicARN, true},
+		{"permanent failure does not publish", http.StatusNotFound, testTopicARN, false},
+		{"retriable failure does not publish", http.StatusServiceUnavailable, testTopicARN, false},
+		{"no topic configured", http.StatusOK, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `<html><body><p>Hello from the events test</p></body></html>`
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(tt.status)
+				_, _ = fmt.Fprint(w, body)
+			})
+
+			var published []*sns.PublishInput
+			snsClient := &mockSNS{
+				publishFunc: func(_ context.Context, input *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+					published = append(published, input)
+					return &sns.PublishOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(authItemDDB(nil), &mockSQS{}, &mockS3{})
+			c.httpClient = testHTTPClientWith(handler)
+			c.crawlDelayMs = 0
+			c.sns = snsClient
+			c.eventTopicARN = tt.topic
+
+			targetURL := "https://example.com/page"
+			_, _ = c.processMessage(context.Background(), &events.SQSMessage{Body: targetURL})
+
+			if !tt.wantPublish {
+				if len(published) != 0 {
+					t.Fatalf("expected no publish, got %d", len(published))
+				}
+				return
+			}
+			if len(published) != 1 {
+				t.Fatalf("expected 1 publish, got %d", len(published))
+			}
+			if *published[0].TopicArn != testTopicARN {
+				t.Errorf("TopicArn = %q, want %q", *published[0].TopicArn, testTopicARN)
+			}
+
+			var got pageCrawledEvent
+			if err := json.Unmarshal([]byte(*published[0].Message), &got); err != nil {
+				t.Fatalf("event is not valid JSON: %v", err)
+			}
+			want := pageCrawledEvent{
+				URL:           targetURL,
+				Host:          "example.com",
+				Status:        http.StatusOK,
+				ContentLength: int64(len(body)),
+				S3TextKey:     urls.Hash(targetURL) + "/text.txt.gz",
+			}
+			if got != want {
+				t.Errorf("event = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPublishPageCrawledErrorIsLogged(t *testing.T) {
+	c := newTestCrawler()
+	c.eventTopicARN = testTopicARN
+	c.sns = &mockSNS{
+		publishFunc: func(_ context.Context, _ *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+			return nil, fmt.Errorf("SNS unavailable")
+		},
+	}
+
+	var buf bytes.Buffer
+	c.log = zerolog.New(&buf)
+
+	c.publishPageCrawled(context.Background(), "https://example.com/page", &FetchResult{Success: true, StatusCode: 200}, "")
+	if !strings.Contains(buf.String(), "Failed to publish page crawled event") {
+		t.Errorf("expected publish failure to be logged, got %q", buf.String())
+	}
+}
+
+func TestPageCrawledEventOmitsEmptyTextKey(t *testing.T) {
+	data, err := json.Marshal(pageCrawledEvent{URL: "https://example.com/doc.pdf", Host: "example.com", Status: 200, ContentLength: 42})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	want := `{"url":"https://example.com/doc.pdf","host":"example.com","status":200,"content_length":42}`
+	if string(data) != want {
+		t.Errorf("event JSON = %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unicode"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// The fakes below are stateful stand-ins for DynamoDB, SQS and S3, for tests that run
+// processMessage end to end and then assert what is left in the table, queue and bucket.
+// Unlike the mocks in mock_test.go they need no per-test wiring.
+
+// fakeDynamoDB is a table keyed by url_hash held in a map. Condition and update expressions are
+// evaluated for the subset of the grammar the crawler writes (see fakeExpr).
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]dynamodbtypes.AttributeValue
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: make(map[string]map[string]dynamodbtypes.AttributeValue)}
+}
+
+// fakeKey returns the url_hash of a request's Key
+func fakeKey(key map[string]dynamodbtypes.AttributeValue) string {
+	if v, ok := key["url_hash"].(*dynamodbtypes.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func (f *fakeDynamoDB) GetItem(_ context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[fakeKey(in.Key)]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	out := make(map[string]dynamodbtypes.AttributeValue, len(item))
+	if in.ProjectionExpression == nil {
+		for k, v := range item {
+			out[k] = v
+		}
+		return &dynamodb.GetItemOutput{Item: out}, nil
+	}
+	if err := fakeReservedName(fakeTokens(*in.ProjectionExpression)); err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(*in.ProjectionExpression, ",") {
+		name = strings.TrimSpace(name)
+		if alias, ok := in.ExpressionAttributeNames[name]; ok {
+			name = alias
+		}
+		if v, ok := item[name]; ok {
+			out[name] = v
+		}
+	}
+	return &dynamodb.GetItemOutput{Item: out}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(in.Item)
+	if in.ConditionExpression != nil {
+		ok, err := newFakeExpr(*in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues, f.items[key]).condition()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errConditionalCheckFailed
+		}
+	}
+	item := make(map[string]dynamodbtypes.AttributeValue, len(in.Item))
+	for k, v := range in.Item {
+		item[k] = v
+	}
+	f.items[key] = item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItem(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(in.Key)
+	old := f.items[key]
+	if in.ConditionExpression != nil {
+		ok, err := newFakeExpr(*in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues, old).condition()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errConditionalCheckFailed
+		}
+	}
+
+	// An update of a missing item creates it, as DynamoDB does
+	item := map[string]dynamodbtypes.AttributeValue{"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: key}}
+	for k, v := range old {
+		item[k] = v
+	}
+	var updated []string
+	if in.UpdateExpression != nil {
+		var err error
+		if updated, err = newFakeExpr(*in.UpdateExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues, old).update(item); err != nil {
+			return nil, err
+		}
+	}
+	f.items[key] = item
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch in.ReturnValues {
+	case dynamodbtypes.ReturnValueAllNew:
+		out.Attributes = make(map[string]dynamodbtypes.AttributeValue, len(item))
+		for k, v := range item {
+			out.Attributes[k] = v
+		}
+	case dynamodbtypes.ReturnValueUpdatedNew:
+		out.Attributes = make(map[string]dynamodbtypes.AttributeValue, len(updated))
+		for _, k := range updated {
+			if v, ok := item[k]; ok {
+				out.Attributes[k] = v
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeDynamoDB) DescribeTable(_ context.Context, in *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodbtypes.TableDescription{TableName: in.TableName}}, nil
+}
+
+// item returns a copy of the item under urlHash, nil when there is none
+func (f *fakeDynamoDB) item(urlHash string) map[string]dynamodbtypes.AttributeValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[urlHash]
+	if !ok {
+		return nil
+	}
+	out := make(map[string]dynamodbtypes.AttributeValue, len(item))
+	for k, v := range item {
+		out[k] = v
+	}
+	return out
+}
+
+// str returns a string or number attribute of the item under urlHash, "" when either is missing
+func (f *fakeDynamoDB) str(urlHash, name string) string {
+	switch v := f.item(urlHash)[name].(type) {
+	case *dynamodbtypes.AttributeValueMemberS:
+		return v.Value
+	case *dynamodbtypes.AttributeValueMemberN:
+		return v.Value
+	}
+	return ""
+}
+
+// fakeExpr evaluates a DynamoDB condition or update expression against an item: conditions of
+// comparisons (=, <>, <, <=, >, >=), attribute_exists, attribute_not_exists, AND, OR, NOT and
+// parentheses; updates of SET (values and if_not_exists), ADD (numbers and string sets) and REMOVE.
+// Operands are read from the item as it was before the update, as DynamoDB does.
+// Attribute names that are DynamoDB reserved words fail validation, as they do in DynamoDB.
+type fakeExpr struct {
+	toks   []string
+	pos    int
+	names  map[string]string
+	values map[string]dynamodbtypes.AttributeValue
+	item   map[string]dynamodbtypes.AttributeValue
+	err    error // A reserved word used as an attribute name
+}
+
+func newFakeExpr(expr string, names map[string]string, values map[string]dynamodbtypes.AttributeValue, item map[string]dynamodbtypes.AttributeValue) *fakeExpr {
+	toks := fakeTokens(expr)
+	return &fakeExpr{toks: toks, names: names, values: values, item: item, err: fakeReservedName(toks)}
+}
+
+// fakeKeywords are the expression keywords and functions the fake parses; they are reserved
+// words too, but not attribute names
+var fakeKeywords = map[string]bool{
+	"SET": true, "ADD": true, "REMOVE": true, "DELETE": true, "AND": true, "OR": true, "NOT": true,
+	"ATTRIBUTE_EXISTS": true, "ATTRIBUTE_NOT_EXISTS": true, "IF_NOT_EXISTS": true,
+}
+
+// fakeReservedWords is DynamoDB's list of reserved words, which an expression can only use as
+// attribute names through #placeholders
+var fakeReservedWords = func() map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.Fields(`ABORT ABSOLUTE ACTION ADD AFTER AGENT AGGREGATE ALL ALLOCATE ALTER
+		ANALYZE AND ANY ARCHIVE ARE ARRAY AS ASC ASCII ASENSITIVE ASSERTION ASYMMETRIC AT ATOMIC ATTACH
+		ATTRIBUTE AUTH AUTHORIZATION AUTHORIZE AUTO AVG BACK BACKUP BASE BATCH BEFORE BEGIN BETWEEN BIGINT
+		BINARY BIT BLOB BLOCK BOOLEAN BOTH BREADTH BUCKET BULK BY BYTE CALL CALLED CALLING CAPACITY CASCADE
+		CASCADED CASE CAST CATALOG CHAR CHARACTER CHECK CLASS CLOB CLOSE CLUSTER CLUSTERED CLUSTERING
+		CLUSTERS COALESCE COLLATE COLLATION COLLECTION COLUMN COLUMNS COMBINE COMMENT COMMIT COMPACT
+		COMPILE COMPRESS CONDITION CONFLICT CONNECT CONNECTION CONSISTENCY CONSISTENT CONSTRAINT
+		CONSTRAINTS CONSTRUCTOR CONSUMED CONTINUE CONVERT COPY CORRESPONDING COUNT COUNTER CREATE CROSS
+		CUBE CURRENT CURSOR CYCLE DATA DATABASE DATE DATETIME DAY DEALLOCATE DEC DECIMAL DECLARE DEFAULT
+		DEFERRABLE DEFERRED DEFINE DEFINED DEFINITION DELETE DELIMITED DEPTH DEREF DESC DESCRIBE
+		DESCRIPTOR DETACH DETERMINISTIC DIAGNOSTICS DIRECTORIES DISABLE DISCONNECT DISTINCT DISTRIBUTE DO
+		DOMAIN DOUBLE DROP DUMP DURATION DYNAMIC EACH ELEMENT ELSE ELSEIF EMPTY ENABLE END EQUAL EQUALS
+		ERROR ESCAPE ESCAPED EVAL EVALUATE EXCEEDED EXCEPT EXCEPTION EXCEPTIONS EXCLUSIVE EXEC EXECUTE
+		EXISTS EXIT EXPLAIN EXPLODE EXPORT EXPRESSION EXTENDED EXTERNAL EXTRACT FAIL FALSE FAMILY FETCH
+		FIELDS FILE FILTER FILTERING FINAL FINISH FIRST FIXED FLATTERN FLOAT FOR FORCE FOREIGN FORMAT
+		FORWARD FOUND FREE FROM FULL FUNCTION FUNCTIONS GENERAL GENERATE GET GLOB GLOBAL GO GOTO GRANT
+		GREATER GROUP GROUPING HANDLER HASH HAVE HAVING HEAP HIDDEN HOLD HOUR IDENTIFIED IDENTITY IF
+		IGNORE IMMEDIATE IMPORT IN INCLUDING INCLUSIVE INCREMENT INCREMENTAL INDEX INDEXED INDEXES
+		INDICATOR INFINITE INITIALLY INLINE INNER INNTER INOUT INPUT INSENSITIVE INSERT INSTEAD INT
+		INTEGER INTERSECT INTERVAL INTO INVALIDATE IS ISOLATION ITEM ITEMS ITERATE JOIN KEY KEYS LAG
+		LANGUAGE LARGE LAST LATERAL LEAD LEADING LEAVE LEFT LENGTH LESS LEVEL LIKE LIMIT LIMITED LINES
+		LIST LOAD LOCAL LOCALTIME LOCALTIMESTAMP LOCATION LOCATOR LOCK LOCKS LOG LOGED LONG LOOP LOWER MAP
+		MATCH MATERIALIZED MAX MAXLEN MEMBER MERGE METHOD METRICS MIN MINUS MINUTE MISSING MOD MODE
+		MODIFIES MODIFY MODULE MONTH MULTI MULTISET NAME NAMES NATIONAL NATURAL NCHAR NCLOB NEW NEXT NO
+		NONE NOT NULL NULLIF NUMBER NUMERIC OBJECT OF OFFLINE OFFSET OLD ON ONLINE ONLY OPAQUE OPEN
+		OPERATOR OPTION OR ORDER ORDINALITY OTHER OTHERS OUT OUTER OUTPUT OVER OVERLAPS OVERRIDE OWNER
+		PAD PARALLEL PARAMETER PARAMETERS PARTIAL PARTITION PARTITIONED PARTITIONS PATH PERCENT
+		PERCENTILE PERMISSION PERMISSIONS PIPE PIPELINED PLAN POOL POSITION PRECISION PREPARE PRESERVE
+		PRIMARY PRIOR PRIVATE PRIVILEGES PROCEDURE PROCESSED PROJECT PROJECTION PROPERTY PROVISIONING
+		PUBLIC PUT QUERY QUIT QUORUM RAISE RANDOM RANGE RANK RAW READ READS REAL REBUILD RECORD RECURSIVE
+		REDUCE REF REFERENCE REFERENCES REFERENCING REGEXP REGION REINDEX RELATIVE RELEASE REMAINDER
+		RENAME REPEAT REPLACE REQUEST RESET RESIGNAL RESOURCE RESPONSE RESTORE RESTRICT RESULT RETURN
+		RETURNING RETURNS REVERSE REVOKE RIGHT ROLE ROLES ROLLBACK ROLLUP ROUTINE ROW ROWS RULE RULES
+		SAMPLE SATISFIES SAVE SAVEPOINT SCAN SCHEMA SCOPE SCROLL SEARCH SECOND SECTION SEGMENT SEGMENTS
+		SELECT SELF SEMI SENSITIVE SEPARATE SEQUENCE SERIALIZABLE SESSION SET SETS SHARD SHARE SHARED
+		SHORT SHOW SIGNAL SIMILAR SIZE SKEWED SMALLINT SNAPSHOT SOME SOURCE SPACE SPACES SPARSE SPECIFIC
+		SPECIFICTYPE SPLIT SQL SQLCODE SQLERROR SQLEXCEPTION SQLSTATE SQLWARNING START STATE STATIC
+		STATUS STORAGE STORE STORED STREAM STRING STRUCT STYLE SUB SUBMULTISET SUBPARTITION SUBSTRING
+		SUBTYPE SUM SUPER SYMMETRIC SYNONYM SYSTEM TABLE TABLESAMPLE TEMP TEMPORARY TERMINATED TEXT THAN
+		THEN THROUGHPUT TIME TIMESTAMP TIMEZONE TINYINT TO TOKEN TOTAL TOUCH TRAILING TRANSACTION
+		TRANSFORM TRANSLATE TRANSLATION TREAT TRIGGER TRIM TRUE TRUNCATE TTL TUPLE TYPE UNDER UNDO UNION
+		UNIQUE UNIT UNKNOWN UNLOGGED UNNEST UNPROCESSED UNSIGNED UNTIL UPDATE UPPER URL USAGE USE USER
+		USERS USING UUID VACUUM VALUE VALUED VALUES VARCHAR VARIABLE VARIANCE VARINT VARYING VIEW VIEWS
+		VIRTUAL VOID WAIT WHEN WHENEVER WHERE WHILE WINDOW WITH WITHIN WITHOUT WORK WRAPPED WRITE YEAR
+		ZONE`) {
+		words[w] = true
+	}
+	return words
+}()
+
+// fakeReservedName returns a validation error for the first reserved word an expression uses as
+// an attribute name (a bare name, or a part of a dotted path), nil if there is none
+func fakeReservedName(toks []string) error {
+	for _, tok := range toks {
+		if strings.HasPrefix(tok, "#") || strings.HasPrefix(tok, ":") || fakeKeywords[strings.ToUpper(tok)] {
+			continue
+		}
+		for _, part := range strings.Split(tok, ".") {
+			if fakeReservedWords[strings.ToUpper(part)] {
+				return fmt.Errorf("fake DynamoDB: ValidationException: Attribute name is a reserved keyword; reserved keyword: %s", part)
+			}
+		}
+	}
+	return nil
+}
+
+// fakeTokens splits an expression into names, placeholders, keywords and punctuation
+func fakeTokens(expr string) []string {
+	var toks []string
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case strings.ContainsRune("(),=", rune(ch)):
+			toks = append(toks, string(ch))
+			i++
+		case ch == '<' || ch == '>':
+			if i+1 < len(expr) && (expr[i+1] == '=' || (ch == '<' && expr[i+1] == '>')) {
+				toks = append(toks, expr[i:i+2])
+				i += 2
+			} else {
+				toks = append(toks, string(ch))
+				i++
+			}
+		default:
+			j := i
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j])) || strings.ContainsRune("_#:.-", rune(expr[j]))) {
+				j++
+			}
+			if j == i {
+				j++ // Unknown character; the parser rejects it
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+func (e *fakeExpr) peek() string {
+	if e.pos < len(e.toks) {
+		return e.toks[e.pos]
+	}
+	return ""
+}
+
+func (e *fakeExpr) next() string {
+	tok := e.peek()
+	e.pos++
+	return tok
+}
+
+func (e *fakeExpr) expect(tok string) error {
+	if got := e.next(); got != tok {
+		return fmt.Errorf("fake DynamoDB: expected %q at token %d, got %q", tok, e.pos-1, got)
+	}
+	return nil
+}
+
+// name resolves an attribute name, which may be a #placeholder
+func (e *fakeExpr) name(tok string) string {
+	if alias, ok := e.names[tok]; ok {
+		return alias
+	}
+	return tok
+}
+
+// operand returns a :placeholder's value, or the current value of a named attribute (nil if absent)
+func (e *fakeExpr) operand(tok string) (dynamodbtypes.AttributeValue, error) {
+	if strings.HasPrefix(tok, ":") {
+		v, ok := e.values[tok]
+		if !ok {
+			return nil, fmt.Errorf("fake DynamoDB: no value for %s", tok)
+		}
+		return v, nil
+	}
+	return e.item[e.name(tok)], nil
+}
+
+// condition evaluates the whole expression as a condition
+func (e *fakeExpr) condition() (bool, error) {
+	if e.err != nil {
+		return false, e.err
+	}
+	ok, err := e.or()
+	if err == nil && e.pos != len(e.toks) {
+		err = fmt.Errorf("fake DynamoDB: unexpected %q in condition", e.peek())
+	}
+	return ok, err
+}
+
+func (e *fakeExpr) or() (bool, error) {
+	ok, err := e.and()
+	for err == nil && strings.EqualFold(e.peek(), "OR") {
+		e.next()
+		var right bool
+		right, err = e.and()
+		ok = ok || right
+	}
+	return ok, err
+}
+
+func (e *fakeExpr) and() (bool, error) {
+	ok, err := e.not()
+	for err == nil && strings.EqualFold(e.peek(), "AND") {
+		e.next()
+		var right bool
+		right, err = e.not()
+		ok = ok && right
+	}
+	return ok, err
+}
+
+func (e *fakeExpr) not() (bool, error) {
+	if strings.EqualFold(e.peek(), "NOT") {
+		e.next()
+		ok, err := e.not()
+		return !ok, err
+	}
+	return e.primary()
+}
+
+func (e *fakeExpr) primary() (bool, error) {
+	tok := e.next()
+	if tok == "(" {
+		ok, err := e.or()
+		if err != nil {
+			return false, err
+		}
+		return ok, e.expect(")")
+	}
+	if tok == "attribute_exists" || tok == "attribute_not_exists" {
+		if err := e.expect("("); err != nil {
+			return false, err
+		}
+		_, exists := e.item[e.name(e.next())]
+		return exists == (tok == "attribute_exists"), e.expect(")")
+	}
+
+	left, err := e.operand(tok)
+	if err != nil {
+		return false, err
+	}
+	op := e.next()
+	right, err := e.operand(e.next())
+	if err != nil {
+		return false, err
+	}
+	cmp, comparable := fakeCompare(left, right)
+	if !comparable {
+		return op == "<>" && left != nil && right != nil, nil
+	}
+	switch op {
+	case "=":
+		return cmp == 0, nil
+	case "<>":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, fmt.Errorf("fake DynamoDB: unknown comparison %q", op)
+}
+
+// fakeCompare orders two values of the same scalar type; comparable is false for a missing
+// value or mismatched types, which no comparison but <> matches
+func fakeCompare(a, b dynamodbtypes.AttributeValue) (cmp int, comparable bool) {
+	switch a := a.(type) {
+	case *dynamodbtypes.AttributeValueMemberS:
+		if b, ok := b.(*dynamodbtypes.AttributeValueMemberS); ok {
+			return strings.Compare(a.Value, b.Value), true
+		}
+	case *dynamodbtypes.AttributeValueMemberN:
+		if b, ok := b.(*dynamodbtypes.AttributeValueMemberN); ok {
+			x, _ := strconv.ParseFloat(a.Value, 64)
+			y, _ := strconv.ParseFloat(b.Value, 64)
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case *dynamodbtypes.AttributeValueMemberBOOL:
+		if b, ok := b.(*dynamodbtypes.AttributeValueMemberBOOL); ok {
+			if a.Value == b.Value {
+				return 0, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// update applies the expression as an update expression to item and returns the names it set or added
+func (e *fakeExpr) update(item map[string]dynamodbtypes.AttributeValue) ([]string, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	var updated []string
+	for e.pos < len(e.toks) {
+		clause := strings.ToUpper(e.next())
+		for {
+			name := e.name(e.next())
+			switch clause {
+			case "SET":
+				if err := e.expect("="); err != nil {
+					return nil, err
+				}
+				v, err := e.setValue()
+				if err != nil {
+					return nil, err
+				}
+				item[name] = v
+				updated = append(updated, name)
+			case "ADD":
+				v, err := e.operand(e.next())
+				if err != nil {
+					return nil, err
+				}
+				sum, err := fakeAdd(e.item[name], v)
+				if err != nil {
+					return nil, err
+				}
+				item[name] = sum
+				updated = append(updated, name)
+			case "REMOVE":
+				delete(item, name)
+			default:
+				return nil, fmt.Errorf("fake DynamoDB: unsupported update clause %q", clause)
+			}
+			if e.peek() != "," {
+				break
+			}
+			e.next()
+		}
+	}
+	return updated, nil
+}
+
+// setValue reads the value of a SET action: an operand, or if_not_exists(name, operand)
+func (e *fakeExpr) setValue() (dynamodbtypes.AttributeValue, error) {
+	tok := e.next()
+	if tok != "if_not_exists" {
+		return e.operand(tok)
+	}
+	if err := e.expect("("); err != nil {
+		return nil, err
+	}
+	existing := e.item[e.name(e.next())]
+	if err := e.expect(","); err != nil {
+		return nil, err
+	}
+	fallback, err := e.operand(e.next())
+	if err != nil {
+		return nil, err
+	}
+	if err := e.expect(")"); err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+	return fallback, nil
+}
+
+// fakeAdd is ADD of v to the current value: a sum for numbers, a union for string sets
+func fakeAdd(current, v dynamodbtypes.AttributeValue) (dynamodbtypes.AttributeValue, error) {
+	if current == nil {
+		return v, nil
+	}
+	switch v := v.(type) {
+	case *dynamodbtypes.AttributeValueMemberN:
+		if cur, ok := current.(*dynamodbtypes.AttributeValueMemberN); ok {
+			x, errX := strconv.ParseInt(cur.Value, 10, 64)
+			y, errY := strconv.ParseInt(v.Value, 10, 64)
+			if errX == nil && errY == nil {
+				return &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(x+y, 10)}, nil
+			}
+			fx, _ := strconv.ParseFloat(cur.Value, 64)
+			fy, _ := strconv.ParseFloat(v.Value, 64)
+			return &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatFloat(fx+fy, 'f', -1, 64)}, nil
+		}
+	case *dynamodbtypes.AttributeValueMemberSS:
+		if cur, ok := current.(*dynamodbtypes.AttributeValueMemberSS); ok {
+			set := slices.Clone(cur.Value)
+			for _, s := range v.Value {
+				if !slices.Contains(set, s) {
+					set = append(set, s)
+				}
+			}
+			return &dynamodbtypes.AttributeValueMemberSS{Value: set}, nil
+		}
+	}
+	return nil, fmt.Errorf("fake DynamoDB: ADD of %T to %T", v, current)
+}
+
+// fakeSQS keeps every message sent, across queues, in send order until receive takes it.
+// DelaySeconds is recorded rather than waited out.
+type fakeSQS struct {
+	mu       sync.Mutex
+	sent     int
+	messages []fakeMessage
+}
+
+// fakeMessage is a message as sent to fakeSQS
+type fakeMessage struct {
+	queueURL string
+	id       string
+	body     string
+	delay    int32
+	attrs    map[string]sqstypes.MessageAttributeValue
+}
+
+func (f *fakeSQS) push(queueURL, body string, delay int32, attrs map[string]sqstypes.MessageAttributeValue) string {
+	f.sent++
+	id := "fake-" + strconv.Itoa(f.sent)
+	f.messages = append(f.messages, fakeMessage{queueURL: queueURL, id: id, body: body, delay: delay, attrs: attrs})
+	return id
+}
+
+func (f *fakeSQS) SendMessage(_ context.Context, in *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.push(aws.ToString(in.QueueUrl), aws.ToString(in.MessageBody), in.DelaySeconds, in.MessageAttributes)
+	return &sqs.SendMessageOutput{MessageId: &id}, nil
+}
+
+func (f *fakeSQS) SendMessageBatch(_ context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(in.Entries) == 0 || len(in.Entries) > 10 {
+		return nil, fmt.Errorf("fake SQS: batch of %d entries, want 1 to 10", len(in.Entries))
+	}
+	out := &sqs.SendMessageBatchOutput{}
+	for _, e := range in.Entries {
+		id := f.push(aws.ToString(in.QueueUrl), aws.ToString(e.MessageBody), e.DelaySeconds, e.MessageAttributes)
+		out.Successful = append(out.Successful, sqstypes.SendMessageBatchResultEntry{Id: e.Id, MessageId: &id})
+	}
+	return out, nil
+}
+
+func (f *fakeSQS) GetQueueAttributes(_ context.Context, in *sqs.GetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, m := range f.messages {
+		if m.queueURL == aws.ToString(in.QueueUrl) {
+			n++
+		}
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{"ApproximateNumberOfMessages": strconv.Itoa(n)}}, nil
+}
+
+// receive removes the oldest message and returns it as the SQS record processMessage takes
+func (f *fakeSQS) receive() (events.SQSMessage, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.messages) == 0 {
+		return events.SQSMessage{}, false
+	}
+	m := f.messages[0]
+	f.messages = f.messages[1:]
+	attrs := make(map[string]events.SQSMessageAttribute, len(m.attrs))
+	for name, v := range m.attrs {
+		attrs[name] = events.SQSMessageAttribute{DataType: aws.ToString(v.DataType), StringValue: v.StringValue}
+	}
+	return events.SQSMessage{MessageId: m.id, Body: m.body, MessageAttributes: attrs}, true
+}
+
+// pending returns the messages not yet received
+func (f *fakeSQS) pending() []fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.messages)
+}
+
+// fakeS3 is a bucket store held in a map, honouring If-None-Match: * like S3 does
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject // By bucket + "/" + key
+}
+
+// fakeObject is an object as stored by fakeS3
+type fakeObject struct {
+	body            []byte
+	contentType     string
+	contentEncoding string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]fakeObject)}
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var body []byte
+	if in.Body != nil {
+		var err error
+		if body, err = io.ReadAll(in.Body); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := aws.ToString(in.Bucket) + "/" + aws.ToString(in.Key)
+	if _, exists := f.objects[path]; exists && aws.ToString(in.IfNoneMatch) == "*" {
+		return nil, fmt.Errorf("operation error S3: PutObject: %w", s3APIError{code: "PreconditionFailed"})
+	}
+	f.objects[path] = fakeObject{body: body, contentType: aws.ToString(in.ContentType), contentEncoding: aws.ToString(in.ContentEncoding)}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadBucket(_ context.Context, _ *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+// object returns the object stored under bucket and key
+func (f *fakeS3) object(bucket, key string) (fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[bucket+"/"+key]
+	return obj, ok
+}
+
+// TestFakeDynamoDBConditions pins the fake's expression handling to DynamoDB's on the crawler's own
+// conditional writes, since the end-to-end tests rely on it
+func TestFakeDynamoDBConditions(t *testing.T) {
+	ctx := context.Background()
+	ddb := newFakeDynamoDB()
+	c := newTestCrawlerWithMocks(ddb, &fakeSQS{}, newFakeS3())
+	c.maxTotalURLs = 2
+
+	u := QueuedURL{URL: "https://example.com/", Canonical: "https://example.com/", Hash: "h1", Priority: priorityNormal}
+	if !c.queue().Add(ctx, u) || c.queue().Add(ctx, u) {
+		t.Error("Add() should put the item once (attribute_not_exists)")
+	}
+	if _, won, err := c.claimURL(ctx, "missing"); won || err != nil {
+		t.Errorf("claimURL() of a missing item = %v, %v, want lost", won, err)
+	}
+	if claimed, won, _ := c.claimURL(ctx, "h1"); !won || claimed.attempts != 1 {
+		t.Errorf("claimURL() = %+v, %v, want attempt 1 won", claimed, won)
+	}
+	if _, won, _ := c.claimURL(ctx, "h1"); won {
+		t.Error("claimURL() of a fresh processing claim won")
+	}
+	c.releaseClaim(ctx, "h1", false)
+	if got := ddb.str("h1", "attempts"); got != "0" {
+		t.Errorf("attempts after an uncounted release = %q, want 0", got)
+	}
+
+	for i, want := range []error{nil, nil, errBudgetExhausted} {
+		if err := c.reserveBudget(ctx); !errors.Is(err, want) {
+			t.Errorf("reserveBudget() #%d = %v, want %v", i+1, err, want)
+		}
+	}
+	if got := ddb.str(crawlBudgetKey, "url_count"); got != "2" {
+		t.Errorf("url_count = %q, want 2", got)
+	}
+}
@@ -1,13 +1,73 @@
 package main
 
 import (
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
 	"lambda/internal/ssrf"
+	"lambda/urls"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// FailureKind is the category of a fetch failure, stored as failure_kind so failures can be
+// told apart without parsing the Error string. Successful fetches are FailureNone, or
+// FailureTruncated when the body was cut off.
+type FailureKind int
+
+const (
+	FailureNone         FailureKind = iota
+	FailureDNS                      // Lookup failed: NXDOMAIN or a DNS server error
+	FailureTimeout                  // fetchTimeout ran out while connecting or reading
+	FailureConnRefused              // Nothing listening on the port
+	FailureTLS                      // Handshake or certificate failure
+	FailureHTTPStatus               // The server answered with a non-2xx/3xx status
+	FailureBodyRead                 // Reading or decoding the body failed
+	FailureSSRF                     // The host resolves to a private or reserved address
+	FailureTruncated                // Fetched, but the body was cut off at maxBodyBytes
+	FailureRequest                  // The URL cannot be requested (malformed, unsupported scheme)
+	FailureNetwork                  // Any other transport error (connection reset, unexpected EOF)
+	FailureTooLarge                 // Content-Length declared a body over maxBodyBytes, so none was read
+	FailureEmptyBody                // A 200 HTML body under EMPTY_HTML_MIN_BYTES, retried with RETRY_EMPTY_HTML
+	FailureRedirectLoop             // A redirect led back to a URL already visited, or past MAX_REDIRECTS hops
 )
 
+var failureKindNames = [...]string{
+	FailureNone:         "none",
+	FailureDNS:          "dns",
+	FailureTimeout:      "timeout",
+	FailureConnRefused:  "conn_refused",
+	FailureTLS:          "tls",
+	FailureHTTPStatus:   "http_status",
+	FailureBodyRead:     "body_read",
+	FailureSSRF:         "ssrf",
+	FailureTruncated:    "truncated",
+	FailureRequest:      "request",
+	FailureNetwork:      "network",
+	FailureTooLarge:     "too_large",
+	FailureEmptyBody:    "empty_body",
+	FailureRedirectLoop: "redirect_loop",
+}
+
+// String returns the name stored in failure_kind
+func (k FailureKind) String() string {
+	if k < 0 || int(k) >= len(failureKindNames) {
+		return "unknown"
+	}
+	return failureKindNames[k]
+}
+
 // FetchResult contains the result of fetching a URL
 type FetchResult struct {
 	Success       bool
@@ -16,57 +76,205 @@ type FetchResult struct {
 	ContentType   string
 	DurationMs    int64
 	Error         string
-	Body          []byte // For HTML pages, contains the body for link extraction
+	FailureKind   FailureKind
+	Body          []byte   // For HTML pages, contains the body for link extraction
+	Truncated     bool     // Body was cut off at maxBodyBytes
+	Permanent     bool     // Transport failure that will never succeed on retry (e.g. NXDOMAIN)
+	RedirectChain []string // Each URL redirected to, in order; the last one served this response
+	RobotsTag     []string // X-Robots-Tag header values, one per header line, for parser.ParseRobots
+}
+
+// ifModifiedSinceKey is the context key for the If-Modified-Since time of a conditional fetch
+type ifModifiedSinceKey struct{}
+
+// withIfModifiedSince returns ctx making fetchURL conditional on the page changing after since;
+// a zero since leaves the fetch unconditional
+func withIfModifiedSince(ctx context.Context, since time.Time) context.Context {
+	if since.IsZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, ifModifiedSinceKey{}, since)
 }
 
-func (c *Crawler) fetchURL(ctx context.Context, targetURL string) FetchResult {
+// modifiedSince returns the time to re-crawl the claimed URL against: the previous crawl's
+// finished_at, or zero unless that crawl stored content a 304 can stand in for
+func (p claim) modifiedSince() time.Time {
+	if p.rawKey == "" {
+		return time.Time{}
+	}
+	return p.finished
+}
+
+// fetchURL GETs targetURL with optional per-domain credentials (nil for none). With a time from
+// withIfModifiedSince on ctx it sends If-Modified-Since, and an unchanged page answers 304 with no body.
+func (c *Crawler) fetchURL(ctx context.Context, targetURL string, auth *domainAuth) FetchResult {
 	start := time.Now()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, http.NoBody)
-	if err != nil {
-		return FetchResult{
-			Success:    false,
-			DurationMs: time.Since(start).Milliseconds(),
-			Error:      "invalid request: " + err.Error(),
+	// The deadline covers connect, headers and body read
+	ctx, cancel := context.WithTimeout(ctx, c.fetchTimeout)
+	defer cancel()
+
+	var chain []string
+	var resp *http.Response
+	currentURL := targetURL
+	originHost := ""
+	visited := map[string]bool{targetURL: true}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, currentURL, http.NoBody)
+		if err != nil {
+			return FetchResult{
+				Success:       false,
+				DurationMs:    time.Since(start).Milliseconds(),
+				Error:         "invalid request: " + err.Error(),
+				FailureKind:   FailureRequest,
+				RedirectChain: chain,
+			}
+		}
+		if originHost == "" {
+			originHost = req.URL.Host
+		}
+
+		// SSRF protection: block requests to private/internal IPs, re-checked on every hop.
+		// The connection is pinned to the validated IPs so DNS cannot change in between.
+		ips, err := ssrf.ResolveHost(ctx, req.URL.Host)
+		if err != nil {
+			return FetchResult{
+				Success:       false,
+				DurationMs:    time.Since(start).Milliseconds(),
+				Error:         "SSRF blocked: " + err.Error(),
+				FailureKind:   resolveFailureKind(err),
+				Permanent:     isPermanentNetworkError(err), // ValidateHost wraps the DNS lookup error
+				RedirectChain: chain,
+			}
+		}
+		req = req.WithContext(ssrf.PinIPs(ctx, req.URL.Hostname(), ips))
+
+		req.Header.Set("User-Agent", c.userAgent)
+		// Setting this ourselves turns off the transport's transparent gzip; decodeBody handles both
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		if c.acceptLang != "" {
+			req.Header.Set("Accept-Language", c.acceptLang)
+		}
+		if since, ok := ctx.Value(ifModifiedSinceKey{}).(time.Time); ok {
+			req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
 		}
+		// Credentials and insecure_tls are configured per host; never apply them to a redirect target elsewhere
+		client := c.httpClient
+		if strings.EqualFold(req.URL.Host, originHost) {
+			auth.apply(req)
+			client = c.clientFor(auth)
+		}
+
+		resp, err = client.Do(req)
+		if err != nil {
+			return FetchResult{
+				Success:       false,
+				DurationMs:    time.Since(start).Milliseconds(),
+				Error:         err.Error(),
+				FailureKind:   networkFailureKind(err),
+				Permanent:     isPermanentNetworkError(err),
+				RedirectChain: chain,
+			}
+		}
+
+		next := redirectTarget(req.URL, resp)
+		if next == "" {
+			break
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, redirectDrainBytes))
+		_ = resp.Body.Close()
+
+		// A loop would otherwise be followed to the hop cap on every retry of the URL
+		errText := ""
+		switch {
+		case visited[next]:
+			errText = "redirect loop back to " + next
+		case len(chain) >= c.maxRedirects:
+			errText = fmt.Sprintf("more than %d redirects", c.maxRedirects)
+		}
+		if errText != "" {
+			return FetchResult{
+				Success:       false,
+				StatusCode:    resp.StatusCode,
+				DurationMs:    time.Since(start).Milliseconds(),
+				Error:         errText,
+				FailureKind:   FailureRedirectLoop,
+				RedirectChain: chain,
+			}
+		}
+		visited[next] = true
+		chain = append(chain, next)
+		currentURL = next
 	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
 
-	// SSRF protection: block requests to private/internal IPs
-	if err := ssrf.ValidateHost(req.URL.Host); err != nil {
+	success := resp.StatusCode >= 200 && resp.StatusCode < 400
+	contentType := resp.Header.Get("Content-Type")
+
+	// A declared length over the limit is skipped without reading a byte. Decoding only grows a
+	// body, so an encoded length over the limit is over it decoded too. Without the header, or when
+	// it understates the body, the LimitReader below still caps the read.
+	if success && resp.ContentLength > c.maxBodyBytes {
 		return FetchResult{
-			Success:    false,
-			DurationMs: time.Since(start).Milliseconds(),
-			Error:      "SSRF blocked: " + err.Error(),
+			Success:       false,
+			StatusCode:    resp.StatusCode,
+			ContentLength: resp.ContentLength,
+			ContentType:   contentType,
+			DurationMs:    time.Since(start).Milliseconds(),
+			Error:         fmt.Sprintf("Content-Length %d exceeds the %d byte limit", resp.ContentLength, c.maxBodyBytes),
+			FailureKind:   FailureTooLarge,
+			RedirectChain: chain,
 		}
 	}
 
-	req.Header.Set("User-Agent", "MyCrawler/1.0 (learning project)")
-
-	resp, err := c.httpClient.Do(req)
+	decoded, err := decodeBody(resp)
 	if err != nil {
 		return FetchResult{
-			Success:    false,
-			DurationMs: time.Since(start).Milliseconds(),
-			Error:      err.Error(),
+			Success:       false,
+			StatusCode:    resp.StatusCode,
+			ContentType:   resp.Header.Get("Content-Type"),
+			DurationMs:    time.Since(start).Milliseconds(),
+			Error:         "decode error: " + err.Error(),
+			FailureKind:   FailureBodyRead,
+			Permanent:     errors.Is(err, errUnsupportedEncoding),
+			RedirectChain: chain,
 		}
 	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	// A server trickling bytes could hold the read past ctx's deadline (FETCH_TIMEOUT_MS or the
+	// Lambda's own); closing the body unblocks a pending read once ctx is done
+	stop := context.AfterFunc(ctx, func() { _ = resp.Body.Close() })
+	defer stop()
+
+	// The limit applies to the decoded bytes, so a small compressed body cannot expand without bound.
+	// Read one extra byte so a body longer than the limit can be told apart from one exactly at it
+	body, err := io.ReadAll(io.LimitReader(contextReader{ctx: ctx, r: decoded}, c.maxBodyBytes+1))
 	if err != nil {
 		return FetchResult{
-			Success:     false,
-			StatusCode:  resp.StatusCode,
-			ContentType: resp.Header.Get("Content-Type"),
-			DurationMs:  time.Since(start).Milliseconds(),
-			Error:       "read error: " + err.Error(),
+			Success:       false,
+			StatusCode:    resp.StatusCode,
+			ContentType:   resp.Header.Get("Content-Type"),
+			DurationMs:    time.Since(start).Milliseconds(),
+			Error:         "read error: " + err.Error(),
+			FailureKind:   readFailureKind(err),
+			RedirectChain: chain,
 		}
 	}
 
-	success := resp.StatusCode >= 200 && resp.StatusCode < 400
-	contentType := resp.Header.Get("Content-Type")
+	truncated := int64(len(body)) > c.maxBodyBytes
+	if truncated {
+		body = body[:c.maxBodyBytes]
+	}
+
+	kind, errText := FailureNone, ""
+	switch {
+	case !success:
+		kind, errText = FailureHTTPStatus, resp.Status
+	case truncated:
+		kind = FailureTruncated
+	}
 
 	return FetchResult{
 		Success:       success,
@@ -74,11 +282,147 @@ func (c *Crawler) fetchURL(ctx context.Context, targetURL string) FetchResult {
 		ContentLength: int64(len(body)),
 		ContentType:   contentType,
 		DurationMs:    time.Since(start).Milliseconds(),
-		Error:         "",
+		Error:         errText,
+		FailureKind:   kind,
 		Body:          body,
+		Truncated:     truncated,
+		RedirectChain: chain,
+		RobotsTag:     resp.Header.Values("X-Robots-Tag"),
+	}
+}
+
+// contextReader reads from r until ctx is done, then fails with ctx's error, so a read cut short
+// by the cancellation is reported as a deadline rather than as a closed or broken body
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cr.r.Read(p)
+	if err != nil && err != io.EOF {
+		if ctxErr := cr.ctx.Err(); ctxErr != nil {
+			return n, ctxErr
+		}
+	}
+	return n, err
+}
+
+// errUnsupportedEncoding means the server used a Content-Encoding fetchURL cannot decode
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decodeBody wraps resp.Body in a decompressor matching its Content-Encoding.
+// gzip and br are the encodings requested; deflate is accepted too since some servers send it anyway.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "br":
+		return brotli.NewReader(resp.Body), nil
+	case "deflate":
+		return zlib.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
 	}
 }
 
+// redirectTarget returns the absolute URL a redirect response points to, or "" when
+// fetchURL should stop: not a redirect, no usable Location, or a scheme outside ALLOWED_SCHEMES or
+// port outside ALLOWED_PORTS (the 3xx is then returned as is). Userinfo in the target is dropped.
+func redirectTarget(from *url.URL, resp *http.Response) string {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return ""
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return ""
+	}
+	next, err := from.Parse(location)
+	if err != nil || !urls.SchemeAllowed(next.Scheme) || !urls.PortAllowed(next.Port()) {
+		return ""
+	}
+	next.User = nil
+	next.Fragment = ""
+	return next.String()
+}
+
+// permanent reports whether a failed fetch will never succeed on retry, by its FailureKind:
+// an SSRF block, an unrequestable URL, an oversized body or a redirect loop always, an HTTP status per isPermanentHTTPError, and
+// DNS, TLS and body failures when fetchURL flagged the underlying error as Permanent
+// (NXDOMAIN, bad certificate, unsupported encoding). Timeouts and connection errors never are.
+func (r *FetchResult) permanent() bool {
+	switch r.FailureKind {
+	case FailureSSRF, FailureRequest, FailureTooLarge, FailureRedirectLoop:
+		return true
+	case FailureHTTPStatus:
+		return isPermanentHTTPError(r.StatusCode)
+	case FailureDNS, FailureTLS, FailureBodyRead:
+		return r.Permanent
+	default:
+		return false
+	}
+}
+
+// resolveFailureKind classifies an ssrf.ResolveHost error: a failed lookup is FailureDNS,
+// anything else is the address check rejecting the host
+func resolveFailureKind(err error) FailureKind {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailureDNS
+	}
+	return FailureSSRF
+}
+
+// networkFailureKind classifies an error from httpClient.Do
+func networkFailureKind(err error) FailureKind {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return FailureDNS
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return FailureTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureConnRefused
+	case errors.As(err, &certErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) || errors.As(err, &invalidErr):
+		return FailureTLS
+	case strings.Contains(err.Error(), "SSRF dialer: blocked"):
+		// The transport re-checks every address it dials; see ssrf.NewTransport
+		return FailureSSRF
+	case strings.Contains(err.Error(), "unsupported protocol scheme"):
+		return FailureRequest
+	default:
+		return FailureNetwork
+	}
+}
+
+// readFailureKind classifies an error reading the response body. A cancelled context counts as a
+// timeout: the read was cut short by a deadline (the Lambda's or the batch's), not by the server.
+func readFailureKind(err error) FailureKind {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return FailureTimeout
+	}
+	return FailureBodyRead
+}
+
 // isPermanentHTTPError returns true for HTTP status codes that will never succeed on retry.
 func isPermanentHTTPError(statusCode int) bool {
 	switch statusCode {
@@ -88,3 +432,32 @@ func isPermanentHTTPError(statusCode int) bool {
 		return false
 	}
 }
+
+// isPermanentNetworkError returns true for transport errors that will never succeed on retry:
+// hosts that do not exist, unsupported schemes and invalid TLS certificates.
+// Timeouts, refused connections and temporary DNS failures stay retriable.
+func isPermanentNetworkError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound && !dnsErr.IsTimeout && !dnsErr.IsTemporary
+	}
+
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || urlErr.Timeout() {
+		return false
+	}
+
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(urlErr.Err, &hostnameErr) || errors.As(urlErr.Err, &authorityErr) || errors.As(urlErr.Err, &invalidErr) {
+		return true
+	}
+
+	// net/http reports unknown schemes with an unexported error type
+	return strings.HasPrefix(urlErr.Err.Error(), "unsupported protocol scheme")
+}
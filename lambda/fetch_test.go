@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
 func TestIsPermanentHTTPError(t *testing.T) {
@@ -46,6 +59,110 @@ func TestIsPermanentHTTPError(t *testing.T) {
 	}
 }
 
+func TestIsPermanentNetworkError(t *testing.T) {
+	getErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/", Err: err}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"NXDOMAIN", &net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}, true},
+		{"NXDOMAIN wrapped in url.Error", getErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}), true},
+		{"NXDOMAIN from ValidateHost", fmt.Errorf("DNS lookup failed for x: %w", &net.DNSError{IsNotFound: true}), true},
+		{"DNS timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, false},
+		{"DNS server failure", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, false},
+		{"connection refused", getErr(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), false},
+		{"deadline exceeded", getErr(context.DeadlineExceeded), false},
+		{"unknown certificate authority", getErr(x509.UnknownAuthorityError{}), true},
+		{"certificate hostname mismatch", getErr(x509.HostnameError{Host: "example.com"}), true},
+		{"expired certificate", getErr(x509.CertificateInvalidError{Reason: x509.Expired}), true},
+		{"unsupported scheme", getErr(errors.New(`unsupported protocol scheme "ftp"`)), true},
+		{"connection reset", getErr(syscall.ECONNRESET), false},
+		{"plain error", errors.New("boom"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPermanentNetworkError(tt.err); got != tt.want {
+				t.Errorf("isPermanentNetworkError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// errRoundTripper fails every request with a fixed transport error
+type errRoundTripper struct {
+	err error
+}
+
+func (e errRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, e.err
+}
+
+func TestFetchURLMarksPermanentNetworkErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no such host", &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, true},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.httpClient = &http.Client{Transport: errRoundTripper{err: tt.err}}
+
+			result := c.fetchURL(context.Background(), "https://example.com/page", nil)
+			if result.Success {
+				t.Fatal("fetchURL() success = true, want false")
+			}
+			if result.Permanent != tt.want {
+				t.Errorf("Permanent = %v, want %v (error: %s)", result.Permanent, tt.want, result.Error)
+			}
+		})
+	}
+}
+
+func TestFetchURLAppliesDomainAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		auth       *domainAuth
+		wantHeader string
+		wantAuth   string
+	}{
+		{"no auth", nil, "", ""},
+		{"custom header", &domainAuth{headerName: "X-Api-Key", headerValue: "k123"}, "k123", ""},
+		{"basic auth", &domainAuth{basicUser: "u", basicPass: "p"}, "", "Basic dTpw"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotHeader, gotAuth string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotHeader = r.Header.Get("X-Api-Key")
+				gotAuth = r.Header.Get("Authorization")
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+			c.fetchURL(context.Background(), "https://example.com/page", tt.auth)
+
+			if gotHeader != tt.wantHeader {
+				t.Errorf("X-Api-Key = %q, want %q", gotHeader, tt.wantHeader)
+			}
+			if gotAuth != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", gotAuth, tt.wantAuth)
+			}
+		})
+	}
+}
+
 func TestFetchURLSuccess(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
@@ -56,7 +173,7 @@ func TestFetchURLSuccess(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = testHTTPClientWith(handler)
 
-	result := c.fetchURL(context.Background(), "https://example.com/page")
+	result := c.fetchURL(context.Background(), "https://example.com/page", nil)
 	if !result.Success {
 		t.Fatalf("fetchURL() success = false, error: %s", result.Error)
 	}
@@ -82,7 +199,7 @@ func TestFetchURL404(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = testHTTPClientWith(handler)
 
-	result := c.fetchURL(context.Background(), "https://example.com/missing")
+	result := c.fetchURL(context.Background(), "https://example.com/missing", nil)
 	if result.Success {
 		t.Fatal("fetchURL() success = true for 404")
 	}
@@ -99,7 +216,7 @@ func TestFetchURL500(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = testHTTPClientWith(handler)
 
-	result := c.fetchURL(context.Background(), "https://example.com/error")
+	result := c.fetchURL(context.Background(), "https://example.com/error", nil)
 	if result.Success {
 		t.Fatal("fetchURL() success = true for 500")
 	}
@@ -108,11 +225,140 @@ func TestFetchURL500(t *testing.T) {
 	}
 }
 
+func TestFetchURLFailureKind(t *testing.T) {
+	getErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/page", Err: err}
+	}
+	status := func(code int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(strings.Repeat("x", 100)))
+		})
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		handler http.Handler // Served through testHTTPClientWith when set
+		err     error        // Otherwise returned by the transport
+		want    FailureKind
+	}{
+		{"success", "https://example.com/page", status(http.StatusOK), nil, FailureNone},
+		{"redirect left unfollowed", "https://example.com/page", status(http.StatusNotModified), nil, FailureNone},
+		{"server error", "https://example.com/page", status(http.StatusServiceUnavailable), nil, FailureHTTPStatus},
+		{"not found", "https://example.com/page", status(http.StatusNotFound), nil, FailureHTTPStatus},
+		{"truncated body", "https://example.com/page", status(http.StatusOK), nil, FailureTruncated},
+		{"no such host", "https://example.com/page", nil, getErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}), FailureDNS},
+		{"deadline exceeded", "https://example.com/page", nil, getErr(context.DeadlineExceeded), FailureTimeout},
+		{"connection refused", "https://example.com/page", nil, getErr(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), FailureConnRefused},
+		{"unknown certificate authority", "https://example.com/page", nil, getErr(x509.UnknownAuthorityError{}), FailureTLS},
+		{"tls alert", "https://example.com/page", nil, getErr(&net.OpError{Op: "remote error", Err: tls.AlertError(40)}), FailureTLS},
+		{"private address at dial", "https://example.com/page", nil, getErr(errors.New("SSRF dialer: blocked: example.com resolves to private IP 10.0.0.1")), FailureSSRF},
+		{"unsupported scheme", "https://example.com/page", nil, getErr(errors.New(`unsupported protocol scheme "ftp"`)), FailureRequest},
+		{"connection reset", "https://example.com/page", nil, getErr(syscall.ECONNRESET), FailureNetwork},
+		{"private address", "http://169.254.169.254/latest/meta-data", nil, errors.New("not reached"), FailureSSRF},
+		{"invalid url", "://invalid", nil, errors.New("not reached"), FailureRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.httpClient = &http.Client{Transport: errRoundTripper{err: tt.err}}
+			if tt.handler != nil {
+				c.httpClient = testHTTPClientWith(tt.handler)
+			}
+			if tt.want == FailureTruncated {
+				c.maxBodyBytes = 10
+			}
+
+			result := c.fetchURL(context.Background(), tt.url, nil)
+			if result.FailureKind != tt.want {
+				t.Errorf("FailureKind = %v, want %v (error: %s)", result.FailureKind, tt.want, result.Error)
+			}
+			if tt.want != FailureNone && tt.want != FailureTruncated && result.Error == "" {
+				t.Error("Error is empty for a failed fetch")
+			}
+		})
+	}
+}
+
+func TestFetchURLBodyFailureKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		timeout time.Duration
+		want    FailureKind
+	}{
+		{"corrupt gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write([]byte("not gzip"))
+		}, defaultFetchTimeout, FailureBodyRead},
+		{"unsupported encoding", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "zstd")
+			_, _ = w.Write([]byte("data"))
+		}, defaultFetchTimeout, FailureBodyRead},
+		{"timeout before headers", slowHandler().ServeHTTP, 50 * time.Millisecond, FailureTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(tt.handler)
+			c.fetchTimeout = tt.timeout
+
+			result := c.fetchURL(context.Background(), "https://example.com/page", nil)
+			if result.FailureKind != tt.want {
+				t.Errorf("FailureKind = %v, want %v (error: %s)", result.FailureKind, tt.want, result.Error)
+			}
+		})
+	}
+}
+
+func TestFetchResultPermanent(t *testing.T) {
+	tests := []struct {
+		name   string
+		result FetchResult
+		want   bool
+	}{
+		{"404", FetchResult{FailureKind: FailureHTTPStatus, StatusCode: 404}, true},
+		{"503", FetchResult{FailureKind: FailureHTTPStatus, StatusCode: 503}, false},
+		{"429", FetchResult{FailureKind: FailureHTTPStatus, StatusCode: 429}, false},
+		{"NXDOMAIN", FetchResult{FailureKind: FailureDNS, Permanent: true}, true},
+		{"DNS server failure", FetchResult{FailureKind: FailureDNS}, false},
+		{"bad certificate", FetchResult{FailureKind: FailureTLS, Permanent: true}, true},
+		{"unsupported encoding", FetchResult{FailureKind: FailureBodyRead, Permanent: true}, true},
+		{"corrupt body", FetchResult{FailureKind: FailureBodyRead}, false},
+		{"private address", FetchResult{FailureKind: FailureSSRF}, true},
+		{"invalid request", FetchResult{FailureKind: FailureRequest}, true},
+		{"redirect loop", FetchResult{FailureKind: FailureRedirectLoop}, true},
+		{"timeout", FetchResult{FailureKind: FailureTimeout}, false},
+		{"connection refused", FetchResult{FailureKind: FailureConnRefused}, false},
+		{"connection reset", FetchResult{FailureKind: FailureNetwork}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.permanent(); got != tt.want {
+				t.Errorf("permanent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureKindString(t *testing.T) {
+	if got := FailureConnRefused.String(); got != "conn_refused" {
+		t.Errorf("FailureConnRefused.String() = %q", got)
+	}
+	if got := FailureKind(99).String(); got != "unknown" {
+		t.Errorf("FailureKind(99).String() = %q, want unknown", got)
+	}
+}
+
 func TestFetchURLSSRFBlocked(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = &http.Client{}
 
-	result := c.fetchURL(context.Background(), "http://169.254.169.254/latest/meta-data")
+	result := c.fetchURL(context.Background(), "http://169.254.169.254/latest/meta-data", nil)
 	if result.Success {
 		t.Fatal("fetchURL() should block SSRF attempt")
 	}
@@ -125,7 +371,7 @@ func TestFetchURLInvalidURL(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = &http.Client{}
 
-	result := c.fetchURL(context.Background(), "://invalid")
+	result := c.fetchURL(context.Background(), "://invalid", nil)
 	if result.Success {
 		t.Fatal("fetchURL() should fail for invalid URL")
 	}
@@ -141,8 +387,542 @@ func TestFetchURLSetsUserAgent(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = testHTTPClientWith(handler)
 
-	c.fetchURL(context.Background(), "https://example.com")
-	if !strings.Contains(capturedUA, "MyCrawler") {
-		t.Errorf("expected User-Agent containing MyCrawler, got %q", capturedUA)
+	c.fetchURL(context.Background(), "https://example.com", nil)
+	if capturedUA != defaultUserAgent {
+		t.Errorf("User-Agent = %q, want %q", capturedUA, defaultUserAgent)
+	}
+}
+
+func TestFetchURLAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		name       string
+		acceptLang string
+		want       string
+		wantSet    bool
+	}{
+		{"configured", "en-US,en;q=0.9", "en-US,en;q=0.9", true},
+		{"unset", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Values("Accept-Language")
+				w.WriteHeader(http.StatusOK)
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+			c.acceptLang = tt.acceptLang
+
+			c.fetchURL(context.Background(), "https://example.com", nil)
+			if tt.wantSet && (len(got) != 1 || got[0] != tt.want) {
+				t.Errorf("Accept-Language = %v, want %q", got, tt.want)
+			}
+			if !tt.wantSet && len(got) != 0 {
+				t.Errorf("Accept-Language = %v, want header omitted", got)
+			}
+		})
+	}
+}
+
+func TestFetchURLBodyLimit(t *testing.T) {
+	const limit = 64
+
+	tests := []struct {
+		name          string
+		size          int
+		wantLen       int
+		wantTruncated bool
+	}{
+		{"under limit", limit - 1, limit - 1, false},
+		{"exactly at limit", limit, limit, false},
+		{"over limit", limit + 100, limit, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(strings.Repeat("x", tt.size)))
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+			c.maxBodyBytes = limit
+
+			result := c.fetchURL(context.Background(), "https://example.com/big", nil)
+			if !result.Success {
+				t.Fatalf("fetchURL() success = false, error: %s", result.Error)
+			}
+			if len(result.Body) != tt.wantLen {
+				t.Errorf("body length = %d, want %d", len(result.Body), tt.wantLen)
+			}
+			if result.ContentLength != int64(tt.wantLen) {
+				t.Errorf("ContentLength = %d, want %d", result.ContentLength, tt.wantLen)
+			}
+			if result.Truncated != tt.wantTruncated {
+				t.Errorf("Truncated = %v, want %v", result.Truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestFetchURLDeclaredContentLength(t *testing.T) {
+	const limit = 64
+
+	tests := []struct {
+		name          string
+		declared      string // Content-Length header; empty sends none
+		size          int
+		status        int
+		wantKind      FailureKind
+		wantBodyLen   int
+		wantPermanent bool
+	}{
+		{"declared over limit", "1000", 1000, http.StatusOK, FailureTooLarge, 0, true},
+		{"no header over limit", "", limit + 100, http.StatusOK, FailureTruncated, limit, false},
+		{"header understates body", "10", limit + 100, http.StatusOK, FailureTruncated, limit, false},
+		{"error status over limit", "1000", 1000, http.StatusNotFound, FailureHTTPStatus, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.declared != "" {
+					w.Header().Set("Content-Length", tt.declared)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(strings.Repeat("x", tt.size)))
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+			c.maxBodyBytes = limit
+
+			result := c.fetchURL(context.Background(), "https://example.com/big", nil)
+			if result.FailureKind != tt.wantKind {
+				t.Errorf("FailureKind = %v, want %v (error: %s)", result.FailureKind, tt.wantKind, result.Error)
+			}
+			if tt.wantKind == FailureTooLarge {
+				if result.Body != nil {
+					t.Errorf("Body = %d bytes, want none read", len(result.Body))
+				}
+				if result.ContentLength != 1000 {
+					t.Errorf("ContentLength = %d, want the declared 1000", result.ContentLength)
+				}
+			} else if tt.wantKind == FailureTruncated && len(result.Body) != tt.wantBodyLen {
+				t.Errorf("body length = %d, want %d", len(result.Body), tt.wantBodyLen)
+			}
+			if !result.Success && result.permanent() != tt.wantPermanent {
+				t.Errorf("permanent() = %v, want %v", result.permanent(), tt.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestFetchURLSurfacesRobotsTag(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Robots-Tag", "noindex")
+		w.Header().Add("X-Robots-Tag", "googlebot: nofollow")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(handler)
+
+	result := c.fetchURL(context.Background(), "https://example.com/page", nil)
+	if got := strings.Join(result.RobotsTag, "|"); got != "noindex|googlebot: nofollow" {
+		t.Errorf("RobotsTag = %q, want each header line", result.RobotsTag)
+	}
+}
+
+// encodeBody compresses data with the named Content-Encoding
+func encodeBody(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return data
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("compress %s: %v", encoding, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("compress %s: %v", encoding, err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchURLDecodesContentEncoding(t *testing.T) {
+	page := `<html><body><p>Compressed hello</p><a href="/next">next</a></body></html>`
+
+	for _, encoding := range []string{"", "gzip", "br", "deflate"} {
+		t.Run("encoding="+encoding, func(t *testing.T) {
+			var acceptEncoding string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "text/html")
+				if encoding != "" {
+					w.Header().Set("Content-Encoding", encoding)
+				}
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(encodeBody(t, encoding, []byte(page)))
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+
+			result := c.fetchURL(context.Background(), "https://example.com/page", nil)
+			if !result.Success {
+				t.Fatalf("fetchURL() success = false, error: %s", result.Error)
+			}
+			if acceptEncoding != "gzip, br" {
+				t.Errorf("Accept-Encoding = %q, want %q", acceptEncoding, "gzip, br")
+			}
+			if string(result.Body) != page {
+				t.Errorf("Body = %q, want decoded page", result.Body)
+			}
+			if result.ContentLength != int64(len(page)) {
+				t.Errorf("ContentLength = %d, want decoded size %d", result.ContentLength, len(page))
+			}
+		})
+	}
+}
+
+func TestFetchURLBodyLimitAppliesToDecodedSize(t *testing.T) {
+	const limit = 64
+
+	for _, encoding := range []string{"gzip", "br"} {
+		t.Run(encoding, func(t *testing.T) {
+			// 1 MB of a single byte compresses to a few KB; only the decoded bytes count toward the limit
+			compressed := encodeBody(t, encoding, bytes.Repeat([]byte("x"), 1<<20))
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", encoding)
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(compressed)
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+			c.maxBodyBytes = limit
+
+			result := c.fetchURL(context.Background(), "https://example.com/bomb", nil)
+			if !result.Success {
+				t.Fatalf("fetchURL() success = false, error: %s", result.Error)
+			}
+			if len(result.Body) != limit || !result.Truncated {
+				t.Errorf("body length = %d, truncated = %v; want %d, true", len(result.Body), result.Truncated, limit)
+			}
+		})
+	}
+}
+
+func TestFetchURLDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		encoding      string
+		wantPermanent bool
+	}{
+		{"unsupported encoding", "zstd", true},
+		{"corrupt gzip", "gzip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("not compressed at all"))
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+
+			result := c.fetchURL(context.Background(), "https://example.com/page", nil)
+			if result.Success {
+				t.Fatal("fetchURL() success = true, want a decode failure")
+			}
+			if result.Permanent != tt.wantPermanent {
+				t.Errorf("Permanent = %v, want %v (error: %s)", result.Permanent, tt.wantPermanent, result.Error)
+			}
+		})
+	}
+}
+
+// slowHandler stalls until the request context is done, or gives up after a long safety cap
+func slowHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestFetchURLTimeout(t *testing.T) {
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(slowHandler())
+	c.fetchTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	result := c.fetchURL(context.Background(), "https://example.com/slow", nil)
+	elapsed := time.Since(start)
+
+	if result.Success {
+		t.Fatal("fetchURL() should fail when the budget is exceeded")
+	}
+	if result.StatusCode != 0 {
+		t.Errorf("StatusCode = %d, want 0 for a transport timeout", result.StatusCode)
+	}
+	if !strings.Contains(result.Error, "deadline exceeded") {
+		t.Errorf("Error = %q, want a deadline exceeded error", result.Error)
+	}
+	if elapsed > time.Second {
+		t.Errorf("fetchURL() took %v, want it to abort near the 50ms budget", elapsed)
+	}
+}
+
+// trickleTransport answers every request with a 200 whose body yields one byte per interval and
+// never looks at the request context, like a connection the transport cannot see stall
+type trickleTransport struct{ interval time.Duration }
+
+func (tt trickleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			if _, err := pw.Write([]byte("x")); err != nil {
+				return // Reader closed
+			}
+			time.Sleep(tt.interval)
+		}
+	}()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       pr,
+		Request:    req,
+	}, nil
+}
+
+// TestFetchURLBodyReadHonorsContext trickles a body past the caller's deadline, which is shorter
+// than FETCH_TIMEOUT_MS (as when the Lambda is about to time out): the read must stop at the
+// deadline and fail as a timeout
+func TestFetchURLBodyReadHonorsContext(t *testing.T) {
+	c := newTestCrawler()
+	c.fetchTimeout = 10 * time.Second
+	c.httpClient = &http.Client{Transport: trickleTransport{interval: 20 * time.Millisecond}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := c.fetchURL(ctx, "https://example.com/trickle", nil)
+	elapsed := time.Since(start)
+
+	if result.Success {
+		t.Fatal("fetchURL() should fail when the context ends mid-body")
+	}
+	if result.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode = %d, want 200 since the headers arrived", result.StatusCode)
+	}
+	if result.FailureKind != FailureTimeout {
+		t.Errorf("FailureKind = %v, want timeout (error %q)", result.FailureKind, result.Error)
+	}
+	if elapsed > time.Second {
+		t.Errorf("fetchURL() took %v, want it to stop near the 100ms deadline", elapsed)
+	}
+}
+
+func TestContextReaderStopsAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := contextReader{ctx: ctx, r: strings.NewReader("abcdef")}
+
+	buf := make([]byte, 3)
+	if n, err := r.Read(buf); n != 3 || err != nil {
+		t.Fatalf("Read() = %d, %v before cancel, want 3, nil", n, err)
+	}
+	cancel()
+	if n, err := r.Read(buf); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() = %d, %v after cancel, want 0, context.Canceled", n, err)
+	}
+	if got := readFailureKind(context.Canceled); got != FailureTimeout {
+		t.Errorf("readFailureKind(context.Canceled) = %v, want timeout", got)
+	}
+}
+
+func TestFetchURLRecordsRedirectChain(t *testing.T) {
+	var requested []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "https://example.com/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound) // relative Location
+		case "/c":
+			http.Redirect(w, r, "https://example.com/d#frag", http.StatusTemporaryRedirect)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = fmt.Fprint(w, "<html>final</html>")
+		}
+	})
+
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(handler)
+
+	result := c.fetchURL(context.Background(), "https://example.com/a", nil)
+	if !result.Success || result.StatusCode != 200 {
+		t.Fatalf("fetchURL() success = %v, status = %d, error = %s", result.Success, result.StatusCode, result.Error)
+	}
+	want := []string{"https://example.com/b", "https://example.com/c", "https://example.com/d"}
+	if strings.Join(result.RedirectChain, " ") != strings.Join(want, " ") {
+		t.Errorf("RedirectChain = %v, want %v", result.RedirectChain, want)
+	}
+	if strings.Join(requested, " ") != "/a /b /c /d" {
+		t.Errorf("requested paths = %v, want [/a /b /c /d]", requested)
+	}
+	if string(result.Body) != "<html>final</html>" {
+		t.Errorf("body = %q, want the final page", result.Body)
+	}
+}
+
+func TestFetchURLDirectHasNoRedirectChain(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(handler)
+
+	result := c.fetchURL(context.Background(), "https://example.com/page", nil)
+	if len(result.RedirectChain) != 0 {
+		t.Errorf("RedirectChain = %v, want empty", result.RedirectChain)
+	}
+}
+
+func TestFetchURLFollowsSingleRedirect(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		_, _ = fmt.Fprint(w, "<html>moved here</html>")
+	})
+
+	c := newTestCrawler()
+	c.maxRedirects = 1
+	c.httpClient = testHTTPClientWith(handler)
+
+	result := c.fetchURL(context.Background(), "https://example.com/old", nil)
+	if !result.Success || result.StatusCode != 200 {
+		t.Fatalf("fetchURL() success = %v, status = %d, error = %s", result.Success, result.StatusCode, result.Error)
+	}
+	if strings.Join(result.RedirectChain, " ") != "https://example.com/new" {
+		t.Errorf("RedirectChain = %v, want [https://example.com/new]", result.RedirectChain)
+	}
+}
+
+func TestFetchURLStopsAtDisallowedPortRedirect(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "https://example.com:8443/admin", http.StatusFound)
+			return
+		}
+		_, _ = fmt.Fprint(w, "<html>admin</html>")
+	})
+
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(handler)
+
+	result := c.fetchURL(context.Background(), "https://example.com/old", nil)
+	if result.StatusCode != http.StatusFound || len(result.RedirectChain) != 0 {
+		t.Errorf("fetchURL() status = %d, chain = %v, want the 302 returned unfollowed", result.StatusCode, result.RedirectChain)
+	}
+}
+
+func TestFetchURLDetectsRedirectLoop(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/a" {
+			http.Redirect(w, r, "/b", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/a", http.StatusFound)
+		}
+	})
+
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(handler)
+
+	result := c.fetchURL(context.Background(), "https://example.com/a", nil)
+	if result.Success || result.FailureKind != FailureRedirectLoop {
+		t.Fatalf("fetchURL() success = %v, kind = %v, want a redirect_loop failure", result.Success, result.FailureKind)
+	}
+	if !result.permanent() {
+		t.Error("redirect loop not permanent")
+	}
+	if strings.Join(result.RedirectChain, " ") != "https://example.com/b" {
+		t.Errorf("RedirectChain = %v, want [https://example.com/b]", result.RedirectChain)
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2 (stopped before revisiting /a)", requests)
+	}
+}
+
+func TestFetchURLStopsAfterMaxRedirects(t *testing.T) {
+	hops := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops++
+		http.Redirect(w, r, fmt.Sprintf("/hop%d", hops), http.StatusFound)
+	})
+
+	c := newTestCrawler()
+	c.maxRedirects = 3
+	c.httpClient = testHTTPClientWith(handler)
+
+	result := c.fetchURL(context.Background(), "https://example.com/start", nil)
+	if result.Success || result.FailureKind != FailureRedirectLoop {
+		t.Fatalf("fetchURL() success = %v, kind = %v, want a redirect_loop failure", result.Success, result.FailureKind)
+	}
+	if result.StatusCode != http.StatusFound {
+		t.Errorf("StatusCode = %d, want the last 302", result.StatusCode)
+	}
+	if len(result.RedirectChain) != 3 {
+		t.Errorf("len(RedirectChain) = %d, want 3", len(result.RedirectChain))
+	}
+	if hops != 4 {
+		t.Errorf("requests = %d, want 4", hops)
+	}
+}
+
+func TestFetchURLDropsAuthOnCrossHostRedirect(t *testing.T) {
+	gotKey := make(map[string]string)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey[r.Host] = r.Header.Get("X-Api-Key")
+		if r.Host == "example.com" {
+			http.Redirect(w, r, "https://google.com/landing", http.StatusFound)
+		}
+	})
+
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(handler)
+
+	auth := &domainAuth{headerName: "X-Api-Key", headerValue: "secret"}
+	c.fetchURL(context.Background(), "https://example.com/page", auth)
+
+	if gotKey["example.com"] != "secret" {
+		t.Errorf("origin X-Api-Key = %q, want secret", gotKey["example.com"])
+	}
+	if v, ok := gotKey["google.com"]; !ok || v != "" {
+		t.Errorf("redirect target X-Api-Key = %q (requested: %v), want empty", v, ok)
 	}
 }
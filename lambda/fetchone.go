@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"lambda/internal/parser"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// fetchOneReport is the JSON summary printed by the fetchone CLI
+type fetchOneReport struct {
+	URL           string   `json:"url"`
+	Success       bool     `json:"success"`
+	StatusCode    int      `json:"status_code"`
+	ContentType   string   `json:"content_type"`
+	ContentLength int64    `json:"content_length"`
+	Truncated     bool     `json:"truncated"`
+	DurationMs    int64    `json:"duration_ms"`
+	Error         string   `json:"error,omitempty"`
+	FailureKind   string   `json:"failure_kind,omitempty"`
+	TextLength    int      `json:"text_length"`
+	Links         []string `json:"links"`
+}
+
+// newLocalCrawler returns a Crawler with no AWS clients, for fetching and parsing only.
+// Calling any DynamoDB, SQS or S3 method on it will panic.
+func newLocalCrawler(log zerolog.Logger) *Crawler {
+	return &Crawler{
+		httpClient:    newHTTPClient(transportTimeouts()),
+		maxBodyBytes:  defaultMaxBodySize,
+		maxRedirects:  envInt("MAX_REDIRECTS", defaultMaxRedirects),
+		fetchTimeout:  defaultFetchTimeout,
+		robotsTimeout: defaultRobotsTimeout,
+		acceptLang:    os.Getenv("ACCEPT_LANGUAGE"),
+		userAgent:     envUserAgent(),
+		log:           log,
+		robotsCache:   newRobotsCache(maxRobotsCacheSize),
+	}
+}
+
+// fetchOne runs the same fetch and extraction path as processMessage for a single URL,
+// without claiming, rate limiting, storing or enqueueing anything
+func (c *Crawler) fetchOne(ctx context.Context, targetURL string) fetchOneReport {
+	result := c.fetchURL(ctx, targetURL, nil)
+
+	report := fetchOneReport{
+		URL:           targetURL,
+		Success:       result.Success,
+		StatusCode:    result.StatusCode,
+		ContentType:   result.ContentType,
+		ContentLength: result.ContentLength,
+		Truncated:     result.Truncated,
+		DurationMs:    result.DurationMs,
+		Error:         result.Error,
+		Links:         []string{},
+	}
+	if result.FailureKind != FailureNone {
+		report.FailureKind = result.FailureKind.String()
+	}
+
+	if extract := parser.ExtractorFor(result.ContentType); result.Success && extract != nil && len(result.Body) > 0 {
+		parsed := extract(result.Body, targetURL)
+		report.TextLength = len(parsed.Text)
+		if parsed.Links != nil {
+			report.Links = parsed.Links
+		}
+	}
+
+	return report
+}
+
+// writeFetchOne fetches targetURL and writes the report to w as indented JSON
+func (c *Crawler) writeFetchOne(ctx context.Context, targetURL string, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.fetchOne(ctx, targetURL))
+}
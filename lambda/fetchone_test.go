@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteFetchOneJSON(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><body><p>Hello world</p><a href="/a">A</a><a href="https://other.com/b">B</a></body></html>`)
+	})
+
+	c := newLocalCrawler(noopLogger())
+	c.httpClient = testHTTPClientWith(handler)
+
+	var buf bytes.Buffer
+	if err := c.writeFetchOne(context.Background(), "https://example.com/page", &buf); err != nil {
+		t.Fatalf("writeFetchOne() error = %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, buf.String())
+	}
+
+	for _, key := range []string{"url", "success", "status_code", "content_type", "content_length", "truncated", "duration_ms", "text_length", "links"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("missing key %q in output", key)
+		}
+	}
+	if _, ok := got["error"]; ok {
+		t.Errorf("unexpected error key on success: %v", got["error"])
+	}
+
+	if got["status_code"] != float64(200) {
+		t.Errorf("status_code = %v, want 200", got["status_code"])
+	}
+	if got["text_length"] != float64(len("Hello world A B")) {
+		t.Errorf("text_length = %v, want %d", got["text_length"], len("Hello world A B"))
+	}
+	links, _ := got["links"].([]any)
+	if fmt.Sprint(links) != "[https://example.com/a https://other.com/b]" {
+		t.Errorf("links = %v", links)
+	}
+}
+
+func TestFetchOneNonHTMLHasNoLinks(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		_, _ = fmt.Fprint(w, "%PDF-1.4")
+	})
+
+	c := newLocalCrawler(noopLogger())
+	c.httpClient = testHTTPClientWith(handler)
+
+	report := c.fetchOne(context.Background(), "https://example.com/doc.pdf")
+	if !report.Success {
+		t.Fatalf("fetchOne() success = false, error: %s", report.Error)
+	}
+	if report.TextLength != 0 || len(report.Links) != 0 {
+		t.Errorf("expected no text or links for non-HTML, got %d chars, %v", report.TextLength, report.Links)
+	}
+	if report.Links == nil {
+		t.Error("Links should be an empty slice so the JSON output is [] not null")
+	}
+}
+
+func TestFetchOneHonorsSSRFProtection(t *testing.T) {
+	hit := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer srv.Close()
+
+	c := newLocalCrawler(noopLogger())
+
+	report := c.fetchOne(context.Background(), srv.URL)
+	if report.Success {
+		t.Fatal("fetchOne() should refuse a loopback URL")
+	}
+	if !strings.Contains(report.Error, "SSRF blocked") {
+		t.Errorf("Error = %q, want SSRF blocked", report.Error)
+	}
+	if hit {
+		t.Error("request reached the loopback server")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lambda/internal/catalog"
+	"lambda/urls"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// QueuedURL is a URL handed to the frontier: a newly discovered link, or one going back on the queue
+type QueuedURL struct {
+	URL       string   // As discovered; what gets fetched
+	Canonical string   // urls.Canonicalize(URL), which Hash is taken of; only needed by Enqueue
+	Hash      string   // url_hash of the item tracking the URL
+	Depth     int      // Crawl depth of the URL itself
+	Priority  string   // priorityNormal or priorityHigh
+	Ancestry  []string // URLs it was discovered through, parent first (see addAncestryAttrs)
+	Hint      string   // content_hint sent with it: hintSitemap, or "" to go by Content-Type
+}
+
+// Frontier is the crawl's URL frontier: the record of every URL seen, so each is crawled once, the
+// queue of those still to fetch, and the status of each while and after it is crawled. The job_id
+// and crawl delay override carried by ctx travel with the URLs queued under it.
+// sqsFrontier, over SQS and DynamoDB, is the default; memFrontier keeps everything in memory.
+type Frontier interface {
+	// Add records a URL not seen before as queued, the dedup check for discovered links. Under
+	// RECRAWL, a known URL finished more than RECRAWL_MAX_AGE ago is reset to queued instead.
+	// False means it is already known (or could not be recorded) and must not be enqueued.
+	Add(ctx context.Context, u QueuedURL) bool
+	// Enqueue queues URLs just recorded by Add and returns how many made it onto the queue
+	Enqueue(ctx context.Context, queued []QueuedURL) int
+	// Requeue puts a URL already recorded back on the queue, visible again after delaySeconds
+	Requeue(ctx context.Context, u QueuedURL, delaySeconds int) error
+	// Claim moves a URL from queued to processing, taking over a processing claim older than
+	// PROCESSING_TIMEOUT. A lost claim is false with a nil error; an error means it is unknown.
+	Claim(ctx context.Context, urlHash string) (claim, bool, error)
+	// Release resets a claimed URL to queued; countAttempt=false refunds the claim's attempt
+	Release(ctx context.Context, urlHash string, countAttempt bool)
+	// MarkStatus sets a terminal status that has no fetch result (robots_blocked, etc.)
+	MarkStatus(ctx context.Context, urlHash, status string) error
+	// MarkNotModified records a 304 answer to a conditional fetch
+	MarkNotModified(ctx context.Context, targetURL, urlHash string, result *FetchResult) error
+	// Save records a fetch result and its status (see resultStatus)
+	Save(ctx context.Context, targetURL, urlHash string, result *FetchResult, depth int) error
+}
+
+// queue returns the crawler's frontier: the one set on it (memFrontier for local runs), else SQS and DynamoDB
+func (c *Crawler) queue() Frontier {
+	if c.frontier != nil {
+		return c.frontier
+	}
+	return sqsFrontier{c}
+}
+
+// claimURL claims a URL before it is fetched (see Frontier.Claim)
+func (c *Crawler) claimURL(ctx context.Context, urlHash string) (claim, bool, error) {
+	return c.queue().Claim(ctx, urlHash)
+}
+
+// releaseClaim hands a claimed URL back so the next delivery of its message can claim it
+func (c *Crawler) releaseClaim(ctx context.Context, urlHash string, countAttempt bool) {
+	c.queue().Release(ctx, urlHash, countAttempt)
+}
+
+// markStatus sets a terminal status (robots_blocked, etc.)
+func (c *Crawler) markStatus(ctx context.Context, urlHash, status string) error {
+	return c.queue().MarkStatus(ctx, urlHash, status)
+}
+
+// markNotModified marks an item whose conditional fetch got a 304 done again
+func (c *Crawler) markNotModified(ctx context.Context, targetURL, urlHash string, result *FetchResult) error {
+	return c.queue().MarkNotModified(ctx, targetURL, urlHash, result)
+}
+
+// saveFetchResult persists a fetch result (see sqsFrontier.Save for what is stored)
+func (c *Crawler) saveFetchResult(ctx context.Context, targetURL, urlHash string, result *FetchResult, depth int) error {
+	return c.queue().Save(ctx, targetURL, urlHash, result, depth)
+}
+
+// requeueWithDelay sends the URL back to the queue for its priority with a jittered delay,
+// keeping the message's crawl_delay_ms and max_depth overrides, job_id, ancestry and content_hint if it has them
+func (c *Crawler) requeueWithDelay(ctx context.Context, urlStr, urlHash string, depth int, priority string, delaySeconds int) error {
+	u := QueuedURL{URL: urlStr, Hash: urlHash, Depth: depth, Priority: priority, Ancestry: ancestryFor(ctx), Hint: contentHint(ctx)}
+	return c.queue().Requeue(ctx, u, c.jitterDelay(delaySeconds))
+}
+
+// sqsFrontier is the default frontier: each URL is a DynamoDB item keyed by url_hash whose status
+// tracks it from queued to done, and a message on the queue for its priority (see queueFor).
+// Its state transitions are in state.go.
+type sqsFrontier struct {
+	c *Crawler
+}
+
+// Add puts the URL's item, conditional on it not existing, which is the whole dedup check: there is
+// no existence read to skip, and skipping the put on a local hint (e.g. a bloom filter hit) would
+// drop new links on false positives. Under RECRAWL a failed put is followed by the conditional
+// reset of recrawlInput, so a stale finished item is crawled again and a fresh one is not.
+func (f sqsFrontier) Add(ctx context.Context, u QueuedURL) bool {
+	c := f.c
+	item := map[string]dynamodbtypes.AttributeValue{
+		"url_hash":      &dynamodbtypes.AttributeValueMemberS{Value: u.Hash},
+		"url":           &dynamodbtypes.AttributeValueMemberS{Value: u.URL},
+		"canonical_url": &dynamodbtypes.AttributeValueMemberS{Value: u.Canonical},
+		"status":        &dynamodbtypes.AttributeValueMemberS{Value: stateQueued},
+		"domain":        &dynamodbtypes.AttributeValueMemberS{Value: catalog.Domain(urls.GetHost(u.Canonical))},
+	}
+	c.addJobIDItem(ctx, item)
+	_, err := c.ddb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &c.tableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(url_hash)"),
+	})
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	if err == nil || c.recrawlAfter <= 0 || !errors.As(err, &condErr) {
+		return err == nil
+	}
+	_, err = c.updateItem(ctx, c.recrawlInput(u.Hash, time.Now().Add(-c.recrawlAfter)))
+	return err == nil
+}
+
+// Enqueue sends the URLs with SendMessageBatch, up to 10 per call; a failed batch is logged and
+// its items stay queued without a message
+func (f sqsFrontier) Enqueue(ctx context.Context, pending []QueuedURL) int {
+	c := f.c
+	// A batch goes to one queue, so it is cut where the priority changes as well as at 10
+	const sqsBatchSize = 10
+	sent := 0
+	for i := 0; i < len(pending); {
+		end := i + 1
+		for end < len(pending) && end-i < sqsBatchSize && pending[end].Priority == pending[i].Priority {
+			end++
+		}
+		batch := pending[i:end]
+
+		entries := make([]sqstypes.SendMessageBatchRequestEntry, len(batch))
+		for j, u := range batch {
+			id := strconv.Itoa(i + j)
+			entries[j] = sqstypes.SendMessageBatchRequestEntry{
+				Id:                &id,
+				MessageBody:       aws.String(u.URL),
+				MessageAttributes: c.messageAttrs(ctx, u),
+			}
+		}
+
+		result, err := c.sqs.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(c.queueFor(batch[0].Priority)),
+			Entries:  entries,
+		})
+		i = end
+		if err != nil {
+			c.log.Error().Err(err).Int("batch_size", len(batch)).Msg("Failed to batch-enqueue links")
+			continue
+		}
+
+		sent += len(batch) - len(result.Failed)
+		for _, fail := range result.Failed {
+			c.log.Error().Str("id", *fail.Id).Str("code", *fail.Code).Msg("Failed to enqueue link in batch")
+		}
+	}
+	return sent
+}
+
+// Requeue sends a message for the URL with DelaySeconds; its item is left as it is
+func (f sqsFrontier) Requeue(ctx context.Context, u QueuedURL, delaySeconds int) error {
+	c := f.c
+	_, err := c.sqs.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(c.queueFor(u.Priority)),
+		MessageBody:       aws.String(u.URL),
+		DelaySeconds:      int32(delaySeconds),
+		MessageAttributes: c.messageAttrs(ctx, u),
+	})
+	return err
+}
+
+// messageAttrs returns the attributes of a URL's message: depth, priority, url_hash and any
+// content_hint, plus the crawl_delay_ms and max_depth overrides, job_id and ancestry it inherits
+func (c *Crawler) messageAttrs(ctx context.Context, u QueuedURL) map[string]sqstypes.MessageAttributeValue {
+	attrs := map[string]sqstypes.MessageAttributeValue{
+		"depth": {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(u.Depth)),
+		},
+		"priority": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(u.Priority),
+		},
+		"url_hash": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(u.Hash),
+		},
+	}
+	addCrawlDelayAttr(ctx, attrs)
+	addMaxDepthAttr(ctx, attrs)
+	c.addJobIDAttr(ctx, attrs)
+	addAncestryAttrs(attrs, u.Ancestry)
+	if u.Hint != "" {
+		attrs["content_hint"] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(u.Hint),
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"math"
+)
+
+// takeGlobalToken consumes one token from the fleet-wide bucket on the crawl#global_rate item,
+// which holds up to one second of GLOBAL_MAX_RPS and refills at that rate. Per-domain limits do not
+// bound the total request rate, which can trip account-level NAT or API limits. Always true
+// when GLOBAL_MAX_RPS is unset.
+func (c *Crawler) takeGlobalToken(ctx context.Context) (bool, error) {
+	if c.globalRPS <= 0 {
+		return true, nil
+	}
+	return c.takeBucketToken(ctx, crawlGlobalRateKey, math.Max(c.globalRPS, 1), c.globalRPS, nil)
+}
+
+// handleGlobalRateLimited releases the claim, refunding the attempt, and requeues the URL for
+// when the global bucket next has a token
+func (c *Crawler) handleGlobalRateLimited(ctx context.Context, targetURL, urlHash string, depth int, priority string) error {
+	c.log.Info().Str("url", targetURL).Float64("global_max_rps", c.globalRPS).Msg("Global rate limit reached, re-queuing")
+
+	c.releaseClaim(ctx, urlHash, false)
+	delaySeconds := max(int(math.Ceil(1/c.globalRPS)), 1)
+	return c.requeueWithDelay(ctx, targetURL, urlHash, depth, priority, delaySeconds)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestTakeGlobalToken(t *testing.T) {
+	now := time.Now().UnixMilli()
+
+	tests := []struct {
+		name       string
+		rps        float64
+		item       map[string]dynamodbtypes.AttributeValue
+		want       bool
+		wantTokens string // "" = no update
+	}{
+		{"disabled", 0, nil, true, ""},
+		{"first take starts full", 10, nil, true, "9.000"},
+		{"tokens available", 10, bucketItem(4, now), true, "3.000"},
+		{"empty bucket", 10, bucketItem(0, now), false, ""},
+		{"fractional rate holds one token", 0.5, nil, true, "0.000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var getKey string
+			var update *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					getKey = input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+					return &dynamodb.GetItemOutput{Item: tt.item}, nil
+				},
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					update = input
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.globalRPS = tt.rps
+			if got, _ := c.takeGlobalToken(context.Background()); got != tt.want {
+				t.Errorf("takeGlobalToken() = %v, want %v", got, tt.want)
+			}
+			if tt.rps > 0 && getKey != crawlGlobalRateKey {
+				t.Errorf("read bucket %q, want %q", getKey, crawlGlobalRateKey)
+			}
+			if (update != nil) != (tt.wantTokens != "") {
+				t.Fatalf("UpdateItem called = %v, want %v", update != nil, tt.wantTokens != "")
+			}
+			if update == nil {
+				return
+			}
+			if got := *update.UpdateExpression; got != "SET tokens = :tokens, last_refill = :now" {
+				t.Errorf("UpdateExpression = %q, want only the bucket attributes", got)
+			}
+			// Allow for a few ms of refill between the test's now and takeBucketToken's now
+			tokens := update.ExpressionAttributeValues[":tokens"].(*dynamodbtypes.AttributeValueMemberN).Value
+			got, _ := strconv.ParseFloat(tokens, 64)
+			want, _ := strconv.ParseFloat(tt.wantTokens, 64)
+			if got < want || got > want+0.1 {
+				t.Errorf("stored tokens = %s, want ~%s", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestProcessMessageGlobalRateLimited(t *testing.T) {
+	ddb := authItemDDB(nil)
+	getItem := ddb.getItemFunc
+	ddb.getItemFunc = func(ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+		if input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value == crawlGlobalRateKey {
+			return &dynamodb.GetItemOutput{Item: bucketItem(0, time.Now().UnixMilli())}, nil
+		}
+		return getItem(ctx, input, opts...)
+	}
+	var refunded bool
+	domainTokens := 0
+	ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		if _, ok := input.ExpressionAttributeValues[":refund"]; ok {
+			refunded = true
+		}
+		if key := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value; strings.HasPrefix(key, domainKeyPrefix) && input.ExpressionAttributeValues[":tokens"] != nil {
+			domainTokens++
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	var requeued *sqs.SendMessageInput
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			requeued = input
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.crawlDelayMs = 0
+	c.requeueJitter = 0
+	c.globalRPS = 2
+	c.rateLimitMode = rateLimitTokenBucket
+	pageFetches := 0
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			pageFetches++
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+	if err != nil || got != outcomeRateLimited {
+		t.Fatalf("processMessage() = %v, %v, want outcomeRateLimited", got, err)
+	}
+	if pageFetches != 0 {
+		t.Errorf("page fetched %d times with the global bucket empty", pageFetches)
+	}
+	if !refunded {
+		t.Error("expected the claim released with its attempt refunded")
+	}
+	if requeued == nil || requeued.DelaySeconds != 1 {
+		t.Errorf("requeued = %+v, want a 1s delay", requeued)
+	}
+	// robots.txt took one domain token; the deferred page fetch must not take another
+	if domainTokens != 1 {
+		t.Errorf("domain tokens taken = %d, want only robots.txt's", domainTokens)
+	}
+}
+
+// TestProcessMessageGlobalRateError checks that a global bucket that cannot be read sends the
+// message back to SQS, with the claim released, instead of treating it as an empty bucket
+func TestProcessMessageGlobalRateError(t *testing.T) {
+	ddb := authItemDDB(nil)
+	getItem := ddb.getItemFunc
+	ddb.getItemFunc = func(ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+		if input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value == crawlGlobalRateKey {
+			return nil, fmt.Errorf("ProvisionedThroughputExceededException")
+		}
+		return getItem(ctx, input, opts...)
+	}
+	var refunded bool
+	ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		if _, ok := input.ExpressionAttributeValues[":refund"]; ok {
+			refunded = true
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	sends := 0
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, _ *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			sends++
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.crawlDelayMs = 0
+	c.globalRPS = 2
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+	if err == nil || got != outcomeRetried {
+		t.Fatalf("processMessage() = %v, %v, want outcomeRetried with an error", got, err)
+	}
+	if !refunded {
+		t.Error("expected the claim released with its attempt refunded")
+	}
+	if sends != 0 {
+		t.Errorf("sent %d messages, want SQS to redeliver the original", sends)
+	}
+}
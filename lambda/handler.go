@@ -3,69 +3,275 @@ package main
 import (
 	"context"
 	"fmt"
+	"lambda/internal/dedup"
+	"lambda/internal/lang"
 	"lambda/internal/parser"
-	"lambda/internal/urls"
+	"lambda/internal/timing"
+	"lambda/urls"
+	"maps"
+	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
 )
 
-func (c *Crawler) Handler(ctx context.Context, sqsEvent events.SQSEvent) error {
+// outcome is how processMessage disposed of a message, tallied per batch by Handler
+type outcome int
+
+const (
+	outcomeSucceeded     outcome = iota // Fetched and saved
+	outcomeFailed                       // Permanent failure or retries exhausted; saved and acknowledged
+	outcomeRetried                      // Retriable failure, requeued with backoff or left for SQS to redeliver
+	outcomeRobotsBlocked                // Disallowed by robots.txt
+	outcomeRateLimited                  // Requeued by the rate limit, the per-host concurrency cap or an open circuit
+	outcomeSkipped                      // Claimed by another invocation, or its domain is at MAX_PAGES_PER_DOMAIN
+	outcomePaused                       // Requeued because the crawl is paused
+	numOutcomes
+)
+
+// Handler processes an SQS batch and reports failed messages individually
+// (ReportBatchItemFailures) so only those are retried; the rest are deleted.
+// Messages not started before the invocation gets within timeMargin of its deadline
+// are reported as failures too, so they redeliver instead of being cut off mid-fetch.
+// Ends with a one-line summary of the batch for dashboards.
+func (c *Crawler) Handler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	start := time.Now()
 	c.log.Info().Int("count", len(sqsEvent.Records)).Msg("Received batch")
 
+	var response events.SQSEventResponse
+	var counts [numOutcomes]int
+	deferred := 0
 	for i := range sqsEvent.Records {
-		if err := c.processMessage(ctx, &sqsEvent.Records[i]); err != nil {
-			c.log.Error().Err(err).Str("message_id", sqsEvent.Records[i].MessageId).Msg("Failed to process message")
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < c.timeMargin {
+			remaining := sqsEvent.Records[i:]
+			c.log.Warn().Int("deferred", len(remaining)).Dur("time_left", time.Until(deadline)).Msg("Near Lambda deadline, deferring rest of batch")
+			for j := range remaining {
+				response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: remaining[j].MessageId})
+			}
+			deferred = len(remaining)
+			break
+		}
+
+		record := &sqsEvent.Records[i]
+		result, err := c.processMessage(ctx, record)
+		counts[result]++
+		if err != nil {
+			c.log.Error().Err(err).Str("message_id", record.MessageId).Msg("Failed to process message")
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
 		}
 	}
+	c.webhooks.Wait() // Each POST is bounded by hookTimeout
 
-	return nil
+	c.log.Info().
+		Int("received", len(sqsEvent.Records)).
+		Int("succeeded", counts[outcomeSucceeded]).
+		Int("failed", counts[outcomeFailed]).
+		Int("retried", counts[outcomeRetried]).
+		Int("robots_blocked", counts[outcomeRobotsBlocked]).
+		Int("rate_limited", counts[outcomeRateLimited]).
+		Int("skipped", counts[outcomeSkipped]).
+		Int("paused", counts[outcomePaused]).
+		Int("deferred", deferred).
+		Int("batch_item_failures", len(response.BatchItemFailures)).
+		Int64("duration_ms", time.Since(start).Milliseconds()).
+		Msg("Batch complete")
+
+	return response, nil
 }
 
-func (c *Crawler) processMessage(ctx context.Context, record *events.SQSMessage) error {
+// processMessage crawls one URL. A non-nil error means the message should be redelivered;
+// the outcome says what happened either way.
+func (c *Crawler) processMessage(ctx context.Context, record *events.SQSMessage) (outcome, error) {
 	targetURL := record.Body
-	urlHash := urls.Hash(targetURL)
+	urlHash := c.extractURLHash(record)
 	depth := c.extractDepth(record)
+	priority := c.extractPriority(record)
+	if delayMs, ok := c.extractCrawlDelay(record); ok {
+		ctx = withCrawlDelay(ctx, delayMs)
+	}
+	if maxDepth, ok := c.extractMaxDepth(record); ok {
+		ctx = withMaxDepth(ctx, maxDepth)
+	}
+	if jobID := c.extractJobID(record); jobID != "" {
+		ctx = withJobID(ctx, jobID)
+	}
+	if ancestry := c.extractAncestry(record); len(ancestry) > 0 {
+		ctx = withAncestry(ctx, ancestry)
+	}
+	if hint := c.extractContentHint(record); hint != "" {
+		ctx = withContentHint(ctx, hint)
+	}
 
 	c.log.Info().Str("url", targetURL).Int("depth", depth).Msg("Processing")
 
-	if !c.claimURL(ctx, urlHash) {
+	timer := timing.New()
+	ctx = timing.NewContext(ctx, timer)
+	defer c.logTimings(targetURL, timer)
+
+	timer.Start("claim")
+	claimed, won, err := c.claimURL(ctx, urlHash)
+	if err != nil {
+		c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to claim URL")
+		return outcomeRetried, fmt.Errorf("claiming %s: %w", targetURL, err)
+	}
+	if !won {
 		c.log.Warn().Str("url", targetURL).Msg("LOST race — already claimed")
-		return nil
+		return outcomeSkipped, nil
+	}
+	if c.isPaused(ctx) {
+		return outcomePaused, c.handlePaused(ctx, targetURL, urlHash, depth, priority)
+	}
+	if c.domainFull(ctx, urls.GetHost(targetURL)) {
+		// Queued before the domain reached MAX_PAGES_PER_DOMAIN; not worth a fetch now
+		c.log.Info().Str("url", targetURL).Int("max_pages_per_domain", c.domainPageCap).Msg("Domain page cap reached, skipping")
+		return outcomeSkipped, c.markStatus(ctx, urlHash, stateSkipped)
 	}
 	c.log.Info().Str("url", targetURL).Msg("WON race — checking robots.txt")
 
+	timer.Start("robots")
+	domain := c.rateLimitDomain(targetURL)
+	if !c.robotsCached(targetURL) {
+		// Fetching robots.txt is a request to the host like any other: it waits its turn under the
+		// rate limit and holds a host slot, so the page fetch below waits for the turn after it
+		allowed, err := c.checkRateLimit(ctx, domain)
+		if err != nil {
+			return c.handleRateLimitError(ctx, targetURL, urlHash, err)
+		}
+		if !allowed {
+			return outcomeRateLimited, c.handleRateLimited(ctx, targetURL, urlHash, depth, priority)
+		}
+		if !c.acquireHostSlot(ctx, domain) {
+			return outcomeRateLimited, c.handleHostBusy(ctx, targetURL, urlHash, depth, priority)
+		}
+		c.getRobots(ctx, targetURL)
+		c.releaseHostSlot(ctx, domain)
+	}
 	if !c.isAllowedByRobots(ctx, targetURL) {
 		c.log.Info().Str("url", targetURL).Msg("Blocked by robots.txt")
-		return c.markStatus(ctx, urlHash, stateRobotsBlocked)
+		return outcomeRobotsBlocked, c.markStatus(ctx, urlHash, stateRobotsBlocked)
+	}
+
+	timer.Start("ratelimit")
+	if remaining := c.circuitOpenFor(ctx, urls.GetHost(targetURL)); remaining > 0 {
+		return outcomeRateLimited, c.handleCircuitOpen(ctx, targetURL, urlHash, depth, priority, remaining)
 	}
 
-	if !c.checkRateLimit(ctx, urls.GetDomain(targetURL)) {
-		return c.handleRateLimited(ctx, targetURL, urlHash, depth)
+	// The global token comes first: a URL deferred by the global limit must not have spent the
+	// domain's delay slot or bucket token, or the domain would be throttled twice
+	allowed, err := c.takeGlobalToken(ctx)
+	if err != nil {
+		return c.handleRateLimitError(ctx, targetURL, urlHash, err)
+	}
+	if !allowed {
+		return outcomeRateLimited, c.handleGlobalRateLimited(ctx, targetURL, urlHash, depth, priority)
+	}
+	allowed, err = c.checkRateLimit(ctx, domain)
+	if err != nil {
+		return c.handleRateLimitError(ctx, targetURL, urlHash, err)
+	}
+	if !allowed {
+		return outcomeRateLimited, c.handleRateLimited(ctx, targetURL, urlHash, depth, priority)
+	}
+	if !c.acquireHostSlot(ctx, domain) {
+		return outcomeRateLimited, c.handleHostBusy(ctx, targetURL, urlHash, depth, priority)
 	}
 
-	result := c.fetchURL(ctx, targetURL)
+	timer.Start("fetch")
+	auth := c.getDomainAuth(ctx, urls.GetHost(targetURL))
+	result := c.fetchURL(withIfModifiedSince(ctx, claimed.modifiedSince()), targetURL, auth)
+	timer.Stop()
+	c.releaseHostSlot(ctx, domain)
+
+	// Unchanged since the last crawl: the stored copy is still current, so there is nothing to
+	// upload or parse, and its links were enqueued when it was first fetched
+	if result.StatusCode == http.StatusNotModified && !claimed.modifiedSince().IsZero() {
+		c.resetFailures(ctx, domain)
+		if err := c.markNotModified(ctx, targetURL, urlHash, &result); err != nil {
+			return outcomeRetried, err
+		}
+		c.log.Info().Str("url", targetURL).Time("since", claimed.finished).Int64("ms", result.DurationMs).Msg("Not modified since last crawl")
+		return outcomeSucceeded, nil
+	}
+
+	if c.emptyHTML(&result) {
+		if claimed.attempts < maxFetchAttempts {
+			result.Success, result.FailureKind = false, FailureEmptyBody
+			result.Error = fmt.Sprintf("HTML body of %d bytes, under %d", len(result.Body), c.emptyHTMLMin)
+		} else {
+			c.log.Info().Str("url", targetURL).Int("bytes", len(result.Body)).Int("attempts", claimed.attempts).Msg("Accepting empty HTML body after max attempts")
+		}
+	}
 
 	if !result.Success {
 		// Classify the failure
-		if result.StatusCode > 0 && isPermanentHTTPError(result.StatusCode) {
-			// Permanent failure (404, 403, etc.) — save and acknowledge
-			c.log.Warn().Str("url", targetURL).Int("status", result.StatusCode).Int64("ms", result.DurationMs).Msg("Permanent failure")
-			return c.saveFetchResult(ctx, urlHash, &result, depth)
+		if result.permanent() {
+			// Permanent failure (404, 403, NXDOMAIN, etc.) — save and acknowledge
+			c.log.Warn().Str("url", targetURL).Int("status", result.StatusCode).Str("error", result.Error).Int64("ms", result.DurationMs).Msg("Permanent failure")
+			return outcomeFailed, c.saveFetchResult(ctx, targetURL, urlHash, &result, depth)
 		}
 
-		// Retriable failure (5xx, network error, etc.) — return error so SQS retries
-		c.log.Warn().Str("url", targetURL).Int("status", result.StatusCode).Str("error", result.Error).Int64("ms", result.DurationMs).Msg("Retriable failure")
-		return fmt.Errorf("retriable failure for %s: status=%d err=%s", targetURL, result.StatusCode, result.Error)
+		// Only failures that suggest the host is struggling count toward its circuit breaker
+		c.recordFetchFailure(ctx, domain, urls.GetHost(targetURL))
+
+		if claimed.attempts >= maxFetchAttempts {
+			// Requeued messages are new to SQS, so the DLQ receive count never trips; give up here instead
+			c.log.Warn().Str("url", targetURL).Int("status", result.StatusCode).Str("error", result.Error).Int("attempts", claimed.attempts).Msg("Giving up after max attempts")
+			return outcomeFailed, c.saveFetchResult(ctx, targetURL, urlHash, &result, depth)
+		}
+
+		// Retriable failure (5xx, network error, etc.) — release the claim and requeue with exponential backoff
+		delay := c.retryDelay(claimed.attempts)
+		c.log.Warn().Str("url", targetURL).Int("status", result.StatusCode).Str("error", result.Error).Int64("ms", result.DurationMs).Int("attempts", claimed.attempts).Int("retry_in_s", delay).Msg("Retriable failure")
+		c.releaseClaim(ctx, urlHash, true)
+		if err := c.requeueWithDelay(ctx, targetURL, urlHash, depth, priority, delay); err != nil {
+			// Could not schedule the backoff; fall back to SQS redelivery of this message
+			return outcomeRetried, fmt.Errorf("retriable failure for %s: status=%d err=%s (requeue failed: %w)", targetURL, result.StatusCode, result.Error, err)
+		}
+		return outcomeRetried, nil
 	}
 
-	if err := c.saveFetchResult(ctx, urlHash, &result, depth); err != nil {
-		return err
+	c.resetFailures(ctx, domain)
+	if err := c.saveFetchResult(ctx, targetURL, urlHash, &result, depth); err != nil {
+		return outcomeRetried, err // Redelivered and fetched again
 	}
 
 	c.log.Info().Str("url", targetURL).Int("status", result.StatusCode).Int64("bytes", result.ContentLength).Int64("ms", result.DurationMs).Msg("Fetched successfully")
-	c.processHTMLContent(ctx, targetURL, urlHash, &result, depth)
-	return nil
+	upload := c.processHTMLContent(ctx, targetURL, urlHash, &result, depth, claimed)
+	c.publishPageCrawled(ctx, targetURL, &result, upload.TextKey)
+	c.notifyWebhook(ctx, targetURL, &result, upload)
+	return outcomeSucceeded, nil
+}
+
+// emptyHTML reports whether RETRY_EMPTY_HTML applies to result: a 200 HTML response whose body
+// is shorter than emptyHTMLMin
+func (c *Crawler) emptyHTML(result *FetchResult) bool {
+	return c.emptyHTMLMin > 0 && result.Success && result.StatusCode == http.StatusOK &&
+		parser.IsHTML(result.ContentType) && len(result.Body) < c.emptyHTMLMin
+}
+
+// logTimings emits one line per message with the milliseconds spent in each stage that ran
+// (claim, robots, ratelimit, fetch, parse, upload, enqueue) and in total, to show where Lambda time goes
+func (c *Crawler) logTimings(targetURL string, timer *timing.Timer) {
+	stages := zerolog.Dict()
+	for _, s := range timer.Stages() {
+		stages.Int64(s.Name, s.Duration.Milliseconds())
+	}
+	c.log.Info().Str("url", targetURL).Dict("stages_ms", stages).Int64("total_ms", timer.Elapsed().Milliseconds()).Msg("Stage timings")
+}
+
+// extractURLHash returns the url_hash of the item the message belongs to. Messages carry it as an
+// attribute because the body is the URL as discovered, which may not be canonical; messages
+// without one fall back to hashing the canonical form of the body.
+func (c *Crawler) extractURLHash(record *events.SQSMessage) string {
+	if attr, ok := record.MessageAttributes["url_hash"]; ok && attr.StringValue != nil && *attr.StringValue != "" {
+		return *attr.StringValue
+	}
+	return urls.Hash(urls.Canonicalize(record.Body))
 }
 
 // extractDepth gets crawl depth from SQS message attributes
@@ -78,30 +284,193 @@ func (c *Crawler) extractDepth(record *events.SQSMessage) int {
 	return 0
 }
 
+// extractMaxDepth gets the optional max_depth override from SQS message attributes, set on a
+// seed that should reach further or less far than MAX_DEPTH and inherited by everything
+// discovered from it. A missing, unparseable or negative value means no override.
+func (c *Crawler) extractMaxDepth(record *events.SQSMessage) (int, bool) {
+	if attr, ok := record.MessageAttributes["max_depth"]; ok && attr.StringValue != nil {
+		if parsed, err := strconv.Atoi(*attr.StringValue); err == nil && parsed >= 0 {
+			return parsed, true
+		}
+	}
+	return 0, false
+}
+
+// extractCrawlDelay gets the optional crawl_delay_ms override from SQS message attributes,
+// the politeness delay to use for this URL instead of the configured rate limit.
+// A missing, unparseable or negative value means no override.
+func (c *Crawler) extractCrawlDelay(record *events.SQSMessage) (int, bool) {
+	if attr, ok := record.MessageAttributes["crawl_delay_ms"]; ok && attr.StringValue != nil {
+		if parsed, err := strconv.Atoi(*attr.StringValue); err == nil && parsed >= 0 {
+			return parsed, true
+		}
+	}
+	return 0, false
+}
+
+// extractJobID gets the optional job_id from SQS message attributes, set by the producer on
+// seeds and inherited by everything discovered from them. Empty means the message has none.
+func (c *Crawler) extractJobID(record *events.SQSMessage) string {
+	if attr, ok := record.MessageAttributes["job_id"]; ok && attr.StringValue != nil {
+		return *attr.StringValue
+	}
+	return ""
+}
+
+// extractAncestry gets the URLs a page was discovered through, parent first, from the ancestry
+// message attribute, or just parent_url for a message from before ancestry was sent.
+// Returns nil for a seed.
+func (c *Crawler) extractAncestry(record *events.SQSMessage) []string {
+	if attr, ok := record.MessageAttributes["ancestry"]; ok && attr.StringValue != nil && *attr.StringValue != "" {
+		ancestry := strings.Split(*attr.StringValue, "\n")
+		return ancestry[:min(len(ancestry), maxStoredAncestry)]
+	}
+	if attr, ok := record.MessageAttributes["parent_url"]; ok && attr.StringValue != nil && *attr.StringValue != "" {
+		return []string{*attr.StringValue}
+	}
+	return nil
+}
+
+// extractContentHint gets the optional content_hint from SQS message attributes, set on the
+// messages of child sitemaps. Empty means the body is handled by its Content-Type.
+func (c *Crawler) extractContentHint(record *events.SQSMessage) string {
+	if attr, ok := record.MessageAttributes["content_hint"]; ok && attr.StringValue != nil {
+		return *attr.StringValue
+	}
+	return ""
+}
+
+// extractPriority gets the crawl priority from SQS message attributes, defaulting to normal
+func (c *Crawler) extractPriority(record *events.SQSMessage) string {
+	if attr, ok := record.MessageAttributes["priority"]; ok && attr.StringValue != nil && *attr.StringValue == priorityHigh {
+		return priorityHigh
+	}
+	return priorityNormal
+}
+
 // processHTMLContent uploads content to S3 and extracts links.
-// Uses single-pass HTML parsing to extract both text and links together.
-func (c *Crawler) processHTMLContent(ctx context.Context, targetURL, urlHash string, result *FetchResult, depth int) {
-	if !parser.IsHTML(result.ContentType) || len(result.Body) == 0 {
-		return
+// HTML uses single-pass parsing to extract both text and links together; JSON and XML bodies
+// only yield text, except sitemaps whose <loc> entries are their links (see c.extractorFor).
+// Other content types are skipped.
+// prior is the claimed item: when it already holds objects for this exact body (a redelivery after
+// a timeout, or a recrawl of an unchanged page) they are reused rather than uploaded again.
+// Returns the keys of the stored S3 objects; zero when nothing was stored (TextKey is "" without a text object).
+func (c *Crawler) processHTMLContent(ctx context.Context, targetURL, urlHash string, result *FetchResult, depth int, prior claim) UploadResult {
+	extract := c.extractorFor(ctx, result.ContentType)
+	if extract == nil || len(result.Body) == 0 {
+		return UploadResult{}
+	}
+
+	timer := timing.FromContext(ctx)
+	timer.Start("parse")
+	defer timer.Stop()
+
+	// Relative links resolve against the URL that served the body, not the one requested
+	baseURL := targetURL
+	if n := len(result.RedirectChain); n > 0 {
+		baseURL = result.RedirectChain[n-1]
+	}
+	parsed := extract(result.Body, baseURL)
+	if parsed.Redirect != "" {
+		// The refresh target is already in parsed.Links and is enqueued with them below
+		c.log.Info().Str("url", targetURL).Str("redirect", parsed.Redirect).Msg("Found meta refresh redirect")
+	}
+
+	language, confidence := lang.Detect(parsed.Text)
+	attrs := map[string]dynamodbtypes.AttributeValue{
+		"language":            &dynamodbtypes.AttributeValueMemberS{Value: language},
+		"language_confidence": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatFloat(confidence, 'f', 2, 64)},
+	}
+	// Near-duplicate fingerprint; downstream tools cluster pages with dedup.Similar. Without text there
+	// is none, and saveS3Keys removes the one an earlier crawl stored
+	if parsed.Text != "" {
+		attrs["simhash"] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatUint(dedup.SimHash(parsed.Text), 10)}
+	}
+	// Page metadata for downstream search; absent tags are not stored (and removed by saveS3Keys)
+	for name, value := range map[string]string{"page_title": parsed.Title, "meta_description": parsed.Description, "h1": parsed.H1} {
+		if value != "" {
+			attrs[name] = &dynamodbtypes.AttributeValueMemberS{Value: value}
+		}
+	}
+	if og := openGraphAttr(parsed.OpenGraph); og != nil {
+		attrs["open_graph"] = og
+	}
+
+	// X-Robots-Tag headers and robots meta tags combine; either can set noindex or nofollow
+	robots := parser.ParseRobots(append(slices.Clip(result.RobotsTag), parsed.RobotsMeta...), c.agentToken())
+	if robots.NoFollow {
+		attrs["nofollow"] = &dynamodbtypes.AttributeValueMemberBOOL{Value: true}
+	}
+
+	withText := true
+	switch {
+	case robots.NoIndex:
+		withText = false
+		attrs["noindex"] = &dynamodbtypes.AttributeValueMemberBOOL{Value: true}
+	case parsed.Text == "" && c.skipEmptyText:
+		withText = false
+		attrs["empty_text"] = &dynamodbtypes.AttributeValueMemberBOOL{Value: true}
+	case len(parsed.Text) < c.minTextLength:
+		withText = false
+		attrs["thin_content"] = &dynamodbtypes.AttributeValueMemberBOOL{Value: true}
 	}
 
-	// Single-pass parse: extract both text and links
-	parsed := parser.Extract(result.Body, targetURL)
+	timer.Start("upload")
+	c.addOutboundLinks(ctx, targetURL, urlHash, parsed.Links, attrs)
+
+	bodyHash := sha256Hex(result.Body)
+	attrs["content_sha256"] = &dynamodbtypes.AttributeValueMemberS{Value: bodyHash}
 
 	// Upload to S3
-	uploadResult, err := c.uploadContent(ctx, urlHash, result.Body, parsed.Text)
+	var stored UploadResult
+	var err error
+	uploadResult := prior.reusableUpload(bodyHash, withText)
+	if uploadResult != nil {
+		c.log.Info().Str("url", targetURL).Str("raw_key", uploadResult.RawKey).Msg("Content unchanged since last upload, skipping S3 upload")
+	} else {
+		uploadResult, err = c.uploadContent(ctx, targetURL, urlHash, result, parsed.Text, withText)
+	}
 	if err != nil {
 		c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to upload content to S3")
 	} else {
-		c.saveS3Keys(ctx, targetURL, urlHash, uploadResult, len(parsed.Text))
+		c.saveS3Keys(ctx, targetURL, urlHash, uploadResult, len(parsed.Text), attrs)
+		stored = *uploadResult
 	}
 
 	// Enqueue discovered links
-	if depth < c.maxDepth && len(parsed.Links) > 0 {
-		c.log.Info().Str("url", targetURL).Int("links_found", len(parsed.Links)).Msg("Extracted links")
-		enqueued := c.enqueueLinks(ctx, parsed.Links, depth+1, targetURL)
+	timer.Start("enqueue")
+	if robots.NoFollow {
+		c.log.Info().Str("url", targetURL).Int("links_found", len(parsed.Links)).Msg("Page is nofollow, not enqueueing links")
+	} else if depth < c.maxDepthFor(ctx) && len(parsed.Links) > 0 {
+		found := len(parsed.Links)
+		if parsed.Sitemap == "" {
+			// Sitemaps list URLs on purpose; only a page's links are sampled
+			parsed.Links = c.selectLinks(parsed.Links, depth)
+		}
+		c.log.Info().Str("url", targetURL).Int("links_found", found).Int("links_selected", len(parsed.Links)).Msg("Extracted links")
+		enqueued := c.enqueueParsed(ctx, &parsed, depth+1, targetURL)
 		if enqueued > 0 {
-			c.log.Info().Str("url", targetURL).Int("enqueued", enqueued).Int("skipped", len(parsed.Links)-enqueued).Int("child_depth", depth+1).Msg("Enqueued new links")
+			c.log.Info().Str("url", targetURL).Int("enqueued", enqueued).Int("skipped", found-enqueued).Int("child_depth", depth+1).Msg("Enqueued new links")
 		}
 	}
+
+	return stored
+}
+
+// openGraphAttr returns a page's Open Graph and Twitter Card properties as a DynamoDB map for
+// social previews, or nil when it has none. Past maxStoredOpenGraph properties only the first
+// keys in sorted order are kept, so og:* wins over twitter:* and the choice is stable across crawls.
+func openGraphAttr(props map[string]string) dynamodbtypes.AttributeValue {
+	if len(props) == 0 {
+		return nil
+	}
+	keys := slices.Sorted(maps.Keys(props))
+	if len(keys) > maxStoredOpenGraph {
+		keys = keys[:maxStoredOpenGraph]
+	}
+	m := make(map[string]dynamodbtypes.AttributeValue, len(keys))
+	for _, k := range keys {
+		m[k] = &dynamodbtypes.AttributeValueMemberS{Value: props[k]}
+	}
+	return &dynamodbtypes.AttributeValueMemberM{Value: m}
 }
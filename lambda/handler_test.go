@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"lambda/internal/dedup"
+	"lambda/urls"
+	"maps"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -12,6 +25,8 @@ import (
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/rs/zerolog"
 	"github.com/temoto/robotstxt"
 )
 
@@ -76,6 +91,50 @@ func TestExtractDepth(t *testing.T) {
 	}
 }
 
+func TestExtractURLHash(t *testing.T) {
+	c := newTestCrawler()
+
+	tests := []struct {
+		name   string
+		record *events.SQSMessage
+		want   string
+	}{
+		{
+			name: "attribute wins over body",
+			record: &events.SQSMessage{
+				Body: "https://Example.com/Page",
+				MessageAttributes: map[string]events.SQSMessageAttribute{
+					"url_hash": {StringValue: aws.String("seed-hash")},
+				},
+			},
+			want: "seed-hash",
+		},
+		{
+			name:   "no attribute hashes canonical body",
+			record: &events.SQSMessage{Body: "https://Example.com:443/Page#top"},
+			want:   urls.Hash("https://example.com/Page"),
+		},
+		{
+			name: "empty attribute ignored",
+			record: &events.SQSMessage{
+				Body: "https://example.com/Page",
+				MessageAttributes: map[string]events.SQSMessageAttribute{
+					"url_hash": {StringValue: aws.String("")},
+				},
+			},
+			want: urls.Hash("https://example.com/Page"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.extractURLHash(tt.record); got != tt.want {
+				t.Errorf("extractURLHash() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestHandlerProcessesAllMessages(t *testing.T) {
 	processed := 0
 	ddb := &mockDynamoDB{
@@ -96,7 +155,7 @@ func TestHandlerProcessesAllMessages(t *testing.T) {
 		},
 	}
 
-	err := c.Handler(context.Background(), event)
+	_, err := c.Handler(context.Background(), event)
 	if err != nil {
 		t.Fatalf("Handler() error = %v", err)
 	}
@@ -107,8 +166,8 @@ func TestHandlerProcessesAllMessages(t *testing.T) {
 	}
 }
 
-func TestHandlerAlwaysReturnsNil(t *testing.T) {
-	// Handler should always return nil (errors are logged, not propagated)
+func TestHandlerLostRaceIsNotAFailure(t *testing.T) {
+	// Lost races are ACKed, so they must not be reported as batch item failures
 	ddb := &mockDynamoDB{
 		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
 			return nil, errConditionalCheckFailed
@@ -123,9 +182,241 @@ func TestHandlerAlwaysReturnsNil(t *testing.T) {
 		},
 	}
 
-	err := c.Handler(context.Background(), event)
+	resp, err := c.Handler(context.Background(), event)
+	if err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Errorf("expected no batch item failures, got %v", resp.BatchItemFailures)
+	}
+}
+
+func TestHandlerClaimErrorIsAFailure(t *testing.T) {
+	// A DynamoDB outage must not look like a lost race: the message is redelivered, not ACKed
+	fetched := false
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			return nil, fmt.Errorf("ResourceNotFoundException: table not found")
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+	}))
+
+	got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/1", MessageId: "msg1"})
+	if err == nil {
+		t.Error("processMessage() error = nil, want the claim error")
+	}
+	if got != outcomeRetried {
+		t.Errorf("outcome = %v, want outcomeRetried", got)
+	}
+	if fetched {
+		t.Error("URL fetched without a claim")
+	}
+
+	resp, err := c.Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: "https://example.com/1", MessageId: "msg1"}}})
+	if err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "msg1" {
+		t.Errorf("batch item failures = %v, want msg1", resp.BatchItemFailures)
+	}
+}
+
+func TestHandlerDefersBatchNearDeadline(t *testing.T) {
+	tests := []struct {
+		name          string
+		deadline      time.Duration
+		margin        time.Duration
+		claimDelay    time.Duration
+		wantClaims    int
+		wantFailedIDs []string
+	}{
+		{"plenty of time", time.Hour, 5 * time.Second, 0, 3, nil},
+		{"already inside margin", time.Second, time.Minute, 0, 0, []string{"msg1", "msg2", "msg3"}},
+		{"margin reached mid-batch", 400 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 1, []string{"msg2", "msg3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := 0
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					claims++
+					time.Sleep(tt.claimDelay)
+					return nil, errConditionalCheckFailed // lost race: ACKed without fetching
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.timeMargin = tt.margin
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.deadline)
+			defer cancel()
+
+			event := events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: "https://example.com/1", MessageId: "msg1"},
+					{Body: "https://example.com/2", MessageId: "msg2"},
+					{Body: "https://example.com/3", MessageId: "msg3"},
+				},
+			}
+
+			resp, err := c.Handler(ctx, event)
+			if err != nil {
+				t.Fatalf("Handler() error = %v", err)
+			}
+			if claims != tt.wantClaims {
+				t.Errorf("claims = %d, want %d", claims, tt.wantClaims)
+			}
+			var failed []string
+			for _, f := range resp.BatchItemFailures {
+				failed = append(failed, f.ItemIdentifier)
+			}
+			if strings.Join(failed, ",") != strings.Join(tt.wantFailedIDs, ",") {
+				t.Errorf("batch item failures = %v, want %v", failed, tt.wantFailedIDs)
+			}
+		})
+	}
+}
+
+func TestHandlerLogsBatchSummary(t *testing.T) {
+	claimedHash := urls.Hash("https://example.com/claimed")
+	ddb := authItemDDB(nil)
+	ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		switch input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value {
+		case claimedHash:
+			return nil, errConditionalCheckFailed // another invocation holds the claim
+		case domainKeyPrefix + "https://busy.example.com":
+			return nil, errConditionalCheckFailed // crawled too recently
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			_, _ = fmt.Fprint(w, "User-agent: *\nDisallow: /private")
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/flaky":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = fmt.Fprint(w, "ok")
+		}
+	})
+
+	var buf bytes.Buffer
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.httpClient = testHTTPClientWith(handler)
+	c.log = zerolog.New(&buf)
+
+	bodies := []string{
+		"https://example.com/ok",
+		"https://example.com/ok-too",
+		"https://example.com/missing",
+		"https://example.com/flaky",
+		"https://example.com/private/page",
+		"https://busy.example.com/page",
+		"https://example.com/claimed",
+	}
+	var event events.SQSEvent
+	for i, body := range bodies {
+		event.Records = append(event.Records, events.SQSMessage{Body: body, MessageId: "msg" + strconv.Itoa(i)})
+	}
+
+	if _, err := c.Handler(context.Background(), event); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+
+	var summary map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, `"Batch complete"`) {
+			if err := json.Unmarshal([]byte(line), &summary); err != nil {
+				t.Fatalf("summary is not JSON: %v", err)
+			}
+		}
+	}
+	if summary == nil {
+		t.Fatal("no batch summary logged")
+	}
+
+	want := map[string]float64{
+		"received":            7,
+		"succeeded":           2,
+		"failed":              1,
+		"retried":             1,
+		"robots_blocked":      1,
+		"rate_limited":        1,
+		"skipped":             1,
+		"deferred":            0,
+		"batch_item_failures": 0,
+	}
+	for field, n := range want {
+		if summary[field] != n {
+			t.Errorf("%s = %v, want %v", field, summary[field], n)
+		}
+	}
+	if _, ok := summary["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms missing from summary: %v", summary)
+	}
+}
+
+func TestHandlerReportsBatchItemFailures(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = fmt.Fprint(w, "ok")
+		}
+	})
+
+	var released []string
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if *input.UpdateExpression == "SET #s = :queued" {
+				released = append(released, input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value)
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	// Requeueing the backoff fails, so the retriable message falls back to SQS redelivery
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, _ *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			return nil, fmt.Errorf("SQS unavailable")
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.httpClient = testHTTPClientWith(handler)
+	c.crawlDelayMs = 0
+
+	event := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{Body: "https://example.com/ok", MessageId: "msg-ok"},
+			{Body: "https://example.com/flaky", MessageId: "msg-flaky"},
+			{Body: "https://example.com/missing", MessageId: "msg-missing"},
+		},
+	}
+
+	resp, err := c.Handler(context.Background(), event)
 	if err != nil {
-		t.Fatalf("Handler() should always return nil, got: %v", err)
+		t.Fatalf("Handler() error = %v", err)
+	}
+
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "msg-flaky" {
+		t.Errorf("expected only msg-flaky in failures, got %v", resp.BatchItemFailures)
+	}
+	if len(released) != 1 || released[0] != urls.Hash("https://example.com/flaky") {
+		t.Errorf("expected claim released for the retriable URL only, got %v", released)
 	}
 }
 
@@ -139,7 +430,7 @@ func TestProcessMessageClaimLost(t *testing.T) {
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
 
 	record := &events.SQSMessage{Body: "https://example.com"}
-	err := c.processMessage(context.Background(), record)
+	_, err := c.processMessage(context.Background(), record)
 	if err != nil {
 		t.Fatalf("processMessage() should return nil when claim lost, got: %v", err)
 	}
@@ -158,10 +449,10 @@ func TestProcessMessageRobotsBlocked(t *testing.T) {
 
 	// Pre-populate robots cache to block the URL
 	robotsData, _ := robotstxt.FromString("User-agent: *\nDisallow: /blocked")
-	c.robotsCache["https://example.com"] = robotsData
+	c.robotsCache.set("https://example.com", robotsData)
 
 	record := &events.SQSMessage{Body: "https://example.com/blocked"}
-	err := c.processMessage(context.Background(), record)
+	_, err := c.processMessage(context.Background(), record)
 	if err != nil {
 		t.Fatalf("processMessage() error = %v", err)
 	}
@@ -177,23 +468,220 @@ func TestProcessMessageRetriableFailure(t *testing.T) {
 		w.WriteHeader(http.StatusInternalServerError)
 	})
 
+	tests := []struct {
+		name      string
+		attempts  string
+		wantDelay int32
+	}{
+		{"first failure waits the base delay", "1", 30},
+		{"third failure waits four times the base", "3", 120},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var released bool
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if *input.UpdateExpression == "SET #s = :queued" {
+						released = true
+					}
+					return &dynamodb.UpdateItemOutput{Attributes: map[string]dynamodbtypes.AttributeValue{
+						"attempts": &dynamodbtypes.AttributeValueMemberN{Value: tt.attempts},
+					}}, nil
+				},
+			}
+
+			var requeued *sqs.SendMessageInput
+			sqsClient := &mockSQS{
+				sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+					requeued = input
+					return &sqs.SendMessageOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.httpClient = testHTTPClientWith(handler)
+			c.crawlDelayMs = 0
+
+			record := &events.SQSMessage{Body: "https://example.com/page"}
+			if _, err := c.processMessage(context.Background(), record); err != nil {
+				t.Fatalf("processMessage() error = %v, want nil once the retry is requeued", err)
+			}
+			if !released {
+				t.Error("expected the processing claim to be released")
+			}
+			if requeued == nil {
+				t.Fatal("expected the URL to be requeued")
+			}
+			if requeued.DelaySeconds != tt.wantDelay {
+				t.Errorf("DelaySeconds = %d, want %d", requeued.DelaySeconds, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestProcessMessageRetriableFailureGivesUpAtMaxAttempts(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	var savedStatus string
 	ddb := &mockDynamoDB{
-		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if v, ok := input.ExpressionAttributeValues[":status"].(*dynamodbtypes.AttributeValueMemberS); ok {
+				savedStatus = v.Value
+			}
+			return &dynamodb.UpdateItemOutput{Attributes: map[string]dynamodbtypes.AttributeValue{
+				"attempts": &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(maxFetchAttempts)},
+			}}, nil
+		},
+	}
+
+	sends := 0
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, _ *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			sends++
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.httpClient = testHTTPClientWith(handler)
+	c.crawlDelayMs = 0
+
+	record := &events.SQSMessage{Body: "https://example.com/page"}
+	if _, err := c.processMessage(context.Background(), record); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+	if savedStatus != stateFailed {
+		t.Errorf("saved status = %q, want %q", savedStatus, stateFailed)
+	}
+	if sends != 0 {
+		t.Errorf("expected no requeue after max attempts, got %d sends", sends)
+	}
+}
+
+// TestProcessMessageRetriesEmptyHTML covers RETRY_EMPTY_HTML: a short 200 HTML body is retried
+// until maxFetchAttempts, then accepted like any other page
+func TestProcessMessageRetriesEmptyHTML(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		attempts    int
+		wantRequeue bool
+		wantStatus  string
+	}{
+		{"empty body is retried", "", 1, true, ""},
+		{"normal body is accepted", "<html><body>Hello</body></html>", 1, false, stateDone},
+		{"empty body accepted at max attempts", "", maxFetchAttempts, false, stateDone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var savedStatus string
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if v, ok := input.ExpressionAttributeValues[":status"].(*dynamodbtypes.AttributeValueMemberS); ok {
+						savedStatus = v.Value
+					}
+					return &dynamodb.UpdateItemOutput{Attributes: map[string]dynamodbtypes.AttributeValue{
+						"attempts": &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(tt.attempts)},
+					}}, nil
+				},
+			}
+
+			var requeued *sqs.SendMessageInput
+			sqsClient := &mockSQS{
+				sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+					requeued = input
+					return &sqs.SendMessageOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.emptyHTMLMin = 16
+			c.crawlDelayMs = 0
+			c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprint(w, tt.body)
+			}))
+
+			record := &events.SQSMessage{Body: "https://example.com/page"}
+			outcome, err := c.processMessage(context.Background(), record)
+			if err != nil {
+				t.Fatalf("processMessage() error = %v", err)
+			}
+			if got := requeued != nil; got != tt.wantRequeue {
+				t.Errorf("requeued = %v, want %v", got, tt.wantRequeue)
+			}
+			if tt.wantRequeue && outcome != outcomeRetried {
+				t.Errorf("outcome = %v, want %v", outcome, outcomeRetried)
+			}
+			if savedStatus != tt.wantStatus {
+				t.Errorf("saved status = %q, want %q", savedStatus, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestProcessMessageFetchTimeoutIsRetriable(t *testing.T) {
+	var released bool
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if *input.UpdateExpression == "SET #s = :queued" {
+				released = true
+			}
 			return &dynamodb.UpdateItemOutput{}, nil
 		},
-		putItemFunc: func(_ context.Context, _ *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
-			return &dynamodb.PutItemOutput{}, nil
+	}
+
+	requeued := false
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, _ *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			requeued = true
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.httpClient = testHTTPClientWith(slowHandler())
+	c.crawlDelayMs = 0
+	c.fetchTimeout = 50 * time.Millisecond
+	c.robotsTimeout = 50 * time.Millisecond
+
+	record := &events.SQSMessage{Body: "https://example.com/slow"}
+	if _, err := c.processMessage(context.Background(), record); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+	if !released {
+		t.Error("expected the processing claim to be released")
+	}
+	if !requeued {
+		t.Error("expected a timed-out fetch to be requeued for retry")
+	}
+}
+
+func TestProcessMessageUnknownHostIsPermanent(t *testing.T) {
+	var savedStatus string
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if v, ok := input.ExpressionAttributeValues[":status"].(*dynamodbtypes.AttributeValueMemberS); ok {
+				savedStatus = v.Value
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
 		},
 	}
 
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
-	c.httpClient = testHTTPClientWith(handler)
+	c.httpClient = &http.Client{Transport: errRoundTripper{err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}}
 	c.crawlDelayMs = 0
 
 	record := &events.SQSMessage{Body: "https://example.com/page"}
-	err := c.processMessage(context.Background(), record)
-	if err == nil {
-		t.Fatal("processMessage() should return error for retriable failure")
+	if _, err := c.processMessage(context.Background(), record); err != nil {
+		t.Fatalf("processMessage() error = %v, want nil so the message is acknowledged", err)
+	}
+	if savedStatus != stateFailed {
+		t.Errorf("saved status = %q, want %q", savedStatus, stateFailed)
 	}
 }
 
@@ -218,13 +706,14 @@ func TestProcessMessagePermanentFailure(t *testing.T) {
 	c.crawlDelayMs = 0
 
 	record := &events.SQSMessage{Body: "https://example.com/page"}
-	err := c.processMessage(context.Background(), record)
+	_, err := c.processMessage(context.Background(), record)
 	if err != nil {
 		t.Fatalf("processMessage() should not return error for permanent failure, got: %v", err)
 	}
 
-	if updateCalls != 2 {
-		t.Errorf("expected 2 UpdateItem calls, got %d", updateCalls)
+	// Claim, fetch result and the domain's pages_failed counter
+	if updateCalls != 3 {
+		t.Errorf("expected 3 UpdateItem calls, got %d", updateCalls)
 	}
 }
 
@@ -265,7 +754,7 @@ func TestProcessMessageSuccessfulFetch(t *testing.T) {
 	c.crawlDelayMs = 0
 
 	record := &events.SQSMessage{Body: "https://example.com/page"}
-	err := c.processMessage(context.Background(), record)
+	_, err := c.processMessage(context.Background(), record)
 	if err != nil {
 		t.Fatalf("processMessage() error = %v", err)
 	}
@@ -275,6 +764,229 @@ func TestProcessMessageSuccessfulFetch(t *testing.T) {
 	}
 }
 
+func TestProcessMessageRedeliveryReusesStoredContent(t *testing.T) {
+	const body = `<html><body><p>Hello</p></body></html>`
+	tests := []struct {
+		name       string
+		storedHash string
+		wantPuts   bool
+	}{
+		{"unchanged body skips upload", sha256Hex([]byte(body)), false},
+		{"changed body uploads again", sha256Hex([]byte("older body")), true},
+		{"no hash recorded uploads again", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status, rawKey string
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					values := input.ExpressionAttributeValues
+					if _, ok := values[":queued"]; ok {
+						// The claim: an earlier delivery uploaded the content but timed out before finishing
+						item := map[string]dynamodbtypes.AttributeValue{
+							"attempts":    &dynamodbtypes.AttributeValueMemberN{Value: "2"},
+							"s3_raw_key":  &dynamodbtypes.AttributeValueMemberS{Value: "hash/raw.html.gz"},
+							"s3_text_key": &dynamodbtypes.AttributeValueMemberS{Value: "hash/text.txt.gz"},
+						}
+						if tt.storedHash != "" {
+							item["content_sha256"] = &dynamodbtypes.AttributeValueMemberS{Value: tt.storedHash}
+						}
+						return &dynamodb.UpdateItemOutput{Attributes: item}, nil
+					}
+					if v, ok := values[":status"].(*dynamodbtypes.AttributeValueMemberS); ok {
+						status = v.Value
+					}
+					if v, ok := values[":raw_key"].(*dynamodbtypes.AttributeValueMemberS); ok {
+						rawKey = v.Value
+					}
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+			puts := 0
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					puts++
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, s3Client)
+			c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprint(w, body)
+			}))
+
+			got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+			if err != nil || got != outcomeSucceeded {
+				t.Fatalf("processMessage() = %v, %v, want outcomeSucceeded", got, err)
+			}
+			if status != stateDone {
+				t.Errorf("status = %q, want %q", status, stateDone)
+			}
+			if (puts > 0) != tt.wantPuts {
+				t.Errorf("PutObject calls = %d, want uploads = %v", puts, tt.wantPuts)
+			}
+			if rawKey != "hash/raw.html.gz" && !tt.wantPuts {
+				t.Errorf("saved raw key = %q, want the stored key reused", rawKey)
+			}
+		})
+	}
+}
+
+// TestProcessMessageConditionalRecrawl checks that a re-crawl of stored content sends the previous
+// finished_at as If-Modified-Since and that a 304 marks the item done without touching S3, while a
+// first crawl sends no conditional header
+func TestProcessMessageConditionalRecrawl(t *testing.T) {
+	const finishedAt = "2024-03-01T12:00:00Z"
+	tests := []struct {
+		name      string
+		prior     map[string]dynamodbtypes.AttributeValue
+		wantSince string
+	}{
+		{
+			name: "re-crawl is conditional",
+			prior: map[string]dynamodbtypes.AttributeValue{
+				"finished_at": &dynamodbtypes.AttributeValueMemberS{Value: finishedAt},
+				"s3_raw_key":  &dynamodbtypes.AttributeValueMemberS{Value: "hash/raw.html.gz"},
+			},
+			wantSince: "Fri, 01 Mar 2024 12:00:00 GMT",
+		},
+		{"first crawl is not", map[string]dynamodbtypes.AttributeValue{}, ""},
+		{
+			name: "failed crawl without content is not",
+			prior: map[string]dynamodbtypes.AttributeValue{
+				"finished_at": &dynamodbtypes.AttributeValueMemberS{Value: finishedAt},
+			},
+			wantSince: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status, httpStatus string
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					values := input.ExpressionAttributeValues
+					if _, ok := values[":processing"]; ok {
+						return &dynamodb.UpdateItemOutput{Attributes: tt.prior}, nil
+					}
+					for _, name := range []string{":status", ":done"} {
+						if v, ok := values[name].(*dynamodbtypes.AttributeValueMemberS); ok {
+							status = v.Value
+							httpStatus = values[":http_status"].(*dynamodbtypes.AttributeValueMemberN).Value
+						}
+					}
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+			puts := 0
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					puts++
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			var gotSince string
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, s3Client)
+			c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					http.NotFound(w, r)
+					return
+				}
+				gotSince = r.Header.Get("If-Modified-Since")
+				if gotSince != "" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprint(w, `<html><body><p>Hello</p></body></html>`)
+			}))
+
+			got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+			if err != nil || got != outcomeSucceeded {
+				t.Fatalf("processMessage() = %v, %v, want outcomeSucceeded", got, err)
+			}
+			if gotSince != tt.wantSince {
+				t.Errorf("If-Modified-Since = %q, want %q", gotSince, tt.wantSince)
+			}
+			if status != stateDone {
+				t.Errorf("status = %q, want %q", status, stateDone)
+			}
+			if tt.wantSince != "" {
+				if httpStatus != "304" {
+					t.Errorf("http_status = %s, want 304", httpStatus)
+				}
+				if puts != 0 {
+					t.Errorf("PutObject calls = %d, want none for an unchanged page", puts)
+				}
+			} else if puts == 0 {
+				t.Error("expected the fetched page to be uploaded")
+			}
+		})
+	}
+}
+
+func TestProcessMessageLogsStageTimings(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		wantStages []string
+	}{
+		{"fetched page", "https://example.com/page", []string{"claim", "robots", "ratelimit", "fetch", "parse", "upload", "enqueue"}},
+		{"robots blocked", "https://example.com/private/page", []string{"claim", "robots"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c := newTestCrawlerWithMocks(authItemDDB(nil), &mockSQS{}, &mockS3{})
+			c.log = zerolog.New(&buf)
+			c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					_, _ = fmt.Fprint(w, "User-agent: *\nDisallow: /private")
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprint(w, `<html><body><p>Hello</p><a href="/other">Link</a></body></html>`)
+			}))
+
+			if _, err := c.processMessage(context.Background(), &events.SQSMessage{Body: tt.url}); err != nil {
+				t.Fatalf("processMessage() error = %v", err)
+			}
+
+			var line struct {
+				Message string           `json:"message"`
+				Stages  map[string]int64 `json:"stages_ms"`
+				TotalMs *int64           `json:"total_ms"`
+			}
+			found := 0
+			for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if strings.Contains(raw, `"Stage timings"`) {
+					found++
+					if err := json.Unmarshal([]byte(raw), &line); err != nil {
+						t.Fatalf("unmarshal %s: %v", raw, err)
+					}
+				}
+			}
+			if found != 1 {
+				t.Fatalf("Stage timings lines = %d, want exactly 1\n%s", found, buf.String())
+			}
+			if got := slices.Sorted(maps.Keys(line.Stages)); !slices.Equal(got, slices.Sorted(slices.Values(tt.wantStages))) {
+				t.Errorf("stages = %v, want %v", got, tt.wantStages)
+			}
+			if line.TotalMs == nil {
+				t.Error("total_ms missing")
+			}
+		})
+	}
+}
+
 func TestProcessHTMLContentSkipsNonHTML(t *testing.T) {
 	s3Calls := 0
 	s3Client := &mockS3{
@@ -286,15 +998,15 @@ func TestProcessHTMLContentSkipsNonHTML(t *testing.T) {
 
 	c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
 
-	// JSON content type should be skipped
+	// Content types without an extractor should be skipped
 	result := &FetchResult{
-		ContentType: "application/json",
-		Body:        []byte(`{"key": "value"}`),
+		ContentType: "application/pdf",
+		Body:        []byte("%PDF-1.7"),
 	}
-	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0)
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0, claim{})
 
 	if s3Calls != 0 {
-		t.Errorf("expected no S3 calls for non-HTML content, got %d", s3Calls)
+		t.Errorf("expected no S3 calls for unsupported content, got %d", s3Calls)
 	}
 
 	// Empty body should also be skipped
@@ -302,7 +1014,7 @@ func TestProcessHTMLContentSkipsNonHTML(t *testing.T) {
 		ContentType: "text/html",
 		Body:        []byte{},
 	}
-	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0)
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0, claim{})
 
 	if s3Calls != 0 {
 		t.Errorf("expected no S3 calls for empty body, got %d", s3Calls)
@@ -341,7 +1053,7 @@ func TestProcessHTMLContentUploadsAndEnqueues(t *testing.T) {
 		Body:        []byte(`<html><body><p>Hello</p><a href="https://example.com/other">Link</a></body></html>`),
 	}
 
-	c.processHTMLContent(context.Background(), "https://example.com", "hash123", result, 0)
+	c.processHTMLContent(context.Background(), "https://example.com", "hash123", result, 0, claim{})
 
 	// Should have uploaded raw HTML + extracted text = 2 S3 PutObject calls
 	if s3Calls != 2 {
@@ -349,6 +1061,51 @@ func TestProcessHTMLContentUploadsAndEnqueues(t *testing.T) {
 	}
 }
 
+func TestProcessHTMLContentExtractsStructuredText(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantText    string
+	}{
+		{"json", "application/json", `{"title": "Hello", "tags": ["crawler", "search"]}`, "crawler search Hello"},
+		{"xml", "application/xml", `<feed><entry><title>Hello</title><summary>world</summary></entry></feed>`, "Hello world"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			uploaded := map[string][]byte{}
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					gz, err := gzip.NewReader(input.Body)
+					if err != nil {
+						t.Fatalf("uploaded object is not gzip: %v", err)
+					}
+					data, _ := io.ReadAll(gz)
+					mu.Lock()
+					uploaded[*input.Key] = data
+					mu.Unlock()
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
+			textKey := c.processHTMLContent(context.Background(), "https://example.com/api", "hash", &FetchResult{ContentType: tt.contentType, Body: []byte(tt.body)}, 0, claim{}).TextKey
+
+			if textKey != "hash/text.txt.gz" {
+				t.Fatalf("text key = %q, want hash/text.txt.gz", textKey)
+			}
+			if got := string(uploaded[textKey]); got != tt.wantText {
+				t.Errorf("text object = %q, want %q", got, tt.wantText)
+			}
+			if got := string(uploaded["hash/raw.html.gz"]); got != tt.body {
+				t.Errorf("raw object = %q, want the body as fetched", got)
+			}
+		})
+	}
+}
+
 func TestProcessHTMLContentAtMaxDepth(t *testing.T) {
 	batchCalls := 0
 	sqsClient := &mockSQS{
@@ -377,9 +1134,451 @@ func TestProcessHTMLContentAtMaxDepth(t *testing.T) {
 	}
 
 	// At depth 2 with maxDepth 2, no links should be enqueued
-	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 2)
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 2, claim{})
 
 	if batchCalls != 0 {
 		t.Errorf("expected no SQS batch calls at max depth, got %d", batchCalls)
 	}
 }
+
+func TestProcessHTMLContentEmptyText(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		skipEmptyText bool
+		wantPuts      int
+		wantFlag      bool
+	}{
+		{"empty text skips text upload", `<html><body><script>app()</script></body></html>`, true, 1, true},
+		{"normal page uploads both", `<html><body><p>Hello world</p></body></html>`, true, 2, false},
+		{"empty text with skip disabled", `<html><body><script>app()</script></body></html>`, false, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puts := 0
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					puts++
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			var update *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					update = input
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, s3Client)
+			c.skipEmptyText = tt.skipEmptyText
+
+			result := &FetchResult{ContentType: "text/html", Body: []byte(tt.body)}
+			c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0, claim{})
+
+			if puts != tt.wantPuts {
+				t.Errorf("expected %d S3 PutObject calls, got %d", tt.wantPuts, puts)
+			}
+			if update == nil {
+				t.Fatal("expected S3 keys to be saved")
+			}
+			gotFlag := strings.Contains(*update.UpdateExpression, "empty_text = :empty_text")
+			if gotFlag != tt.wantFlag {
+				t.Errorf("empty_text flag set = %v, want %v (expr %q)", gotFlag, tt.wantFlag, *update.UpdateExpression)
+			}
+		})
+	}
+}
+
+func TestProcessHTMLContentThinContent(t *testing.T) {
+	puts := 0
+	s3Client := &mockS3{
+		putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			puts++
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	var update *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			update = input
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+		getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{
+				Item: map[string]dynamodbtypes.AttributeValue{
+					"status": &dynamodbtypes.AttributeValueMemberS{Value: "active"},
+				},
+			}, nil
+		},
+	}
+	batchEntries := 0
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			batchEntries += len(input.Entries)
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, s3Client)
+	c.minTextLength = 100
+
+	// Extracted text is exactly 10 characters: "Login here"
+	result := &FetchResult{
+		ContentType: "text/html",
+		Body:        []byte(`<html><body><a href="https://example.com/login">Login here</a></body></html>`),
+	}
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0, claim{})
+
+	if puts != 1 {
+		t.Errorf("expected only the raw upload, got %d PutObject calls", puts)
+	}
+	if !strings.Contains(*update.UpdateExpression, "thin_content = :thin_content") {
+		t.Errorf("expected thin_content flag, got %q", *update.UpdateExpression)
+	}
+	if batchEntries != 1 {
+		t.Errorf("expected links to still be enqueued, got %d entries", batchEntries)
+	}
+}
+
+func TestProcessHTMLContentRobotsDirectives(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       []string // X-Robots-Tag values
+		meta         string   // <meta name="robots"> content; empty for no tag
+		wantNoIndex  bool
+		wantNoFollow bool
+	}{
+		{name: "no directives"},
+		{name: "header noindex", header: []string{"noindex"}, wantNoIndex: true},
+		{name: "header nofollow", header: []string{"nofollow"}, wantNoFollow: true},
+		{name: "header none", header: []string{"none"}, wantNoIndex: true, wantNoFollow: true},
+		{name: "header for another agent", header: []string{"googlebot: noindex, nofollow"}},
+		{name: "header for this agent", header: []string{"mycrawler: noindex"}, wantNoIndex: true},
+		{name: "header noindex with meta nofollow", header: []string{"noindex"}, meta: "nofollow", wantNoIndex: true, wantNoFollow: true},
+		{name: "meta alone", meta: "noindex, nofollow", wantNoIndex: true, wantNoFollow: true},
+		{name: "meta none", meta: "none", wantNoIndex: true, wantNoFollow: true},
+		{name: "header index does not override meta noindex", header: []string{"index, follow"}, meta: "noindex", wantNoIndex: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puts := 0
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					puts++
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			var update *dynamodb.UpdateItemInput
+			ddb := authItemDDB(nil)
+			ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+				update = input
+				return &dynamodb.UpdateItemOutput{}, nil
+			}
+			batchEntries := 0
+			sqsClient := &mockSQS{
+				sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+					batchEntries += len(input.Entries)
+					return &sqs.SendMessageBatchOutput{}, nil
+				},
+			}
+
+			meta := ""
+			if tt.meta != "" {
+				meta = `<meta name="robots" content="` + tt.meta + `">`
+			}
+			result := &FetchResult{
+				ContentType: "text/html",
+				Body:        []byte(`<html><head>` + meta + `</head><body><p>Some page text</p><a href="https://example.com/next">Next</a></body></html>`),
+				RobotsTag:   tt.header,
+			}
+			c := newTestCrawlerWithMocks(ddb, sqsClient, s3Client)
+			textKey := c.processHTMLContent(context.Background(), "https://example.com/", "hash", result, 0, claim{}).TextKey
+
+			if gotText := textKey != ""; gotText == tt.wantNoIndex {
+				t.Errorf("text stored = %v, want %v", gotText, !tt.wantNoIndex)
+			}
+			if wantPuts := map[bool]int{true: 1, false: 2}[tt.wantNoIndex]; puts != wantPuts {
+				t.Errorf("PutObject calls = %d, want %d", puts, wantPuts)
+			}
+			if got := strings.Contains(*update.UpdateExpression, "noindex = :noindex"); got != tt.wantNoIndex {
+				t.Errorf("noindex flag set = %v, want %v (expr %q)", got, tt.wantNoIndex, *update.UpdateExpression)
+			}
+			if got := strings.Contains(*update.UpdateExpression, "nofollow = :nofollow"); got != tt.wantNoFollow {
+				t.Errorf("nofollow flag set = %v, want %v (expr %q)", got, tt.wantNoFollow, *update.UpdateExpression)
+			}
+			if got := batchEntries > 0; got == tt.wantNoFollow {
+				t.Errorf("links enqueued = %d, want enqueued = %v", batchEntries, !tt.wantNoFollow)
+			}
+		})
+	}
+}
+
+func TestProcessHTMLContentStoresLanguage(t *testing.T) {
+	var update *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			update = input
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	result := &FetchResult{
+		ContentType: "text/html",
+		Body:        []byte(`<html><body><p>Le chat est sur la table et il regarde les oiseaux dans le jardin.</p></body></html>`),
+	}
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0, claim{})
+
+	language, ok := update.ExpressionAttributeValues[":language"].(*dynamodbtypes.AttributeValueMemberS)
+	if !ok || language.Value != "fr" {
+		t.Errorf("expected language fr, got %v", update.ExpressionAttributeValues[":language"])
+	}
+	if _, ok := update.ExpressionAttributeValues[":language_confidence"].(*dynamodbtypes.AttributeValueMemberN); !ok {
+		t.Error("expected numeric language_confidence")
+	}
+}
+
+func TestProcessHTMLContentStoresSimHash(t *testing.T) {
+	var update *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			update = input
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	text := "Opening hours for the library change during the summer holidays."
+	result := &FetchResult{ContentType: "text/html", Body: []byte(`<html><body><p>` + text + `</p></body></html>`)}
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", result, 0, claim{})
+
+	simhash, ok := update.ExpressionAttributeValues[":simhash"].(*dynamodbtypes.AttributeValueMemberN)
+	if !ok {
+		t.Fatalf("expected numeric simhash, got %v", update.ExpressionAttributeValues[":simhash"])
+	}
+	if want := strconv.FormatUint(dedup.SimHash(text), 10); simhash.Value != want {
+		t.Errorf("simhash = %s, want %s", simhash.Value, want)
+	}
+}
+
+func TestProcessHTMLContentStoresMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{
+			name: "all fields",
+			body: `<html><head><title>Widgets</title><meta name="description" content="All about widgets"></head><body><h1>Widget guide</h1></body></html>`,
+			want: map[string]string{"page_title": "Widgets", "meta_description": "All about widgets", "h1": "Widget guide"},
+		},
+		{
+			name: "missing tags not stored",
+			body: `<html><head><title>Only a title</title></head><body><p>Text</p></body></html>`,
+			want: map[string]string{"page_title": "Only a title"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var update *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					update = input
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.processHTMLContent(context.Background(), "https://example.com", "hash", &FetchResult{ContentType: "text/html", Body: []byte(tt.body)}, 0, claim{})
+
+			for _, name := range []string{"page_title", "meta_description", "h1"} {
+				got, ok := update.ExpressionAttributeValues[":"+name].(*dynamodbtypes.AttributeValueMemberS)
+				want, wantOK := tt.want[name]
+				switch {
+				case ok != wantOK:
+					t.Errorf("%s stored = %v, want %v (%q)", name, ok, wantOK, *update.UpdateExpression)
+				case ok && got.Value != want:
+					t.Errorf("%s = %q, want %q", name, got.Value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessHTMLContentStoresOpenGraph(t *testing.T) {
+	var update *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			update = input
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+	body := `<html><head><meta property="og:title" content="Widgets"><meta name="twitter:card" content="summary"></head><body><p>Text</p></body></html>`
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", &FetchResult{ContentType: "text/html", Body: []byte(body)}, 0, claim{})
+
+	og, ok := update.ExpressionAttributeValues[":open_graph"].(*dynamodbtypes.AttributeValueMemberM)
+	if !ok {
+		t.Fatalf("open_graph not stored (%q)", *update.UpdateExpression)
+	}
+	for key, want := range map[string]string{"og:title": "Widgets", "twitter:card": "summary"} {
+		if got, ok := og.Value[key].(*dynamodbtypes.AttributeValueMemberS); !ok || got.Value != want {
+			t.Errorf("open_graph[%q] = %v, want %q", key, og.Value[key], want)
+		}
+	}
+}
+
+func TestOpenGraphAttr(t *testing.T) {
+	if got := openGraphAttr(nil); got != nil {
+		t.Errorf("openGraphAttr(nil) = %v, want nil", got)
+	}
+
+	props := make(map[string]string)
+	for i := range maxStoredOpenGraph + 5 {
+		props[fmt.Sprintf("twitter:p%02d", i)] = "t"
+	}
+	props["og:title"] = "Widgets"
+
+	m, ok := openGraphAttr(props).(*dynamodbtypes.AttributeValueMemberM)
+	if !ok {
+		t.Fatal("openGraphAttr() is not a map")
+	}
+	if len(m.Value) != maxStoredOpenGraph {
+		t.Errorf("stored %d properties, want %d", len(m.Value), maxStoredOpenGraph)
+	}
+	if _, ok := m.Value["og:title"]; !ok {
+		t.Error("og:title dropped; want og:* kept ahead of twitter:*")
+	}
+}
+
+func TestExtractCrawlDelay(t *testing.T) {
+	c := newTestCrawler()
+
+	tests := []struct {
+		name   string
+		attrs  map[string]events.SQSMessageAttribute
+		want   int
+		wantOK bool
+	}{
+		{"no attribute", nil, 0, false},
+		{"valid", map[string]events.SQSMessageAttribute{"crawl_delay_ms": {StringValue: aws.String("5000")}}, 5000, true},
+		{"zero disables the delay", map[string]events.SQSMessageAttribute{"crawl_delay_ms": {StringValue: aws.String("0")}}, 0, true},
+		{"negative", map[string]events.SQSMessageAttribute{"crawl_delay_ms": {StringValue: aws.String("-1")}}, 0, false},
+		{"not a number", map[string]events.SQSMessageAttribute{"crawl_delay_ms": {StringValue: aws.String("slow")}}, 0, false},
+		{"nil string value", map[string]events.SQSMessageAttribute{"crawl_delay_ms": {}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := c.extractCrawlDelay(&events.SQSMessage{MessageAttributes: tt.attrs})
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("extractCrawlDelay() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestExtractMaxDepth(t *testing.T) {
+	c := newTestCrawler()
+
+	tests := []struct {
+		name   string
+		attrs  map[string]events.SQSMessageAttribute
+		want   int
+		wantOK bool
+	}{
+		{"no attribute", nil, 0, false},
+		{"valid", map[string]events.SQSMessageAttribute{"max_depth": {StringValue: aws.String("5")}}, 5, true},
+		{"zero stops at the seed", map[string]events.SQSMessageAttribute{"max_depth": {StringValue: aws.String("0")}}, 0, true},
+		{"negative", map[string]events.SQSMessageAttribute{"max_depth": {StringValue: aws.String("-1")}}, 0, false},
+		{"not a number", map[string]events.SQSMessageAttribute{"max_depth": {StringValue: aws.String("deep")}}, 0, false},
+		{"nil string value", map[string]events.SQSMessageAttribute{"max_depth": {}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := c.extractMaxDepth(&events.SQSMessage{MessageAttributes: tt.attrs})
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("extractMaxDepth() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestProcessHTMLContentMaxDepthOverride(t *testing.T) {
+	tests := []struct {
+		name        string
+		global      int
+		override    int
+		hasOverride bool
+		depth       int
+		wantLinks   bool
+	}{
+		{"global allows", 3, 0, false, 1, true},
+		{"global stops", 1, 0, false, 1, false},
+		{"override stops before global", 3, 1, true, 1, false},
+		{"override reaches past global", 1, 3, true, 1, true},
+		{"override of zero stops at the seed", 3, 0, true, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []sqstypes.SendMessageBatchRequestEntry
+			sqsClient := &mockSQS{
+				sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+					sent = append(sent, input.Entries...)
+					return &sqs.SendMessageBatchOutput{}, nil
+				},
+			}
+			c := newTestCrawlerWithMocks(authItemDDB(nil), sqsClient, &mockS3{})
+			c.maxDepth = tt.global
+
+			ctx := context.Background()
+			if tt.hasOverride {
+				ctx = withMaxDepth(ctx, tt.override)
+			}
+			result := &FetchResult{ContentType: "text/html", Body: []byte(`<html><body><a href="https://example.com/link">Link</a></body></html>`)}
+			c.processHTMLContent(ctx, "https://example.com/", "hash", result, tt.depth, claim{})
+
+			if got := len(sent) > 0; got != tt.wantLinks {
+				t.Fatalf("links enqueued = %v, want %v", got, tt.wantLinks)
+			}
+			for _, e := range sent {
+				got, ok := e.MessageAttributes["max_depth"]
+				if ok != tt.hasOverride || (ok && *got.StringValue != strconv.Itoa(tt.override)) {
+					t.Errorf("child max_depth = %+v, want the override carried only when set", got)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractPriority(t *testing.T) {
+	c := newTestCrawler()
+
+	tests := []struct {
+		name  string
+		attrs map[string]events.SQSMessageAttribute
+		want  string
+	}{
+		{"no attribute", nil, priorityNormal},
+		{"high", map[string]events.SQSMessageAttribute{"priority": {StringValue: aws.String("high")}}, priorityHigh},
+		{"normal", map[string]events.SQSMessageAttribute{"priority": {StringValue: aws.String("normal")}}, priorityNormal},
+		{"unknown value", map[string]events.SQSMessageAttribute{"priority": {StringValue: aws.String("urgent")}}, priorityNormal},
+		{"nil string value", map[string]events.SQSMessageAttribute{"priority": {}}, priorityNormal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.extractPriority(&events.SQSMessage{MessageAttributes: tt.attrs})
+			if got != tt.want {
+				t.Errorf("extractPriority() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package awsx
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// retryableCodes are the API error codes worth another attempt: throttling and server-side
+// failures. ConditionalCheckFailedException is deliberately absent, since a failed condition
+// is a real answer (a lost race), not a transient fault.
+var retryableCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"RequestLimitExceeded":                   true,
+	"InternalServerError":                    true,
+	"ServiceUnavailable":                     true,
+}
+
+// Retry retries an AWS call on throttling and transient errors with exponential backoff and
+// full jitter: before retry n it waits a random duration up to BaseDelay * 2^(n-1), capped at MaxDelay.
+// The zero value makes a single attempt.
+type Retry struct {
+	Attempts  int           // Total tries, including the first
+	BaseDelay time.Duration // Backoff ceiling before the first retry, doubled per retry
+	MaxDelay  time.Duration // Cap on the backoff ceiling (0 = uncapped)
+}
+
+// Do calls fn until it succeeds, returns an error IsRetryable rejects, or Attempts run out,
+// and returns fn's last error. It stops early with ctx's error if ctx ends while waiting.
+func (r Retry) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	ceiling := r.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= r.Attempts || !IsRetryable(err) {
+			return err
+		}
+
+		var wait time.Duration
+		if ceiling > 0 {
+			wait = rand.N(ceiling) + 1
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		ceiling *= 2
+		if r.MaxDelay > 0 && ceiling > r.MaxDelay {
+			ceiling = r.MaxDelay
+		}
+	}
+}
+
+// IsRetryable reports whether err is a throttling or transient server error. It matches on the
+// error code (and HTTP status) the SDK attaches, so it works for any service client.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) {
+		return retryableCodes[apiErr.ErrorCode()]
+	}
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		return httpErr.HTTPStatusCode() >= 500
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package awsx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"throttled", &types.ProvisionedThroughputExceededException{}, true},
+		{"wrapped throttle", fmt.Errorf("update: %w", &types.ProvisionedThroughputExceededException{}), true},
+		{"request limit", &types.RequestLimitExceeded{}, true},
+		{"internal server error", &types.InternalServerError{}, true},
+		{"conditional check failed", &types.ConditionalCheckFailedException{}, false},
+		{"validation error", &types.ResourceNotFoundException{}, false},
+		{"plain error", errors.New("boom"), false},
+		{"context cancelled", context.Canceled, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoRetriesThrottling(t *testing.T) {
+	calls := 0
+	err := Retry{Attempts: 3, BaseDelay: time.Millisecond}.Do(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return &types.ProvisionedThroughputExceededException{}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Do() error = %v, want success on the third attempt", err)
+	}
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+}
+
+func TestDoGivesUpAfterAttempts(t *testing.T) {
+	calls := 0
+	err := Retry{Attempts: 2, BaseDelay: time.Millisecond}.Do(context.Background(), func(context.Context) error {
+		calls++
+		return &types.ProvisionedThroughputExceededException{}
+	})
+	var throttled *types.ProvisionedThroughputExceededException
+	if !errors.As(err, &throttled) {
+		t.Errorf("Do() error = %v, want the last throttling error", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestDoDoesNotRetryConditionalFailure(t *testing.T) {
+	calls := 0
+	err := Retry{Attempts: 5, BaseDelay: time.Millisecond}.Do(context.Background(), func(context.Context) error {
+		calls++
+		return &types.ConditionalCheckFailedException{}
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &condErr) {
+		t.Errorf("Do() error = %v, want the conditional check failure", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1 (a lost race is not retried)", calls)
+	}
+}
+
+func TestDoStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Retry{Attempts: 5, BaseDelay: time.Hour}.Do(ctx, func(context.Context) error {
+		calls++
+		cancel()
+		return &types.ProvisionedThroughputExceededException{}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() error = %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestDoZeroValueTriesOnce(t *testing.T) {
+	calls := 0
+	_ = Retry{}.Do(context.Background(), func(context.Context) error {
+		calls++
+		return &types.ProvisionedThroughputExceededException{}
+	})
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
@@ -0,0 +1,118 @@
+package catalog
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DomainIndexName is the GSI keyed by domain (PK) and finished_at (SK).
+// It is sparse: only fetched items that carry a domain attribute appear in it.
+const DomainIndexName = "domain-index"
+
+// QueryAPI is the subset of the DynamoDB client used for index queries
+type QueryAPI interface {
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// Page is a crawled URL item as returned by an index query
+type Page struct {
+	URLHash    string
+	URL        string
+	Status     string
+	FinishedAt string
+	HTTPStatus int
+}
+
+// Catalog queries URL items in the state table through its secondary indexes
+type Catalog struct {
+	client    QueryAPI
+	tableName string
+}
+
+// New returns a Catalog for the given table
+func New(client QueryAPI, tableName string) *Catalog {
+	return &Catalog{client: client, tableName: tableName}
+}
+
+// Domain returns the value stored in the domain attribute for a URL host.
+// Hosts are case-insensitive, so the attribute is always lowercase.
+func Domain(host string) string {
+	return strings.ToLower(host)
+}
+
+// QueryByDomain returns up to limit pages crawled for host, most recently finished first.
+// A limit of 0 returns every page. Items written before the domain attribute existed
+// are not in the index until they are fetched again.
+func (c *Catalog) QueryByDomain(ctx context.Context, host string, limit int) ([]Page, error) {
+	var pages []Page
+	var lastKey map[string]types.AttributeValue
+
+	for {
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - len(pages)
+		}
+
+		out, err := c.client.Query(ctx, domainQueryInput(c.tableName, host, remaining, lastKey))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			pages = append(pages, parsePage(item))
+		}
+
+		if out.LastEvaluatedKey == nil || (limit > 0 && len(pages) >= limit) {
+			return pages, nil
+		}
+		lastKey = out.LastEvaluatedKey
+	}
+}
+
+// domainQueryInput builds one page of the domain index query.
+// limit 0 leaves the page size to DynamoDB (1MB per page).
+func domainQueryInput(tableName, host string, limit int, startKey map[string]types.AttributeValue) *dynamodb.QueryInput {
+	input := &dynamodb.QueryInput{
+		TableName:              &tableName,
+		IndexName:              aws.String(DomainIndexName),
+		KeyConditionExpression: aws.String("#d = :domain"),
+		ExpressionAttributeNames: map[string]string{
+			"#d": "domain",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":domain": &types.AttributeValueMemberS{Value: Domain(host)},
+		},
+		ScanIndexForward:  aws.Bool(false), // Newest finished_at first
+		ExclusiveStartKey: startKey,
+	}
+	if limit > 0 {
+		input.Limit = aws.Int32(int32(limit))
+	}
+	return input
+}
+
+// parsePage reads the known attributes of an item, leaving missing ones empty
+func parsePage(item map[string]types.AttributeValue) Page {
+	str := func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+
+	page := Page{
+		URLHash:    str("url_hash"),
+		URL:        str("url"),
+		Status:     str("status"),
+		FinishedAt: str("finished_at"),
+	}
+	if v, ok := item["http_status"].(*types.AttributeValueMemberN); ok {
+		page.HTTPStatus, _ = strconv.Atoi(v.Value)
+	}
+	return page
+}
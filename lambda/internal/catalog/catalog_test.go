@@ -0,0 +1,175 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeQuery serves pre-built result pages in order and records each request
+type fakeQuery struct {
+	pages  [][]map[string]types.AttributeValue
+	inputs []*dynamodb.QueryInput
+}
+
+func (f *fakeQuery) Query(_ context.Context, params *dynamodb.QueryInput, _ ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	n := len(f.inputs)
+	f.inputs = append(f.inputs, params)
+
+	items := f.pages[n]
+	if params.Limit != nil && int(*params.Limit) < len(items) {
+		items = items[:*params.Limit]
+	}
+	out := &dynamodb.QueryOutput{Items: items}
+	if n < len(f.pages)-1 {
+		out.LastEvaluatedKey = map[string]types.AttributeValue{
+			"url_hash": &types.AttributeValueMemberS{Value: fmt.Sprintf("page%d", n)},
+		}
+	}
+	return out, nil
+}
+
+func item(hash string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"url_hash": &types.AttributeValueMemberS{Value: hash},
+		"url":      &types.AttributeValueMemberS{Value: "https://example.com/" + hash},
+	}
+}
+
+func TestDomainQueryInput(t *testing.T) {
+	startKey := map[string]types.AttributeValue{"url_hash": &types.AttributeValueMemberS{Value: "k"}}
+	in := domainQueryInput("test-table", "Example.COM", 25, startKey)
+
+	if *in.TableName != "test-table" || *in.IndexName != DomainIndexName {
+		t.Errorf("table/index = %q/%q", *in.TableName, *in.IndexName)
+	}
+	if *in.KeyConditionExpression != "#d = :domain" || in.ExpressionAttributeNames["#d"] != "domain" {
+		t.Errorf("key condition = %q %v", *in.KeyConditionExpression, in.ExpressionAttributeNames)
+	}
+	if got := in.ExpressionAttributeValues[":domain"].(*types.AttributeValueMemberS).Value; got != "example.com" {
+		t.Errorf(":domain = %q, want lowercase example.com", got)
+	}
+	if in.Limit == nil || *in.Limit != 25 {
+		t.Errorf("Limit = %v, want 25", in.Limit)
+	}
+	if in.ScanIndexForward == nil || *in.ScanIndexForward {
+		t.Error("expected newest-first ordering (ScanIndexForward = false)")
+	}
+	if in.ExclusiveStartKey["url_hash"].(*types.AttributeValueMemberS).Value != "k" {
+		t.Error("ExclusiveStartKey not passed through")
+	}
+
+	if unlimited := domainQueryInput("t", "example.com", 0, nil); unlimited.Limit != nil {
+		t.Errorf("Limit = %d, want unset for limit 0", *unlimited.Limit)
+	}
+}
+
+func TestQueryByDomainPaginates(t *testing.T) {
+	tests := []struct {
+		name       string
+		pages      [][]map[string]types.AttributeValue
+		limit      int
+		wantHashes string
+		wantLimits string
+		wantStarts string
+	}{
+		{
+			name:       "follows every page when unlimited",
+			pages:      [][]map[string]types.AttributeValue{{item("a"), item("b")}, {item("c")}, {item("d")}},
+			limit:      0,
+			wantHashes: "[a b c d]",
+			wantLimits: "[0 0 0]",
+			wantStarts: "[ page0 page1]",
+		},
+		{
+			name:       "shrinks page size to what is left of the limit",
+			pages:      [][]map[string]types.AttributeValue{{item("a"), item("b")}, {item("c"), item("d")}, {item("e")}},
+			limit:      3,
+			wantHashes: "[a b c]",
+			wantLimits: "[3 1]",
+			wantStarts: "[ page0]",
+		},
+		{
+			name:       "stops when the first page fills the limit",
+			pages:      [][]map[string]types.AttributeValue{{item("a"), item("b")}, {item("c")}},
+			limit:      2,
+			wantHashes: "[a b]",
+			wantLimits: "[2]",
+			wantStarts: "[]",
+		},
+		{
+			name:       "empty result",
+			pages:      [][]map[string]types.AttributeValue{{}},
+			limit:      10,
+			wantHashes: "[]",
+			wantLimits: "[10]",
+			wantStarts: "[]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeQuery{pages: tt.pages}
+			got, err := New(fake, "test-table").QueryByDomain(context.Background(), "example.com", tt.limit)
+			if err != nil {
+				t.Fatalf("QueryByDomain() error = %v", err)
+			}
+
+			hashes := []string{}
+			for _, p := range got {
+				hashes = append(hashes, p.URLHash)
+			}
+			var limits []int32
+			var starts []string
+			for _, in := range fake.inputs {
+				l := int32(0)
+				if in.Limit != nil {
+					l = *in.Limit
+				}
+				limits = append(limits, l)
+				if in.ExclusiveStartKey == nil {
+					starts = append(starts, "")
+				} else {
+					starts = append(starts, in.ExclusiveStartKey["url_hash"].(*types.AttributeValueMemberS).Value)
+				}
+			}
+
+			if fmt.Sprint(hashes) != tt.wantHashes {
+				t.Errorf("pages = %v, want %s", hashes, tt.wantHashes)
+			}
+			if fmt.Sprint(limits) != tt.wantLimits {
+				t.Errorf("request limits = %v, want %s", limits, tt.wantLimits)
+			}
+			if fmt.Sprint(starts) != tt.wantStarts {
+				t.Errorf("start keys = %q, want %s", starts, tt.wantStarts)
+			}
+		})
+	}
+}
+
+func TestQueryByDomainError(t *testing.T) {
+	c := New(errQuery{}, "test-table")
+	if _, err := c.QueryByDomain(context.Background(), "example.com", 10); err == nil {
+		t.Fatal("QueryByDomain() expected error, got nil")
+	}
+}
+
+type errQuery struct{}
+
+func (errQuery) Query(context.Context, *dynamodb.QueryInput, ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return nil, fmt.Errorf("throttled")
+}
+
+func TestParsePageToleratesMissingAttributes(t *testing.T) {
+	got := parsePage(map[string]types.AttributeValue{
+		"url_hash":    &types.AttributeValueMemberS{Value: "abc"},
+		"http_status": &types.AttributeValueMemberN{Value: "200"},
+	})
+	want := Page{URLHash: "abc", HTTPStatus: 200}
+	if got != want {
+		t.Errorf("parsePage() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,74 @@
+package dedup
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Threshold is the largest Hamming distance at which two fingerprints count as near-duplicates.
+	// Unrelated texts differ in about 32 bits (binomially, sd 4), so 10 leaves a wide margin while
+	// still matching short pages that differ by a few words.
+	Threshold = 10
+
+	shingleWords = 2     // Words per shingle; longer shingles make word order matter more but move further per edit
+	maxWords     = 20000 // Only the first maxWords words are fingerprinted to bound the work per page
+)
+
+// SimHash returns a 64-bit fingerprint of text's overlapping word shingles. Texts that share most
+// of their shingles get fingerprints that differ in few bits, so a small edit (a date, a counter)
+// moves the fingerprint a short Hamming distance while unrelated texts land about 32 bits apart.
+// Words are lowercased and split on anything that is not a letter or digit. Text with no words
+// fingerprints to 0.
+func SimHash(text string) uint64 {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return 0
+	}
+	if len(words) > maxWords {
+		words = words[:maxWords]
+	}
+
+	var weights [64]int
+	h := fnv.New64a()
+	n := max(len(words)-shingleWords+1, 1)
+	for i := range n {
+		h.Reset()
+		for j, w := range words[i:min(i+shingleWords, len(words))] {
+			if j > 0 {
+				_, _ = h.Write([]byte{' '})
+			}
+			_, _ = h.Write([]byte(w))
+		}
+		sum := h.Sum64()
+		for b := range weights {
+			if sum&(1<<b) != 0 {
+				weights[b]++
+			} else {
+				weights[b]--
+			}
+		}
+	}
+
+	var fp uint64
+	for b, w := range weights {
+		if w > 0 {
+			fp |= 1 << b
+		}
+	}
+	return fp
+}
+
+// Distance returns the Hamming distance between two fingerprints: the number of differing bits.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Similar reports whether two fingerprints are within Threshold bits of each other.
+func Similar(a, b uint64) bool {
+	return Distance(a, b) <= Threshold
+}
@@ -0,0 +1,67 @@
+package dedup
+
+import "testing"
+
+const report = "Annual report of the harbour authority. The harbour handled more cargo this year than in any " +
+	"previous year, with container traffic rising sharply while bulk grain shipments held steady. New cranes " +
+	"on the east quay shortened turnaround times, and the dredging of the outer channel let larger vessels " +
+	"call without waiting for the tide. Published on 12 March 2024 by the press office."
+
+func TestSimHashIdentical(t *testing.T) {
+	if got := Distance(SimHash(report), SimHash(report)); got != 0 {
+		t.Errorf("Distance() of identical text = %d, want 0", got)
+	}
+	// Case, punctuation and spacing are not part of the fingerprint
+	if got := Distance(SimHash(report), SimHash("  ANNUAL report, of the harbour authority!! "+report[len("Annual report of the harbour authority."):])); got != 0 {
+		t.Errorf("Distance() after reformatting = %d, want 0", got)
+	}
+}
+
+func TestSimHashSmallEdit(t *testing.T) {
+	edited := report[:len(report)-len("12 March 2024 by the press office.")] + "19 April 2025 by the press office."
+	a, b := SimHash(report), SimHash(edited)
+	if got := Distance(a, b); got == 0 || got > Threshold {
+		t.Errorf("Distance() after changing the date = %d, want in (0, %d]", got, Threshold)
+	}
+	if !Similar(a, b) {
+		t.Error("Similar() = false for a page differing only by its date")
+	}
+}
+
+func TestSimHashUnrelated(t *testing.T) {
+	recipe := "Preheat the oven and butter a deep tin. Whisk the eggs with sugar until pale, fold in the flour " +
+		"and a pinch of salt, then pour the batter into the tin and bake until a skewer comes out clean. " +
+		"Let it cool before slicing and serve with cream."
+	a, b := SimHash(report), SimHash(recipe)
+	if got := Distance(a, b); got <= 2*Threshold {
+		t.Errorf("Distance() of unrelated text = %d, want more than %d", got, 2*Threshold)
+	}
+	if Similar(a, b) {
+		t.Error("Similar() = true for unrelated text")
+	}
+}
+
+func TestSimHashShortText(t *testing.T) {
+	if got := SimHash(" ... "); got != 0 {
+		t.Errorf("SimHash() of text without words = %#x, want 0", got)
+	}
+	if SimHash("hello") == 0 {
+		t.Error("SimHash() of a single word = 0, want a fingerprint")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0b1011, 0b0001, 2},
+		{0, ^uint64(0), 64},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%#x, %#x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
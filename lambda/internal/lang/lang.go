@@ -0,0 +1,71 @@
+package lang
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// Undetermined is returned when the text is too short or has no recognizable stop words
+	Undetermined = "und"
+
+	minWords  = 4    // Fewer words than this is too little signal to guess
+	maxWords  = 1000 // Only the first maxWords words are scored to keep detection cheap
+	minScored = 2    // Best language must match at least this many stop words
+)
+
+// stopWords maps ISO 639-1 codes to high-frequency function words for that language.
+var stopWords = map[string]map[string]bool{
+	"en": set("the", "and", "of", "to", "is", "that", "it", "was", "for", "with", "as", "on", "are",
+		"this", "be", "at", "by", "have", "from", "not", "but", "or", "which", "you", "they", "we", "his", "her", "a", "an"),
+	"fr": set("le", "la", "les", "de", "des", "et", "est", "un", "une", "du", "que", "qui", "dans", "pour",
+		"pas", "sur", "au", "avec", "il", "elle", "ce", "sont", "nous", "vous", "ne", "se", "plus", "par", "aux", "été"),
+	"de": set("der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "den", "von", "mit", "sich", "des",
+		"auf", "für", "im", "dem", "es", "auch", "als", "wird", "sind", "werden", "bei", "oder", "ich", "wir", "sie", "über"),
+	"es": set("el", "los", "las", "y", "en", "una", "es", "por", "con", "para", "no", "del", "al", "lo", "como",
+		"más", "pero", "sus", "son", "está", "muy", "también", "fue", "hay", "esta", "este"),
+}
+
+func set(words ...string) map[string]bool {
+	m := make(map[string]bool, len(words))
+	for _, w := range words {
+		m[w] = true
+	}
+	return m
+}
+
+// Detect guesses the language of text by counting stop-word hits per language.
+// Confidence is the winning language's share of all stop-word hits, in [0, 1].
+func Detect(text string) (code string, confidence float64) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(words) < minWords {
+		return Undetermined, 0
+	}
+	if len(words) > maxWords {
+		words = words[:maxWords]
+	}
+
+	scores := make(map[string]int, len(stopWords))
+	total := 0
+	for _, w := range words {
+		for code, sw := range stopWords {
+			if sw[w] {
+				scores[code]++
+				total++
+			}
+		}
+	}
+
+	best, bestScore := Undetermined, 0
+	for code, score := range scores {
+		if score > bestScore || (score == bestScore && code < best) {
+			best, bestScore = code, score
+		}
+	}
+	if bestScore < minScored {
+		return Undetermined, 0
+	}
+	return best, float64(bestScore) / float64(total)
+}
@@ -0,0 +1,63 @@
+package lang
+
+import "testing"
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"english", "The quick brown fox jumps over the lazy dog and runs into the forest with his friends.", "en"},
+		{"french", "Le chat est sur la table et il regarde les oiseaux dans le jardin avec une grande attention.", "fr"},
+		{"german", "Der Hund ist nicht im Haus, sondern er spielt mit den Kindern auf der Straße und das ist gut.", "de"},
+		{"spanish", "El perro está en la casa y los niños juegan con él en el jardín porque hace muy buen tiempo.", "es"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, confidence := Detect(tt.text)
+			if got != tt.want {
+				t.Errorf("Detect() = %q, want %q", got, tt.want)
+			}
+			if confidence <= 0 || confidence > 1 {
+				t.Errorf("Detect() confidence = %f, want in (0, 1]", confidence)
+			}
+		})
+	}
+}
+
+func TestDetectUndetermined(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty", ""},
+		{"very short", "Hello there"},
+		{"no stop words", "Login Register Dashboard Settings Profile"},
+		{"numbers only", "123 456 789 1011 1213"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, confidence := Detect(tt.text)
+			if got != Undetermined {
+				t.Errorf("Detect(%q) = %q, want %q", tt.text, got, Undetermined)
+			}
+			if confidence != 0 {
+				t.Errorf("Detect(%q) confidence = %f, want 0", tt.text, confidence)
+			}
+		})
+	}
+}
+
+// BenchmarkDetect measures detection on a typical page-sized text
+func BenchmarkDetect(b *testing.B) {
+	text := ""
+	for range 200 {
+		text += "The crawler fetches the page and extracts all of the links that it can find. "
+	}
+	for b.Loop() {
+		Detect(text)
+	}
+}
@@ -2,9 +2,11 @@ package parser
 
 import (
 	"bytes"
-	"lambda/internal/urls"
+	"lambda/urls"
 	"net/url"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
 )
@@ -60,7 +62,7 @@ func extractText(body []byte) string {
 		// Skip non-visible elements
 		if n.Type == html.ElementNode {
 			switch n.Data {
-			case "script", "style", "noscript", "head", "meta", "link":
+			case "script", "style", "noscript", "head", "meta", "link", "template", "svg":
 				return
 			}
 		}
@@ -86,10 +88,28 @@ func extractText(body []byte) string {
 	return sb.String()
 }
 
+const (
+	maxMetadataLength      = 1024 // Byte cap on Title, Description, H1 and OpenGraph values so a hostile page cannot bloat the item
+	maxOpenGraphProperties = 32   // Distinct og:* and twitter:* properties kept per page
+)
+
 // Result holds both extracted links and text from a single HTML parse pass.
+// Redirect is the target of a zero-delay <meta http-equiv="refresh">; it is also included in Links.
+// Title, Description (<meta name="description">) and H1 (the first <h1>) are empty when absent.
+// OpenGraph maps the lowercased keys of <meta property="og:*"> and <meta name="twitter:*"> tags to
+// their content (the first tag wins for a repeated key); it is nil when the page has none.
+// RobotsMeta holds the content of each <meta name="robots"> tag, for ParseRobots.
+// Sitemap is SitemapIndex or SitemapURLSet when ExtractXML parsed a sitemap, else empty.
 type Result struct {
-	Links []string
-	Text  string
+	Links       []string
+	Text        string
+	Redirect    string
+	Title       string
+	Description string
+	H1          string
+	OpenGraph   map[string]string
+	RobotsMeta  []string
+	Sitemap     string
 }
 
 // Extract parses HTML once, extracting both links and visible text in a single traversal.
@@ -106,27 +126,74 @@ func Extract(body []byte, baseURLStr string) Result {
 	}
 
 	var links []string
+	var redirect, title, description, h1 string
+	var openGraph map[string]string
+	var robotsMeta []string
 	seen := make(map[string]bool)
 	var sb strings.Builder
 
-	var traverse func(*html.Node)
-	traverse = func(n *html.Node) {
+	addLink := func(raw string) string {
+		link := urls.Normalize(raw, baseURL)
+		if link != "" && !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+		return link
+	}
+
+	// hidden is set inside <head>, <template> and <svg>: their text is not page content, but <head>'s
+	// <title> and <meta> tags are still read and links inside a template or an SVG still count
+	var traverse func(*html.Node, bool)
+	traverse = func(n *html.Node, hidden bool) {
 		if n.Type == html.ElementNode {
+			// Metadata is read before the visibility check below, since <title> and <meta> live in <head>
+			switch n.Data {
+			case "meta":
+				// A zero-delay refresh is a client-side redirect; only the first one counts
+				if redirect == "" {
+					if target, ok := refreshTarget(n); ok {
+						redirect = addLink(target)
+					}
+				}
+				if description == "" && strings.EqualFold(attrValue(n, "name"), "description") {
+					description = Truncate(collapseSpace(attrValue(n, "content")), maxMetadataLength)
+				}
+				if strings.EqualFold(strings.TrimSpace(attrValue(n, "name")), "robots") {
+					robotsMeta = append(robotsMeta, attrValue(n, "content"))
+				}
+				if key, ok := socialProperty(n); ok && len(openGraph) < maxOpenGraphProperties {
+					if _, dup := openGraph[key]; !dup {
+						if content := Truncate(collapseSpace(attrValue(n, "content")), maxMetadataLength); content != "" {
+							if openGraph == nil {
+								openGraph = make(map[string]string)
+							}
+							openGraph[key] = content
+						}
+					}
+				}
+			case "title":
+				if title == "" && n.Namespace == "" { // not an SVG <title> tooltip
+					title = Truncate(nodeText(n), maxMetadataLength)
+				}
+			case "h1":
+				if h1 == "" {
+					h1 = Truncate(nodeText(n), maxMetadataLength)
+				}
+			}
+
 			// Skip non-visible elements for text extraction
 			switch n.Data {
-			case "script", "style", "noscript", "head", "meta", "link":
+			case "script", "style", "noscript", "meta", "link":
 				return
+			case "head", "template", "svg":
+				hidden = true
 			}
 
 			// Extract links from <a> elements
 			if n.Data == "a" {
 				for _, attr := range n.Attr {
 					if attr.Key == "href" {
-						link := urls.Normalize(attr.Val, baseURL)
-						if link != "" && !seen[link] {
-							seen[link] = true
-							links = append(links, link)
-						}
+						addLink(attr.Val)
 						break
 					}
 				}
@@ -134,7 +201,7 @@ func Extract(body []byte, baseURLStr string) Result {
 		}
 
 		// Extract text nodes
-		if n.Type == html.TextNode {
+		if n.Type == html.TextNode && !hidden {
 			text := strings.TrimSpace(n.Data)
 			if text != "" {
 				if sb.Len() > 0 {
@@ -145,12 +212,102 @@ func Extract(body []byte, baseURLStr string) Result {
 		}
 
 		for child := n.FirstChild; child != nil; child = child.NextSibling {
-			traverse(child)
+			traverse(child, hidden)
 		}
 	}
-	traverse(doc)
+	traverse(doc, false)
+
+	return Result{Links: links, Text: sb.String(), Redirect: redirect, Title: title, Description: description, H1: h1, OpenGraph: openGraph, RobotsMeta: robotsMeta}
+}
 
-	return Result{Links: links, Text: sb.String()}
+// attrValue returns the value of n's attribute key, or "" when it has none
+func attrValue(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// socialProperty returns the lowercased key of an Open Graph (<meta property="og:...">) or
+// Twitter Card (<meta name="twitter:...">) tag
+func socialProperty(n *html.Node) (string, bool) {
+	if key := strings.ToLower(strings.TrimSpace(attrValue(n, "property"))); len(key) > len("og:") && strings.HasPrefix(key, "og:") {
+		return Truncate(key, maxMetadataLength), true
+	}
+	if key := strings.ToLower(strings.TrimSpace(attrValue(n, "name"))); len(key) > len("twitter:") && strings.HasPrefix(key, "twitter:") {
+		return Truncate(key, maxMetadataLength), true
+	}
+	return "", false
+}
+
+// nodeText joins the text beneath n, skipping scripts and styles, with whitespace collapsed
+func nodeText(n *html.Node) string {
+	var parts []string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style") {
+			return
+		}
+		if n.Type == html.TextNode {
+			parts = append(parts, n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return collapseSpace(strings.Join(parts, " "))
+}
+
+// collapseSpace trims s and reduces each run of whitespace to a single space
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Truncate cuts s to at most limit bytes without splitting a UTF-8 sequence, so free-form text
+// from pages, servers and transport errors cannot bloat an item toward the 400KB limit.
+// limit <= 0 keeps s whole.
+func Truncate(s string, limit int) string {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// refreshTarget returns the URL of a <meta http-equiv="refresh"> tag whose delay is 0.
+// Accepts the usual content forms: "0;url=/next", "0; URL='/next'", "0, /next".
+// Longer delays are informational and malformed content is ignored.
+func refreshTarget(n *html.Node) (string, bool) {
+	if !strings.EqualFold(strings.TrimSpace(attrValue(n, "http-equiv")), "refresh") {
+		return "", false
+	}
+	content := attrValue(n, "content")
+
+	delay, target, found := strings.Cut(content, ";")
+	if !found {
+		delay, target, found = strings.Cut(content, ",")
+	}
+	if !found {
+		return "", false
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(delay)); err != nil || seconds != 0 {
+		return "", false
+	}
+
+	target = strings.TrimSpace(target)
+	if len(target) >= 4 && strings.EqualFold(target[:3], "url") {
+		if rest := strings.TrimSpace(target[3:]); strings.HasPrefix(rest, "=") {
+			target = strings.TrimSpace(rest[1:])
+		}
+	}
+	target = strings.Trim(target, `"'`)
+	return target, target != ""
 }
 
 // IsHTML checks if content type indicates HTML
@@ -1,7 +1,11 @@
 package parser
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestExtractLinks(t *testing.T) {
@@ -232,6 +236,264 @@ func TestParseAndExtract(t *testing.T) {
 	}
 }
 
+func TestExtractMetaRefresh(t *testing.T) {
+	tests := []struct {
+		name         string
+		meta         string
+		wantRedirect string
+		wantLinks    []string
+	}{
+		{
+			name:         "zero delay is a redirect",
+			meta:         `<meta http-equiv="refresh" content="0;url=/new-home">`,
+			wantRedirect: "https://example.com/new-home",
+			wantLinks:    []string{"https://example.com/new-home", "https://example.com/a"},
+		},
+		{
+			name:         "quoted url with spaces and mixed case",
+			meta:         `<meta http-equiv="Refresh" content="0; URL='https://other.com/landing#top'">`,
+			wantRedirect: "https://other.com/landing",
+			wantLinks:    []string{"https://other.com/landing", "https://example.com/a"},
+		},
+		{
+			name:         "url without url= prefix",
+			meta:         `<meta http-equiv="refresh" content="0, /moved">`,
+			wantRedirect: "https://example.com/moved",
+			wantLinks:    []string{"https://example.com/moved", "https://example.com/a"},
+		},
+		{
+			name:      "non-zero delay is informational",
+			meta:      `<meta http-equiv="refresh" content="5;url=/later">`,
+			wantLinks: []string{"https://example.com/a"},
+		},
+		{
+			name:      "reload without url",
+			meta:      `<meta http-equiv="refresh" content="0">`,
+			wantLinks: []string{"https://example.com/a"},
+		},
+		{
+			name:      "malformed delay",
+			meta:      `<meta http-equiv="refresh" content="soon;url=/x">`,
+			wantLinks: []string{"https://example.com/a"},
+		},
+		{
+			name:      "empty url",
+			meta:      `<meta http-equiv="refresh" content="0;url=">`,
+			wantLinks: []string{"https://example.com/a"},
+		},
+		{
+			name:      "other http-equiv ignored",
+			meta:      `<meta http-equiv="content-type" content="0;url=/x">`,
+			wantLinks: []string{"https://example.com/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := `<html><head><title>Moved</title>` + tt.meta + `</head><body><a href="/a">A</a></body></html>`
+			result := Extract([]byte(page), "https://example.com/old")
+
+			if result.Redirect != tt.wantRedirect {
+				t.Errorf("Redirect = %q, want %q", result.Redirect, tt.wantRedirect)
+			}
+			if strings.Join(result.Links, " ") != strings.Join(tt.wantLinks, " ") {
+				t.Errorf("Links = %v, want %v", result.Links, tt.wantLinks)
+			}
+			if result.Text != "A" {
+				t.Errorf("Text = %q, want %q", result.Text, "A")
+			}
+		})
+	}
+}
+
+func TestExtractMetadata(t *testing.T) {
+	tests := []struct {
+		name            string
+		html            string
+		wantTitle       string
+		wantDescription string
+		wantH1          string
+		wantText        string
+	}{
+		{
+			name: "all fields present",
+			html: `<html><head><title> Widgets
+				&amp; Gadgets </title><meta name="description" content="  Everything about   widgets. "></head>
+				<body><h1>Welcome <em>home</em></h1><h1>Second heading</h1><p>Body</p></body></html>`,
+			wantTitle:       "Widgets & Gadgets",
+			wantDescription: "Everything about widgets.",
+			wantH1:          "Welcome home",
+			wantText:        "Welcome home Second heading Body",
+		},
+		{
+			name:     "missing tags yield empty strings",
+			html:     `<html><head></head><body><h2>Sub</h2><p>Body</p></body></html>`,
+			wantText: "Sub Body",
+		},
+		{
+			name:            "meta name is case-insensitive",
+			html:            `<html><head><meta name="Description" content="Mixed case"></head><body></body></html>`,
+			wantDescription: "Mixed case",
+		},
+		{
+			name:     "other meta names ignored",
+			html:     `<html><head><meta name="keywords" content="a, b"><meta property="og:description" content="og"></head><body></body></html>`,
+			wantText: "",
+		},
+		{
+			name:      "svg title does not override the page title",
+			html:      `<html><head></head><body><svg><title>Icon</title></svg><p>Body</p></body></html>`,
+			wantTitle: "",
+			wantText:  "Body",
+		},
+		{
+			name:     "empty h1 yields empty string",
+			html:     `<html><body><h1>  </h1><p>Body</p></body></html>`,
+			wantText: "Body",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Extract([]byte(tt.html), "https://example.com")
+			if result.Title != tt.wantTitle {
+				t.Errorf("Title = %q, want %q", result.Title, tt.wantTitle)
+			}
+			if result.Description != tt.wantDescription {
+				t.Errorf("Description = %q, want %q", result.Description, tt.wantDescription)
+			}
+			if result.H1 != tt.wantH1 {
+				t.Errorf("H1 = %q, want %q", result.H1, tt.wantH1)
+			}
+			if result.Text != tt.wantText {
+				t.Errorf("Text = %q, want %q", result.Text, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestExtractSkipsTemplateAndSVGText(t *testing.T) {
+	body := []byte(`<html><body>
+		<p>Visible</p>
+		<template id="row"><tr><td>Template cell</td><a href="/from-template">T</a></tr></template>
+		<svg viewBox="0 0 10 10"><text>Chart label</text><a href="/from-svg"><circle r="1"/></a></svg>
+		<p>After</p>
+	</body></html>`)
+
+	result := Extract(body, "https://example.com/")
+	if result.Text != "Visible After" {
+		t.Errorf("Text = %q, want %q", result.Text, "Visible After")
+	}
+	if len(result.Links) != 2 {
+		t.Errorf("Links = %v, want the template and SVG links kept", result.Links)
+	}
+	if got := extractText(body); got != "Visible After" {
+		t.Errorf("extractText() = %q, want %q", got, "Visible After")
+	}
+}
+
+func TestExtractDecodesEntities(t *testing.T) {
+	result := Extract([]byte(`<html><head><title>Tom &amp; Jerry</title>
+		<meta name="description" content="Caf&eacute; &#169; 2024"></head>
+		<body><h1>Q&amp;A</h1><p>5 &lt; 6 &#x2014; &quot;quoted&quot;&nbsp;text</p></body></html>`), "https://example.com/")
+
+	if result.Title != "Tom & Jerry" {
+		t.Errorf("Title = %q", result.Title)
+	}
+	if result.Description != "Café © 2024" {
+		t.Errorf("Description = %q", result.Description)
+	}
+	if result.H1 != "Q&A" {
+		t.Errorf("H1 = %q", result.H1)
+	}
+	if want := "Q&A 5 < 6 — \"quoted\" text"; result.Text != want {
+		t.Errorf("Text = %q, want %q", result.Text, want)
+	}
+}
+
+func TestExtractMetadataTruncated(t *testing.T) {
+	long := strings.Repeat("é", maxMetadataLength) // 2 bytes per rune
+	result := Extract([]byte(`<html><head><title>`+long+`</title></head><body><h1>`+long+`</h1></body></html>`), "https://example.com")
+
+	for name, got := range map[string]string{"Title": result.Title, "H1": result.H1} {
+		if len(got) != maxMetadataLength {
+			t.Errorf("%s length = %d, want %d", name, len(got), maxMetadataLength)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s was cut mid-rune", name)
+		}
+	}
+}
+
+func TestExtractOpenGraph(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want map[string]string
+	}{
+		{
+			name: "og and twitter tags",
+			html: `<html><head>
+				<meta property="og:title" content="Widgets">
+				<meta property="OG:Description" content="  All about   widgets ">
+				<meta property="og:image" content="https://example.com/w.png">
+				<meta property="og:image" content="https://example.com/second.png">
+				<meta name="twitter:card" content="summary_large_image">
+				<meta name="twitter:site" content="@widgets">
+				</head><body><p>Body</p></body></html>`,
+			want: map[string]string{
+				"og:title":       "Widgets",
+				"og:description": "All about widgets",
+				"og:image":       "https://example.com/w.png",
+				"twitter:card":   "summary_large_image",
+				"twitter:site":   "@widgets",
+			},
+		},
+		{
+			name: "no social tags",
+			html: `<html><head><title>Plain</title><meta name="description" content="Nothing social"></head><body></body></html>`,
+			want: nil,
+		},
+		{
+			name: "wrong attribute, empty content and bare prefixes ignored",
+			html: `<html><head>
+				<meta name="og:title" content="name is not property">
+				<meta property="twitter:card" content="property is not name">
+				<meta property="og:type" content="  ">
+				<meta property="og:" content="no key">
+				<meta property="og:url" content="https://example.com/">
+				</head><body></body></html>`,
+			want: map[string]string{"og:url": "https://example.com/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Extract([]byte(tt.html), "https://example.com")
+			if !reflect.DeepEqual(result.OpenGraph, tt.want) {
+				t.Errorf("OpenGraph = %v, want %v", result.OpenGraph, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractOpenGraphCapped(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("<html><head>")
+	for i := range maxOpenGraphProperties + 10 {
+		fmt.Fprintf(&sb, `<meta property="og:custom%d" content="v">`, i)
+	}
+	sb.WriteString("</head><body></body></html>")
+
+	result := Extract([]byte(sb.String()), "https://example.com")
+	if len(result.OpenGraph) != maxOpenGraphProperties {
+		t.Errorf("len(OpenGraph) = %d, want %d", len(result.OpenGraph), maxOpenGraphProperties)
+	}
+	if _, ok := result.OpenGraph["og:custom0"]; !ok {
+		t.Error("first property dropped; want the earliest tags kept")
+	}
+}
+
 func TestParseAndExtractMatchesSeparateFunctions(t *testing.T) {
 	html := `<html><head><title>Test</title></head><body>
 		<h1>Welcome</h1>
@@ -284,3 +546,22 @@ func TestIsHTML(t *testing.T) {
 		})
 	}
 }
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s     string
+		limit int
+		want  string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"too long", 3, "too"},
+		{"naïve", 3, "na"}, // ï is two bytes starting at offset 2
+		{"uncapped", 0, "uncapped"},
+	}
+	for _, tt := range tests {
+		if got := Truncate(tt.s, tt.limit); got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.s, tt.limit, got, tt.want)
+		}
+	}
+}
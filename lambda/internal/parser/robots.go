@@ -0,0 +1,83 @@
+package parser
+
+import "strings"
+
+// Robots holds the indexing directives that apply to a crawler, from X-Robots-Tag headers and
+// <meta name="robots"> tags
+type Robots struct {
+	NoIndex  bool // Do not store the page's text
+	NoFollow bool // Do not follow the page's links
+}
+
+// valuedDirectives take a value after a colon, so "max-snippet: 20" is not read as an agent name
+var valuedDirectives = map[string]bool{
+	"max-snippet":       true,
+	"max-image-preview": true,
+	"max-video-preview": true,
+	"unavailable_after": true,
+}
+
+// RobotsDirectives are the directives of one X-Robots-Tag header value or robots meta tag content:
+// those for every crawler, and those scoped by an "agent: directive" entry, by lowercased agent
+type RobotsDirectives struct {
+	All    Robots
+	Agents map[string]Robots
+}
+
+// For returns the directives that apply to agent: the unscoped ones plus any scoped to it
+func (d RobotsDirectives) For(agent string) Robots {
+	scoped := d.Agents[strings.ToLower(agent)]
+	return Robots{NoIndex: d.All.NoIndex || scoped.NoIndex, NoFollow: d.All.NoFollow || scoped.NoFollow}
+}
+
+// parseRobotsDirectives parses one directive list, an X-Robots-Tag header value or a robots meta
+// tag's content. Directives are comma-separated and case-insensitive, surrounding whitespace is
+// ignored, and "none" means noindex and nofollow; unknown directives are skipped. An
+// "agent: directive" entry scopes it and the directives after it to that crawler
+// ("googlebot: noindex, nofollow").
+func parseRobotsDirectives(s string) RobotsDirectives {
+	var d RobotsDirectives
+	scope := ""
+	for _, directive := range strings.Split(s, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if name, rest, found := strings.Cut(directive, ":"); found && !valuedDirectives[strings.TrimSpace(name)] {
+			scope, directive = strings.TrimSpace(name), strings.TrimSpace(rest)
+		}
+		r := d.All
+		if scope != "" {
+			r = d.Agents[scope]
+		}
+		switch directive {
+		case "noindex":
+			r.NoIndex = true
+		case "nofollow":
+			r.NoFollow = true
+		case "none":
+			r.NoIndex, r.NoFollow = true, true
+		default:
+			continue
+		}
+		if scope == "" {
+			d.All = r
+			continue
+		}
+		if d.Agents == nil {
+			d.Agents = make(map[string]Robots)
+		}
+		d.Agents[scope] = r
+	}
+	return d
+}
+
+// ParseRobots combines robots directive lists (see parseRobotsDirectives) from X-Robots-Tag
+// headers and robots meta tags, keeping those for agent. Once any value sets a directive it stays
+// set, so the most restrictive combination wins.
+func ParseRobots(values []string, agent string) Robots {
+	var r Robots
+	for _, value := range values {
+		d := parseRobotsDirectives(value).For(agent)
+		r.NoIndex = r.NoIndex || d.NoIndex
+		r.NoFollow = r.NoFollow || d.NoFollow
+	}
+	return r
+}
@@ -0,0 +1,79 @@
+package parser
+
+import "testing"
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   Robots
+	}{
+		{"nothing", nil, Robots{}},
+		{"noindex", []string{"noindex"}, Robots{NoIndex: true}},
+		{"both in one value", []string{"NoIndex, NOFOLLOW"}, Robots{NoIndex: true, NoFollow: true}},
+		{"none", []string{"none"}, Robots{NoIndex: true, NoFollow: true}},
+		{"permissive directives", []string{"all", "index, follow"}, Robots{}},
+		{"values combine", []string{"noindex", "nofollow"}, Robots{NoIndex: true, NoFollow: true}},
+		{"other agent", []string{"googlebot: noindex, nofollow"}, Robots{}},
+		{"own agent", []string{"MyCrawler: noindex"}, Robots{NoIndex: true}},
+		{"agent scope switches", []string{"googlebot: noindex, mycrawler: nofollow"}, Robots{NoFollow: true}},
+		{"agent scope ends with the value", []string{"googlebot: noindex", "nofollow"}, Robots{NoFollow: true}},
+		{"valued directives are not agents", []string{"max-snippet: 20, noindex"}, Robots{NoIndex: true}},
+		{"unavailable_after is not an agent", []string{"unavailable_after: 25 Jun 2010 15:00:00 PST, nofollow"}, Robots{NoFollow: true}},
+		{"empty entries", []string{" , ,noindex,"}, Robots{NoIndex: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseRobots(tt.values, "MyCrawler"); got != tt.want {
+				t.Errorf("ParseRobots(%q) = %+v, want %+v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRobotsDirectives(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  Robots
+	}{
+		{"none", "none", Robots{NoIndex: true, NoFollow: true}},
+		{"noindex", "noindex", Robots{NoIndex: true}},
+		{"nofollow", "nofollow", Robots{NoFollow: true}},
+		{"noindex,nofollow", "noindex,nofollow", Robots{NoIndex: true, NoFollow: true}},
+		{"spaces around entries", "  noindex ,  nofollow  ", Robots{NoIndex: true, NoFollow: true}},
+		{"tabs and newlines", "\tNONE\n", Robots{NoIndex: true, NoFollow: true}},
+		{"mixed case", "NoFollow", Robots{NoFollow: true}},
+		{"unknown tokens", "noarchive, nosnippet, notranslate", Robots{}},
+		{"unknown tokens around a known one", "noarchive,nofollow, bogus", Robots{NoFollow: true}},
+		{"empty", "", Robots{}},
+		{"none scoped to another agent", "googlebot: none", Robots{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := parseRobotsDirectives(tt.value)
+			if got := d.For("MyCrawler"); got != tt.want {
+				t.Errorf("parseRobotsDirectives(%q).For(MyCrawler) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+
+	d := parseRobotsDirectives("nofollow, Googlebot: none, bingbot: noindex")
+	if d.All != (Robots{NoFollow: true}) || d.Agents["googlebot"] != (Robots{NoIndex: true, NoFollow: true}) || d.Agents["bingbot"] != (Robots{NoIndex: true}) {
+		t.Errorf("parseRobotsDirectives() = %+v, want nofollow for all, none for googlebot, noindex for bingbot", d)
+	}
+}
+
+func TestExtractRobotsMeta(t *testing.T) {
+	result := Extract([]byte(`<html><head>
+		<meta name="Robots" content="noindex">
+		<meta name="googlebot" content="nofollow">
+		<meta name="robots" content="nofollow">
+	</head><body></body></html>`), "https://example.com")
+
+	if len(result.RobotsMeta) != 2 || result.RobotsMeta[0] != "noindex" || result.RobotsMeta[1] != "nofollow" {
+		t.Errorf("RobotsMeta = %q, want [noindex nofollow]", result.RobotsMeta)
+	}
+}
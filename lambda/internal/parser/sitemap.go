@@ -0,0 +1,66 @@
+package parser
+
+import (
+	"encoding/xml"
+	"lambda/urls"
+	"net/url"
+	"strings"
+)
+
+// Sitemap kinds, named after their root element
+const (
+	SitemapIndex  = "sitemapindex" // <loc> entries are child sitemaps
+	SitemapURLSet = "urlset"       // <loc> entries are pages
+)
+
+// ParseSitemap returns the <loc> URLs of a sitemap (<urlset>) or sitemap index (<sitemapindex>),
+// resolved against baseURL and normalized like page links. Any other XML document yields nil.
+// Elements are matched by local name, so the usual sitemaps.org namespace is not required.
+func ParseSitemap(body []byte, baseURL string) []string {
+	_, links := parseSitemap(body, baseURL)
+	return links
+}
+
+// parseSitemap is ParseSitemap that also returns the sitemap's kind, "" for any other document
+func parseSitemap(body []byte, baseURL string) (kind string, links []string) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", nil
+	}
+
+	dec := newXMLDecoder(body)
+	seen := make(map[string]bool)
+	root := ""
+	var loc *strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root == "" {
+				root = t.Name.Local
+				if root != SitemapURLSet && root != SitemapIndex {
+					return "", nil
+				}
+			}
+			if t.Name.Local == "loc" {
+				loc = &strings.Builder{}
+			}
+		case xml.CharData:
+			if loc != nil {
+				loc.Write(t)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "loc" && loc != nil {
+				if link := urls.Normalize(strings.TrimSpace(loc.String()), base); link != "" && !seen[link] {
+					seen[link] = true
+					links = append(links, link)
+				}
+				loc = nil
+			}
+		}
+	}
+	return root, links
+}
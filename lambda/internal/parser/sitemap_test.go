@@ -0,0 +1,69 @@
+package parser
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSitemap(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{
+			name: "urlset",
+			body: `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc> https://example.com/a </loc><lastmod>2024-01-01</lastmod></url>
+  <url><loc>https://example.com/b?x=1&amp;y=2</loc></url>
+  <url><loc>https://example.com/a</loc></url>
+</urlset>`,
+			want: []string{"https://example.com/a", "https://example.com/b?x=1&y=2"},
+		},
+		{
+			name: "sitemap index",
+			body: `<sitemapindex><sitemap><loc>https://example.com/posts.xml</loc></sitemap></sitemapindex>`,
+			want: []string{"https://example.com/posts.xml"},
+		},
+		{
+			name: "relative loc resolves against the sitemap",
+			body: `<urlset><url><loc>/c</loc></url></urlset>`,
+			want: []string{"https://example.com/c"},
+		},
+		{
+			name: "other XML",
+			body: `<rss><channel><item><loc>https://example.com/a</loc></item></channel></rss>`,
+			want: nil,
+		},
+		{
+			name: "not XML",
+			body: `plain text`,
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseSitemap([]byte(tt.body), "https://example.com/sitemap.xml"); !slices.Equal(got, tt.want) {
+				t.Errorf("ParseSitemap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractXMLSitemapLinks(t *testing.T) {
+	got := ExtractXML([]byte(`<urlset><url><loc>https://example.com/a</loc></url></urlset>`), "https://example.com/sitemap.xml")
+	if !slices.Equal(got.Links, []string{"https://example.com/a"}) {
+		t.Errorf("ExtractXML() links = %v, want the sitemap's <loc>", got.Links)
+	}
+	if got.Sitemap != SitemapURLSet {
+		t.Errorf("ExtractXML() sitemap = %q, want %q", got.Sitemap, SitemapURLSet)
+	}
+	if got := ExtractXML([]byte(`<sitemapindex><sitemap><loc>https://example.com/posts.xml</loc></sitemap></sitemapindex>`), "https://example.com/sitemap.xml"); got.Sitemap != SitemapIndex {
+		t.Errorf("ExtractXML() sitemap of an index = %q, want %q", got.Sitemap, SitemapIndex)
+	}
+	if got := ExtractXML([]byte(`<feed><link>https://example.com/a</link></feed>`), "https://example.com/feed.xml"); got.Links != nil || got.Sitemap != "" {
+		t.Errorf("ExtractXML() of a feed = %v, %q, want no links and no sitemap kind", got.Links, got.Sitemap)
+	}
+}
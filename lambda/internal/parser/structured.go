@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"io"
+	"maps"
+	"mime"
+	"slices"
+	"strings"
+)
+
+// maxJSONDepth bounds how deep ExtractJSON walks nested objects and arrays; deeper values are dropped
+const maxJSONDepth = 32
+
+// Extractor turns a fetched body into a Result. baseURL resolves relative links where the format has any.
+type Extractor func(body []byte, baseURL string) Result
+
+// ExtractorFor returns the extractor for a Content-Type header value: Extract for HTML and XHTML,
+// ExtractJSON for JSON and ExtractXML for other XML (feeds, sitemaps, APIs). Returns nil when
+// the type has no extractor and the body should not be processed.
+func ExtractorFor(contentType string) Extractor {
+	if IsHTML(contentType) {
+		return Extract
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json"):
+		return ExtractJSON
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return ExtractXML
+	}
+	return nil
+}
+
+// ExtractJSON flattens the string values of a JSON document into Text, in document order for
+// arrays and key order for objects. Keys, numbers and booleans are left out, as are values nested
+// deeper than maxJSONDepth. Invalid JSON yields an empty Result. JSON has no links to extract.
+// APIs often send HTML-escaped strings, so entities (&amp;, &#169;) in values are decoded.
+func ExtractJSON(body []byte, _ string) Result {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return Result{}
+	}
+
+	var parts []string
+	var walk func(v any, depth int)
+	walk = func(v any, depth int) {
+		if depth > maxJSONDepth {
+			return
+		}
+		switch v := v.(type) {
+		case string:
+			if s := collapseSpace(html.UnescapeString(v)); s != "" {
+				parts = append(parts, s)
+			}
+		case []any:
+			for _, item := range v {
+				walk(item, depth+1)
+			}
+		case map[string]any:
+			for _, key := range slices.Sorted(maps.Keys(v)) {
+				walk(v[key], depth+1)
+			}
+		}
+	}
+	walk(doc, 0)
+
+	return Result{Text: strings.Join(parts, " ")}
+}
+
+// ExtractXML strips the tags of an XML document, keeping its character data as Text like
+// Extract does for HTML. The decoder is lenient, so text up to a syntax error is kept.
+// Sitemaps and sitemap indexes also yield their <loc> entries as Links (see ParseSitemap), with
+// Sitemap set to their kind.
+func ExtractXML(body []byte, baseURL string) Result {
+	dec := newXMLDecoder(body)
+
+	var sb strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		data, ok := tok.(xml.CharData)
+		if !ok {
+			continue
+		}
+		if text := collapseSpace(string(data)); text != "" {
+			if sb.Len() > 0 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(text)
+		}
+	}
+
+	kind, links := parseSitemap(body, baseURL)
+	return Result{Text: sb.String(), Links: links, Sitemap: kind}
+}
+
+// newXMLDecoder returns a lenient decoder for fetched XML, which is often not well-formed
+func newXMLDecoder(body []byte) *xml.Decoder {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	// Non-UTF-8 declarations are read as-is rather than rejected; tags and most text are ASCII anyway
+	dec.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) { return r, nil }
+	return dec
+}
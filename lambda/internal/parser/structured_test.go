@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestExtractorFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        Extractor
+	}{
+		{"text/html; charset=utf-8", Extract},
+		{"application/xhtml+xml", Extract},
+		{"application/json", ExtractJSON},
+		{"application/json; charset=utf-8", ExtractJSON},
+		{"application/ld+json", ExtractJSON},
+		{"text/json", ExtractJSON},
+		{"application/xml", ExtractXML},
+		{"text/xml; charset=iso-8859-1", ExtractXML},
+		{"application/rss+xml", ExtractXML},
+		{"Application/XML", ExtractXML},
+		{"text/plain", nil},
+		{"application/pdf", nil},
+		{"", nil},
+		{"not a media type;;", nil},
+	}
+
+	name := func(e Extractor) string {
+		if e == nil {
+			return "nil"
+		}
+		return runtime.FuncForPC(reflect.ValueOf(e).Pointer()).Name()
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := ExtractorFor(tt.contentType); name(got) != name(tt.want) {
+				t.Errorf("ExtractorFor(%q) = %s, want %s", tt.contentType, name(got), name(tt.want))
+			}
+		})
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	body := []byte(`{
+		"title": "Crawler   docs",
+		"count": 3,
+		"active": true,
+		"author": {"name": "Ada", "tags": ["go", "  aws  ", 7, null]},
+		"items": [{"body": "first"}, {"body": "second\nline"}],
+		"empty": ""
+	}`)
+
+	got := ExtractJSON(body, "https://example.com/api").Text
+	want := "Ada go aws first second line Crawler docs"
+	if got != want {
+		t.Errorf("ExtractJSON() text = %q, want %q", got, want)
+	}
+}
+
+func TestExtractJSONDecodesEntities(t *testing.T) {
+	body := []byte(`{"title": "Tom &amp; Jerry", "footer": "&#169; 2024 Caf&eacute;", "raw": "a < b"}`)
+
+	got := ExtractJSON(body, "").Text
+	want := "© 2024 Café a < b Tom & Jerry"
+	if got != want {
+		t.Errorf("ExtractJSON() text = %q, want %q", got, want)
+	}
+}
+
+func TestExtractJSONDepthBound(t *testing.T) {
+	depth := maxJSONDepth + 10
+	body := strings.Repeat(`{"a": `, depth) + `"deep"` + strings.Repeat("}", depth)
+	shallow := `{"a": {"b": "shallow"}}`
+
+	if got := ExtractJSON([]byte(body), "").Text; got != "" {
+		t.Errorf("ExtractJSON() text = %q, want values below maxJSONDepth dropped", got)
+	}
+	if got := ExtractJSON([]byte(shallow), "").Text; got != "shallow" {
+		t.Errorf("ExtractJSON() text = %q, want %q", got, "shallow")
+	}
+}
+
+func TestExtractJSONInvalid(t *testing.T) {
+	for _, body := range []string{"", "{", "not json", `{"a": "b"} trailing`} {
+		if got := ExtractJSON([]byte(body), ""); got.Text != "" || got.Links != nil {
+			t.Errorf("ExtractJSON(%q) = %+v, want empty", body, got)
+		}
+	}
+}
+
+func TestExtractXML(t *testing.T) {
+	body := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!-- a comment -->
+<catalog xmlns="urn:example">
+  <book id="1">
+    <title>Go   &amp; AWS</title>
+    <summary><![CDATA[Serverless <crawling>]]></summary>
+  </book>
+  <book id="2"><title>Second&nbsp;book</title></book>
+</catalog>`)
+
+	got := ExtractXML(body, "https://example.com/feed.xml").Text
+	want := "Go & AWS Serverless <crawling> Second book"
+	if got != want {
+		t.Errorf("ExtractXML() text = %q, want %q", got, want)
+	}
+}
+
+func TestExtractXMLKeepsTextBeforeError(t *testing.T) {
+	got := ExtractXML([]byte(`<root><a>kept</a><b>also kept</b><<<`), "").Text
+	if got != "kept also kept" {
+		t.Errorf("ExtractXML() text = %q, want %q", got, "kept also kept")
+	}
+}
+
+func TestExtractXMLNonUTF8Declaration(t *testing.T) {
+	got := ExtractXML([]byte(`<?xml version="1.0" encoding="ISO-8859-1"?><root>plain ascii</root>`), "").Text
+	if got != "plain ascii" {
+		t.Errorf("ExtractXML() text = %q, want %q", got, "plain ascii")
+	}
+}
@@ -0,0 +1,107 @@
+package ssrf
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultDNSCacheTTL is how long a resolved host is reused. Short, so DNS changes are picked
+// up quickly, but long enough to cover the validate-then-dial of a fetch and its robots.txt.
+const DefaultDNSCacheTTL = 30 * time.Second
+
+// maxDNSCacheSize bounds the number of cached hosts on a warm Lambda container
+const maxDNSCacheSize = 1024
+
+// dnsEntry is one cached lookup result
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// dnsCache resolves hostnames and caches the results for ttl. Only successful lookups are
+// cached; callers check the returned IPs every time, so a cached private result still blocks.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+	ttl     time.Duration
+	maxSize int
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	now     func() time.Time
+}
+
+// resolver is shared by ValidateHost and the SSRF-safe dialer, so the connection goes to the
+// same addresses that were validated rather than to a fresh (possibly rebound) lookup
+var resolver = newDNSCache(DefaultDNSCacheTTL, maxDNSCacheSize, net.DefaultResolver.LookupIPAddr)
+
+func newDNSCache(ttl time.Duration, maxSize int, lookup func(ctx context.Context, host string) ([]net.IPAddr, error)) *dnsCache {
+	return &dnsCache{
+		entries: make(map[string]dnsEntry),
+		ttl:     ttl,
+		maxSize: maxSize,
+		lookup:  lookup,
+		now:     time.Now,
+	}
+}
+
+// SetDNSCacheTTL changes how long resolved hosts are cached and drops existing entries.
+// A ttl of zero or less disables caching.
+func SetDNSCacheTTL(ttl time.Duration) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	resolver.ttl = ttl
+	resolver.entries = make(map[string]dnsEntry)
+}
+
+// lookupIP returns the IPs of host, from the cache while the entry is fresh
+func (d *dnsCache) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	ttl := d.ttl
+	d.mu.Unlock()
+	if ok && d.now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	if ttl <= 0 {
+		return ips, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.entries[host]; !ok {
+		d.evictIfFullLocked()
+	}
+	d.entries[host] = dnsEntry{ips: ips, expires: d.now().Add(ttl)}
+	return ips, nil
+}
+
+// evictIfFullLocked drops expired entries once the cache reaches maxSize, and a random
+// entry (Go map iteration order) if none had expired. The caller holds d.mu.
+func (d *dnsCache) evictIfFullLocked() {
+	if len(d.entries) < d.maxSize {
+		return
+	}
+	now := d.now()
+	for k, e := range d.entries {
+		if !now.Before(e.expires) {
+			delete(d.entries, k)
+		}
+	}
+	if len(d.entries) < d.maxSize {
+		return
+	}
+	for k := range d.entries {
+		delete(d.entries, k)
+		break
+	}
+}
@@ -0,0 +1,160 @@
+package ssrf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLookup resolves every host to ips and counts the lookups
+type fakeLookup struct {
+	ips   []string
+	err   error
+	calls int
+}
+
+func (f *fakeLookup) lookup(_ context.Context, _ string) ([]net.IPAddr, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	addrs := make([]net.IPAddr, 0, len(f.ips))
+	for _, ip := range f.ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+// useResolver swaps the package resolver for the duration of the test
+func useResolver(t *testing.T, d *dnsCache) {
+	t.Helper()
+	orig := resolver
+	resolver = d
+	t.Cleanup(func() { resolver = orig })
+}
+
+func TestDNSCacheHit(t *testing.T) {
+	fake := &fakeLookup{ips: []string{"93.184.216.34"}}
+	d := newDNSCache(time.Minute, 10, fake.lookup)
+
+	for i := 0; i < 3; i++ {
+		ips, err := d.lookupIP(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("lookupIP() error = %v", err)
+		}
+		if len(ips) != 1 || ips[0].String() != "93.184.216.34" {
+			t.Fatalf("lookupIP() = %v", ips)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("lookups = %d, want 1", fake.calls)
+	}
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+	fake := &fakeLookup{ips: []string{"93.184.216.34"}}
+	d := newDNSCache(time.Minute, 10, fake.lookup)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	_, _ = d.lookupIP(context.Background(), "example.com")
+	now = now.Add(59 * time.Second)
+	_, _ = d.lookupIP(context.Background(), "example.com")
+	if fake.calls != 1 {
+		t.Fatalf("lookups before expiry = %d, want 1", fake.calls)
+	}
+
+	now = now.Add(time.Second)
+	_, _ = d.lookupIP(context.Background(), "example.com")
+	if fake.calls != 2 {
+		t.Errorf("lookups after expiry = %d, want 2", fake.calls)
+	}
+}
+
+func TestDNSCacheDisabled(t *testing.T) {
+	fake := &fakeLookup{ips: []string{"93.184.216.34"}}
+	d := newDNSCache(0, 10, fake.lookup)
+
+	_, _ = d.lookupIP(context.Background(), "example.com")
+	_, _ = d.lookupIP(context.Background(), "example.com")
+	if fake.calls != 2 {
+		t.Errorf("lookups = %d, want 2 with caching disabled", fake.calls)
+	}
+}
+
+func TestDNSCacheErrorsNotCached(t *testing.T) {
+	fake := &fakeLookup{err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}
+	d := newDNSCache(time.Minute, 10, fake.lookup)
+
+	for i := 0; i < 2; i++ {
+		_, err := d.lookupIP(context.Background(), "example.com")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) {
+			t.Fatalf("lookupIP() error = %v, want the *net.DNSError", err)
+		}
+	}
+	if fake.calls != 2 {
+		t.Errorf("lookups = %d, want 2", fake.calls)
+	}
+}
+
+func TestDNSCacheEvictsWhenFull(t *testing.T) {
+	fake := &fakeLookup{ips: []string{"93.184.216.34"}}
+	d := newDNSCache(time.Minute, 3, fake.lookup)
+
+	for i := 0; i < 10; i++ {
+		_, _ = d.lookupIP(context.Background(), fmt.Sprintf("host%d.example.com", i))
+	}
+	if len(d.entries) > 3 {
+		t.Errorf("cache holds %d entries, want at most 3", len(d.entries))
+	}
+}
+
+func TestValidateHostCachedPrivateResultBlocks(t *testing.T) {
+	fake := &fakeLookup{ips: []string{"93.184.216.34", "10.0.0.1"}}
+	useResolver(t, newDNSCache(time.Minute, 10, fake.lookup))
+
+	for i := 0; i < 2; i++ {
+		err := ValidateHost("internal.example.com")
+		if err == nil || !strings.Contains(err.Error(), "private IP 10.0.0.1") {
+			t.Errorf("ValidateHost() call %d error = %v, want private IP block", i+1, err)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("lookups = %d, want 1 (second check served from cache)", fake.calls)
+	}
+}
+
+func TestDialResolvedBlocksPrivateHostname(t *testing.T) {
+	fake := &fakeLookup{ips: []string{"127.0.0.1"}}
+	useResolver(t, newDNSCache(time.Minute, 10, fake.lookup))
+
+	_, err := dialResolved(context.Background(), &net.Dialer{}, "tcp", "rebind.example.com:80")
+	if err == nil || !strings.Contains(err.Error(), "SSRF dialer") {
+		t.Errorf("dialResolved() error = %v, want SSRF dialer block", err)
+	}
+}
+
+func TestDialResolvedUsesValidatedIP(t *testing.T) {
+	fake := &fakeLookup{ips: []string{"93.184.216.34"}}
+	useResolver(t, newDNSCache(time.Minute, 10, fake.lookup))
+
+	if err := ValidateHost("example.com"); err != nil {
+		t.Fatalf("ValidateHost() error = %v", err)
+	}
+
+	// DNS now rebinds to loopback; the dial must still target the validated address
+	fake.ips = []string{"127.0.0.1"}
+	var dialed []string
+	_, _ = dialResolved(context.Background(), recordingDialer(&dialed), "tcp", "example.com:443")
+	if len(dialed) != 1 || dialed[0] != "93.184.216.34:443" {
+		t.Errorf("dialed %v, want [93.184.216.34:443]", dialed)
+	}
+	if fake.calls != 1 {
+		t.Errorf("lookups = %d, want 1", fake.calls)
+	}
+}
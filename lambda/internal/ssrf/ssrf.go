@@ -1,72 +1,207 @@
 package ssrf
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"syscall"
 	"time"
 )
 
-// IsPrivateIP checks if an IP is loopback, private, or link-local
+// blockedRanges are reserved IPv4 ranges not covered by the net.IP helpers in IsPrivateIP
+var blockedRanges = mustParseCIDRs(
+	"0.0.0.0/8",      // "this network"; 0.0.0.0 reaches localhost on most stacks
+	"100.64.0.0/10",  // carrier-grade NAT (RFC 6598), used for internal addressing by cloud providers
+	"169.254.0.0/16", // IPv4 link-local, including the 169.254.169.254 metadata endpoint
+	"192.0.0.0/24",   // IETF protocol assignments (RFC 6890)
+	"198.18.0.0/15",  // network benchmarking (RFC 2544)
+	"240.0.0.0/4",    // reserved, including the 255.255.255.255 broadcast address
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// IsPrivateIP reports whether ip must never be fetched. Blocked are:
+//   - loopback: 127.0.0.0/8 and ::1
+//   - private: 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16 and IPv6 unique-local fc00::/7
+//   - link-local: 169.254.0.0/16, fe80::/10 and the link-local multicast ranges
+//   - unspecified: 0.0.0.0 and ::
+//   - the reserved IPv4 ranges in blockedRanges, such as carrier-grade NAT 100.64.0.0/10
+//
+// IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are unwrapped and checked as the IPv4 address
+// they carry, so ::ffff:169.254.169.254 is blocked like 169.254.169.254.
 func IsPrivateIP(ip net.IP) bool {
-	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range blockedRanges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // ValidateHost resolves a hostname and checks that none of its IPs are private/internal.
 // Blocks SSRF attempts targeting AWS metadata (169.254.169.254), localhost, or internal networks.
-// Note: This provides early rejection only. The SSRF-safe dialer (ssrfSafeDialer) provides
-// defense-in-depth against DNS rebinding by validating IPs at connection time.
+// Lookups go through the shared DNS cache, which the NewTransport dialer also resolves from,
+// so the connection targets the addresses validated here.
 func ValidateHost(hostname string) error {
+	_, err := ResolveHost(context.Background(), hostname)
+	return err
+}
+
+// ResolveHost is ValidateHost returning the validated IPs of a hostname (nil for an IP
+// literal), for PinIPs to hand to the dialer
+func ResolveHost(ctx context.Context, hostname string) ([]net.IP, error) {
 	host, _, err := net.SplitHostPort(hostname)
 	if err != nil {
-		host = hostname // no port
+		host = strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]") // no port
 	}
 
 	// Check literal IP addresses
-	if ip := net.ParseIP(host); ip != nil {
+	if ip := parseIP(host); ip != nil {
 		if IsPrivateIP(ip) {
-			return fmt.Errorf("blocked: private IP %s", ip)
+			return nil, fmt.Errorf("blocked: private IP %s", ip)
 		}
-		return nil
+		return nil, nil
 	}
 
 	// Resolve hostname and check all results
-	addrs, err := net.LookupHost(host)
+	ips, err := resolver.lookupIP(ctx, host)
 	if err != nil {
-		return fmt.Errorf("DNS lookup failed for %s: %w", host, err)
+		return nil, fmt.Errorf("DNS lookup failed for %s: %w", host, err)
 	}
 
-	for _, addr := range addrs {
-		if ip := net.ParseIP(addr); ip != nil && IsPrivateIP(ip) {
-			return fmt.Errorf("blocked: %s resolves to private IP %s", host, ip)
+	for _, ip := range ips {
+		if IsPrivateIP(ip) {
+			return nil, fmt.Errorf("blocked: %s resolves to private IP %s", host, ip)
 		}
 	}
 
-	return nil
+	return ips, nil
+}
+
+// pinnedKey is the context key for the IPs pinned by PinIPs
+type pinnedKey struct{}
+
+// pinnedIPs are the validated addresses of one host
+type pinnedIPs struct {
+	host string
+	ips  []net.IP
+}
+
+// PinIPs returns a context that makes the NewTransport dialer connect host to exactly ips, as
+// returned by ResolveHost, instead of resolving it again. Without the pin a DNS answer that
+// changes between validation and dial (cache expiry, caching disabled) could still be followed.
+// Only the connection address changes; the request URL, and so Host and TLS SNI, keep the name.
+func PinIPs(ctx context.Context, host string, ips []net.IP) context.Context {
+	if len(ips) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, pinnedKey{}, pinnedIPs{host: host, ips: ips})
+}
+
+// parseIP parses an IP literal, ignoring an IPv6 zone (fe80::1%eth0) that net.ParseIP rejects.
+// Returns nil when host is not an IP literal.
+func parseIP(host string) net.IP {
+	if i := strings.IndexByte(host, '%'); i >= 0 && strings.Contains(host[:i], ":") {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
 }
 
-// NewTransport returns an http.Transport with a Control function on the dialer
-// that checks the resolved IP at connection time, preventing DNS rebinding attacks.
-// This is defense-in-depth: validateHost provides early rejection, and this transport
-// ensures the actual TCP connection never reaches a private IP even if DNS changes
-// between the validateHost call and the connection.
-func NewTransport() *http.Transport {
+// Timeouts bound the connection stages of a request, so a stuck connect or handshake fails fast
+// rather than using up a deadline meant to cover a slow body. A zero field leaves that stage to
+// the request's context.
+type Timeouts struct {
+	Dial           time.Duration // TCP connect, per address tried
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration // From the request being written until the response headers arrive
+}
+
+// NewTransport returns an http.Transport whose dialer resolves hostnames through the DNS cache
+// shared with ValidateHost and connects to those validated IPs, so a DNS change between
+// ValidateHost and the connection (DNS rebinding) cannot redirect it. As defense-in-depth,
+// a Control function on the dialer still checks every IP at connection time.
+func NewTransport(timeouts Timeouts) *http.Transport {
+	dialer := newDialer(timeouts.Dial)
 	return &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-			Control: func(network, address string, c syscall.RawConn) error {
-				host, _, err := net.SplitHostPort(address)
-				if err != nil {
-					return fmt.Errorf("SSRF dialer: invalid address %s: %w", address, err)
-				}
-				ip := net.ParseIP(host)
-				if ip != nil && IsPrivateIP(ip) {
-					return fmt.Errorf("SSRF dialer: blocked connection to private IP %s", ip)
-				}
-				return nil
-			},
-		}).DialContext,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialResolved(ctx, dialer, network, address)
+		},
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+	}
+}
+
+// newDialer returns the dialer NewTransport connects with, checking every IP via dialControl
+func newDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   dialControl,
+	}
+}
+
+// dialResolved dials address, connecting a hostname to the IPs pinned in ctx by PinIPs or else
+// resolving it through the shared DNS cache, and refusing it outright if any of its IPs is
+// private. The IPs are tried in order.
+func dialResolved(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("SSRF dialer: invalid address %s: %w", address, err)
+	}
+	if parseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
 	}
+
+	var ips []net.IP
+	if pinned, ok := ctx.Value(pinnedKey{}).(pinnedIPs); ok && strings.EqualFold(pinned.host, host) {
+		ips = pinned.ips
+	} else if ips, err = resolver.lookupIP(ctx, host); err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if IsPrivateIP(ip) {
+			return nil, fmt.Errorf("SSRF dialer: blocked: %s resolves to private IP %s", host, ip)
+		}
+	}
+
+	lastErr := fmt.Errorf("SSRF dialer: no addresses for %s", host)
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dialControl rejects a connection whose resolved address is private, after DNS and just before connect
+func dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("SSRF dialer: invalid address %s: %w", address, err)
+	}
+	ip := parseIP(host)
+	if ip != nil && IsPrivateIP(ip) {
+		return fmt.Errorf("SSRF dialer: blocked connection to private IP %s", ip)
+	}
+	return nil
 }
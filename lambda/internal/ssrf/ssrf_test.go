@@ -1,11 +1,15 @@
 package ssrf
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestIsPrivateIP(t *testing.T) {
@@ -24,6 +28,22 @@ func TestIsPrivateIP(t *testing.T) {
 		{"link-local", "169.254.169.254", true},
 		{"unspecified v4", "0.0.0.0", true},
 		{"unspecified v6", "::", true},
+		{"unique-local v6", "fd00::1", true},
+		{"unique-local v6 fc00", "fc00::1", true},
+		{"link-local v6", "fe80::1", true},
+		{"IPv4-mapped loopback", "::ffff:127.0.0.1", true},
+		{"IPv4-mapped metadata", "::ffff:169.254.169.254", true},
+		{"IPv4-mapped 10.x", "::ffff:10.0.0.1", true},
+		{"IPv4-mapped CGNAT", "::ffff:100.64.0.1", true},
+		{"link-local other than metadata", "169.254.1.1", true},
+		{"link-local top", "169.254.255.255", true},
+		{"CGNAT start", "100.64.0.0", true},
+		{"CGNAT end", "100.127.255.255", true},
+		{"this network", "0.1.2.3", true},
+		{"IETF protocol assignments", "192.0.0.8", true},
+		{"benchmarking", "198.18.0.1", true},
+		{"reserved", "240.0.0.1", true},
+		{"broadcast", "255.255.255.255", true},
 
 		// Public ranges
 		{"public 8.8.8.8", "8.8.8.8", false},
@@ -31,6 +51,14 @@ func TestIsPrivateIP(t *testing.T) {
 		{"public 93.x", "93.184.216.34", false},
 		{"172.15.x.x (not private)", "172.15.255.255", false},
 		{"172.32.x.x (not private)", "172.32.0.1", false},
+		{"public v6", "2606:4700:4700::1111", false},
+		{"IPv4-mapped public", "::ffff:8.8.8.8", false},
+		{"below CGNAT", "100.63.255.255", false},
+		{"above CGNAT", "100.128.0.0", false},
+		{"below link-local", "169.253.255.255", false},
+		{"above link-local", "169.255.0.1", false},
+		{"public 192.0.2.x neighbour", "192.0.1.1", false},
+		{"public 223.x", "223.255.255.254", false},
 	}
 
 	for _, tt := range tests {
@@ -60,12 +88,25 @@ func TestValidateHost(t *testing.T) {
 		{"blocks 192.168.x", "192.168.1.1", true},
 		{"blocks 172.16.x", "172.16.0.1", true},
 		{"blocks 0.0.0.0", "0.0.0.0", true},
+		{"blocks CGNAT", "100.64.0.1", true},
+		{"blocks CGNAT with port", "100.100.100.200:80", true},
 		{"blocks IPv6 loopback", "::1", true},
 
 		// Literal private IPs with port
 		{"blocks localhost with port", "127.0.0.1:8080", true},
 		{"blocks metadata with port", "169.254.169.254:80", true},
 
+		// IPv6 literals, bracketed with and without port
+		{"blocks bracketed IPv6 loopback", "[::1]", true},
+		{"blocks bracketed IPv6 loopback with port", "[::1]:8080", true},
+		{"blocks unique-local", "[fd00::1]", true},
+		{"blocks link-local with port", "[fe80::1]:443", true},
+		{"blocks link-local with zone", "[fe80::1%eth0]:443", true},
+		{"blocks IPv4-mapped metadata", "::ffff:169.254.169.254", true},
+		{"blocks bracketed IPv4-mapped metadata with port", "[::ffff:169.254.169.254]:80", true},
+		{"allows public IPv6", "[2606:4700:4700::1111]", false},
+		{"allows public IPv6 with port", "[2606:4700:4700::1111]:443", false},
+
 		// Public IPs should pass
 		{"allows 8.8.8.8", "8.8.8.8", false},
 		{"allows 1.1.1.1", "1.1.1.1", false},
@@ -85,7 +126,7 @@ func TestValidateHost(t *testing.T) {
 }
 
 func TestSSRFSafeTransportBlocksPrivateIPs(t *testing.T) {
-	transport := NewTransport()
+	transport := NewTransport(Timeouts{Dial: 10 * time.Second})
 	client := &http.Client{Transport: transport}
 
 	tests := []struct {
@@ -117,6 +158,21 @@ func TestSSRFSafeTransportBlocksPrivateIPs(t *testing.T) {
 	}
 }
 
+func TestNewTransportTimeouts(t *testing.T) {
+	timeouts := Timeouts{Dial: 2 * time.Second, TLSHandshake: 3 * time.Second, ResponseHeader: 4 * time.Second}
+	transport := NewTransport(timeouts)
+
+	if transport.TLSHandshakeTimeout != timeouts.TLSHandshake {
+		t.Errorf("TLSHandshakeTimeout = %v, want %v", transport.TLSHandshakeTimeout, timeouts.TLSHandshake)
+	}
+	if transport.ResponseHeaderTimeout != timeouts.ResponseHeader {
+		t.Errorf("ResponseHeaderTimeout = %v, want %v", transport.ResponseHeaderTimeout, timeouts.ResponseHeader)
+	}
+	if dialer := newDialer(timeouts.Dial); dialer.Timeout != timeouts.Dial || dialer.Control == nil {
+		t.Errorf("dialer timeout = %v with control %v, want %v with the SSRF control", dialer.Timeout, dialer.Control != nil, timeouts.Dial)
+	}
+}
+
 func TestSSRFSafeTransportBlocksLocalhostServer(t *testing.T) {
 	// Start a real server on loopback to prove the transport blocks it even when reachable
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -125,7 +181,7 @@ func TestSSRFSafeTransportBlocksLocalhostServer(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	transport := NewTransport()
+	transport := NewTransport(Timeouts{Dial: 10 * time.Second})
 	client := &http.Client{Transport: transport}
 
 	resp, err := client.Get(srv.URL)
@@ -141,7 +197,7 @@ func TestSSRFSafeTransportBlocksLocalhostServer(t *testing.T) {
 
 func TestSSRFSafeTransportAllowsPublicIPs(t *testing.T) {
 	// Verify the dialer control function doesn't block public IPs
-	transport := NewTransport()
+	transport := NewTransport(Timeouts{Dial: 10 * time.Second})
 
 	// We can't easily test an actual connection to a public IP in unit tests,
 	// but we can verify the Control function directly
@@ -153,7 +209,7 @@ func TestSSRFSafeTransportAllowsPublicIPs(t *testing.T) {
 
 func TestSSRFDialerControlFunction(t *testing.T) {
 	// Test the Control function directly by creating a dialer and calling Control
-	transport := NewTransport()
+	transport := NewTransport(Timeouts{Dial: 10 * time.Second})
 
 	// Extract and test the dialer through a test connection
 	// We test by attempting connections to known private IPs
@@ -198,3 +254,113 @@ func TestSSRFDialerControlFunction(t *testing.T) {
 		t.Fatal("ssrfSafeTransport() returned nil")
 	}
 }
+
+func TestDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"[fd00::1]:443", true},
+		{"[fe80::1%eth0]:443", true},
+		{"[::ffff:169.254.169.254]:80", true},
+		{"[::ffff:10.0.0.1]:443", true},
+		{"8.8.8.8:443", false},
+		{"[2606:4700:4700::1111]:443", false},
+		{"[::ffff:8.8.8.8]:443", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := dialControl("tcp", tt.address, nil)
+			if (err != nil) != tt.blocked {
+				t.Errorf("dialControl(%q) error = %v, blocked %v", tt.address, err, tt.blocked)
+			}
+		})
+	}
+}
+
+// sequenceLookup resolves to the next entry of answers on every call, like a rebinding DNS server
+type sequenceLookup struct {
+	answers []string
+	calls   int
+}
+
+func (s *sequenceLookup) lookup(_ context.Context, _ string) ([]net.IPAddr, error) {
+	ip := s.answers[min(s.calls, len(s.answers)-1)]
+	s.calls++
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+// recordingDialer records the addresses it is asked to connect to without connecting
+func recordingDialer(dialed *[]string) *net.Dialer {
+	return &net.Dialer{Control: func(_, address string, _ syscall.RawConn) error {
+		*dialed = append(*dialed, address)
+		return errors.New("stop before connecting")
+	}}
+}
+
+func TestPinIPsDialsValidatedIP(t *testing.T) {
+	// Caching disabled, so every lookup goes to the rebinding server
+	rebind := &sequenceLookup{answers: []string{"93.184.216.34", "127.0.0.1"}}
+	useResolver(t, newDNSCache(0, 10, rebind.lookup))
+
+	ips, err := ResolveHost(context.Background(), "rebind.example.com:443")
+	if err != nil {
+		t.Fatalf("ResolveHost() error = %v", err)
+	}
+
+	var dialed []string
+	ctx := PinIPs(context.Background(), "rebind.example.com", ips)
+	_, _ = dialResolved(ctx, recordingDialer(&dialed), "tcp", "rebind.example.com:443")
+
+	if len(dialed) != 1 || dialed[0] != "93.184.216.34:443" {
+		t.Errorf("dialed %v, want [93.184.216.34:443]", dialed)
+	}
+	if rebind.calls != 1 {
+		t.Errorf("lookups = %d, want 1 (the dial must not resolve again)", rebind.calls)
+	}
+}
+
+func TestDialWithoutPinResolvesAgain(t *testing.T) {
+	rebind := &sequenceLookup{answers: []string{"93.184.216.34", "127.0.0.1"}}
+	useResolver(t, newDNSCache(0, 10, rebind.lookup))
+
+	if _, err := ResolveHost(context.Background(), "rebind.example.com"); err != nil {
+		t.Fatalf("ResolveHost() error = %v", err)
+	}
+
+	// A pin for another host does not apply; the fresh answer is private and still refused
+	var dialed []string
+	ctx := PinIPs(context.Background(), "other.example.com", []net.IP{net.ParseIP("93.184.216.34")})
+	_, err := dialResolved(ctx, recordingDialer(&dialed), "tcp", "rebind.example.com:443")
+	if err == nil || !strings.Contains(err.Error(), "SSRF dialer") {
+		t.Errorf("dialResolved() error = %v, want SSRF dialer block", err)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("dialed %v, want nothing", dialed)
+	}
+}
+
+func TestPinnedPrivateIPStillBlocked(t *testing.T) {
+	var dialed []string
+	ctx := PinIPs(context.Background(), "example.com", []net.IP{net.ParseIP("169.254.169.254")})
+	_, err := dialResolved(ctx, recordingDialer(&dialed), "tcp", "example.com:80")
+	if err == nil || !strings.Contains(err.Error(), "SSRF dialer") {
+		t.Errorf("dialResolved() error = %v, want SSRF dialer block", err)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("dialed %v, want nothing", dialed)
+	}
+}
+
+func TestResolveHostLiteralNotPinned(t *testing.T) {
+	ips, err := ResolveHost(context.Background(), "93.184.216.34:443")
+	if err != nil || ips != nil {
+		t.Errorf("ResolveHost() = %v, %v; want nil, nil for an IP literal", ips, err)
+	}
+	if ctx := context.Background(); PinIPs(ctx, "93.184.216.34", ips) != ctx {
+		t.Error("PinIPs() with no IPs should return ctx unchanged")
+	}
+}
@@ -0,0 +1,107 @@
+// Package timing accumulates how long each stage of a unit of work takes, so one log line can
+// show where the time went.
+package timing
+
+import (
+	"context"
+	"time"
+)
+
+// Stage is the total time spent in one named stage
+type Stage struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Timer accumulates durations per stage. One stage runs at a time: Start stops the running stage
+// before starting the next, and a stage started more than once adds to its total.
+// A nil *Timer is valid and records nothing, so instrumented code need not check for one.
+type Timer struct {
+	now     func() time.Time
+	begun   time.Time
+	stages  []Stage // In order of first Start
+	current int     // Index into stages of the running stage, -1 when none
+	started time.Time
+}
+
+// New returns a Timer reading the wall clock
+func New() *Timer {
+	return NewWithClock(time.Now)
+}
+
+// NewWithClock returns a Timer reading now, for tests that need deterministic durations
+func NewWithClock(now func() time.Time) *Timer {
+	return &Timer{now: now, begun: now(), current: -1}
+}
+
+// Start stops the running stage, if any, and starts timing name
+func (t *Timer) Start(name string) {
+	if t == nil {
+		return
+	}
+	now := t.now()
+	t.stopAt(now)
+	t.current = len(t.stages)
+	for i, s := range t.stages {
+		if s.Name == name {
+			t.current = i
+			break
+		}
+	}
+	if t.current == len(t.stages) {
+		t.stages = append(t.stages, Stage{Name: name})
+	}
+	t.started = now
+}
+
+// Stop adds the running stage's time since Start to its total. It does nothing when no stage is running.
+func (t *Timer) Stop() {
+	if t == nil || t.current < 0 {
+		return
+	}
+	t.stopAt(t.now())
+}
+
+func (t *Timer) stopAt(now time.Time) {
+	if t.current < 0 {
+		return
+	}
+	t.stages[t.current].Duration += now.Sub(t.started)
+	t.current = -1
+}
+
+// Stages returns the total of every stage started so far, in the order they first started.
+// A running stage is included up to now without being stopped.
+func (t *Timer) Stages() []Stage {
+	if t == nil {
+		return nil
+	}
+	stages := make([]Stage, len(t.stages))
+	copy(stages, t.stages)
+	if t.current >= 0 {
+		stages[t.current].Duration += t.now().Sub(t.started)
+	}
+	return stages
+}
+
+// Elapsed returns the time since the Timer was created, including time outside any stage
+func (t *Timer) Elapsed() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return t.now().Sub(t.begun)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying t, so functions deeper in the call chain can time
+// their own stages without a parameter for it
+func NewContext(ctx context.Context, t *Timer) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the Timer carried by ctx, or nil (which records nothing) when there is none
+func FromContext(ctx context.Context) *Timer {
+	t, _ := ctx.Value(contextKey{}).(*Timer)
+	return t
+}
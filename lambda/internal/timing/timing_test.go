@@ -0,0 +1,83 @@
+package timing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stepClock returns a clock that advances by the next step each time it is read
+func stepClock(steps ...time.Duration) func() time.Time {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		if len(steps) > 0 {
+			now = now.Add(steps[0])
+			steps = steps[1:]
+		}
+		return now
+	}
+}
+
+func TestTimerStages(t *testing.T) {
+	// Reads: New, Start claim, Start fetch (stops claim), Start claim (stops fetch), Stop, Elapsed.
+	// Stages reads nothing once every stage is stopped.
+	timer := NewWithClock(stepClock(0, 0, 10*time.Millisecond, 200*time.Millisecond, 5*time.Millisecond, time.Second))
+
+	timer.Start("claim")
+	timer.Start("fetch")
+	timer.Start("claim")
+	timer.Stop()
+
+	want := []Stage{
+		{Name: "claim", Duration: 15 * time.Millisecond},
+		{Name: "fetch", Duration: 200 * time.Millisecond},
+	}
+	if got := timer.Stages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stages() = %v, want %v", got, want)
+	}
+	if got := timer.Elapsed(); got != 1215*time.Millisecond {
+		t.Errorf("Elapsed() = %v, want 1.215s (stage time plus time outside stages)", got)
+	}
+}
+
+func TestTimerStagesIncludesRunningStage(t *testing.T) {
+	// Reads: New, Start parse, Stages, Stop
+	timer := NewWithClock(stepClock(0, 0, 30*time.Millisecond, 20*time.Millisecond))
+
+	timer.Start("parse")
+	if got := timer.Stages(); len(got) != 1 || got[0].Duration != 30*time.Millisecond {
+		t.Errorf("Stages() while running = %v, want parse at 30ms", got)
+	}
+	timer.Stop()
+	if got := timer.Stages(); got[0].Duration != 50*time.Millisecond {
+		t.Errorf("Stages() after Stop = %v, want parse at 50ms", got)
+	}
+}
+
+func TestTimerStopWithoutStart(t *testing.T) {
+	timer := NewWithClock(stepClock())
+	timer.Stop()
+	if got := timer.Stages(); len(got) != 0 {
+		t.Errorf("Stages() = %v, want none", got)
+	}
+}
+
+func TestNilTimer(t *testing.T) {
+	var timer *Timer
+	timer.Start("fetch")
+	timer.Stop()
+	if timer.Stages() != nil || timer.Elapsed() != 0 {
+		t.Error("nil Timer recorded something")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Error("FromContext() without a timer should be nil")
+	}
+	timer := New()
+	if FromContext(NewContext(context.Background(), timer)) != timer {
+		t.Error("FromContext() did not return the timer from NewContext")
+	}
+}
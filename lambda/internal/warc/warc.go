@@ -0,0 +1,89 @@
+package warc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	Version             = "WARC/1.1"
+	TypeResponse        = "response"
+	ContentTypeResponse = "application/http;msgtype=response"
+)
+
+// Record is a single WARC record with the mandatory named fields and a content block.
+type Record struct {
+	Type        string
+	ID          string // Generated as a urn:uuid when empty
+	Date        time.Time
+	TargetURI   string
+	ContentType string
+	Block       []byte
+}
+
+// Write serializes a record using WARC text framing: version line, CRLF-terminated
+// headers, a blank line, the content block, and two trailing CRLFs.
+func Write(w io.Writer, r *Record) error {
+	id := r.ID
+	if id == "" {
+		var err error
+		if id, err = newRecordID(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(Version + "\r\n")
+	writeHeader(&buf, "WARC-Type", r.Type)
+	writeHeader(&buf, "WARC-Record-ID", "<"+id+">")
+	writeHeader(&buf, "WARC-Date", r.Date.UTC().Format(time.RFC3339))
+	if r.TargetURI != "" {
+		writeHeader(&buf, "WARC-Target-URI", r.TargetURI)
+	}
+	if r.ContentType != "" {
+		writeHeader(&buf, "Content-Type", r.ContentType)
+	}
+	writeHeader(&buf, "Content-Length", strconv.Itoa(len(r.Block)))
+	buf.WriteString("\r\n")
+	buf.Write(r.Block)
+	buf.WriteString("\r\n\r\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// HTTPResponseBlock rebuilds the HTTP response bytes (status line, headers, body) for a response record.
+func HTTPResponseBlock(statusCode int, contentType string, body []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	if contentType != "" {
+		writeHeader(&buf, "Content-Type", contentType)
+	}
+	writeHeader(&buf, "Content-Length", strconv.Itoa(len(body)))
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteString("\r\n")
+}
+
+// newRecordID returns a random (version 4) UUID URN
+func newRecordID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
@@ -0,0 +1,164 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parsedRecord is a WARC record read back from its text framing
+type parsedRecord struct {
+	version string
+	headers map[string]string
+	block   []byte
+}
+
+func parseRecord(t *testing.T, data []byte) parsedRecord {
+	t.Helper()
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	version, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading version line: %v", err)
+	}
+	rec := parsedRecord{version: strings.TrimSuffix(version, "\r\n"), headers: make(map[string]string)}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading header line: %v", err)
+		}
+		if !strings.HasSuffix(line, "\r\n") {
+			t.Fatalf("header line not CRLF-terminated: %q", line)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			t.Fatalf("malformed header line: %q", line)
+		}
+		rec.headers[name] = value
+	}
+
+	length, err := strconv.Atoi(rec.headers["Content-Length"])
+	if err != nil {
+		t.Fatalf("invalid Content-Length %q: %v", rec.headers["Content-Length"], err)
+	}
+	rec.block = make([]byte, length)
+	if _, err := io.ReadFull(r, rec.block); err != nil {
+		t.Fatalf("reading block: %v", err)
+	}
+
+	trailer, _ := io.ReadAll(r)
+	if string(trailer) != "\r\n\r\n" {
+		t.Errorf("record trailer = %q, want CRLF CRLF", trailer)
+	}
+	return rec
+}
+
+func TestWriteResponseRecord(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	block := HTTPResponseBlock(200, "text/html", []byte("<html>hi</html>"))
+
+	var buf bytes.Buffer
+	err := Write(&buf, &Record{
+		Type:        TypeResponse,
+		Date:        date,
+		TargetURI:   "https://example.com/page",
+		ContentType: ContentTypeResponse,
+		Block:       block,
+	})
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	rec := parseRecord(t, buf.Bytes())
+
+	if rec.version != Version {
+		t.Errorf("version = %q, want %q", rec.version, Version)
+	}
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"WARC-Type", "response"},
+		{"WARC-Date", "2024-03-01T12:30:00Z"},
+		{"WARC-Target-URI", "https://example.com/page"},
+		{"Content-Type", "application/http;msgtype=response"},
+		{"Content-Length", strconv.Itoa(len(block))},
+	}
+	for _, tt := range tests {
+		if got := rec.headers[tt.header]; got != tt.want {
+			t.Errorf("header %s = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+
+	id := rec.headers["WARC-Record-ID"]
+	if !strings.HasPrefix(id, "<urn:uuid:") || !strings.HasSuffix(id, ">") {
+		t.Errorf("WARC-Record-ID = %q, want <urn:uuid:...>", id)
+	}
+
+	if !bytes.Equal(rec.block, block) {
+		t.Errorf("block = %q, want %q", rec.block, block)
+	}
+}
+
+func TestWriteKeepsExplicitRecordID(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, &Record{Type: TypeResponse, ID: "urn:uuid:fixed", Date: time.Now()})
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	rec := parseRecord(t, buf.Bytes())
+	if rec.headers["WARC-Record-ID"] != "<urn:uuid:fixed>" {
+		t.Errorf("WARC-Record-ID = %q, want <urn:uuid:fixed>", rec.headers["WARC-Record-ID"])
+	}
+	if rec.headers["Content-Length"] != "0" {
+		t.Errorf("Content-Length = %q, want 0", rec.headers["Content-Length"])
+	}
+}
+
+func TestRecordIDsAreUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 100 {
+		id, err := newRecordID()
+		if err != nil {
+			t.Fatalf("newRecordID() error = %v", err)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate record ID %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestHTTPResponseBlockParses(t *testing.T) {
+	body := []byte("<html><body>content</body></html>")
+	block := HTTPResponseBlock(404, "text/html; charset=utf-8", body)
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse() error = %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html; charset=utf-8", ct)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(got, body) {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// jobIDKey is the context key for the job_id of the message being processed
+type jobIDKey struct{}
+
+// withJobID returns ctx carrying a message's job_id, which the items and messages created
+// while processing it inherit
+func withJobID(ctx context.Context, jobID string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, jobID)
+}
+
+// jobFor returns the job new items and messages belong to: the job_id of the message being
+// processed, falling back to JOB_ID. Empty means no job.
+func (c *Crawler) jobFor(ctx context.Context) string {
+	if jobID, ok := ctx.Value(jobIDKey{}).(string); ok && jobID != "" {
+		return jobID
+	}
+	return c.jobID
+}
+
+// addJobIDItem stamps the current job, if any, on an item about to be put
+func (c *Crawler) addJobIDItem(ctx context.Context, item map[string]dynamodbtypes.AttributeValue) {
+	if jobID := c.jobFor(ctx); jobID != "" {
+		item["job_id"] = &dynamodbtypes.AttributeValueMemberS{Value: jobID}
+	}
+}
+
+// addJobIDAttr copies the current job, if any, into a message's attributes
+func (c *Crawler) addJobIDAttr(ctx context.Context, attrs map[string]sqstypes.MessageAttributeValue) {
+	if jobID := c.jobFor(ctx); jobID != "" {
+		attrs["job_id"] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(jobID),
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestExtractJobID(t *testing.T) {
+	c := newTestCrawler()
+
+	tests := []struct {
+		name  string
+		attrs map[string]events.SQSMessageAttribute
+		want  string
+	}{
+		{"no attribute", nil, ""},
+		{"set", map[string]events.SQSMessageAttribute{"job_id": {StringValue: aws.String("june-crawl")}}, "june-crawl"},
+		{"nil string value", map[string]events.SQSMessageAttribute{"job_id": {}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.extractJobID(&events.SQSMessage{MessageAttributes: tt.attrs}); got != tt.want {
+				t.Errorf("extractJobID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobFor(t *testing.T) {
+	c := newTestCrawler()
+	if got := c.jobFor(context.Background()); got != "" {
+		t.Errorf("jobFor() without a job = %q, want empty", got)
+	}
+
+	c.jobID = "env-job"
+	if got := c.jobFor(context.Background()); got != "env-job" {
+		t.Errorf("jobFor() = %q, want JOB_ID %q", got, "env-job")
+	}
+	if got := c.jobFor(withJobID(context.Background(), "message-job")); got != "message-job" {
+		t.Errorf("jobFor() = %q, want the message's job_id", got)
+	}
+}
+
+// TestProcessMessagePropagatesJobID follows a seed's job_id to the items and messages of the
+// links and domains discovered on it
+func TestProcessMessagePropagatesJobID(t *testing.T) {
+	ddb := authItemDDB(nil)
+	jobOf := map[string]string{} // url_hash -> job_id put
+	var claimJob string
+	ddb.putItemFunc = func(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		key := in.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+		if job, ok := in.Item["job_id"].(*dynamodbtypes.AttributeValueMemberS); ok {
+			jobOf[key] = job.Value
+		} else {
+			jobOf[key] = ""
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}
+	ddb.updateItemFunc = func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		if job, ok := in.ExpressionAttributeValues[":job"].(*dynamodbtypes.AttributeValueMemberS); ok && strings.Contains(*in.UpdateExpression, ":processing") {
+			claimJob = job.Value
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	var batch *sqs.SendMessageBatchInput
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			batch = in
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.jobID = "env-job" // The message's job_id wins
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><body><a href="/a">A</a><a href="https://other.example.org/b">B</a></body></html>`)
+	}))
+
+	record := &events.SQSMessage{
+		Body: "https://example.com/",
+		MessageAttributes: map[string]events.SQSMessageAttribute{
+			"job_id": {StringValue: aws.String("june-crawl"), DataType: "String"},
+		},
+	}
+	if _, err := c.processMessage(context.Background(), record); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+
+	if claimJob != "june-crawl" {
+		t.Errorf("claim job_id = %q, want june-crawl", claimJob)
+	}
+	if len(jobOf) == 0 {
+		t.Fatal("no items put")
+	}
+	for key, job := range jobOf {
+		if job != "june-crawl" {
+			t.Errorf("item %s job_id = %q, want june-crawl", key, job)
+		}
+	}
+	if batch == nil || len(batch.Entries) != 2 {
+		t.Fatalf("batch = %+v, want 2 child links", batch)
+	}
+	for _, e := range batch.Entries {
+		if got := e.MessageAttributes["job_id"]; got.StringValue == nil || *got.StringValue != "june-crawl" {
+			t.Errorf("%s job_id attribute = %+v, want june-crawl", *e.MessageBody, got)
+		}
+	}
+}
+
+func TestEnqueueLinksWithoutJob(t *testing.T) {
+	ddb := authItemDDB(nil)
+	var putJob bool
+	ddb.putItemFunc = func(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		_, putJob = in.Item["job_id"]
+		return &dynamodb.PutItemOutput{}, nil
+	}
+	var batch *sqs.SendMessageBatchInput
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			batch = in
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+	c.enqueueLinks(context.Background(), []string{"https://example.com/a"}, 1, "https://example.com/")
+
+	if putJob {
+		t.Error("item has job_id without a job")
+	}
+	if _, ok := batch.Entries[0].MessageAttributes["job_id"]; ok {
+		t.Error("message has job_id without a job")
+	}
+}
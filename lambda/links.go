@@ -2,103 +2,197 @@ package main
 
 import (
 	"context"
-	"lambda/internal/urls"
-	"strconv"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
-	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"errors"
+	"lambda/urls"
+	"net/url"
+	"strings"
 )
 
-// enqueueLinks adds new URLs to DynamoDB and SQS queue (with deduplication).
-// Uses SQS SendMessageBatch to send up to 10 messages per API call.
+// enqueueLinks records the discovered links that pass the filters and are not already known, then
+// queues them in one go as pages. Returns how many were queued.
 func (c *Crawler) enqueueLinks(ctx context.Context, links []string, depth int, sourceURL string) int {
-	enqueued := 0
+	return c.enqueueLinksAs(ctx, links, depth, sourceURL, priorityNormal, "")
+}
+
+// enqueueLinksAs is enqueueLinks with the priority and content_hint the links are queued under
+func (c *Crawler) enqueueLinksAs(ctx context.Context, links []string, depth int, sourceURL, priority, hint string) int {
 	newDomains := 0
-	depthStr := strconv.Itoa(depth)
+	ancestry := childAncestry(ctx, sourceURL)
+
+	var pending []QueuedURL // New links, queued after the loop
 
-	// Collect new URLs that pass dedup, then batch-send to SQS
-	var pending []string
+	// Links that canonicalize to the same URL only cost one PutItem
+	seen := make(map[string]bool, len(links))
+
+	// domainFull per host, so the cap costs one read per host rather than per link
+	full := map[string]bool{}
+
+	// Strict mode: out-of-scope links are dropped before the allowlist, so they are never auto-discovered.
+	// In-scope links still need the allowlist, so both filters apply (intersection).
+	sourceHost := urls.GetHost(urls.Canonicalize(sourceURL))
+	sourceScope := ""
+	if c.sameDomain {
+		sourceScope = c.linkScope(sourceHost)
+	}
 
+	// Dedup and filtering use the canonical form; the link as discovered is what gets fetched,
+	// since servers may treat path case or encoding differently than Canonicalize does
 	for _, link := range links {
-		host := urls.GetHost(link)
+		canonical := urls.Canonicalize(link)
+		if seen[canonical] {
+			continue
+		}
+		seen[canonical] = true
+
+		// Checked before any DynamoDB call: trap URLs are cheap to generate and costly to store
+		if reason := c.oversizedURL(link, canonical); reason != "" {
+			c.log.Info().Str("url", link[:min(len(link), 256)]).Int("length", len(link)).Str("reason", reason).Str("source", sourceURL).Msg("Skipping oversized URL")
+			continue
+		}
+		if urls.LooksLikeTrap(canonical, urls.TrapLimits{MaxSegmentRepeats: c.trapSegs, MaxParamRepeats: c.trapParams}) {
+			c.log.Info().Str("url", link[:min(len(link), 256)]).Str("source", sourceURL).Msg("Skipping likely crawler trap")
+			continue
+		}
+
+		if ext := urls.Extension(canonical); c.skipExts[ext] {
+			c.log.Debug().Str("url", link[:min(len(link), 256)]).Str("extension", ext).Msg("Skipping link by extension")
+			continue
+		}
+		if !urls.HasPathPrefix(canonical, c.includes) {
+			c.log.Debug().Str("url", link[:min(len(link), 256)]).Msg("Skipping link outside INCLUDE_PREFIXES")
+			continue
+		}
+
+		host := urls.GetHost(canonical)
 		if host == "" {
 			continue
 		}
+		if c.sameDomain && c.linkScope(host) != sourceScope {
+			continue
+		}
 
-		// Check if domain is allowed, auto-discover if not
-		if !c.isDomainAllowed(ctx, host) {
+		// Check if domain is allowed, auto-discover if not. The source page was just fetched, so its
+		// own host is in scope even when seeding never allowlisted it (a cold start's first links);
+		// third-party hosts are only added with AUTO_DISCOVER_DOMAINS.
+		// DISABLE_DOMAIN_ALLOWLIST skips this and the path filters, which live on allowlist items.
+		if !c.noAllowlist && !c.isDomainAllowed(ctx, host) {
+			if !c.autoDiscover && c.scopeHost(host) != c.scopeHost(sourceHost) {
+				c.log.Debug().Str("url", link[:min(len(link), 256)]).Str("domain", host).Msg("Skipping link to a host not on the allowlist")
+				continue
+			}
 			if c.maybeAddDomain(ctx, host, sourceURL) {
 				newDomains++
+				if c.probeSitemap {
+					c.enqueueSitemapProbe(ctx, link, depth, sourceURL)
+				}
 			} else {
 				continue
 			}
 		}
 
-		urlHash := urls.Hash(link)
-
-		// Try to add to DynamoDB (will fail if already exists)
-		_, err := c.ddb.PutItem(ctx, &dynamodb.PutItemInput{
-			TableName: &c.tableName,
-			Item: map[string]dynamodbtypes.AttributeValue{
-				"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
-				"url":      &dynamodbtypes.AttributeValueMemberS{Value: link},
-				"status":   &dynamodbtypes.AttributeValueMemberS{Value: stateQueued},
-			},
-			ConditionExpression: aws.String("attribute_not_exists(url_hash)"),
-		})
-		if err != nil {
+		// Operator-configured path restrictions beyond robots.txt
+		if !c.noAllowlist && !c.getPathFilter(ctx, host).allows(canonical) {
 			continue
 		}
 
-		pending = append(pending, link)
-	}
-
-	// Batch send to SQS (up to 10 per batch)
-	const sqsBatchSize = 10
-	for i := 0; i < len(pending); i += sqsBatchSize {
-		end := i + sqsBatchSize
-		if end > len(pending) {
-			end = len(pending)
+		// MAX_PAGES_PER_DOMAIN: a domain that has used up its pages gets no more links
+		capped, checked := full[host]
+		if !checked {
+			capped = c.domainFull(ctx, host)
+			full[host] = capped
 		}
-		batch := pending[i:end]
-
-		entries := make([]sqstypes.SendMessageBatchRequestEntry, len(batch))
-		for j, link := range batch {
-			id := strconv.Itoa(i + j)
-			linkCopy := link
-			entries[j] = sqstypes.SendMessageBatchRequestEntry{
-				Id:          &id,
-				MessageBody: &linkCopy,
-				MessageAttributes: map[string]sqstypes.MessageAttributeValue{
-					"depth": {
-						DataType:    aws.String("Number"),
-						StringValue: &depthStr,
-					},
-				},
-			}
+		if capped {
+			c.log.Debug().Str("url", link[:min(len(link), 256)]).Str("domain", host).Msg("Skipping link to a domain at MAX_PAGES_PER_DOMAIN")
+			continue
 		}
 
-		result, err := c.sqs.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
-			QueueUrl: &c.queueURL,
-			Entries:  entries,
-		})
-		if err != nil {
-			c.log.Error().Err(err).Int("batch_size", len(batch)).Msg("Failed to batch-enqueue links")
+		// Count the link against the global budget before it becomes a queued item
+		if err := c.reserveBudget(ctx); err != nil {
+			if errors.Is(err, errBudgetExhausted) {
+				c.log.Warn().Int64("max_total_urls", c.maxTotalURLs).Str("source", sourceURL).Msg("Crawl budget reached, not enqueueing further links")
+				break
+			}
+			c.log.Error().Err(err).Str("url", link).Msg("Failed to reserve crawl budget")
 			continue
 		}
 
-		enqueued += len(batch) - len(result.Failed)
-		for _, fail := range result.Failed {
-			c.log.Error().Str("id", *fail.Id).Str("code", *fail.Code).Msg("Failed to enqueue link in batch")
+		u := QueuedURL{URL: link, Canonical: canonical, Hash: urls.Hash(canonical), Depth: depth, Priority: priority, Ancestry: ancestry, Hint: hint}
+		if !c.queue().Add(ctx, u) {
+			c.refundBudget(ctx) // Already known; it was counted when first discovered
+			continue
 		}
+		pending = append(pending, u)
 	}
 
+	enqueued := c.queue().Enqueue(ctx, pending)
+
 	if newDomains > 0 {
 		c.log.Info().Int("new_domains", newDomains).Msg("Auto-discovered new domains")
 	}
 
 	return enqueued
 }
+
+// selectLinks applies LINK_POLICY to the links found on a page at depth, shaping the crawl:
+// "breadth" keeps every link of pages shallower than LINK_SAMPLE_DEPTH and samples LINKS_PER_PAGE
+// from deeper ones, so the crawl spreads wide near the seeds and thins out below; "depth" does the
+// reverse, narrowing the top levels so the budget goes down fewer paths. "all", or LINKS_PER_PAGE
+// unset, keeps every link.
+func (c *Crawler) selectLinks(links []string, depth int) []string {
+	if c.linksPerPage <= 0 || len(links) <= c.linksPerPage {
+		return links
+	}
+	switch c.linkPolicy {
+	case linkPolicyBreadth:
+		if depth < c.sampleDepth {
+			return links
+		}
+	case linkPolicyDepth:
+		if depth >= c.sampleDepth {
+			return links
+		}
+	default:
+		return links
+	}
+	return sampleLinks(links, c.linksPerPage)
+}
+
+// sampleLinks returns k of links spread evenly over the page, so a sample is not just the
+// navigation links pages tend to start with, and an unchanged page yields the same sample each crawl
+func sampleLinks(links []string, k int) []string {
+	sample := make([]string, k)
+	for i := range sample {
+		sample[i] = links[i*len(links)/k]
+	}
+	return sample
+}
+
+// oversizedURL returns why a discovered link is too large to enqueue, or "" if it is fine.
+// Very long URLs, deep paths and long query strings usually come from session-id loops or
+// bad relative resolution; they bloat DynamoDB and SQS and tend to lead into crawler traps.
+func (c *Crawler) oversizedURL(link, canonical string) string {
+	if c.maxURLLength > 0 && len(link) > c.maxURLLength {
+		return "length"
+	}
+	parsed, err := url.Parse(canonical)
+	if err != nil {
+		return ""
+	}
+	if c.maxPathSegs > 0 && len(strings.FieldsFunc(parsed.Path, func(r rune) bool { return r == '/' })) > c.maxPathSegs {
+		return "path_segments"
+	}
+	if c.maxParams > 0 && len(strings.FieldsFunc(parsed.RawQuery, func(r rune) bool { return r == '&' || r == ';' })) > c.maxParams {
+		return "query_params"
+	}
+	return ""
+}
+
+// queueFor picks the queue for a priority. SQS has no native priorities, so high-priority URLs
+// go to a separate queue with its own event source mapping; its pollers are never stuck behind
+// the backlog of discovered links in the main queue.
+func (c *Crawler) queueFor(priority string) string {
+	if priority == priorityHigh && c.highQueueURL != "" {
+		return c.highQueueURL
+	}
+	return c.queueURL
+}
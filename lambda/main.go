@@ -2,19 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
+	"lambda/internal/awsx"
 	"lambda/internal/ssrf"
+	"lambda/urls"
+	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
 	awsddb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	awssns "github.com/aws/aws-sdk-go-v2/service/sns"
 	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/rs/zerolog"
-	"github.com/temoto/robotstxt"
 )
 
 const (
@@ -23,38 +29,166 @@ const (
 	stateDone          = "done"
 	stateFailed        = "failed"
 	stateRobotsBlocked = "robots_blocked"
+	stateSkipped       = "skipped" // Deliberately not fetched, e.g. a declared Content-Length over MAX_BODY_BYTES
 
 	defaultMaxDepth        = 3    // Default max crawl depth
 	defaultCrawlDelay      = 1000 // Default delay between requests to same domain (ms)
-	robotsUserAgent        = "MyCrawler"
+	defaultRequeueJitterMs = 1000 // Default max +/- jitter added to requeue delays (ms)
+	defaultRetryBaseDelay  = 30   // Default first retry delay after a retriable failure (s), doubled per attempt
+	maxFetchAttempts       = 5    // Retriable failures give up after this many attempts (matches the DLQ maxReceiveCount)
+	defaultUserAgent       = "MyCrawler/1.0 (learning project)"
 	domainKeyPrefix        = "domain#"         // Prefix for domain rate limit keys in DynamoDB
 	allowedDomainKeyPrefix = "allowed_domain#" // Prefix for allowed domain keys in DynamoDB
+	crawlBudgetKey         = "crawl#budget"    // Counter item for MAX_TOTAL_URLS
+	crawlControlKey        = "crawl#control"   // Operator control item; paused = true stops fetching
+	crawlGlobalRateKey     = "crawl#global_rate"
 	domainStatusActive     = "active"
+	storageFormatRaw       = "raw"          // Separate raw.html.gz and text.txt.gz objects
+	storageFormatWARC      = "warc"         // Single gzipped WARC response record
+	keySchemeHash          = "hash"         // Object keys <url_hash>/raw.html.gz
+	keySchemeDomain        = "domain"       // Object keys <host>/<url_hash>/raw.html.gz, listable per domain
+	keySchemeContent       = "content"      // Object keys content/<sha256>.html.gz, shared by URLs serving identical bytes
+	rateLimitDelay         = "delay"        // Minimum gap between requests (CRAWL_DELAY_MS)
+	linkPolicyAll          = "all"          // LINK_POLICY default: every link of every page is enqueued
+	linkPolicyBreadth      = "breadth"      // Pages at LINK_SAMPLE_DEPTH or deeper enqueue LINKS_PER_PAGE of their links
+	linkPolicyDepth        = "depth"        // Pages shallower than LINK_SAMPLE_DEPTH enqueue LINKS_PER_PAGE of their links
+	defaultLinkSampleDepth = 1              // Page depth at which LINK_POLICY switches between keeping all links and sampling
+	rateLimitTokenBucket   = "token_bucket" // Sustained rate with bursts
+	defaultBucketCapacity  = 5              // Default burst size in requests
+	defaultBucketRefill    = 1.0            // Default refill rate in tokens per second
+	priorityHigh           = "high"         // Seeds and sitemaps
+	priorityNormal         = "normal"       // Discovered links
+	hintSitemap            = "sitemap"      // content_hint of a child sitemap's message; see contentHint
+	defaultAllowedSchemes  = "http,https"   // Link schemes crawled unless ALLOWED_SCHEMES says otherwise
+	defaultAllowedPorts    = "80,443"       // Explicit link ports crawled unless ALLOWED_PORTS says otherwise ("*" = any)
 
-	httpTimeout        = 10 * time.Second
-	maxBodySize        = 10 * 1024 * 1024 // 10MB
-	maxRobotsTxtSize   = 512 * 1024       // 512KB
-	itemTTL            = 7 * 24 * time.Hour
-	sqsMaxDelaySeconds = 900  // 15 minutes
-	maxRobotsCacheSize = 1000 // Max domains to cache robots.txt for
+	// Extensions of archives, installers, disk images and media: large, and never parsed for links
+	defaultSkipExtensions = ".zip,.gz,.tgz,.bz2,.xz,.tar,.rar,.7z,.exe,.msi,.dmg,.pkg,.deb,.rpm,.apk,.iso,.img,.bin,.jar," +
+		".mp4,.m4v,.mov,.avi,.mkv,.wmv,.flv,.webm,.mp3,.m4a,.wav,.flac,.ogg,.aac," +
+		".jpg,.jpeg,.png,.gif,.bmp,.tif,.tiff,.webp,.ico,.woff,.woff2,.ttf,.otf,.eot"
+
+	defaultFetchTimeout      = 10 * time.Second
+	defaultRobotsTimeout     = 5 * time.Second
+	defaultWebhookTimeout    = 2 * time.Second
+	defaultDialTimeout       = 10 * time.Second // TCP connect to one address
+	defaultTLSTimeout        = 10 * time.Second // TLS handshake
+	defaultTimeSafetyMargin  = 5 * time.Second  // Stop starting messages when less than this remains before the Lambda deadline
+	defaultCircuitWindow     = time.Minute      // Window CIRCUIT_FAILURE_THRESHOLD failures must fall within
+	defaultCircuitCooldown   = 10 * time.Minute // How long a tripped circuit keeps a domain paused
+	domainItemTTL            = 15 * time.Minute // Rate limit items expire this long after their last use (plus CRAWL_DELAY_MS)
+	pauseCacheTTL            = 15 * time.Second // How long a read of crawl#control's paused flag is reused
+	defaultMaxBodySize       = 10 * 1024 * 1024 // 10MB
+	maxRobotsTxtSize         = 512 * 1024       // 512KB
+	itemTTL                  = 7 * 24 * time.Hour
+	defaultProcessingTimeout = 5 * time.Minute // Default age after which a processing claim is considered stale
+	defaultRecrawlMaxAge     = 24 * time.Hour  // Default RECRAWL_MAX_AGE; below itemTTL, which deletes finished items
+	sqsMaxDelaySeconds       = 900             // 15 minutes
+	maxRobotsCacheSize       = 1000            // Max domains to cache robots.txt for
+	maxPathFilterCacheSize   = 1000            // Max hosts to cache compiled path filters for
+	defaultMaxRedirects      = 5               // Redirect hops fetchURL follows before failing as redirect_loop
+	hostBusyDelay            = 5               // Requeue delay (s) when a host is at MAX_PER_HOST_CONCURRENCY
+	pausedDelay              = 300             // Requeue delay (s) while crawl#control is paused
+	defaultMaxURLLength      = 2048            // Longer discovered URLs are skipped as likely crawler traps
+	defaultMaxPathSegments   = 32              // Deeper discovered paths are skipped (e.g. /a/b/a/b/... loops)
+	defaultMaxQueryParams    = 32              // Discovered URLs with more query parameters are skipped
+	defaultTrapSegRepeats    = 3               // Times one path segment may repeat before a URL looks like a trap
+	defaultTrapParamRepeats  = 5               // Times one query parameter may repeat before a URL looks like a trap
+	defaultMaxStoredLinks    = 500             // Outbound links stored on the item before they overflow to S3
+	defaultEmptyHTMLMinBytes = 1               // With RETRY_EMPTY_HTML, 200 HTML bodies shorter than this are retried
+	defaultMaxErrorLength    = 1024            // Byte cap on the saved fetch_error; transport errors can run to kilobytes
+	defaultMaxCTypeLength    = 256             // Byte cap on the saved content_type, which comes straight from the server
+	maxStoredLinksBytes      = 100 * 1024      // Byte cap on the outbound_links set, well under the 400KB item limit
+	maxStoredRedirectChain   = 10              // Cap on redirect_chain entries saved per item
+	maxStoredAncestry        = 10              // Cap on ancestry entries carried by messages and saved per item
+	maxStoredOpenGraph       = 16              // Cap on og:* / twitter:* properties saved in open_graph
+	redirectDrainBytes       = 64 * 1024       // Redirect bodies read before closing so the connection can be reused
+
+	saveKeysAttempts   = 3                      // saveS3Keys tries before flagging the item s3_orphaned
+	defaultKeysBackoff = 100 * time.Millisecond // Pause before the first saveS3Keys retry
+	defaultDDBRetries  = 3                      // Tries per state write when DynamoDB throttles
+	defaultDDBBackoff  = 50 * time.Millisecond  // Backoff ceiling before the first throttled-write retry
+	maxDDBBackoff      = time.Second            // Cap on the throttled-write backoff ceiling
 )
 
 type Crawler struct {
 	ddb           DynamoDBAPI
 	sqs           SQSAPI
 	s3            S3API
+	sns           SNSAPI
+	frontier      Frontier // URL queue and item state; nil is SQS and DynamoDB (sqsFrontier)
 	httpClient    *http.Client
+	insecureHTTP  *http.Client // httpClient without certificate checks, for hosts flagged insecure_tls only
+	hookClient    *http.Client // SSRF-safe client for COMPLETION_WEBHOOK_URL POSTs
 	tableName     string
 	queueURL      string
+	highQueueURL  string // Optional queue for high-priority URLs; empty routes everything to queueURL
 	contentBucket string
+	eventTopicARN string // Optional SNS topic for page-crawled events; empty disables publishing
+	webhookURL    string // COMPLETION_WEBHOOK_URL: POSTed a pageCompletedHook per page done; empty disables it
+	acceptLang    string // Accept-Language sent with page and robots.txt fetches; empty omits the header
+	userAgent     string // USER_AGENT sent with page and robots.txt fetches; its productToken is the robots.txt agent
+	jobID         string // JOB_ID stamped on items and messages whose message carries no job_id; empty for none
 	maxDepth      int
 	crawlDelayMs  int
+	rateLimitMode string
+	bucketSize    float64       // Token bucket capacity (token_bucket mode)
+	bucketRefill  float64       // Token bucket refill rate in tokens per second (token_bucket mode)
+	globalRPS     float64       // GLOBAL_MAX_RPS: fetches per second across all Lambdas, bucketed on crawl#global_rate (0 = disabled)
+	staleAfter    time.Duration // Processing claims older than this can be reclaimed
+	recrawlAfter  time.Duration // RECRAWL_MAX_AGE when RECRAWL is set: rediscovered items finished longer ago are reset; 0 never does
+	fetchTimeout  time.Duration // Per-request budget for page fetches, including the body read
+	robotsTimeout time.Duration // Per-request budget for robots.txt fetches
+	hookTimeout   time.Duration // WEBHOOK_TIMEOUT_MS: budget for each completion webhook POST
+	timeMargin    time.Duration // Remaining invocation time below which Handler defers the rest of the batch
+	keysBackoff   time.Duration // Pause before the first saveS3Keys retry, doubled per retry
+	keyScheme     string        // S3_KEY_SCHEME: hash (default), domain-partitioned or content-addressed object keys
+	linkPolicy    string        // LINK_POLICY: all, breadth or depth; see selectLinks
+	breakerWindow time.Duration // Failures older than this no longer count toward the circuit breaker
+	breakerCool   time.Duration // How long a tripped circuit pauses the domain
+	storageFormat string
+	skipEmptyText bool // Skip the text object upload when extraction yields no text
+	storeLinks    bool // STORE_LINKS: save each page's outbound links for link-graph analysis
+	maxLinks      int  // Outbound links kept on the item; longer lists go to S3 as links.json.gz
+	linksPerPage  int  // LINKS_PER_PAGE: links a sampled page enqueues (0 = no sampling)
+	sampleDepth   int  // LINK_SAMPLE_DEPTH: page depth where LINK_POLICY switches (see selectLinks)
+	minTextLength int  // Text shorter than this is flagged thin_content and not uploaded (0 = disabled)
+	minCompress   int  // Raw bodies shorter than this are stored uncompressed as raw.html (0 = always gzip)
+	domainPageCap int  // MAX_PAGES_PER_DOMAIN: pages_crawled at which a domain gets no more links or fetches (0 = unlimited)
+	maxErrorLen   int  // MAX_FETCH_ERROR_LENGTH: bytes of fetch_error saved on the item (0 = uncapped)
+	maxCTypeLen   int  // MAX_CONTENT_TYPE_LENGTH: bytes of content_type saved on the item (0 = uncapped)
+	maxBodyBytes  int64
+	maxRedirects  int        // Redirect hops followed before failing as redirect_loop
+	requeueJitter int        // Max +/- jitter in ms added to requeue delays (0 = disabled)
+	rng           *rand.Rand // Seeded source for jitter; not safe for concurrent use
+	retryBase     int        // First retry delay in seconds after a retriable failure, doubled per attempt
+	maxTotalURLs  int64      // Ceiling on URLs discovered across the crawl, counted in crawl#budget (0 = disabled)
+	maxPerHost    int        // Cap on concurrent fetches per rate-limit domain, counted in its in_flight (0 = disabled)
+	emptyHTMLMin  int        // RETRY_EMPTY_HTML: 200 HTML bodies shorter than this are retried until maxFetchAttempts (0 = disabled)
+	breakerMax    int        // Retriable failures within breakerWindow that trip a domain's circuit (0 = disabled)
+	maxURLLength  int        // Discovered links longer than this are not enqueued (0 = disabled)
+	maxPathSegs   int        // Discovered links with more path segments are not enqueued (0 = disabled)
+	maxParams     int        // Discovered links with more query parameters are not enqueued (0 = disabled)
+	trapSegs      int        // Times one path segment may repeat before urls.LooksLikeTrap flags a link
+	trapParams    int        // Times one query parameter may repeat before urls.LooksLikeTrap flags a link
+	autoDiscover  bool       // AUTO_DISCOVER_DOMAINS: allowlist third-party hosts of discovered links (the source page's own host always is)
+	noAllowlist   bool       // DISABLE_DOMAIN_ALLOWLIST: enqueueLinks follows links to any host, skipping allowlist and path filter reads
+	probeSitemap  bool       // PROBE_SITEMAP: queue /sitemap.xml of each host newly added to the allowlist
+	sameDomain    bool       // SAME_DOMAIN_ONLY: drop links outside the source page's host, never auto-discovering them
+	sameRegDomain bool       // SAME_DOMAIN_REGISTRABLE: with sameDomain, compare eTLD+1 so subdomains are kept
+	regScope      bool       // SCOPE_BY_REGISTRABLE_DOMAIN: allowlist and rate limits key off eTLD+1, not the full host
 	log           zerolog.Logger
-	robotsCache   map[string]*robotstxt.RobotsData // Cache robots.txt per domain
+	robotsCache   *robotsCache     // Cache robots.txt per domain
+	pathFilters   *pathFilterCache // Cache compiled path_allow / path_deny per host
+	pause         *pauseState      // Cached paused flag of the crawl#control item
+	skipExts      map[string]bool  // Discovered links whose path ends in one of these extensions are not enqueued
+	robotsAgents  []string         // ROBOTS_AGENTS: tokens tried against robots.txt groups in order, before falling back to *
+	includes      []string         // INCLUDE_PREFIXES: when set, only links whose path starts with one of these are enqueued
+	ddbRetry      awsx.Retry       // Retries state writes on DynamoDB throttling (DDB_RETRY_ATTEMPTS, DDB_RETRY_BASE_MS)
+	webhooks      sync.WaitGroup   // Completion webhook POSTs in flight; Handler waits for them
 }
 
 func NewCrawler(ctx context.Context) (*Crawler, error) {
-	log := zerolog.New(os.Stdout).With().Timestamp().Logger()
+	log := newLogger(os.Stdout)
 
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
@@ -71,6 +205,14 @@ func NewCrawler(ctx context.Context) (*Crawler, error) {
 		log.Fatal().Msg("QUEUE_URL environment variable not set")
 	}
 
+	highQueueURL := os.Getenv("HIGH_PRIORITY_QUEUE_URL")
+	eventTopicARN := os.Getenv("EVENT_TOPIC_ARN")
+	webhookURL := os.Getenv("COMPLETION_WEBHOOK_URL")
+	acceptLanguage := os.Getenv("ACCEPT_LANGUAGE")
+	userAgent := envUserAgent()
+	robotsAgents := parseAgents(os.Getenv("ROBOTS_AGENTS"), productToken(userAgent))
+	jobID := os.Getenv("JOB_ID")
+
 	contentBucket := os.Getenv("CONTENT_BUCKET")
 	if contentBucket == "" {
 		log.Fatal().Msg("CONTENT_BUCKET environment variable not set")
@@ -90,36 +232,457 @@ func NewCrawler(ctx context.Context) (*Crawler, error) {
 		}
 	}
 
-	log.Info().Int("max_depth", maxDepth).Int("crawl_delay_ms", crawlDelayMs).Str("content_bucket", contentBucket).Msg("Crawler initialized")
+	staleAfter := defaultProcessingTimeout
+	if timeoutStr := os.Getenv("PROCESSING_TIMEOUT"); timeoutStr != "" {
+		if parsed, err := time.ParseDuration(timeoutStr); err == nil && parsed > 0 {
+			staleAfter = parsed
+		}
+	}
+
+	// RECRAWL: a rediscovered URL whose crawl finished over RECRAWL_MAX_AGE ago is queued again
+	var recrawlAfter time.Duration
+	if envBool("RECRAWL", false) {
+		recrawlAfter = defaultRecrawlMaxAge
+		if maxAgeStr := os.Getenv("RECRAWL_MAX_AGE"); maxAgeStr != "" {
+			if parsed, err := time.ParseDuration(maxAgeStr); err == nil && parsed > 0 {
+				recrawlAfter = parsed
+			}
+		}
+	}
+
+	storageFormat := storageFormatRaw
+	if os.Getenv("STORAGE_FORMAT") == storageFormatWARC {
+		storageFormat = storageFormatWARC
+	}
+
+	keyScheme := keySchemeHash
+	switch scheme := os.Getenv("S3_KEY_SCHEME"); scheme {
+	case keySchemeDomain, keySchemeContent:
+		keyScheme = scheme
+	}
+
+	rateLimitMode := rateLimitDelay
+	if os.Getenv("RATE_LIMIT_MODE") == rateLimitTokenBucket {
+		rateLimitMode = rateLimitTokenBucket
+	}
+
+	bucketSize := float64(defaultBucketCapacity)
+	if capStr := os.Getenv("TOKEN_BUCKET_CAPACITY"); capStr != "" {
+		if parsed, err := strconv.ParseFloat(capStr, 64); err == nil && parsed >= 1 {
+			bucketSize = parsed
+		}
+	}
+
+	bucketRefill := defaultBucketRefill
+	if rateStr := os.Getenv("TOKEN_BUCKET_REFILL_PER_SEC"); rateStr != "" {
+		if parsed, err := strconv.ParseFloat(rateStr, 64); err == nil && parsed > 0 {
+			bucketRefill = parsed
+		}
+	}
+
+	globalRPS := 0.0
+	if rpsStr := os.Getenv("GLOBAL_MAX_RPS"); rpsStr != "" {
+		if parsed, err := strconv.ParseFloat(rpsStr, 64); err == nil && parsed > 0 {
+			globalRPS = parsed
+		}
+	}
+
+	requeueJitter := defaultRequeueJitterMs
+	if jitterStr := os.Getenv("REQUEUE_JITTER_MS"); jitterStr != "" {
+		if parsed, err := strconv.Atoi(jitterStr); err == nil && parsed >= 0 {
+			requeueJitter = parsed
+		}
+	}
+
+	retryBase := defaultRetryBaseDelay
+	if baseStr := os.Getenv("RETRY_BASE_DELAY_SECONDS"); baseStr != "" {
+		if parsed, err := strconv.Atoi(baseStr); err == nil && parsed > 0 {
+			retryBase = parsed
+		}
+	}
+
+	maxPerHost := 0
+	if perHostStr := os.Getenv("MAX_PER_HOST_CONCURRENCY"); perHostStr != "" {
+		if parsed, err := strconv.Atoi(perHostStr); err == nil && parsed > 0 {
+			maxPerHost = parsed
+		}
+	}
+
+	ddbRetry := awsx.Retry{
+		Attempts:  envInt("DDB_RETRY_ATTEMPTS", defaultDDBRetries),
+		BaseDelay: envMillis("DDB_RETRY_BASE_MS", defaultDDBBackoff),
+		MaxDelay:  maxDDBBackoff,
+	}
+
+	circuitThreshold := envInt("CIRCUIT_FAILURE_THRESHOLD", 0)
+	circuitWindow := envMillis("CIRCUIT_WINDOW_MS", defaultCircuitWindow)
+	circuitCooldown := envMillis("CIRCUIT_COOLDOWN_MS", defaultCircuitCooldown)
+
+	var maxTotalURLs int64
+	if maxStr := os.Getenv("MAX_TOTAL_URLS"); maxStr != "" {
+		if parsed, err := strconv.ParseInt(maxStr, 10, 64); err == nil && parsed >= 0 {
+			maxTotalURLs = parsed
+		}
+	}
+
+	skipEmptyText := envBool("SKIP_EMPTY_TEXT", true)
+	storeLinks := envBool("STORE_LINKS", false)
+	maxStoredLinks := envInt("MAX_STORED_LINKS", defaultMaxStoredLinks)
+	maxErrorLen := envCap("MAX_FETCH_ERROR_LENGTH", defaultMaxErrorLength)
+	maxCTypeLen := envCap("MAX_CONTENT_TYPE_LENGTH", defaultMaxCTypeLength)
+	linkPolicy := linkPolicyAll
+	switch policy := os.Getenv("LINK_POLICY"); policy {
+	case linkPolicyBreadth, linkPolicyDepth:
+		linkPolicy = policy
+	}
+	linksPerPage := envInt("LINKS_PER_PAGE", 0)
+	sampleDepth := envInt("LINK_SAMPLE_DEPTH", defaultLinkSampleDepth)
+	autoDiscover := envBool("AUTO_DISCOVER_DOMAINS", false)
+	noAllowlist := envBool("DISABLE_DOMAIN_ALLOWLIST", false)
+	probeSitemap := envBool("PROBE_SITEMAP", false)
+	sameDomainOnly := envBool("SAME_DOMAIN_ONLY", false)
+	sameDomainRegistrable := envBool("SAME_DOMAIN_REGISTRABLE", false)
+	scopeByRegistrable := envBool("SCOPE_BY_REGISTRABLE_DOMAIN", false)
+
+	maxBodyBytes := int64(defaultMaxBodySize)
+	if maxBodyStr := os.Getenv("MAX_BODY_BYTES"); maxBodyStr != "" {
+		if parsed, err := strconv.ParseInt(maxBodyStr, 10, 64); err == nil && parsed > 0 {
+			maxBodyBytes = parsed
+		}
+	}
+
+	// Parsed once into the urls package, which Normalize consults for every link
+	// Unset keeps the defaults; an empty value skips nothing
+	skipExtensions, ok := os.LookupEnv("SKIP_EXTENSIONS")
+	if !ok {
+		skipExtensions = defaultSkipExtensions
+	}
+	skipExts := parseExtensions(skipExtensions)
+	includes := parsePrefixes(os.Getenv("INCLUDE_PREFIXES"))
+
+	allowedSchemes := os.Getenv("ALLOWED_SCHEMES")
+	if allowedSchemes == "" {
+		allowedSchemes = defaultAllowedSchemes
+	}
+	urls.SetAllowedSchemes(strings.Split(allowedSchemes, ","))
+	preserveFragments := envBool("PRESERVE_FRAGMENTS", false)
+	urls.SetPreserveFragments(preserveFragments)
+	allowedPorts := os.Getenv("ALLOWED_PORTS")
+	if allowedPorts == "" {
+		allowedPorts = defaultAllowedPorts
+	}
+	urls.SetAllowedPorts(strings.Split(allowedPorts, ","))
+	rejectUserinfo := envBool("REJECT_USERINFO", false)
+	urls.SetRejectUserinfo(rejectUserinfo)
+
+	maxURLLength := envInt("MAX_URL_LENGTH", defaultMaxURLLength)
+	maxPathSegments := envInt("MAX_PATH_SEGMENTS", defaultMaxPathSegments)
+	maxQueryParams := envInt("MAX_QUERY_PARAMS", defaultMaxQueryParams)
+	trapSegRepeats := envInt("TRAP_MAX_SEGMENT_REPEATS", defaultTrapSegRepeats)
+	trapParamRepeats := envInt("TRAP_MAX_PARAM_REPEATS", defaultTrapParamRepeats)
+	maxRedirects := envInt("MAX_REDIRECTS", defaultMaxRedirects)
+
+	fetchTimeout := envMillis("FETCH_TIMEOUT_MS", defaultFetchTimeout)
+	robotsTimeout := envMillis("ROBOTS_TIMEOUT_MS", defaultRobotsTimeout)
+	hookTimeout := envMillis("WEBHOOK_TIMEOUT_MS", defaultWebhookTimeout)
+	timeouts := transportTimeouts()
+	timeMargin := envMillis("TIME_SAFETY_MARGIN_MS", defaultTimeSafetyMargin)
+
+	// Some servers answer 200 with an empty shell while warming up or overloaded
+	emptyHTMLMin := 0
+	if envBool("RETRY_EMPTY_HTML", false) {
+		emptyHTMLMin = envInt("EMPTY_HTML_MIN_BYTES", defaultEmptyHTMLMinBytes)
+	}
+
+	// Shared by ValidateHost and the SSRF-safe dialer for the lifetime of the container
+	dnsCacheTTL := envMillis("DNS_CACHE_TTL_MS", ssrf.DefaultDNSCacheTTL)
+	ssrf.SetDNSCacheTTL(dnsCacheTTL)
+
+	minCompress := envInt("MIN_COMPRESS_BYTES", 0)
+	maxDomainPages := envInt("MAX_PAGES_PER_DOMAIN", 0)
+	minTextLength := 0
+	if minStr := os.Getenv("MIN_TEXT_LENGTH"); minStr != "" {
+		if parsed, err := strconv.Atoi(minStr); err == nil && parsed >= 0 {
+			minTextLength = parsed
+		}
+	}
+
+	// One line per group of settings, so a config change shows up in a reviewable diff of the logs
+	log.Info().
+		Int("max_depth", maxDepth).
+		Int64("max_total_urls", maxTotalURLs).
+		Int("max_pages_per_domain", maxDomainPages).
+		Bool("disable_domain_allowlist", noAllowlist).
+		Bool("auto_discover_domains", autoDiscover).
+		Bool("probe_sitemap", probeSitemap).
+		Bool("same_domain_only", sameDomainOnly).
+		Bool("same_domain_registrable", sameDomainRegistrable).
+		Bool("scope_by_registrable_domain", scopeByRegistrable).
+		Str("allowed_schemes", allowedSchemes).
+		Bool("preserve_fragments", preserveFragments).
+		Str("allowed_ports", allowedPorts).
+		Bool("reject_userinfo", rejectUserinfo).
+		Int("skip_extensions", len(skipExts)).
+		Strs("include_prefixes", includes).
+		Int("max_url_length", maxURLLength).
+		Int("max_path_segments", maxPathSegments).
+		Int("max_query_params", maxQueryParams).
+		Int("trap_max_segment_repeats", trapSegRepeats).
+		Int("trap_max_param_repeats", trapParamRepeats).
+		Str("link_policy", linkPolicy).
+		Int("links_per_page", linksPerPage).
+		Int("link_sample_depth", sampleDepth).
+		Dur("recrawl_max_age", recrawlAfter).
+		Msg("Crawler config: scope")
+	log.Info().
+		Int("crawl_delay_ms", crawlDelayMs).
+		Str("rate_limit_mode", rateLimitMode).
+		Float64("global_max_rps", globalRPS).
+		Int("max_per_host_concurrency", maxPerHost).
+		Int("requeue_jitter_ms", requeueJitter).
+		Int("retry_base_delay_s", retryBase).
+		Int("circuit_failure_threshold", circuitThreshold).
+		Dur("circuit_window", circuitWindow).
+		Dur("circuit_cooldown", circuitCooldown).
+		Dur("processing_timeout", staleAfter).
+		Int("ddb_retry_attempts", ddbRetry.Attempts).
+		Dur("ddb_retry_base", ddbRetry.BaseDelay).
+		Msg("Crawler config: rate limiting")
+	log.Info().
+		Str("content_bucket", contentBucket).
+		Str("storage_format", storageFormat).
+		Str("s3_key_scheme", keyScheme).
+		Bool("skip_empty_text", skipEmptyText).
+		Int("min_text_length", minTextLength).
+		Int("min_compress_bytes", minCompress).
+		Bool("store_links", storeLinks).
+		Int("max_stored_links", maxStoredLinks).
+		Int("max_fetch_error_length", maxErrorLen).
+		Int("max_content_type_length", maxCTypeLen).
+		Bool("high_priority_queue", highQueueURL != "").
+		Bool("page_events", eventTopicARN != "").
+		Bool("completion_webhook", webhookURL != "").
+		Dur("webhook_timeout", hookTimeout).
+		Msg("Crawler config: storage")
+	log.Info().
+		Str("user_agent", userAgent).
+		Strs("robots_agents", robotsAgents).
+		Str("accept_language", acceptLanguage).
+		Dur("fetch_timeout", fetchTimeout).
+		Dur("robots_timeout", robotsTimeout).
+		Dur("dial_timeout", timeouts.Dial).
+		Dur("tls_timeout", timeouts.TLSHandshake).
+		Dur("response_header_timeout", timeouts.ResponseHeader).
+		Dur("time_safety_margin", timeMargin).
+		Dur("dns_cache_ttl", dnsCacheTTL).
+		Int64("max_body_bytes", maxBodyBytes).
+		Int("max_redirects", maxRedirects).
+		Int("empty_html_min_bytes", emptyHTMLMin).
+		Msg("Crawler config: fetch")
+	log.Info().
+		Str("job_id", jobID).
+		Str("log_level", log.GetLevel().String()).
+		Msg("Crawler initialized")
 
 	return &Crawler{
-		ddb: awsddb.NewFromConfig(cfg),
-		sqs: awssqs.NewFromConfig(cfg),
-		s3:  awss3.NewFromConfig(cfg),
-		httpClient: &http.Client{
-			Timeout:   httpTimeout,
-			Transport: ssrf.NewTransport(),
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-		},
+		ddb:           awsddb.NewFromConfig(cfg),
+		sqs:           awssqs.NewFromConfig(cfg),
+		s3:            awss3.NewFromConfig(cfg),
+		sns:           awssns.NewFromConfig(cfg),
+		httpClient:    newHTTPClient(timeouts),
+		hookClient:    newHTTPClient(timeouts),
+		insecureHTTP:  newInsecureHTTPClient(timeouts),
 		tableName:     tableName,
 		queueURL:      queueURL,
+		highQueueURL:  highQueueURL,
 		contentBucket: contentBucket,
+		eventTopicARN: eventTopicARN,
+		webhookURL:    webhookURL,
+		acceptLang:    acceptLanguage,
+		userAgent:     userAgent,
+		robotsAgents:  robotsAgents,
+		jobID:         jobID,
 		maxDepth:      maxDepth,
 		crawlDelayMs:  crawlDelayMs,
+		rateLimitMode: rateLimitMode,
+		bucketSize:    bucketSize,
+		bucketRefill:  bucketRefill,
+		globalRPS:     globalRPS,
+		staleAfter:    staleAfter,
+		recrawlAfter:  recrawlAfter,
+		fetchTimeout:  fetchTimeout,
+		robotsTimeout: robotsTimeout,
+		hookTimeout:   hookTimeout,
+		timeMargin:    timeMargin,
+		keysBackoff:   defaultKeysBackoff,
+		storageFormat: storageFormat,
+		keyScheme:     keyScheme,
+		breakerWindow: circuitWindow,
+		breakerCool:   circuitCooldown,
+		skipEmptyText: skipEmptyText,
+		storeLinks:    storeLinks,
+		maxLinks:      maxStoredLinks,
+		linkPolicy:    linkPolicy,
+		linksPerPage:  linksPerPage,
+		sampleDepth:   sampleDepth,
+		minTextLength: minTextLength,
+		minCompress:   minCompress,
+		domainPageCap: maxDomainPages,
+		maxErrorLen:   maxErrorLen,
+		maxCTypeLen:   maxCTypeLen,
+		maxBodyBytes:  maxBodyBytes,
+		maxRedirects:  maxRedirects,
+		requeueJitter: requeueJitter,
+		retryBase:     retryBase,
+		maxTotalURLs:  maxTotalURLs,
+		maxPerHost:    maxPerHost,
+		emptyHTMLMin:  emptyHTMLMin,
+		breakerMax:    circuitThreshold,
+		maxURLLength:  maxURLLength,
+		maxPathSegs:   maxPathSegments,
+		maxParams:     maxQueryParams,
+		trapSegs:      trapSegRepeats,
+		trapParams:    trapParamRepeats,
+		autoDiscover:  autoDiscover,
+		noAllowlist:   noAllowlist,
+		probeSitemap:  probeSitemap,
+		sameDomain:    sameDomainOnly,
+		sameRegDomain: sameDomainRegistrable,
+		regScope:      scopeByRegistrable,
+		rng:           rand.New(rand.NewSource(time.Now().UnixNano())),
 		log:           log,
-		robotsCache:   make(map[string]*robotstxt.RobotsData),
+		robotsCache:   newRobotsCache(maxRobotsCacheSize),
+		pathFilters:   newPathFilterCache(maxPathFilterCacheSize),
+		pause:         newPauseState(pauseCacheTTL),
+		skipExts:      skipExts,
+		includes:      includes,
+		ddbRetry:      ddbRetry,
 	}, nil
 }
 
-func main() {
-	ctx := context.Background()
+// newHTTPClient returns the SSRF-safe client used for page and robots.txt fetches.
+// Redirects are not followed by the client (fetchURL follows them itself so every hop
+// passes the SSRF check), and there is no client-level Timeout: fetchURL and
+// getRobots bound each request via its context, and timeouts bound its connection stages.
+func newHTTPClient(timeouts ssrf.Timeouts) *http.Client {
+	return &http.Client{
+		Transport: ssrf.NewTransport(timeouts),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
 
-	crawler, err := NewCrawler(ctx)
+// newInsecureHTTPClient is newHTTPClient skipping TLS certificate verification, for allowlisted
+// hosts whose item sets insecure_tls (expired or self-signed certificates). Only the certificate
+// check is off: the dialer, and so SSRF protection, is the same as newHTTPClient's.
+func newInsecureHTTPClient(timeouts ssrf.Timeouts) *http.Client {
+	client := newHTTPClient(timeouts)
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return client
+}
+
+// parseExtensions turns a comma-separated extension list (SKIP_EXTENSIONS) into a set of
+// lowercased extensions with a leading dot, so "ZIP" and ".zip" both match .zip
+func parseExtensions(list string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" || ext == "." {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[ext] = true
+	}
+	return exts
+}
+
+// newLogger builds the JSON logger writing to w. LOG_LEVEL (debug, info, warn, error) sets the
+// minimum level, defaulting to info; LOG_DEBUG_SAMPLE=N keeps one in N debug messages, so debug
+// logging can be switched on under load without flooding CloudWatch.
+func newLogger(w io.Writer) zerolog.Logger {
+	level, err := zerolog.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil || level == zerolog.NoLevel {
+		level = zerolog.InfoLevel
+	}
+	log := zerolog.New(w).Level(level).With().Timestamp().Logger()
+	if n := envInt("LOG_DEBUG_SAMPLE", 1); n > 1 {
+		log = log.Sample(zerolog.LevelSampler{DebugSampler: &zerolog.BasicSampler{N: uint32(n)}})
+	}
+	return log
+}
+
+// parsePrefixes turns a comma-separated path prefix list (INCLUDE_PREFIXES) into prefixes that
+// each start with a slash, so "docs/" and "/docs/" are the same. Returns nil for an empty list.
+func parsePrefixes(list string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(list, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// envUserAgent returns USER_AGENT, or defaultUserAgent when it is unset or has no product token
+func envUserAgent() string {
+	if ua := strings.TrimSpace(os.Getenv("USER_AGENT")); productToken(ua) != "" {
+		return ua
+	}
+	return defaultUserAgent
+}
+
+// envBool parses a boolean environment variable, falling back to def when unset or invalid
+func envBool(name string, def bool) bool {
+	parsed, err := strconv.ParseBool(os.Getenv(name))
 	if err != nil {
-		panic(err)
+		return def
 	}
+	return parsed
+}
+
+// envInt parses a positive integer from an environment variable, falling back to def
+func envInt(name string, def int) int {
+	parsed, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || parsed <= 0 {
+		return def
+	}
+	return parsed
+}
 
-	lambda.Start(crawler.Handler)
+// envCap parses a byte cap from an environment variable, falling back to def when unset, invalid
+// or negative. Unlike envInt it accepts 0, which turns the cap off.
+func envCap(name string, def int) int {
+	parsed, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || parsed < 0 {
+		return def
+	}
+	return parsed
+}
+
+// transportTimeouts reads the connection stage timeouts from DIAL_TIMEOUT_MS, TLS_TIMEOUT_MS and
+// RESPONSE_HEADER_TIMEOUT_MS. They sit inside FETCH_TIMEOUT_MS / ROBOTS_TIMEOUT_MS, which still
+// bound the whole request, so a stuck connection fails before a slow body could.
+func transportTimeouts() ssrf.Timeouts {
+	return ssrf.Timeouts{
+		Dial:           envMillis("DIAL_TIMEOUT_MS", defaultDialTimeout),
+		TLSHandshake:   envMillis("TLS_TIMEOUT_MS", defaultTLSTimeout),
+		ResponseHeader: envMillis("RESPONSE_HEADER_TIMEOUT_MS", 0),
+	}
+}
+
+// envMillis parses a positive millisecond count from an environment variable, falling back to def
+func envMillis(name string, def time.Duration) time.Duration {
+	parsed, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || parsed <= 0 {
+		return def
+	}
+	return time.Duration(parsed) * time.Millisecond
 }
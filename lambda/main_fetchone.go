@@ -0,0 +1,31 @@
+//go:build fetchone
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// Local dry run: fetch and parse one URL without touching AWS.
+//
+//	go run -tags fetchone . -url https://example.com
+func main() {
+	targetURL := flag.String("url", "", "URL to fetch and parse")
+	flag.Parse()
+
+	if *targetURL == "" {
+		fmt.Println("Usage: go run -tags fetchone . -url <url>")
+		os.Exit(1)
+	}
+
+	c := newLocalCrawler(zerolog.New(os.Stderr).With().Timestamp().Logger())
+	if err := c.writeFetchOne(context.Background(), *targetURL, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write report:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !fetchone && !selftest
+
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	ctx := context.Background()
+
+	crawler, err := NewCrawler(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	lambda.Start(crawler.Handler)
+}
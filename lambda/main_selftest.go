@@ -0,0 +1,30 @@
+//go:build selftest
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Deployment self-test: check the configured table, queues and bucket are reachable with the
+// current credentials and that a public URL can be fetched. Exits non-zero on any failure.
+//
+//	go run -tags selftest . -url https://example.com/
+func main() {
+	targetURL := flag.String("url", defaultSelfTestURL, "Public URL to fetch")
+	flag.Parse()
+
+	ctx := context.Background()
+	crawler, err := NewCrawler(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load configuration:", err)
+		os.Exit(1)
+	}
+
+	if !runSelfTest(ctx, crawler.selfTestChecks(*targetURL), os.Stdout) {
+		os.Exit(1)
+	}
+}
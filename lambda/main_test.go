@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerLevel(t *testing.T) {
+	tests := []struct {
+		name      string
+		level     string
+		wantDebug bool
+		wantInfo  bool
+		wantWarn  bool
+	}{
+		{"unset defaults to info", "", false, true, true},
+		{"debug", "debug", true, true, true},
+		{"warn suppresses info", "warn", false, false, true},
+		{"invalid defaults to info", "chatty", false, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", tt.level)
+			var buf bytes.Buffer
+			log := newLogger(&buf)
+
+			log.Debug().Msg("debug message")
+			log.Info().Msg("info message")
+			log.Warn().Msg("warn message")
+
+			out := buf.String()
+			for msg, want := range map[string]bool{"debug message": tt.wantDebug, "info message": tt.wantInfo, "warn message": tt.wantWarn} {
+				if got := strings.Contains(out, msg); got != want {
+					t.Errorf("%q logged = %v, want %v\n%s", msg, got, want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestNewLoggerSamplesDebug(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("LOG_DEBUG_SAMPLE", "3")
+	var buf bytes.Buffer
+	log := newLogger(&buf)
+
+	for range 9 {
+		log.Debug().Msg("debug message")
+		log.Info().Msg("info message")
+	}
+
+	out := buf.String()
+	if got := strings.Count(out, "debug message"); got != 3 {
+		t.Errorf("debug messages = %d, want 3 (one in three)", got)
+	}
+	if got := strings.Count(out, "info message"); got != 9 {
+		t.Errorf("info messages = %d, want all 9 (only debug is sampled)", got)
+	}
+}
+
+func TestEnvCap(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 256},
+		{"512", 512},
+		{"0", 0}, // Uncapped
+		{"-1", 256},
+		{"lots", 256},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_CONTENT_TYPE_LENGTH", tt.value)
+		if got := envCap("MAX_CONTENT_TYPE_LENGTH", 256); got != tt.want {
+			t.Errorf("envCap(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
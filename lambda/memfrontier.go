@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// memFrontier is a Frontier held in memory, for running the crawl loop locally and in tests without
+// SQS or DynamoDB. Next hands out queued URLs as the SQS records processMessage takes.
+// Nothing is persisted, and S3 keys saved by saveS3Keys still go to DynamoDB.
+type memFrontier struct {
+	mu           sync.Mutex
+	staleAfter   time.Duration
+	recrawlAfter time.Duration       // RECRAWL_MAX_AGE under RECRAWL: Add resets finished items older than this; 0 never does
+	items        map[string]*memItem // By url_hash
+	messages     []memMessage        // In the order queued
+	sent         int                 // Messages queued so far, for message IDs
+}
+
+// memItem is what memFrontier keeps per URL, the state attributes of its DynamoDB item
+type memItem struct {
+	status       string
+	attempts     int
+	processingAt time.Time
+	finished     time.Time
+	result       *FetchResult // Last saved fetch result, nil until one is saved
+}
+
+// memMessage is a queued URL with the job_id and crawl delay and max depth overrides it was queued under
+type memMessage struct {
+	QueuedURL
+	id          string
+	jobID       string
+	crawlDelay  int
+	hasDelay    bool
+	maxDepth    int
+	hasMaxDepth bool
+	visibleAt   time.Time
+}
+
+// newMemFrontier returns an empty frontier; a processing claim older than staleAfter can be taken over
+func newMemFrontier(staleAfter time.Duration) *memFrontier {
+	return &memFrontier{staleAfter: staleAfter, items: make(map[string]*memItem)}
+}
+
+// Add records the URL as queued unless its url_hash is already known. With recrawlAfter set, a
+// known URL in a terminal state finished longer ago than that is reset to queued instead.
+func (f *memFrontier) Add(_ context.Context, u QueuedURL) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if item, ok := f.items[u.Hash]; ok {
+		if f.recrawlAfter <= 0 || !terminalState(item.status) || time.Since(item.finished) <= f.recrawlAfter {
+			return false
+		}
+		item.status, item.attempts, item.processingAt = stateQueued, 0, time.Time{}
+		return true
+	}
+	f.items[u.Hash] = &memItem{status: stateQueued}
+	return true
+}
+
+// Enqueue queues every URL; memory never refuses one
+func (f *memFrontier) Enqueue(ctx context.Context, queued []QueuedURL) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range queued {
+		f.push(ctx, u, 0)
+	}
+	return len(queued)
+}
+
+// Requeue queues the URL again, handed out by Next once delaySeconds have passed
+func (f *memFrontier) Requeue(ctx context.Context, u QueuedURL, delaySeconds int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.push(ctx, u, delaySeconds)
+	return nil
+}
+
+// push appends a message for u; f.mu must be held
+func (f *memFrontier) push(ctx context.Context, u QueuedURL, delaySeconds int) {
+	f.sent++
+	m := memMessage{QueuedURL: u, id: "mem-" + strconv.Itoa(f.sent), visibleAt: time.Now().Add(time.Duration(delaySeconds) * time.Second)}
+	m.jobID, _ = ctx.Value(jobIDKey{}).(string)
+	m.crawlDelay, m.hasDelay = crawlDelayOverride(ctx)
+	m.maxDepth, m.hasMaxDepth = maxDepthOverride(ctx)
+	f.messages = append(f.messages, m)
+}
+
+// Next removes and returns the first message due, high priority first, as the SQS record
+// processMessage takes. ok is false when no message is due.
+func (f *memFrontier) Next() (record events.SQSMessage, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	pick := -1
+	for i, m := range f.messages {
+		if m.visibleAt.After(now) {
+			continue
+		}
+		if pick < 0 || (m.Priority == priorityHigh && f.messages[pick].Priority != priorityHigh) {
+			pick = i
+		}
+	}
+	if pick < 0 {
+		return events.SQSMessage{}, false
+	}
+	m := f.messages[pick]
+	f.messages = append(f.messages[:pick], f.messages[pick+1:]...)
+	return m.record(), true
+}
+
+// record returns the message as SQS would deliver it, with the attributes sqsFrontier sends
+func (m memMessage) record() events.SQSMessage {
+	attrs := map[string]events.SQSMessageAttribute{
+		"depth":    memAttr(strconv.Itoa(m.Depth)),
+		"priority": memAttr(m.Priority),
+		"url_hash": memAttr(m.Hash),
+	}
+	if m.hasDelay {
+		attrs["crawl_delay_ms"] = memAttr(strconv.Itoa(m.crawlDelay))
+	}
+	if m.hasMaxDepth {
+		attrs["max_depth"] = memAttr(strconv.Itoa(m.maxDepth))
+	}
+	if m.jobID != "" {
+		attrs["job_id"] = memAttr(m.jobID)
+	}
+	if len(m.Ancestry) > 0 {
+		attrs["parent_url"] = memAttr(m.Ancestry[0])
+		attrs["ancestry"] = memAttr(strings.Join(m.Ancestry, "\n"))
+	}
+	if m.Hint != "" {
+		attrs["content_hint"] = memAttr(m.Hint)
+	}
+	return events.SQSMessage{MessageId: m.id, Body: m.URL, MessageAttributes: attrs}
+}
+
+// memAttr returns a message attribute holding value
+func memAttr(value string) events.SQSMessageAttribute {
+	return events.SQSMessageAttribute{DataType: "String", StringValue: &value}
+}
+
+// Claim takes a queued URL, or one whose processing claim is older than staleAfter; an unknown
+// url_hash is lost, as the conditional update on a missing DynamoDB item would be
+func (f *memFrontier) Claim(_ context.Context, urlHash string) (claim, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[urlHash]
+	if !ok {
+		return claim{}, false, nil
+	}
+	now := time.Now()
+	if item.status != stateQueued && (item.status != stateProcessing || !item.processingAt.Before(now.Add(-f.staleAfter))) {
+		return claim{}, false, nil
+	}
+	item.status, item.processingAt = stateProcessing, now
+	item.attempts++
+	return claim{attempts: item.attempts, finished: item.finished}, true, nil
+}
+
+// Release resets the URL to queued, refunding the attempt unless countAttempt
+func (f *memFrontier) Release(_ context.Context, urlHash string, countAttempt bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if item, ok := f.items[urlHash]; ok {
+		item.status = stateQueued
+		if !countAttempt {
+			item.attempts--
+		}
+	}
+}
+
+// MarkStatus sets a terminal status
+func (f *memFrontier) MarkStatus(_ context.Context, urlHash, status string) error {
+	f.finish(urlHash, status, nil)
+	return nil
+}
+
+// MarkNotModified marks the URL done again; the result it was saved with last is kept
+func (f *memFrontier) MarkNotModified(_ context.Context, _, urlHash string, _ *FetchResult) error {
+	f.finish(urlHash, stateDone, nil)
+	return nil
+}
+
+// Save keeps the fetch result and sets the status it implies
+func (f *memFrontier) Save(_ context.Context, _, urlHash string, result *FetchResult, _ int) error {
+	f.finish(urlHash, resultStatus(result), result)
+	return nil
+}
+
+// finish sets a URL's final status and finish time, and its result when one is given
+func (f *memFrontier) finish(urlHash, status string, result *FetchResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[urlHash]
+	if !ok {
+		item = &memItem{}
+		f.items[urlHash] = item
+	}
+	item.status, item.finished = status, time.Now()
+	if result != nil {
+		item.result = result
+	}
+}
+
+// status returns the URL's status, or "" for one never added
+func (f *memFrontier) status(urlHash string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if item, ok := f.items[urlHash]; ok {
+		return item.status
+	}
+	return ""
+}
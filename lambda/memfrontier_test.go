@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"lambda/urls"
+	"testing"
+	"time"
+)
+
+// newMemCrawler returns a test crawler whose frontier is in memory and that has no DynamoDB or SQS
+// client, so any call that skips the frontier panics
+func newMemCrawler() (*Crawler, *memFrontier) {
+	f := newMemFrontier(defaultProcessingTimeout)
+	c := newTestCrawler()
+	c.ddb, c.sqs = nil, nil
+	c.frontier = f
+	c.noAllowlist = true
+	return c, f
+}
+
+func TestMemFrontierClaimLifecycle(t *testing.T) {
+	ctx := context.Background()
+	f := newMemFrontier(time.Minute)
+	u := QueuedURL{URL: "https://example.com/", Hash: "h1", Priority: priorityNormal}
+
+	if !f.Add(ctx, u) || f.Add(ctx, u) {
+		t.Fatal("Add() should record a URL once")
+	}
+	if _, won, _ := f.Claim(ctx, "unknown"); won {
+		t.Error("Claim() of an unknown url_hash won")
+	}
+
+	claimed, won, err := f.Claim(ctx, "h1")
+	if err != nil || !won || claimed.attempts != 1 {
+		t.Fatalf("Claim() = %+v, %v, %v, want attempt 1 won", claimed, won, err)
+	}
+	if _, won, _ := f.Claim(ctx, "h1"); won {
+		t.Error("second Claim() won a fresh processing claim")
+	}
+
+	f.Release(ctx, "h1", false)
+	if claimed, won, _ := f.Claim(ctx, "h1"); !won || claimed.attempts != 1 {
+		t.Errorf("Claim() after an uncounted release = %+v, %v, want attempt 1 again", claimed, won)
+	}
+	f.items["h1"].processingAt = time.Now().Add(-2 * time.Minute)
+	if claimed, won, _ := f.Claim(ctx, "h1"); !won || claimed.attempts != 2 {
+		t.Errorf("Claim() of a stale claim = %+v, %v, want it taken over as attempt 2", claimed, won)
+	}
+
+	if err := f.Save(ctx, u.URL, "h1", &FetchResult{FailureKind: FailureTooLarge}, 0); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if got := f.status("h1"); got != stateSkipped {
+		t.Errorf("status = %q, want %q", got, stateSkipped)
+	}
+	if _, won, _ := f.Claim(ctx, "h1"); won {
+		t.Error("Claim() of a finished URL won")
+	}
+}
+
+func TestMemFrontierNext(t *testing.T) {
+	ctx := withJobID(withMaxDepth(withCrawlDelay(context.Background(), 250), 5), "june-crawl")
+	f := newMemFrontier(time.Minute)
+
+	f.Enqueue(ctx, []QueuedURL{
+		{URL: "https://example.com/a", Hash: "a", Depth: 2, Priority: priorityNormal, Ancestry: []string{"https://example.com/"}},
+		{URL: "https://example.com/sitemap.xml", Hash: "s", Depth: 2, Priority: priorityHigh},
+	})
+	_ = f.Requeue(ctx, QueuedURL{URL: "https://example.com/later", Hash: "l", Priority: priorityNormal}, 60)
+
+	record, ok := f.Next()
+	if !ok || record.Body != "https://example.com/sitemap.xml" {
+		t.Fatalf("Next() = %q, %v, want the high-priority sitemap first", record.Body, ok)
+	}
+	record, ok = f.Next()
+	if !ok || record.Body != "https://example.com/a" {
+		t.Fatalf("Next() = %q, %v, want https://example.com/a", record.Body, ok)
+	}
+
+	c := newTestCrawler()
+	if got := c.extractDepth(&record); got != 2 {
+		t.Errorf("depth = %d, want 2", got)
+	}
+	if got := c.extractURLHash(&record); got != "a" {
+		t.Errorf("url_hash = %q, want a", got)
+	}
+	if got := c.extractJobID(&record); got != "june-crawl" {
+		t.Errorf("job_id = %q, want june-crawl", got)
+	}
+	if got, ok := c.extractCrawlDelay(&record); !ok || got != 250 {
+		t.Errorf("crawl_delay_ms = %d, %v, want 250", got, ok)
+	}
+	if got, ok := c.extractMaxDepth(&record); !ok || got != 5 {
+		t.Errorf("max_depth = %d, %v, want 5", got, ok)
+	}
+	if got := c.extractAncestry(&record); len(got) != 1 || got[0] != "https://example.com/" {
+		t.Errorf("ancestry = %v, want the parent", got)
+	}
+
+	if record, ok := f.Next(); ok {
+		t.Errorf("Next() = %q, want nothing due before the requeue delay", record.Body)
+	}
+}
+
+// TestEnqueueLinksWithMemFrontier runs link discovery and the claim step of processMessage against
+// the in-memory frontier, with no AWS clients at all
+func TestEnqueueLinksWithMemFrontier(t *testing.T) {
+	c, f := newMemCrawler()
+	ctx := context.Background()
+
+	links := []string{"https://example.com/a", "https://example.com/b", "https://example.com/a#top"}
+	if got := c.enqueueLinks(ctx, links, 1, "https://example.com/"); got != 2 {
+		t.Fatalf("enqueueLinks() = %d, want 2", got)
+	}
+	if got := c.enqueueLinks(ctx, []string{"https://example.com/b", "https://example.com/c"}, 1, "https://example.com/"); got != 1 {
+		t.Errorf("enqueueLinks() of a known link = %d, want only the new one queued", got)
+	}
+
+	var bodies []string
+	for {
+		record, ok := f.Next()
+		if !ok {
+			break
+		}
+		bodies = append(bodies, record.Body)
+		if got := f.status(c.extractURLHash(&record)); got != stateQueued {
+			t.Errorf("%s status = %q, want queued", record.Body, got)
+		}
+		if record.Body == "https://example.com/c" {
+			// Another worker holds the claim, so processMessage stops before touching anything else
+			if _, won, _ := c.claimURL(ctx, urls.Hash(urls.Canonicalize(record.Body))); !won {
+				t.Fatal("claimURL() lost on a queued URL")
+			}
+			if got, err := c.processMessage(ctx, &record); err != nil || got != outcomeSkipped {
+				t.Errorf("processMessage() = %v, %v, want skipped", got, err)
+			}
+		}
+	}
+	if len(bodies) != 3 {
+		t.Errorf("queued %v, want a, b and c once each", bodies)
+	}
+}
+
+func TestRequeueWithDelayMemFrontier(t *testing.T) {
+	c, f := newMemCrawler()
+	ctx := withAncestry(context.Background(), []string{"https://example.com/"})
+
+	if err := c.requeueWithDelay(ctx, "https://example.com/a", "a", 1, priorityNormal, 0); err != nil {
+		t.Fatalf("requeueWithDelay() error = %v", err)
+	}
+	record, ok := f.Next()
+	if !ok || record.Body != "https://example.com/a" {
+		t.Fatalf("Next() = %q, %v, want the requeued URL", record.Body, ok)
+	}
+	if got := c.extractAncestry(&record); len(got) != 1 || got[0] != "https://example.com/" {
+		t.Errorf("ancestry = %v, want it kept", got)
+	}
+}
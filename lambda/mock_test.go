@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"io"
+	"lambda/internal/awsx"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/rs/zerolog"
-	"github.com/temoto/robotstxt"
 )
 
 func noopLogger() zerolog.Logger {
@@ -31,20 +35,31 @@ type mockRoundTripper struct {
 func (m *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	rr := httptest.NewRecorder()
 	m.handler.ServeHTTP(rr, req)
+	// Surface cancellation like a real transport would when the handler gave up on the request
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
 	return rr.Result(), nil
 }
 
 // testHTTPClientWith returns an http.Client that routes requests through the given handler
-// bypassing real network calls and SSRF checks on loopback
+// bypassing real network calls and SSRF checks on loopback.
+// Like newHTTPClient, it leaves redirects for fetchURL to follow.
 func testHTTPClientWith(handler http.Handler) *http.Client {
-	return &http.Client{Transport: &mockRoundTripper{handler: handler}}
+	return &http.Client{
+		Transport: &mockRoundTripper{handler: handler},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 }
 
 // mockDynamoDB implements DynamoDBAPI for testing
 type mockDynamoDB struct {
-	getItemFunc    func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
-	putItemFunc    func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
-	updateItemFunc func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	getItemFunc       func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	putItemFunc       func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	updateItemFunc    func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	describeTableFunc func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
 }
 
 func (m *mockDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
@@ -68,10 +83,18 @@ func (m *mockDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateIt
 	return &dynamodb.UpdateItemOutput{}, nil
 }
 
+func (m *mockDynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	if m.describeTableFunc != nil {
+		return m.describeTableFunc(ctx, params, optFns...)
+	}
+	return &dynamodb.DescribeTableOutput{}, nil
+}
+
 // mockSQS implements SQSAPI for testing
 type mockSQS struct {
-	sendMessageFunc      func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
-	sendMessageBatchFunc func(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+	sendMessageFunc        func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	sendMessageBatchFunc   func(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+	getQueueAttributesFunc func(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
 }
 
 func (m *mockSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
@@ -88,9 +111,17 @@ func (m *mockSQS) SendMessageBatch(ctx context.Context, params *sqs.SendMessageB
 	return &sqs.SendMessageBatchOutput{}, nil
 }
 
+func (m *mockSQS) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	if m.getQueueAttributesFunc != nil {
+		return m.getQueueAttributesFunc(ctx, params, optFns...)
+	}
+	return &sqs.GetQueueAttributesOutput{}, nil
+}
+
 // mockS3 implements S3API for testing
 type mockS3 struct {
-	putObjectFunc func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	putObjectFunc  func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	headBucketFunc func(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
 }
 
 func (m *mockS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
@@ -100,6 +131,27 @@ func (m *mockS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFn
 	return &s3.PutObjectOutput{}, nil
 }
 
+func (m *mockS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if m.headBucketFunc != nil {
+		return m.headBucketFunc(ctx, params, optFns...)
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+// mockSNS implements SNSAPI for testing
+type mockSNS struct {
+	publishFunc func(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+func (m *mockSNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	if m.publishFunc != nil {
+		return m.publishFunc(ctx, params, optFns...)
+	}
+	return &sns.PublishOutput{}, nil
+}
+
+const testQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789/test-queue"
+
 // newTestCrawler creates a Crawler with mock dependencies for testing
 func newTestCrawler() *Crawler {
 	return newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, &mockS3{})
@@ -110,15 +162,50 @@ func newTestCrawlerWithMocks(ddb DynamoDBAPI, sqsClient SQSAPI, s3Client S3API)
 		ddb:           ddb,
 		sqs:           sqsClient,
 		s3:            s3Client,
+		sns:           &mockSNS{},
 		tableName:     "test-table",
-		queueURL:      "https://sqs.us-east-1.amazonaws.com/123456789/test-queue",
+		queueURL:      testQueueURL,
 		contentBucket: "test-bucket",
 		maxDepth:      3,
 		crawlDelayMs:  1000,
+		rateLimitMode: rateLimitDelay,
+		bucketSize:    defaultBucketCapacity,
+		bucketRefill:  defaultBucketRefill,
+		staleAfter:    defaultProcessingTimeout,
+		fetchTimeout:  defaultFetchTimeout,
+		robotsTimeout: defaultRobotsTimeout,
+		hookTimeout:   defaultWebhookTimeout,
+		timeMargin:    defaultTimeSafetyMargin,
+		keysBackoff:   time.Millisecond,
+		storageFormat: storageFormatRaw,
+		keyScheme:     keySchemeHash,
+		breakerWindow: defaultCircuitWindow,
+		breakerCool:   defaultCircuitCooldown,
+		skipEmptyText: true,
+		maxLinks:      defaultMaxStoredLinks,
+		linkPolicy:    linkPolicyAll,
+		sampleDepth:   defaultLinkSampleDepth,
+		maxErrorLen:   defaultMaxErrorLength,
+		maxCTypeLen:   defaultMaxCTypeLength,
+		maxBodyBytes:  defaultMaxBodySize,
+		maxRedirects:  defaultMaxRedirects,
+		maxURLLength:  defaultMaxURLLength,
+		maxPathSegs:   defaultMaxPathSegments,
+		maxParams:     defaultMaxQueryParams,
+		trapSegs:      defaultTrapSegRepeats,
+		trapParams:    defaultTrapParamRepeats,
+		rng:           rand.New(rand.NewSource(1)),
+		retryBase:     defaultRetryBaseDelay,
 		log:           noopLogger(),
-		robotsCache:   make(map[string]*robotstxt.RobotsData),
+		robotsCache:   newRobotsCache(maxRobotsCacheSize),
+		userAgent:     defaultUserAgent,
+		robotsAgents:  []string{productToken(defaultUserAgent)},
+		pathFilters:   newPathFilterCache(maxPathFilterCacheSize),
+		pause:         newPauseState(pauseCacheTTL),
+		skipExts:      parseExtensions(defaultSkipExtensions),
+		ddbRetry:      awsx.Retry{Attempts: defaultDDBRetries, BaseDelay: time.Millisecond},
 	}
 }
 
 // errConditionalCheckFailed simulates a DynamoDB conditional check failure
-var errConditionalCheckFailed = fmt.Errorf("ConditionalCheckFailedException")
+var errConditionalCheckFailed error = &dynamodbtypes.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// pathFilter restricts which URL paths of a host are enqueued, from the allowlist item's
+// optional path_allow / path_deny regexes. A nil pattern does not constrain.
+type pathFilter struct {
+	allow *regexp.Regexp
+	deny  *regexp.Regexp
+}
+
+// allows reports whether link's path matches allow (if set) and does not match deny (if set).
+// A nil filter allows everything.
+func (f *pathFilter) allows(link string) bool {
+	if f == nil {
+		return true
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	path := parsed.Path
+	if path == "" {
+		path = "/"
+	}
+	if f.allow != nil && !f.allow.MatchString(path) {
+		return false
+	}
+	return f.deny == nil || !f.deny.MatchString(path)
+}
+
+// getPathFilter returns the compiled path filter for host, loading it from the allowlist item
+// on first use. Invalid regexes are logged and ignored (fail-open). Returns nil when the host
+// has no patterns; DynamoDB errors are not cached so the next link retries the lookup.
+func (c *Crawler) getPathFilter(ctx context.Context, host string) *pathFilter {
+	if filter, ok := c.pathFilters.get(host); ok {
+		return filter
+	}
+
+	result, err := c.ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: allowedDomainKeyPrefix + c.scopeHost(host)},
+		},
+		ProjectionExpression: aws.String("path_allow, path_deny"),
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Str("domain", host).Msg("Failed to load path filter, allowing all paths")
+		return nil
+	}
+
+	compile := func(name string) *regexp.Regexp {
+		attr, ok := result.Item[name].(*dynamodbtypes.AttributeValueMemberS)
+		if !ok || attr.Value == "" {
+			return nil
+		}
+		re, err := regexp.Compile(attr.Value)
+		if err != nil {
+			c.log.Warn().Err(err).Str("domain", host).Str("attribute", name).Str("pattern", attr.Value).Msg("Ignoring invalid path regex")
+			return nil
+		}
+		return re
+	}
+
+	var filter *pathFilter
+	if allow, deny := compile("path_allow"), compile("path_deny"); allow != nil || deny != nil {
+		filter = &pathFilter{allow: allow, deny: deny}
+	}
+	c.pathFilters.set(host, filter)
+	return filter
+}
+
+// pathFilterCache holds compiled path filters per host. A nil entry records a host with no
+// patterns so its allowlist item is not read again. Safe for concurrent use.
+type pathFilterCache struct {
+	mu      sync.RWMutex
+	entries map[string]*pathFilter
+	maxSize int
+}
+
+func newPathFilterCache(maxSize int) *pathFilterCache {
+	return &pathFilterCache{entries: make(map[string]*pathFilter), maxSize: maxSize}
+}
+
+// get returns the cached filter for host and whether one exists
+func (pc *pathFilterCache) get(host string) (*pathFilter, bool) {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	filter, ok := pc.entries[host]
+	return filter, ok
+}
+
+// set stores filter for host, evicting a random entry first if a new host would exceed maxSize
+func (pc *pathFilterCache) set(host string, filter *pathFilter) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if _, ok := pc.entries[host]; !ok && len(pc.entries) >= pc.maxSize {
+		for k := range pc.entries {
+			delete(pc.entries, k)
+			break
+		}
+	}
+	pc.entries[host] = filter
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog"
+)
+
+func TestEnqueueLinksPathFilter(t *testing.T) {
+	links := []string{
+		"https://example.com/",
+		"https://example.com/blog/post-1",
+		"https://example.com/blog/drafts/post-2",
+		"https://example.com/admin/settings",
+		"https://example.com/about",
+	}
+
+	tests := []struct {
+		name  string
+		attrs map[string]string
+		want  []string
+	}{
+		{
+			name:  "no patterns",
+			attrs: nil,
+			want:  links,
+		},
+		{
+			name:  "allow only",
+			attrs: map[string]string{"path_allow": "^/blog/"},
+			want:  []string{"https://example.com/blog/post-1", "https://example.com/blog/drafts/post-2"},
+		},
+		{
+			name:  "deny only",
+			attrs: map[string]string{"path_deny": "^/admin/"},
+			want:  []string{"https://example.com/", "https://example.com/blog/post-1", "https://example.com/blog/drafts/post-2", "https://example.com/about"},
+		},
+		{
+			name:  "allow and deny",
+			attrs: map[string]string{"path_allow": "^/blog/", "path_deny": "/drafts/"},
+			want:  []string{"https://example.com/blog/post-1"},
+		},
+		{
+			name:  "invalid allow ignored",
+			attrs: map[string]string{"path_allow": "^/blog/(", "path_deny": "^/admin/"},
+			want:  []string{"https://example.com/", "https://example.com/blog/post-1", "https://example.com/blog/drafts/post-2", "https://example.com/about"},
+		},
+		{
+			name:  "invalid deny ignored",
+			attrs: map[string]string{"path_deny": "[admin"},
+			want:  links,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := authItemDDB(tt.attrs)
+			ddb.putItemFunc = func(_ context.Context, _ *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+				return &dynamodb.PutItemOutput{}, nil
+			}
+
+			var sent []string
+			sqsClient := &mockSQS{
+				sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+					for _, e := range input.Entries {
+						sent = append(sent, *e.MessageBody)
+					}
+					return &sqs.SendMessageBatchOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.enqueueLinks(context.Background(), links, 1, "https://example.com")
+
+			if strings.Join(sent, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("enqueued %v, want %v", sent, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPathFilterLogsInvalidRegex(t *testing.T) {
+	var buf bytes.Buffer
+	c := newTestCrawlerWithMocks(authItemDDB(map[string]string{"path_allow": "(unclosed"}), &mockSQS{}, &mockS3{})
+	c.log = zerolog.New(&buf)
+
+	if filter := c.getPathFilter(context.Background(), "example.com"); filter != nil {
+		t.Errorf("getPathFilter() = %+v, want nil when the only pattern is invalid", filter)
+	}
+	if !strings.Contains(buf.String(), "Ignoring invalid path regex") {
+		t.Errorf("expected invalid regex warning, got log %q", buf.String())
+	}
+}
+
+func TestGetPathFilterCachesPerHost(t *testing.T) {
+	ddb := authItemDDB(map[string]string{"path_deny": "^/admin/"})
+	lookups := 0
+	getItem := ddb.getItemFunc
+	ddb.getItemFunc = func(ctx context.Context, input *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+		lookups++
+		return getItem(ctx, input, optFns...)
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	for range 3 {
+		c.getPathFilter(context.Background(), "example.com")
+	}
+	c.getPathFilter(context.Background(), "other.com")
+
+	if lookups != 2 {
+		t.Errorf("GetItem calls = %d, want 2 (one per host)", lookups)
+	}
+}
+
+func TestPathFilterAllows(t *testing.T) {
+	var nilFilter *pathFilter
+	if !nilFilter.allows("https://example.com/anything") {
+		t.Error("nil filter should allow everything")
+	}
+
+	c := newTestCrawlerWithMocks(authItemDDB(map[string]string{"path_allow": "^/$"}), &mockSQS{}, &mockS3{})
+	filter := c.getPathFilter(context.Background(), "example.com")
+	if !filter.allows("https://example.com") {
+		t.Error("empty path should match as /")
+	}
+	if filter.allows("https://example.com/page") {
+		t.Error("/page should not match ^/$")
+	}
+}
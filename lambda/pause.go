@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// pauseState caches the paused flag of the crawl#control item, so pausing or resuming the crawl
+// takes effect within pauseCacheTTL without a GetItem per message. Safe for concurrent use.
+type pauseState struct {
+	mu        sync.Mutex
+	paused    bool
+	checkedAt time.Time // Zero until the first successful read
+	ttl       time.Duration
+	now       func() time.Time
+}
+
+func newPauseState(ttl time.Duration) *pauseState {
+	return &pauseState{ttl: ttl, now: time.Now}
+}
+
+// cached returns the last value read and whether it is still fresh
+func (ps *pauseState) cached() (paused, fresh bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.paused, !ps.checkedAt.IsZero() && ps.now().Sub(ps.checkedAt) < ps.ttl
+}
+
+// store records a value just read from DynamoDB
+func (ps *pauseState) store(paused bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.paused = paused
+	ps.checkedAt = ps.now()
+}
+
+// isPaused reports whether an operator has set paused = true on the crawl#control item.
+// A failed read keeps the last known value (not paused on a cold start) and is retried by the
+// next message rather than cached.
+func (c *Crawler) isPaused(ctx context.Context) bool {
+	paused, fresh := c.pause.cached()
+	if fresh {
+		return paused
+	}
+
+	result, err := c.ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: crawlControlKey},
+		},
+		ProjectionExpression: aws.String("paused"),
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Bool("paused", paused).Msg("Failed to read crawl control item, keeping last known state")
+		return paused
+	}
+
+	flag, ok := result.Item["paused"].(*dynamodbtypes.AttributeValueMemberBOOL)
+	paused = ok && flag.Value
+	c.pause.store(paused)
+	return paused
+}
+
+// handlePaused releases the claim without counting an attempt and requeues the URL for after
+// pausedDelay, so a paused crawl cycles its backlog through the queue without fetching anything
+func (c *Crawler) handlePaused(ctx context.Context, targetURL, urlHash string, depth int, priority string) error {
+	c.log.Info().Str("url", targetURL).Int("delay_s", pausedDelay).Msg("Crawl paused, re-queuing")
+
+	c.releaseClaim(ctx, urlHash, false)
+	return c.requeueWithDelay(ctx, targetURL, urlHash, depth, priority, pausedDelay)
+}
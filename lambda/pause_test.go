@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// controlDDB serves a crawl#control item with the given paused flag (nil for no item),
+// counting reads of it, and no other items
+func controlDDB(paused *bool, reads *int) *mockDynamoDB {
+	return &mockDynamoDB{
+		getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			if input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value != crawlControlKey {
+				return &dynamodb.GetItemOutput{}, nil
+			}
+			*reads++
+			if paused == nil {
+				return &dynamodb.GetItemOutput{}, nil
+			}
+			return &dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+				"paused": &dynamodbtypes.AttributeValueMemberBOOL{Value: *paused},
+			}}, nil
+		},
+	}
+}
+
+func TestProcessMessagePaused(t *testing.T) {
+	tests := []struct {
+		name        string
+		paused      *bool
+		wantOutcome outcome
+		wantFetched bool
+	}{
+		{"paused", aws.Bool(true), outcomePaused, false},
+		{"resumed", aws.Bool(false), outcomeSucceeded, true},
+		{"no control item", nil, outcomeSucceeded, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reads := 0
+			ddb := controlDDB(tt.paused, &reads)
+			var releasedQueued bool
+			ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+				if q, ok := input.ExpressionAttributeValues[":queued"].(*dynamodbtypes.AttributeValueMemberS); ok && q.Value == stateQueued {
+					releasedQueued = true
+				}
+				return &dynamodb.UpdateItemOutput{}, nil
+			}
+			var requeued *sqs.SendMessageInput
+			sqsClient := &mockSQS{
+				sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+					requeued = input
+					return &sqs.SendMessageOutput{}, nil
+				},
+			}
+
+			fetched := false
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.requeueJitter = 0
+			c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/robots.txt" {
+					fetched = true
+				}
+			}))
+
+			got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+			if err != nil {
+				t.Fatalf("processMessage() error = %v", err)
+			}
+			if got != tt.wantOutcome {
+				t.Errorf("outcome = %v, want %v", got, tt.wantOutcome)
+			}
+			if fetched != tt.wantFetched {
+				t.Errorf("fetched = %v, want %v", fetched, tt.wantFetched)
+			}
+			if reads != 1 {
+				t.Errorf("control item read %d times, want 1", reads)
+			}
+			if !tt.wantFetched {
+				if !releasedQueued {
+					t.Error("claim not released back to queued")
+				}
+				if requeued == nil || requeued.DelaySeconds != pausedDelay {
+					t.Errorf("requeued = %+v, want a requeue after %ds", requeued, pausedDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestIsPausedCachesRead(t *testing.T) {
+	paused := true
+	reads := 0
+	c := newTestCrawlerWithMocks(controlDDB(&paused, &reads), &mockSQS{}, &mockS3{})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.pause.now = func() time.Time { return now }
+
+	if !c.isPaused(context.Background()) {
+		t.Fatal("isPaused() = false, want true")
+	}
+
+	// An operator resumes the crawl; the cached value holds until pauseCacheTTL has passed
+	paused = false
+	now = now.Add(pauseCacheTTL - time.Second)
+	if !c.isPaused(context.Background()) || reads != 1 {
+		t.Errorf("isPaused() within the TTL read the item again (reads = %d) or changed value", reads)
+	}
+
+	now = now.Add(time.Second)
+	if c.isPaused(context.Background()) || reads != 2 {
+		t.Errorf("isPaused() after the TTL = true with %d reads, want false after a fresh read", reads)
+	}
+}
+
+func TestIsPausedReadErrorKeepsLastState(t *testing.T) {
+	paused := true
+	reads := 0
+	ddb := controlDDB(&paused, &reads)
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.pause.now = func() time.Time { return now }
+
+	if !c.isPaused(context.Background()) {
+		t.Fatal("isPaused() = false, want true")
+	}
+
+	failures := 0
+	ddb.getItemFunc = func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+		failures++
+		return nil, errors.New("throttled")
+	}
+	now = now.Add(pauseCacheTTL)
+	for range 2 {
+		if !c.isPaused(context.Background()) {
+			t.Error("isPaused() after a failed read = false, want the last known true")
+		}
+	}
+	if failures != 2 {
+		t.Errorf("failed reads = %d, want 2 (failures are not cached)", failures)
+	}
+}
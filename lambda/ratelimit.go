@@ -2,99 +2,166 @@ package main
 
 import (
 	"context"
-	"lambda/internal/urls"
+	"errors"
+	"fmt"
+	"lambda/urls"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 )
 
-// checkRateLimit checks if we can crawl the domain (enough time since last crawl)
-// Returns true if allowed, false if rate limited
-func (c *Crawler) checkRateLimit(ctx context.Context, domain string) bool {
-	if c.crawlDelayMs <= 0 {
-		return true // No rate limiting
+// rateLimitDomain returns the key a URL is rate limited under: scheme://host, or
+// scheme://registrable-domain when SCOPE_BY_REGISTRABLE_DOMAIN is set so a site's
+// subdomains share one budget
+func (c *Crawler) rateLimitDomain(targetURL string) string {
+	if !c.regScope {
+		return urls.GetDomain(targetURL)
+	}
+	parsed, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Scheme + "://" + urls.RegistrableDomain(parsed.Host)
+}
+
+// crawlDelayKey is the context key for a message's crawl_delay_ms override
+type crawlDelayKey struct{}
+
+// withCrawlDelay returns ctx carrying a message's crawl_delay_ms override, which the rate limit
+// check, requeues and the links the message discovers all pick up
+func withCrawlDelay(ctx context.Context, delayMs int) context.Context {
+	return context.WithValue(ctx, crawlDelayKey{}, delayMs)
+}
+
+// crawlDelayOverride returns the crawl_delay_ms override carried by ctx, if any
+func crawlDelayOverride(ctx context.Context) (int, bool) {
+	delayMs, ok := ctx.Value(crawlDelayKey{}).(int)
+	return delayMs, ok
+}
+
+// checkRateLimit checks if we can crawl the domain under the configured rate limit mode
+// Returns true if allowed, false if rate limited, and an error when the limit could not be
+// checked. A message's crawl_delay_ms override replaces the limit with that minimum gap,
+// whichever mode is configured.
+func (c *Crawler) checkRateLimit(ctx context.Context, domain string) (bool, error) {
+	if delayMs, ok := crawlDelayOverride(ctx); ok {
+		return c.checkCrawlDelay(ctx, domain, delayMs)
+	}
+	if c.rateLimitMode == rateLimitTokenBucket {
+		return c.takeToken(ctx, domain)
+	}
+	return c.checkCrawlDelay(ctx, domain, c.crawlDelayMs)
+}
+
+// checkCrawlDelay enforces a minimum gap of delayMs between requests (enough time since last crawl).
+// Only a failed condition means the domain was crawled too recently; any other error is returned.
+func (c *Crawler) checkCrawlDelay(ctx context.Context, domain string, delayMs int) (bool, error) {
+	if delayMs <= 0 {
+		return true, nil // No rate limiting
 	}
 
 	domainKey := domainKeyPrefix + domain
 	now := time.Now().UnixMilli()
 	nowStr := strconv.FormatInt(now, 10)
-	minTime := now - int64(c.crawlDelayMs)
+	minTime := now - int64(delayMs)
 	minTimeStr := strconv.FormatInt(minTime, 10)
 
-	// Try to update last_crawled_at with condition: either doesn't exist or is old enough
-	_, err := c.ddb.PutItem(ctx, &dynamodb.PutItemInput{
+	// Try to update last_crawled_at with condition: either never set or old enough.
+	// An update rather than a put, so the rest of the domain item (in_flight) is kept
+	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: &c.tableName,
-		Item: map[string]dynamodbtypes.AttributeValue{
-			"url_hash":        &dynamodbtypes.AttributeValueMemberS{Value: domainKey},
-			"last_crawled_at": &dynamodbtypes.AttributeValueMemberN{Value: nowStr},
-			"domain":          &dynamodbtypes.AttributeValueMemberS{Value: domain},
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: domainKey},
+		},
+		UpdateExpression:    aws.String("SET last_crawled_at = :now, #d = :domain, expires_at = :ttl"),
+		ConditionExpression: aws.String("attribute_not_exists(last_crawled_at) OR last_crawled_at < :min_time"),
+		ExpressionAttributeNames: map[string]string{
+			"#d": "domain",
 		},
-		// Only succeed if: key doesn't exist OR last_crawled_at < minTime
-		ConditionExpression: aws.String("attribute_not_exists(url_hash) OR last_crawled_at < :min_time"),
 		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":now":      &dynamodbtypes.AttributeValueMemberN{Value: nowStr},
+			":domain":   &dynamodbtypes.AttributeValueMemberS{Value: domain},
 			":min_time": &dynamodbtypes.AttributeValueMemberN{Value: minTimeStr},
+			":ttl":      c.domainExpiry(),
 		},
 	})
 	if err != nil {
-		// Condition failed = rate limited
-		c.log.Debug().Str("domain", domain).Int("delay_ms", c.crawlDelayMs).Msg("Rate limited")
-		return false
+		var condErr *dynamodbtypes.ConditionalCheckFailedException
+		if !errors.As(err, &condErr) {
+			c.log.Warn().Err(err).Str("domain", domain).Msg("Failed to check crawl delay")
+			return false, err
+		}
+		c.log.Debug().Str("domain", domain).Int("delay_ms", delayMs).Msg("Rate limited")
+		return false, nil
 	}
 
-	return true
+	return true, nil
+}
+
+// handleRateLimitError releases the claim on a URL whose rate limit could not be checked,
+// refunding the attempt, and returns the error so SQS redelivers the message
+func (c *Crawler) handleRateLimitError(ctx context.Context, targetURL, urlHash string, err error) (outcome, error) {
+	c.releaseClaim(ctx, urlHash, false)
+	return outcomeRetried, fmt.Errorf("checking rate limit for %s: %w", targetURL, err)
+}
+
+// domainExpiry returns the expires_at for a domain item being used now. Every crawl that passes
+// the rate limit pushes it forward, so only domains idle for domainItemTTL are removed by the
+// table's TTL, by which time their delay, bucket and failure window have long since lapsed.
+func (c *Crawler) domainExpiry() dynamodbtypes.AttributeValue {
+	expires := time.Now().Add(domainItemTTL + time.Duration(max(c.crawlDelayMs, 0))*time.Millisecond)
+	return &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(expires.Unix(), 10)}
 }
 
 // handleRateLimited resets URL to queued and re-queues with delay
-func (c *Crawler) handleRateLimited(ctx context.Context, targetURL, urlHash string, depth int) error {
-	c.log.Info().Str("url", targetURL).Str("domain", urls.GetDomain(targetURL)).Msg("Rate limited, re-queuing")
+func (c *Crawler) handleRateLimited(ctx context.Context, targetURL, urlHash string, depth int, priority string) error {
+	c.log.Info().Str("url", targetURL).Str("domain", c.rateLimitDomain(targetURL)).Msg("Rate limited, re-queuing")
 
-	// Reset to queued
-	_, _ = c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: &c.tableName,
-		Key: map[string]dynamodbtypes.AttributeValue{
-			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
-		},
-		UpdateExpression: aws.String("SET #s = :queued"),
-		ExpressionAttributeNames: map[string]string{
-			"#s": "status",
-		},
-		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
-			":queued": &dynamodbtypes.AttributeValueMemberS{Value: stateQueued},
-		},
-	})
+	c.releaseClaim(ctx, urlHash, false)
 
 	delaySeconds := c.crawlDelayMs / 1000
+	if delayMs, ok := crawlDelayOverride(ctx); ok {
+		delaySeconds = delayMs / 1000
+	} else if c.rateLimitMode == rateLimitTokenBucket {
+		delaySeconds = c.tokenWaitSeconds()
+	}
 	if delaySeconds < 1 {
 		delaySeconds = 1
 	}
-	return c.requeueWithDelay(ctx, targetURL, depth, delaySeconds)
+	return c.requeueWithDelay(ctx, targetURL, urlHash, depth, priority, delaySeconds)
 }
 
-// requeueWithDelay sends the URL back to the queue with a delay
-func (c *Crawler) requeueWithDelay(ctx context.Context, urlStr string, depth, delaySeconds int) error {
-	depthStr := strconv.Itoa(depth)
-
-	// Cap delay at SQS maximum
-	if delaySeconds > sqsMaxDelaySeconds {
-		delaySeconds = sqsMaxDelaySeconds
+// addCrawlDelayAttr copies the crawl_delay_ms override carried by ctx, if any, into a message's attributes
+func addCrawlDelayAttr(ctx context.Context, attrs map[string]sqstypes.MessageAttributeValue) {
+	if delayMs, ok := crawlDelayOverride(ctx); ok {
+		attrs["crawl_delay_ms"] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(delayMs)),
+		}
 	}
+}
 
-	_, err := c.sqs.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:     &c.queueURL,
-		MessageBody:  &urlStr,
-		DelaySeconds: int32(delaySeconds),
-		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
-			"depth": {
-				DataType:    aws.String("Number"),
-				StringValue: &depthStr,
-			},
-		},
-	})
+// jitterDelay spreads requeued URLs by adding up to +/- requeueJitter ms to the delay,
+// rounded to whole seconds and clamped to [0, sqsMaxDelaySeconds].
+func (c *Crawler) jitterDelay(delaySeconds int) int {
+	delayMs := delaySeconds * 1000
+	if c.requeueJitter > 0 && c.rng != nil {
+		delayMs += c.rng.Intn(2*c.requeueJitter+1) - c.requeueJitter
+	}
+	return min(max((delayMs+500)/1000, 0), sqsMaxDelaySeconds)
+}
 
-	return err
+// retryDelay returns the backoff in seconds before retrying a failed fetch:
+// retryBase * 2^(attempts-1), capped at sqsMaxDelaySeconds.
+func (c *Crawler) retryDelay(attempts int) int {
+	delay := c.retryBase
+	for i := 1; i < attempts && delay < sqsMaxDelaySeconds; i++ {
+		delay *= 2
+	}
+	return min(delay, sqsMaxDelaySeconds)
 }
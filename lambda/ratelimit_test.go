@@ -2,38 +2,110 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 )
 
 func TestCheckRateLimitAllowed(t *testing.T) {
+	var input *dynamodb.UpdateItemInput
 	ddb := &mockDynamoDB{
-		putItemFunc: func(_ context.Context, _ *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
-			return &dynamodb.PutItemOutput{}, nil
+		updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			input = in
+			return &dynamodb.UpdateItemOutput{}, nil
 		},
 	}
 
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
-	got := c.checkRateLimit(context.Background(), "example.com")
+	got, _ := c.checkRateLimit(context.Background(), "example.com")
 	if !got {
 		t.Error("checkRateLimit() = false, want true")
 	}
+	// An update, not a put: the domain item also carries the in_flight counter
+	if *input.ConditionExpression != "attribute_not_exists(last_crawled_at) OR last_crawled_at < :min_time" {
+		t.Errorf("ConditionExpression = %q", *input.ConditionExpression)
+	}
+}
+
+func TestCheckRateLimitSetsExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+	}{
+		{"crawl delay", rateLimitDelay},
+		{"token bucket", rateLimitTokenBucket},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					input = in
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.rateLimitMode = tt.mode
+			c.bucketSize = 5
+			c.bucketRefill = 1
+			if ok, _ := c.checkRateLimit(context.Background(), "https://example.com"); !ok {
+				t.Fatal("checkRateLimit() = false, want true")
+			}
+
+			if !strings.Contains(*input.UpdateExpression, "expires_at = :ttl") {
+				t.Errorf("UpdateExpression = %q, want it to set expires_at", *input.UpdateExpression)
+			}
+			ttl, ok := input.ExpressionAttributeValues[":ttl"].(*dynamodbtypes.AttributeValueMemberN)
+			if !ok {
+				t.Fatal(":ttl missing or not a number")
+			}
+			expires, _ := strconv.ParseInt(ttl.Value, 10, 64)
+			if until := time.Until(time.Unix(expires, 0)); until < domainItemTTL-time.Minute || until > domainItemTTL+time.Minute {
+				t.Errorf("expires_at is %v away, want about %v (crawl delay %dms)", until, domainItemTTL, c.crawlDelayMs)
+			}
+		})
+	}
 }
 
 func TestCheckRateLimitBlocked(t *testing.T) {
 	ddb := &mockDynamoDB{
-		putItemFunc: func(_ context.Context, _ *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
 			return nil, errConditionalCheckFailed
 		},
 	}
 
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
-	got := c.checkRateLimit(context.Background(), "example.com")
-	if got {
-		t.Error("checkRateLimit() = true, want false")
+	got, err := c.checkRateLimit(context.Background(), "example.com")
+	if got || err != nil {
+		t.Errorf("checkRateLimit() = %v, %v, want false, nil", got, err)
+	}
+}
+
+// TestCheckRateLimitDelayError checks that a failed crawl delay write other than a failed
+// condition is returned, not taken as the domain being rate limited
+func TestCheckRateLimitDelayError(t *testing.T) {
+	throttled := fmt.Errorf("ProvisionedThroughputExceededException")
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			return nil, throttled
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	got, err := c.checkRateLimit(context.Background(), "example.com")
+	if got || !errors.Is(err, throttled) {
+		t.Errorf("checkRateLimit() = %v, %v, want false, %v", got, err, throttled)
 	}
 }
 
@@ -42,7 +114,7 @@ func TestCheckRateLimitDisabled(t *testing.T) {
 	c.crawlDelayMs = 0
 
 	// Should always return true when rate limiting is disabled
-	got := c.checkRateLimit(context.Background(), "example.com")
+	got, _ := c.checkRateLimit(context.Background(), "example.com")
 	if !got {
 		t.Error("checkRateLimit() = false, want true (disabled)")
 	}
@@ -52,12 +124,70 @@ func TestCheckRateLimitNegativeDelay(t *testing.T) {
 	c := newTestCrawler()
 	c.crawlDelayMs = -1
 
-	got := c.checkRateLimit(context.Background(), "example.com")
+	got, _ := c.checkRateLimit(context.Background(), "example.com")
 	if !got {
 		t.Error("checkRateLimit() = false, want true (negative delay)")
 	}
 }
 
+func TestCheckRateLimitCrawlDelayOverride(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		crawlDelay int
+		override   int
+	}{
+		{"longer than configured", rateLimitDelay, 1000, 60000},
+		{"with rate limiting disabled", rateLimitDelay, 0, 2000},
+		{"in token bucket mode", rateLimitTokenBucket, 1000, 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					input = in
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.rateLimitMode = tt.mode
+			c.crawlDelayMs = tt.crawlDelay
+			ctx := withCrawlDelay(context.Background(), tt.override)
+			before := time.Now().UnixMilli()
+			if ok, _ := c.checkRateLimit(ctx, "example.com"); !ok {
+				t.Fatal("checkRateLimit() = false, want true")
+			}
+
+			if input == nil {
+				t.Fatal("UpdateItem not called; want the override to apply")
+			}
+			if !strings.Contains(*input.ConditionExpression, ":min_time") {
+				t.Fatalf("ConditionExpression = %q, want the crawl delay check", *input.ConditionExpression)
+			}
+			minTime, _ := strconv.ParseInt(input.ExpressionAttributeValues[":min_time"].(*dynamodbtypes.AttributeValueMemberN).Value, 10, 64)
+			if gap := before - minTime; gap < int64(tt.override) || gap > int64(tt.override)+1000 {
+				t.Errorf("min_time is %dms before now, want about %dms", gap, tt.override)
+			}
+		})
+	}
+}
+
+func TestCheckRateLimitZeroOverride(t *testing.T) {
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			return nil, errConditionalCheckFailed
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	if ok, _ := c.checkRateLimit(withCrawlDelay(context.Background(), 0), "example.com"); !ok {
+		t.Error("checkRateLimit() = false, want true (override of 0 disables the delay)")
+	}
+}
+
 func TestHandleRateLimited(t *testing.T) {
 	updateCalls := 0
 	sqsSendCalls := 0
@@ -77,7 +207,7 @@ func TestHandleRateLimited(t *testing.T) {
 	}
 
 	c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
-	err := c.handleRateLimited(context.Background(), "https://example.com/page", "abc123", 1)
+	err := c.handleRateLimited(context.Background(), "https://example.com/page", "abc123", 1, priorityNormal)
 	if err != nil {
 		t.Fatalf("handleRateLimited() error = %v", err)
 	}
@@ -105,7 +235,7 @@ func TestHandleRateLimitedMinDelay(t *testing.T) {
 	c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
 	c.crawlDelayMs = 500 // Less than 1 second
 
-	_ = c.handleRateLimited(context.Background(), "https://example.com/page", "abc123", 0)
+	_ = c.handleRateLimited(context.Background(), "https://example.com/page", "abc123", 0, priorityNormal)
 
 	// Minimum delay should be 1 second
 	if capturedDelay < 1 {
@@ -113,20 +243,69 @@ func TestHandleRateLimitedMinDelay(t *testing.T) {
 	}
 }
 
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     int
+		attempts int
+		want     int
+	}{
+		{"first attempt uses base", 30, 1, 30},
+		{"second attempt doubles", 30, 2, 60},
+		{"third attempt", 30, 3, 120},
+		{"fifth attempt", 30, 5, 480},
+		{"capped at SQS max", 30, 6, sqsMaxDelaySeconds},
+		{"far past cap", 30, 60, sqsMaxDelaySeconds},
+		{"zero attempts treated as first", 10, 0, 10},
+		{"base above cap", 1000, 1, sqsMaxDelaySeconds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.retryBase = tt.base
+			if got := c.retryDelay(tt.attempts); got != tt.want {
+				t.Errorf("retryDelay(%d) = %d, want %d", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelayGrowsWithAttempts(t *testing.T) {
+	c := newTestCrawler()
+	c.retryBase = 5
+
+	prev := 0
+	for attempts := 1; attempts <= 12; attempts++ {
+		got := c.retryDelay(attempts)
+		if got < prev {
+			t.Fatalf("retryDelay(%d) = %d, less than previous %d", attempts, got, prev)
+		}
+		if got > sqsMaxDelaySeconds {
+			t.Fatalf("retryDelay(%d) = %d exceeds cap %d", attempts, got, sqsMaxDelaySeconds)
+		}
+		prev = got
+	}
+	if prev != sqsMaxDelaySeconds {
+		t.Errorf("retryDelay(12) = %d, want it to reach the cap %d", prev, sqsMaxDelaySeconds)
+	}
+}
+
 func TestRequeueWithDelay(t *testing.T) {
 	var capturedDelay int32
-	var capturedBody string
+	var capturedBody, capturedHash string
 	sqsClient := &mockSQS{
 		sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
 			capturedDelay = input.DelaySeconds
 			capturedBody = *input.MessageBody
+			capturedHash = *input.MessageAttributes["url_hash"].StringValue
 			return &sqs.SendMessageOutput{}, nil
 		},
 	}
 
 	c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
 
-	err := c.requeueWithDelay(context.Background(), "https://example.com", 2, 5)
+	err := c.requeueWithDelay(context.Background(), "https://example.com", "hash", 2, priorityNormal, 5)
 	if err != nil {
 		t.Fatalf("requeueWithDelay() error = %v", err)
 	}
@@ -137,6 +316,34 @@ func TestRequeueWithDelay(t *testing.T) {
 	if capturedBody != "https://example.com" {
 		t.Errorf("expected body %q, got %q", "https://example.com", capturedBody)
 	}
+	if capturedHash != "hash" {
+		t.Errorf("expected url_hash attribute %q, got %q", "hash", capturedHash)
+	}
+}
+
+func TestRequeueWithDelayKeepsCrawlDelayOverride(t *testing.T) {
+	var attrs []map[string]sqstypes.MessageAttributeValue
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			attrs = append(attrs, input.MessageAttributes)
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
+	if err := c.requeueWithDelay(context.Background(), "https://example.com", "hash", 0, priorityNormal, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.requeueWithDelay(withCrawlDelay(context.Background(), 7000), "https://example.com", "hash", 0, priorityNormal, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := attrs[0]["crawl_delay_ms"]; ok {
+		t.Error("crawl_delay_ms set without an override")
+	}
+	if got := attrs[1]["crawl_delay_ms"]; got.StringValue == nil || *got.StringValue != "7000" || *got.DataType != "Number" {
+		t.Errorf("crawl_delay_ms = %+v, want Number 7000", got)
+	}
 }
 
 func TestRequeueWithDelayCapsAtMax(t *testing.T) {
@@ -150,7 +357,7 @@ func TestRequeueWithDelayCapsAtMax(t *testing.T) {
 
 	c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
 
-	_ = c.requeueWithDelay(context.Background(), "https://example.com", 0, 99999)
+	_ = c.requeueWithDelay(context.Background(), "https://example.com", "hash", 0, priorityNormal, 99999)
 
 	if capturedDelay != int32(sqsMaxDelaySeconds) {
 		t.Errorf("expected delay capped at %d, got %d", sqsMaxDelaySeconds, capturedDelay)
@@ -166,8 +373,122 @@ func TestRequeueWithDelayError(t *testing.T) {
 
 	c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
 
-	err := c.requeueWithDelay(context.Background(), "https://example.com", 0, 1)
+	err := c.requeueWithDelay(context.Background(), "https://example.com", "hash", 0, priorityNormal, 1)
 	if err == nil {
 		t.Fatal("requeueWithDelay() expected error, got nil")
 	}
 }
+
+func TestJitterDelayBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    int
+		jitterMs int
+		wantMin  int
+		wantMax  int
+	}{
+		{"no jitter", 5, 0, 5, 5},
+		{"one second jitter", 5, 1000, 4, 6},
+		{"jitter never negative", 1, 3000, 0, 4},
+		{"jitter never exceeds cap", sqsMaxDelaySeconds, 5000, sqsMaxDelaySeconds - 5, sqsMaxDelaySeconds},
+		{"over cap clamped", 99999, 1000, sqsMaxDelaySeconds, sqsMaxDelaySeconds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.rng = rand.New(rand.NewSource(42))
+			c.requeueJitter = tt.jitterMs
+
+			seen := make(map[int]bool)
+			for range 1000 {
+				got := c.jitterDelay(tt.delay)
+				if got < tt.wantMin || got > tt.wantMax {
+					t.Fatalf("jitterDelay(%d) = %d, want in [%d, %d]", tt.delay, got, tt.wantMin, tt.wantMax)
+				}
+				seen[got] = true
+			}
+			if tt.wantMin != tt.wantMax && len(seen) < 2 {
+				t.Errorf("expected jitter to produce varied delays, got %v", seen)
+			}
+		})
+	}
+}
+
+func TestRequeueWithDelayJitterDeterministic(t *testing.T) {
+	var delays []int32
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			delays = append(delays, input.DelaySeconds)
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	run := func() []int32 {
+		delays = nil
+		c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
+		c.rng = rand.New(rand.NewSource(7))
+		c.requeueJitter = 2000
+		for range 5 {
+			_ = c.requeueWithDelay(context.Background(), "https://example.com", "hash", 0, priorityNormal, 10)
+		}
+		return delays
+	}
+
+	first := fmt.Sprint(run())
+	second := fmt.Sprint(run())
+	if first != second {
+		t.Errorf("same seed produced different delays: %s vs %s", first, second)
+	}
+}
+
+func TestQueueFor(t *testing.T) {
+	const highQueue = "https://sqs.us-east-1.amazonaws.com/123456789/high-queue"
+
+	tests := []struct {
+		name         string
+		highQueueURL string
+		priority     string
+		want         string
+	}{
+		{"high priority uses high queue", highQueue, priorityHigh, highQueue},
+		{"normal priority uses main queue", highQueue, priorityNormal, testQueueURL},
+		{"high priority without high queue falls back", "", priorityHigh, testQueueURL},
+		{"unknown priority uses main queue", highQueue, "urgent", testQueueURL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.highQueueURL = tt.highQueueURL
+			if got := c.queueFor(tt.priority); got != tt.want {
+				t.Errorf("queueFor(%q) = %q, want %q", tt.priority, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequeueWithDelayRoutesByPriority(t *testing.T) {
+	const highQueue = "https://sqs.us-east-1.amazonaws.com/123456789/high-queue"
+
+	var captured *sqs.SendMessageInput
+	sqsClient := &mockSQS{
+		sendMessageFunc: func(_ context.Context, input *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			captured = input
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(&mockDynamoDB{}, sqsClient, &mockS3{})
+	c.highQueueURL = highQueue
+
+	if err := c.requeueWithDelay(context.Background(), "https://example.com", "hash", 0, priorityHigh, 1); err != nil {
+		t.Fatalf("requeueWithDelay() error = %v", err)
+	}
+	if *captured.QueueUrl != highQueue {
+		t.Errorf("expected queue %s, got %s", highQueue, *captured.QueueUrl)
+	}
+	if got := *captured.MessageAttributes["priority"].StringValue; got != priorityHigh {
+		t.Errorf("expected priority attribute %q, got %q", priorityHigh, got)
+	}
+}
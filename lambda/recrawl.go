@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// terminalState reports whether status is one a crawl ends in, the states RECRAWL resets
+func terminalState(status string) bool {
+	switch status {
+	case stateDone, stateFailed, stateRobotsBlocked, stateSkipped:
+		return true
+	}
+	return false
+}
+
+// recrawlInput moves an item back to queued, with a fresh attempt count and no TTL, when it is in
+// a terminal state and was finished before cutoff. Items still queued or processing, or finished
+// since cutoff, fail the condition and stay as they are. finished_at is RFC3339 UTC, so string
+// order matches time order.
+func (c *Crawler) recrawlInput(urlHash string, cutoff time.Time) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
+		},
+		UpdateExpression: aws.String("SET #s = :queued REMOVE attempts, processing_at, expires_at"),
+		ConditionExpression: aws.String("(#s = :done OR #s = :failed OR #s = :robots_blocked OR #s = :skipped) " +
+			"AND finished_at < :cutoff"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":queued":         &dynamodbtypes.AttributeValueMemberS{Value: stateQueued},
+			":done":           &dynamodbtypes.AttributeValueMemberS{Value: stateDone},
+			":failed":         &dynamodbtypes.AttributeValueMemberS{Value: stateFailed},
+			":robots_blocked": &dynamodbtypes.AttributeValueMemberS{Value: stateRobotsBlocked},
+			":skipped":        &dynamodbtypes.AttributeValueMemberS{Value: stateSkipped},
+			":cutoff":         &dynamodbtypes.AttributeValueMemberS{Value: cutoff.UTC().Format(time.RFC3339)},
+		},
+	}
+}
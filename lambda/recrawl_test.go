@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// recrawlCase is a URL's item before Add (no status for a first-seen URL) and what Add should
+// return with RECRAWL off and on (recrawlAfter of an hour)
+type recrawlCase struct {
+	name     string
+	status   string
+	age      time.Duration // How long ago the item's crawl finished
+	wantOff  bool
+	wantOn   bool
+	wantNote string
+}
+
+var recrawlCases = []recrawlCase{
+	{"first seen", "", 0, true, true, "a new URL is recorded"},
+	{"fresh done", stateDone, 10 * time.Minute, false, false, "a recent crawl is skipped"},
+	{"stale done", stateDone, 2 * time.Hour, false, true, "an old crawl is reset under RECRAWL"},
+	{"stale failed", stateFailed, 2 * time.Hour, false, true, "every terminal state is reset"},
+	{"stale robots_blocked", stateRobotsBlocked, 2 * time.Hour, false, true, "every terminal state is reset"},
+	{"stale queued", stateQueued, 2 * time.Hour, false, false, "a URL still waiting is not queued twice"},
+	{"stale processing", stateProcessing, 2 * time.Hour, false, false, "a URL being crawled is left to its claim"},
+}
+
+func TestSQSFrontierAddRecrawl(t *testing.T) {
+	for _, recrawl := range []bool{false, true} {
+		for _, tt := range recrawlCases {
+			name := tt.name + " (recrawl off)"
+			want := tt.wantOff
+			if recrawl {
+				name, want = tt.name+" (recrawl on)", tt.wantOn
+			}
+			t.Run(name, func(t *testing.T) {
+				ddb := newFakeDynamoDB()
+				c := newTestCrawlerWithMocks(ddb, &fakeSQS{}, newFakeS3())
+				if recrawl {
+					c.recrawlAfter = time.Hour
+				}
+				u := QueuedURL{URL: "https://example.com/page", Canonical: "https://example.com/page", Hash: "h1"}
+				if tt.status != "" {
+					ddb.items[u.Hash] = map[string]dynamodbtypes.AttributeValue{
+						"url_hash":    &dynamodbtypes.AttributeValueMemberS{Value: u.Hash},
+						"status":      &dynamodbtypes.AttributeValueMemberS{Value: tt.status},
+						"finished_at": &dynamodbtypes.AttributeValueMemberS{Value: time.Now().UTC().Add(-tt.age).Format(time.RFC3339)},
+						"attempts":    &dynamodbtypes.AttributeValueMemberN{Value: "3"},
+						"expires_at":  &dynamodbtypes.AttributeValueMemberN{Value: "1700000000"},
+					}
+				}
+
+				if got := c.queue().Add(context.Background(), u); got != want {
+					t.Fatalf("Add() = %v, want %v: %s", got, want, tt.wantNote)
+				}
+				switch {
+				case want:
+					if got := ddb.str(u.Hash, "status"); got != stateQueued {
+						t.Errorf("status = %q, want %q", got, stateQueued)
+					}
+					if tt.status != "" {
+						item := ddb.item(u.Hash)
+						if _, ok := item["attempts"]; ok {
+							t.Error("a reset item kept its attempts")
+						}
+						if _, ok := item["expires_at"]; ok {
+							t.Error("a reset item kept its TTL")
+						}
+					}
+				case ddb.str(u.Hash, "status") != tt.status:
+					t.Errorf("status = %q, want %q left alone", ddb.str(u.Hash, "status"), tt.status)
+				}
+			})
+		}
+	}
+}
+
+func TestMemFrontierAddRecrawl(t *testing.T) {
+	for _, recrawl := range []bool{false, true} {
+		for _, tt := range recrawlCases {
+			name := tt.name + " (recrawl off)"
+			want := tt.wantOff
+			if recrawl {
+				name, want = tt.name+" (recrawl on)", tt.wantOn
+			}
+			t.Run(name, func(t *testing.T) {
+				f := newMemFrontier(defaultProcessingTimeout)
+				if recrawl {
+					f.recrawlAfter = time.Hour
+				}
+				u := QueuedURL{URL: "https://example.com/page", Hash: "h1"}
+				if tt.status != "" {
+					f.items[u.Hash] = &memItem{status: tt.status, attempts: 3, finished: time.Now().Add(-tt.age)}
+				}
+
+				if got := f.Add(context.Background(), u); got != want {
+					t.Fatalf("Add() = %v, want %v: %s", got, want, tt.wantNote)
+				}
+				switch {
+				case want:
+					if got := f.status(u.Hash); got != stateQueued || f.items[u.Hash].attempts != 0 {
+						t.Errorf("item = %q with %d attempts, want queued with none", got, f.items[u.Hash].attempts)
+					}
+				case f.status(u.Hash) != tt.status:
+					t.Errorf("status = %q, want %q left alone", f.status(u.Hash), tt.status)
+				}
+			})
+		}
+	}
+}
+
+// TestE2ERecrawlStalePage checks that under RECRAWL a link to a page crawled long ago gets it
+// fetched again, while without RECRAWL the page is crawled once
+func TestE2ERecrawlStalePage(t *testing.T) {
+	for _, recrawl := range []bool{false, true} {
+		site := newSitePages(map[string]string{
+			"/":  `<html><body><a href="/a">A</a></body></html>`,
+			"/a": `<html><body><p>Page A</p></body></html>`,
+		})
+		c, ddb, queue, _ := newFakeCrawler(site)
+		if recrawl {
+			c.recrawlAfter = time.Hour
+		}
+		drain := func() {
+			for range 10 {
+				record, ok := queue.receive()
+				if !ok {
+					return
+				}
+				if _, err := c.processMessage(context.Background(), &record); err != nil {
+					t.Fatalf("processMessage(%s) error = %v", record.Body, err)
+				}
+			}
+		}
+
+		// Crawl /a, backdate its crawl, then rediscover it from the home page
+		hashA := seed(t, c, "https://example.com/a")
+		drain()
+		ddb.items[hashA]["finished_at"] = &dynamodbtypes.AttributeValueMemberS{Value: time.Now().UTC().Add(-2 * time.Hour).Format(time.RFC3339)}
+		seed(t, c, "https://example.com/")
+		drain()
+
+		want := 1
+		if recrawl {
+			want = 2
+		}
+		if got := site.hits["/a"]; got != want {
+			t.Errorf("recrawl=%v: /a fetched %d times, want %d", recrawl, got, want)
+		}
+		if got := ddb.str(hashA, "status"); got != stateDone {
+			t.Errorf("recrawl=%v: /a status = %q, want %q", recrawl, got, stateDone)
+		}
+	}
+}
+
+// TestE2ERecrawlClearsStaleAttrs crawls a page, changes it, recrawls it under RECRAWL and checks
+// that the attributes the first version set and the second does not are gone from the item
+func TestE2ERecrawlClearsStaleAttrs(t *testing.T) {
+	const text = `<p>Plenty of text on this page now, well past any minimum length.</p>`
+	tests := []struct {
+		name      string
+		first     string
+		second    string
+		configure func(c *Crawler)
+		attrs     []string
+	}{
+		{"empty to text", `<html><body></body></html>`, `<html><body>` + text + `</body></html>`, nil, []string{"empty_text"}},
+		{"thin to normal", `<html><body><p>Short</p></body></html>`, `<html><body>` + text + `</body></html>`,
+			func(c *Crawler) { c.minTextLength = 30 }, []string{"thin_content"}},
+		{"metadata dropped", `<html><head><title>Old</title><meta name="description" content="Old page"></head><body><h1>Old</h1>` + text + `</body></html>`,
+			`<html><body>` + text + `</body></html>`, nil, []string{"page_title", "meta_description", "h1"}},
+		{"links dropped", `<html><body>` + text + `<a href="/b">B</a></body></html>`, `<html><body>` + text + `</body></html>`,
+			func(c *Crawler) { c.storeLinks = true }, []string{"outbound_links", "outbound_links_count"}},
+		{"links moved inline", `<html><body>` + text + `<a href="/b">B</a><a href="/c">C</a></body></html>`, `<html><body>` + text + `<a href="/b">B</a></body></html>`,
+			func(c *Crawler) { c.storeLinks, c.maxLinks = true, 1 }, []string{"outbound_links_key"}},
+		{"social tags dropped", `<html><head><meta property="og:title" content="Old"><meta name="twitter:card" content="summary"></head><body>` + text + `</body></html>`,
+			`<html><body>` + text + `</body></html>`, nil, []string{"open_graph"}},
+		{"robots meta dropped", `<html><head><meta name="robots" content="noindex, nofollow"></head><body>` + text + `</body></html>`,
+			`<html><body>` + text + `</body></html>`, nil, []string{"noindex", "nofollow"}},
+		{"text to empty", `<html><body>` + text + `</body></html>`, `<html><body></body></html>`, nil, []string{"simhash"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := newSitePages(map[string]string{"/a": tt.first})
+			c, ddb, queue, _ := newFakeCrawler(site)
+			c.recrawlAfter = time.Hour
+			if tt.configure != nil {
+				tt.configure(c)
+			}
+			crawl := func() {
+				for range 10 {
+					record, ok := queue.receive()
+					if !ok {
+						return
+					}
+					if _, err := c.processMessage(context.Background(), &record); err != nil {
+						t.Fatalf("processMessage(%s) error = %v", record.Body, err)
+					}
+				}
+			}
+
+			hash := seed(t, c, "https://example.com/a")
+			crawl()
+			for _, name := range tt.attrs {
+				if _, ok := ddb.item(hash)[name]; !ok {
+					t.Fatalf("first crawl did not set %s", name)
+				}
+			}
+
+			site.mu.Lock()
+			site.pages["/a"] = tt.second
+			site.mu.Unlock()
+			ddb.items[hash]["finished_at"] = &dynamodbtypes.AttributeValueMemberS{Value: time.Now().UTC().Add(-2 * time.Hour).Format(time.RFC3339)}
+			seed(t, c, "https://example.com/a")
+			crawl()
+
+			if got := site.hits["/a"]; got != 2 {
+				t.Fatalf("/a fetched %d times, want 2", got)
+			}
+			for _, name := range tt.attrs {
+				if got, ok := ddb.item(hash)[name]; ok {
+					t.Errorf("%s = %v after the recrawl, want it removed", name, got)
+				}
+			}
+		})
+	}
+}
@@ -6,10 +6,23 @@ import (
 	"lambda/internal/ssrf"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/temoto/robotstxt"
 )
 
+// robotsCached reports whether checking urlStr against robots.txt can be answered from the cache,
+// without a request to the host
+func (c *Crawler) robotsCached(urlStr string) bool {
+	parsed, err := url.Parse(urlStr)
+	if err != nil {
+		return true // getRobots makes no request for it either
+	}
+	_, ok := c.robotsCache.get(parsed.Scheme + "://" + parsed.Host)
+	return ok
+}
+
 // getRobots fetches and caches robots.txt for a domain
 func (c *Crawler) getRobots(ctx context.Context, urlStr string) *robotstxt.RobotsData {
 	parsed, err := url.Parse(urlStr)
@@ -20,7 +33,7 @@ func (c *Crawler) getRobots(ctx context.Context, urlStr string) *robotstxt.Robot
 	domain := parsed.Scheme + "://" + parsed.Host
 
 	// Check cache first
-	if robots, ok := c.robotsCache[domain]; ok {
+	if robots, ok := c.robotsCache.get(domain); ok {
 		return robots
 	}
 
@@ -28,23 +41,30 @@ func (c *Crawler) getRobots(ctx context.Context, urlStr string) *robotstxt.Robot
 	robotsURL := domain + "/robots.txt"
 
 	// SSRF protection: block requests to private/internal IPs
-	if err := ssrf.ValidateHost(parsed.Host); err != nil {
+	ips, err := ssrf.ResolveHost(ctx, parsed.Host)
+	if err != nil {
 		c.log.Warn().Str("domain", domain).Err(err).Msg("SSRF blocked for robots.txt")
-		c.robotsCache[domain] = nil
+		c.robotsCache.set(domain, nil)
 		return nil
 	}
 
+	ctx, cancel := context.WithTimeout(ssrf.PinIPs(ctx, parsed.Hostname(), ips), c.robotsTimeout)
+	defer cancel()
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, http.NoBody)
 	if err != nil {
-		c.robotsCache[domain] = nil // Cache the failure
+		c.robotsCache.set(domain, nil) // Cache the failure
 		return nil
 	}
-	req.Header.Set("User-Agent", robotsUserAgent+"/1.0")
+	req.Header.Set("User-Agent", c.userAgent) // Same as page fetches, so the rules read are for the agent sent
+	if c.acceptLang != "" {
+		req.Header.Set("Accept-Language", c.acceptLang) // Same as page fetches, in case robots.txt varies by locale
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		c.log.Debug().Str("domain", domain).Err(err).Msg("Failed to fetch robots.txt")
-		c.robotsCache[domain] = nil
+		c.robotsCache.set(domain, nil)
 		return nil
 	}
 	defer func() { _ = resp.Body.Close() }()
@@ -52,42 +72,28 @@ func (c *Crawler) getRobots(ctx context.Context, urlStr string) *robotstxt.Robot
 	// If not found or error, allow all
 	if resp.StatusCode != http.StatusOK {
 		c.log.Debug().Str("domain", domain).Int("status", resp.StatusCode).Msg("robots.txt not found, allowing all")
-		c.robotsCache[domain] = nil
+		c.robotsCache.set(domain, nil)
 		return nil
 	}
 
 	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRobotsTxtSize))
 	if err != nil {
-		c.robotsCache[domain] = nil
+		c.robotsCache.set(domain, nil)
 		return nil
 	}
 
 	robots, err := robotstxt.FromBytes(body)
 	if err != nil {
 		c.log.Warn().Str("domain", domain).Err(err).Msg("Failed to parse robots.txt")
-		c.robotsCache[domain] = nil
+		c.robotsCache.set(domain, nil)
 		return nil
 	}
 
 	c.log.Info().Str("domain", domain).Msg("Loaded robots.txt")
-	c.evictRobotsCacheIfFull()
-	c.robotsCache[domain] = robots
+	c.robotsCache.set(domain, robots)
 	return robots
 }
 
-// evictRobotsCacheIfFull removes a random entry when the cache reaches max size.
-// Using random eviction (Go map iteration order) keeps it simple and O(1).
-func (c *Crawler) evictRobotsCacheIfFull() {
-	if len(c.robotsCache) < maxRobotsCacheSize {
-		return
-	}
-	// Delete one random entry (Go map iteration is randomized)
-	for k := range c.robotsCache {
-		delete(c.robotsCache, k)
-		break
-	}
-}
-
 // isAllowedByRobots checks if a URL is allowed by robots.txt
 func (c *Crawler) isAllowedByRobots(ctx context.Context, urlStr string) bool {
 	robots := c.getRobots(ctx, urlStr)
@@ -102,5 +108,105 @@ func (c *Crawler) isAllowedByRobots(ctx context.Context, urlStr string) bool {
 	}
 
 	// Check if the path is allowed for our user agent
-	return robots.TestAgent(parsed.Path, robotsUserAgent)
+	return robots.TestAgent(parsed.Path, c.robotsAgent(robots))
+}
+
+// robotsAgent returns the token whose robots.txt group applies: the first of ROBOTS_AGENTS with a
+// group of its own, else "*" so the wildcard group (or no rules at all) applies. Between groups
+// matching one token, robotstxt picks the longest name, the most specific match.
+func (c *Crawler) robotsAgent(robots *robotstxt.RobotsData) string {
+	// FindGroup falls back to the wildcard group, so a token has its own group when it finds another
+	wildcard := robots.FindGroup("*")
+	for _, agent := range c.robotsAgents {
+		if robots.FindGroup(agent) != wildcard {
+			return agent
+		}
+	}
+	return "*"
+}
+
+// parseAgents turns a comma-separated token list (ROBOTS_AGENTS) into the agents robotsAgent
+// tries, defaulting to def (the USER_AGENT product token) alone
+func parseAgents(list, def string) []string {
+	var agents []string
+	for _, agent := range strings.Split(list, ",") {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			agents = append(agents, agent)
+		}
+	}
+	if len(agents) == 0 {
+		return []string{def}
+	}
+	return agents
+}
+
+// robotsCache holds parsed robots.txt per domain (scheme://host). A nil entry records a
+// domain with no usable robots.txt so it is not fetched again. Safe for concurrent use.
+type robotsCache struct {
+	mu      sync.RWMutex
+	entries map[string]*robotstxt.RobotsData
+	maxSize int
+}
+
+func newRobotsCache(maxSize int) *robotsCache {
+	return &robotsCache{entries: make(map[string]*robotstxt.RobotsData), maxSize: maxSize}
+}
+
+// get returns the cached entry for domain and whether one exists
+func (rc *robotsCache) get(domain string) (*robotstxt.RobotsData, bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	robots, ok := rc.entries[domain]
+	return robots, ok
+}
+
+// set stores robots for domain, evicting an entry first if a new domain would exceed maxSize
+func (rc *robotsCache) set(domain string, robots *robotstxt.RobotsData) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.entries[domain]; !ok {
+		rc.evictIfFullLocked()
+	}
+	rc.entries[domain] = robots
+}
+
+// evictIfFull removes a random entry when the cache reaches max size
+func (rc *robotsCache) evictIfFull() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.evictIfFullLocked()
+}
+
+// evictIfFullLocked is evictIfFull for callers already holding the write lock.
+// Using random eviction (Go map iteration order) keeps it simple and O(1).
+func (rc *robotsCache) evictIfFullLocked() {
+	if len(rc.entries) < rc.maxSize {
+		return
+	}
+	// Delete one random entry (Go map iteration is randomized)
+	for k := range rc.entries {
+		delete(rc.entries, k)
+		break
+	}
+}
+
+// len returns the number of cached domains
+func (rc *robotsCache) len() int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return len(rc.entries)
+}
+
+// productToken returns the product name a User-Agent starts with, the part before the first "/"
+// or space ("MyCrawler" for "MyCrawler/1.0 (learning project)"). robots.txt groups and robots
+// directives name crawlers by it.
+func productToken(userAgent string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(userAgent), " ")
+	token, _, _ = strings.Cut(token, "/")
+	return token
+}
+
+// agentToken returns the product token of the User-Agent the crawler sends
+func (c *Crawler) agentToken() string {
+	return productToken(c.userAgent)
 }
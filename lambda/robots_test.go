@@ -4,65 +4,108 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/rs/zerolog"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/temoto/robotstxt"
 )
 
 func TestEvictRobotsCacheIfFull(t *testing.T) {
-	c := &Crawler{
-		robotsCache: make(map[string]*robotstxt.RobotsData),
-		log:         zerolog.Nop(),
-	}
+	rc := newRobotsCache(maxRobotsCacheSize)
 
 	// Fill cache to max
 	for i := range maxRobotsCacheSize {
 		domain := "https://domain" + string(rune('A'+i%26)) + string(rune('0'+i/26)) + ".com"
-		c.robotsCache[domain] = nil
+		rc.entries[domain] = nil
 	}
 
-	if len(c.robotsCache) != maxRobotsCacheSize {
-		t.Fatalf("expected cache size %d, got %d", maxRobotsCacheSize, len(c.robotsCache))
+	if rc.len() != maxRobotsCacheSize {
+		t.Fatalf("expected cache size %d, got %d", maxRobotsCacheSize, rc.len())
 	}
 
 	// Evict should remove one entry
-	c.evictRobotsCacheIfFull()
-	if len(c.robotsCache) != maxRobotsCacheSize-1 {
-		t.Fatalf("expected cache size %d after eviction, got %d", maxRobotsCacheSize-1, len(c.robotsCache))
+	rc.evictIfFull()
+	if rc.len() != maxRobotsCacheSize-1 {
+		t.Fatalf("expected cache size %d after eviction, got %d", maxRobotsCacheSize-1, rc.len())
 	}
 }
 
 func TestEvictRobotsCacheDoesNothingWhenNotFull(t *testing.T) {
-	c := &Crawler{
-		robotsCache: make(map[string]*robotstxt.RobotsData),
-		log:         zerolog.Nop(),
-	}
+	rc := newRobotsCache(maxRobotsCacheSize)
 
-	c.robotsCache["https://example.com"] = nil
-	c.robotsCache["https://other.com"] = nil
+	rc.set("https://example.com", nil)
+	rc.set("https://other.com", nil)
 
-	c.evictRobotsCacheIfFull()
-	if len(c.robotsCache) != 2 {
-		t.Fatalf("expected cache size 2, got %d", len(c.robotsCache))
+	rc.evictIfFull()
+	if rc.len() != 2 {
+		t.Fatalf("expected cache size 2, got %d", rc.len())
 	}
 }
 
 func TestRobotsCacheNeverExceedsMax(t *testing.T) {
-	c := &Crawler{
-		robotsCache: make(map[string]*robotstxt.RobotsData),
-		log:         zerolog.Nop(),
-	}
+	rc := newRobotsCache(maxRobotsCacheSize)
 
 	// Simulate adding entries beyond max
 	for i := range maxRobotsCacheSize + 100 {
-		domain := "https://domain-" + string(rune(i))
-		c.evictRobotsCacheIfFull()
-		c.robotsCache[domain] = nil
+		rc.set("https://domain-"+string(rune(i)), nil)
 	}
 
-	if len(c.robotsCache) > maxRobotsCacheSize {
-		t.Fatalf("cache size %d exceeds max %d", len(c.robotsCache), maxRobotsCacheSize)
+	if rc.len() > maxRobotsCacheSize {
+		t.Fatalf("cache size %d exceeds max %d", rc.len(), maxRobotsCacheSize)
+	}
+}
+
+func TestRobotsCacheOverwriteDoesNotEvict(t *testing.T) {
+	rc := newRobotsCache(2)
+	rc.set("https://a.com", nil)
+	rc.set("https://b.com", nil)
+
+	robots, _ := robotstxt.FromString("User-agent: *\nDisallow: /")
+	rc.set("https://a.com", robots)
+
+	if rc.len() != 2 {
+		t.Fatalf("expected cache size 2, got %d", rc.len())
+	}
+	if got, ok := rc.get("https://a.com"); !ok || got != robots {
+		t.Error("expected overwritten entry for https://a.com")
+	}
+	if _, ok := rc.get("https://b.com"); !ok {
+		t.Error("expected https://b.com to survive an overwrite of another key")
+	}
+}
+
+func TestRobotsCacheConcurrentAccess(t *testing.T) {
+	rc := newRobotsCache(50)
+	robots, _ := robotstxt.FromString("User-agent: *\nDisallow: /private")
+
+	var wg sync.WaitGroup
+	for g := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				domain := fmt.Sprintf("https://d%d.example.com", (g*31+i)%120)
+				if i%3 == 0 {
+					rc.set(domain, robots)
+				} else if got, ok := rc.get(domain); ok && got != nil && got != robots {
+					t.Errorf("get(%s) returned unexpected data", domain)
+				}
+				if i%50 == 0 {
+					rc.evictIfFull()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if rc.len() > 50 {
+		t.Fatalf("cache size %d exceeds max 50", rc.len())
 	}
 }
 
@@ -72,13 +115,13 @@ func TestGetRobotsFromCache(t *testing.T) {
 
 	// Pre-populate cache
 	robotsData, _ := robotstxt.FromString("User-agent: *\nDisallow: /secret")
-	c.robotsCache["https://example.com"] = robotsData
+	c.robotsCache.set("https://example.com", robotsData)
 
 	got := c.getRobots(context.Background(), "https://example.com/page")
 	if got == nil {
 		t.Fatal("getRobots() returned nil, expected cached data")
 	}
-	if got.TestAgent("/secret", robotsUserAgent) {
+	if got.TestAgent("/secret", c.agentToken()) {
 		t.Error("expected /secret to be disallowed")
 	}
 }
@@ -99,12 +142,12 @@ func TestGetRobotsFetchesRemote(t *testing.T) {
 	if got == nil {
 		t.Fatal("getRobots() returned nil")
 	}
-	if got.TestAgent("/private", robotsUserAgent) {
+	if got.TestAgent("/private", c.agentToken()) {
 		t.Error("expected /private to be disallowed")
 	}
 
 	// Should be cached now
-	if _, ok := c.robotsCache["https://example.com"]; !ok {
+	if _, ok := c.robotsCache.get("https://example.com"); !ok {
 		t.Error("expected robots data to be cached")
 	}
 }
@@ -123,6 +166,20 @@ func TestGetRobotsNotFound(t *testing.T) {
 	}
 }
 
+func TestGetRobotsTimeout(t *testing.T) {
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(slowHandler())
+	c.robotsTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if got := c.getRobots(context.Background(), "https://example.com/page"); got != nil {
+		t.Error("getRobots() expected nil when robots.txt times out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("getRobots() took %v, want it to abort near the 50ms budget", elapsed)
+	}
+}
+
 func TestGetRobotsInvalidURL(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = testHTTPClient()
@@ -142,7 +199,7 @@ func TestGetRobotsSSRFProtection(t *testing.T) {
 		t.Error("getRobots() should block SSRF attempt")
 	}
 	// Should cache the nil result
-	if _, ok := c.robotsCache["http://127.0.0.1"]; !ok {
+	if _, ok := c.robotsCache.get("http://127.0.0.1"); !ok {
 		t.Error("expected failed SSRF attempt to be cached")
 	}
 }
@@ -167,7 +224,7 @@ func TestIsAllowedByRobotsBlocked(t *testing.T) {
 	c.httpClient = testHTTPClient()
 
 	robotsData, _ := robotstxt.FromString("User-agent: *\nDisallow: /blocked")
-	c.robotsCache["https://example.com"] = robotsData
+	c.robotsCache.set("https://example.com", robotsData)
 
 	got := c.isAllowedByRobots(context.Background(), "https://example.com/blocked")
 	if got {
@@ -180,7 +237,7 @@ func TestIsAllowedByRobotsAllowed(t *testing.T) {
 	c.httpClient = testHTTPClient()
 
 	robotsData, _ := robotstxt.FromString("User-agent: *\nDisallow: /blocked")
-	c.robotsCache["https://example.com"] = robotsData
+	c.robotsCache.set("https://example.com", robotsData)
 
 	got := c.isAllowedByRobots(context.Background(), "https://example.com/allowed")
 	if !got {
@@ -188,6 +245,113 @@ func TestIsAllowedByRobotsAllowed(t *testing.T) {
 	}
 }
 
+func TestIsAllowedByRobotsAgentGroups(t *testing.T) {
+	robotsData, err := robotstxt.FromString(`User-agent: *
+Disallow: /x
+
+User-agent: MyCrawler
+Allow: /x
+Disallow: /private
+
+User-agent: MyCrawler-News
+Disallow: /
+
+User-agent: NewsBot
+Disallow: /x
+`)
+	if err != nil {
+		t.Fatalf("FromString() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		agents []string
+		path   string
+		want   bool
+	}{
+		{"own group overrides wildcard", []string{"MyCrawler"}, "/x", true},
+		{"own group rules apply", []string{"MyCrawler"}, "/private", false},
+		{"token case does not matter", []string{"mycrawler"}, "/x", true},
+		{"longest matching group name wins", []string{"MyCrawler-News"}, "/x", false},
+		{"no group falls back to wildcard", []string{"OtherBot"}, "/x", false},
+		{"wildcard allows the rest", []string{"OtherBot"}, "/y", true},
+		{"later token with a group is used", []string{"OtherBot", "MyCrawler"}, "/x", true},
+		{"first token with a group wins", []string{"NewsBot", "MyCrawler"}, "/x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.robotsAgents = tt.agents
+			c.robotsCache.set("https://example.com", robotsData)
+
+			if got := c.isAllowedByRobots(context.Background(), "https://example.com"+tt.path); got != tt.want {
+				t.Errorf("isAllowedByRobots(%s) with agents %v = %v, want %v", tt.path, tt.agents, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAgents(t *testing.T) {
+	if got, want := parseAgents(" MyCrawler, ,mycrawler-news,", "MyCrawler"), []string{"MyCrawler", "mycrawler-news"}; !slices.Equal(got, want) {
+		t.Errorf("parseAgents() = %v, want %v", got, want)
+	}
+	if got := parseAgents("", "MyCrawler"); !slices.Equal(got, []string{"MyCrawler"}) {
+		t.Errorf("parseAgents(\"\") = %v, want [MyCrawler]", got)
+	}
+}
+
+func TestProductToken(t *testing.T) {
+	for ua, want := range map[string]string{
+		defaultUserAgent:                      "MyCrawler",
+		"TestBot/2.0 (+https://example.com/)": "TestBot",
+		"TestBot":                             "TestBot",
+		"  TestBot (no version)":              "TestBot",
+		"":                                    "",
+	} {
+		if got := productToken(ua); got != want {
+			t.Errorf("productToken(%q) = %q, want %q", ua, got, want)
+		}
+	}
+}
+
+// TestUserAgentMatchesRobotsToken checks that the User-Agent sent for robots.txt and pages carries
+// the product token whose robots.txt group is applied
+func TestUserAgentMatchesRobotsToken(t *testing.T) {
+	var robotsUA, pageUA string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			robotsUA = r.Header.Get("User-Agent")
+			_, _ = fmt.Fprint(w, "User-agent: TestBot\nDisallow: /private\n\nUser-agent: *\nDisallow:")
+			return
+		}
+		pageUA = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	c := newTestCrawler()
+	c.httpClient = testHTTPClientWith(handler)
+	c.userAgent = "TestBot/2.0 (+https://example.com/bot)"
+	c.robotsAgents = parseAgents("", c.agentToken())
+
+	robots := c.getRobots(context.Background(), "https://example.com/page")
+	if robots == nil {
+		t.Fatal("getRobots() returned nil")
+	}
+	c.fetchURL(context.Background(), "https://example.com/page", nil)
+
+	if robotsUA != c.userAgent || pageUA != c.userAgent {
+		t.Errorf("User-Agent = %q (robots.txt), %q (page), want %q for both", robotsUA, pageUA, c.userAgent)
+	}
+	agent := c.robotsAgent(robots)
+	if got := productToken(robotsUA); got != agent {
+		t.Errorf("sent product token = %q, TestAgent token = %q, want them equal", got, agent)
+	}
+	if robots.TestAgent("/private", agent) {
+		t.Error("/private allowed, want the TestBot group applied")
+	}
+}
+
 func TestIsAllowedByRobotsInvalidURL(t *testing.T) {
 	c := newTestCrawler()
 	c.httpClient = testHTTPClient()
@@ -198,3 +362,95 @@ func TestIsAllowedByRobotsInvalidURL(t *testing.T) {
 		t.Error("isAllowedByRobots() = false for invalid URL, want true (fail-open)")
 	}
 }
+
+func TestGetRobotsSendsAcceptLanguage(t *testing.T) {
+	for _, acceptLang := range []string{"de-DE,de;q=0.8", ""} {
+		t.Run("accept_language="+acceptLang, func(t *testing.T) {
+			var got []string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Values("Accept-Language")
+				w.WriteHeader(http.StatusNotFound)
+			})
+
+			c := newTestCrawler()
+			c.httpClient = testHTTPClientWith(handler)
+			c.acceptLang = acceptLang
+
+			c.getRobots(context.Background(), "https://example.com/page")
+			if acceptLang == "" && len(got) != 0 {
+				t.Errorf("Accept-Language = %v, want header omitted", got)
+			}
+			if acceptLang != "" && (len(got) != 1 || got[0] != acceptLang) {
+				t.Errorf("Accept-Language = %v, want %q", got, acceptLang)
+			}
+		})
+	}
+}
+
+func TestProcessMessageRateLimitsRobotsFetch(t *testing.T) {
+	tests := []struct {
+		name        string
+		cached      bool // robots.txt already in the cache
+		turns       int  // crawl delay checks that pass before the domain is rate limited
+		wantOutcome outcome
+		wantPaths   []string
+	}{
+		{"rate limited domain defers robots and page", false, 0, outcomeRateLimited, nil},
+		{"robots fetch takes the turn, page waits", false, 1, outcomeRateLimited, []string{"/robots.txt"}},
+		{"both allowed", false, 2, outcomeSucceeded, []string{"/robots.txt", "/page"}},
+		{"cached robots uses no turn", true, 1, outcomeSucceeded, []string{"/page"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			turns := tt.turns
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if input.ConditionExpression != nil && strings.Contains(*input.ConditionExpression, "last_crawled_at") {
+						if turns == 0 {
+							return nil, errConditionalCheckFailed
+						}
+						turns--
+					}
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+			requeued := false
+			sqsClient := &mockSQS{
+				sendMessageFunc: func(_ context.Context, _ *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+					requeued = true
+					return &sqs.SendMessageOutput{}, nil
+				},
+			}
+
+			var mu sync.Mutex
+			var paths []string
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+				if r.URL.Path == "/robots.txt" {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			if tt.cached {
+				c.robotsCache.set("https://example.com", nil)
+			}
+
+			got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+			if err != nil {
+				t.Fatalf("processMessage() error = %v", err)
+			}
+			if got != tt.wantOutcome {
+				t.Errorf("outcome = %v, want %v", got, tt.wantOutcome)
+			}
+			if strings.Join(paths, " ") != strings.Join(tt.wantPaths, " ") {
+				t.Errorf("requested %v, want %v", paths, tt.wantPaths)
+			}
+			if requeued != (tt.wantOutcome == outcomeRateLimited) {
+				t.Errorf("requeued = %v, want %v", requeued, tt.wantOutcome == outcomeRateLimited)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// defaultSelfTestURL is the public page the selftest CLI fetches unless -url says otherwise
+const defaultSelfTestURL = "https://example.com/"
+
+// selfTestCheck probes one dependency, returning the check's name and whether it passed.
+// err explains a failure and is nil when ok.
+type selfTestCheck func(ctx context.Context) (name string, ok bool, err error)
+
+// selfTestChecks returns the deployment checks for the configured table, queues and bucket,
+// plus a fetch of fetchTarget through fetchURL (and so through the SSRF-guarded client)
+func (c *Crawler) selfTestChecks(fetchTarget string) []selfTestCheck {
+	checks := []selfTestCheck{c.checkTable, c.queueCheck("queue", c.queueURL)}
+	if c.highQueueURL != "" {
+		checks = append(checks, c.queueCheck("high priority queue", c.highQueueURL))
+	}
+	return append(checks, c.checkBucket, c.fetchCheck(fetchTarget))
+}
+
+// checkTable describes the DynamoDB table
+func (c *Crawler) checkTable(ctx context.Context) (string, bool, error) {
+	name := "dynamodb table " + c.tableName
+	if _, err := c.ddb.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: &c.tableName}); err != nil {
+		return name, false, err
+	}
+	return name, true, nil
+}
+
+// queueCheck returns a check that reads the attributes of the queue at queueURL
+func (c *Crawler) queueCheck(label, queueURL string) selfTestCheck {
+	return func(ctx context.Context) (string, bool, error) {
+		name := "sqs " + label + " " + queueURL
+		_, err := c.sqs.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       &queueURL,
+			AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+		})
+		if err != nil {
+			return name, false, err
+		}
+		return name, true, nil
+	}
+}
+
+// checkBucket heads the content bucket
+func (c *Crawler) checkBucket(ctx context.Context) (string, bool, error) {
+	name := "s3 bucket " + c.contentBucket
+	if _, err := c.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &c.contentBucket}); err != nil {
+		return name, false, err
+	}
+	return name, true, nil
+}
+
+// fetchCheck returns a check that fetches targetURL the way processMessage would
+func (c *Crawler) fetchCheck(targetURL string) selfTestCheck {
+	return func(ctx context.Context) (string, bool, error) {
+		name := "fetch " + targetURL
+		result := c.fetchURL(ctx, targetURL, nil)
+		if result.Success {
+			return name, true, nil
+		}
+		if result.Error != "" {
+			return name, false, errors.New(result.Error)
+		}
+		return name, false, fmt.Errorf("HTTP %d", result.StatusCode)
+	}
+}
+
+// runSelfTest runs every check in order, even after a failure, and writes a PASS or FAIL line
+// for each to w. It reports whether all of them passed.
+func runSelfTest(ctx context.Context, checks []selfTestCheck, w io.Writer) bool {
+	passed := 0
+	for _, check := range checks {
+		name, ok, err := check(ctx)
+		if !ok {
+			if err == nil {
+				err = errors.New("failed")
+			}
+			_, _ = fmt.Fprintf(w, "FAIL  %s: %v\n", name, err)
+			continue
+		}
+		passed++
+		_, _ = fmt.Fprintf(w, "PASS  %s\n", name)
+	}
+	_, _ = fmt.Fprintf(w, "%d of %d checks passed\n", passed, len(checks))
+	return passed == len(checks)
+}
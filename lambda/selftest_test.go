@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func staticCheck(name string, ok bool, err error) selfTestCheck {
+	return func(context.Context) (string, bool, error) { return name, ok, err }
+}
+
+func TestRunSelfTest(t *testing.T) {
+	tests := []struct {
+		name      string
+		checks    []selfTestCheck
+		wantOK    bool
+		wantLines []string
+	}{
+		{
+			name:      "all pass",
+			checks:    []selfTestCheck{staticCheck("table", true, nil), staticCheck("queue", true, nil)},
+			wantOK:    true,
+			wantLines: []string{"PASS  table", "PASS  queue", "2 of 2 checks passed"},
+		},
+		{
+			name:      "one failure fails the run but later checks still run",
+			checks:    []selfTestCheck{staticCheck("table", false, errors.New("AccessDenied")), staticCheck("queue", true, nil)},
+			wantOK:    false,
+			wantLines: []string{"FAIL  table: AccessDenied", "PASS  queue", "1 of 2 checks passed"},
+		},
+		{
+			name:      "failure without an error",
+			checks:    []selfTestCheck{staticCheck("bucket", false, nil)},
+			wantOK:    false,
+			wantLines: []string{"FAIL  bucket: failed", "0 of 1 checks passed"},
+		},
+		{
+			name:      "no checks",
+			checks:    nil,
+			wantOK:    true,
+			wantLines: []string{"0 of 0 checks passed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if got := runSelfTest(context.Background(), tt.checks, &buf); got != tt.wantOK {
+				t.Errorf("runSelfTest() = %v, want %v", got, tt.wantOK)
+			}
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if strings.Join(lines, "\n") != strings.Join(tt.wantLines, "\n") {
+				t.Errorf("output:\n%s\nwant:\n%s", buf.String(), strings.Join(tt.wantLines, "\n"))
+			}
+		})
+	}
+}
+
+func TestSelfTestChecks(t *testing.T) {
+	var described, bucket string
+	var queues []string
+	ddb := &mockDynamoDB{
+		describeTableFunc: func(_ context.Context, in *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+			described = *in.TableName
+			return &dynamodb.DescribeTableOutput{}, nil
+		},
+	}
+	sqsClient := &mockSQS{
+		getQueueAttributesFunc: func(_ context.Context, in *sqs.GetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+			queues = append(queues, *in.QueueUrl)
+			if strings.HasSuffix(*in.QueueUrl, "high-queue") {
+				return nil, errors.New("AccessDenied")
+			}
+			return &sqs.GetQueueAttributesOutput{}, nil
+		},
+	}
+	s3Client := &mockS3{
+		headBucketFunc: func(_ context.Context, in *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+			bucket = *in.Bucket
+			return &s3.HeadBucketOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, sqsClient, s3Client)
+	c.highQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789/high-queue"
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	var buf bytes.Buffer
+	if runSelfTest(context.Background(), c.selfTestChecks("https://example.com/"), &buf) {
+		t.Errorf("runSelfTest() = true, want false\n%s", buf.String())
+	}
+
+	if described != c.tableName || bucket != c.contentBucket {
+		t.Errorf("checked table %q and bucket %q, want %q and %q", described, bucket, c.tableName, c.contentBucket)
+	}
+	if len(queues) != 2 || queues[0] != testQueueURL {
+		t.Errorf("checked queues %v, want the main queue then the high priority queue", queues)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"PASS  dynamodb table",
+		"PASS  sqs queue",
+		"FAIL  sqs high priority queue",
+		"PASS  s3 bucket",
+		"FAIL  fetch https://example.com/: 503 Service Unavailable",
+		"3 of 5 checks passed",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lambda/internal/parser"
+	"lambda/urls"
+	"net/url"
+)
+
+// enqueueSitemapProbe queues <scheme>://<host>/sitemap.xml for link's host, which was just added
+// to the allowlist, since many sites publish one without a robots.txt Sitemap: line. The sitemap
+// goes out at high priority with the sitemap content_hint, and is expanded by enqueueParsed.
+// The frontier dedups it like any link, so a host is probed at most once.
+func (c *Crawler) enqueueSitemapProbe(ctx context.Context, link string, depth int, sourceURL string) {
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host == "" {
+		return
+	}
+	sitemapURL := (&url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: "/sitemap.xml"}).String()
+	canonical := urls.Canonicalize(sitemapURL)
+
+	if err := c.reserveBudget(ctx); err != nil {
+		if !errors.Is(err, errBudgetExhausted) {
+			c.log.Error().Err(err).Str("url", sitemapURL).Msg("Failed to reserve crawl budget")
+		}
+		return
+	}
+
+	probe := QueuedURL{URL: sitemapURL, Canonical: canonical, Hash: urls.Hash(canonical), Depth: depth, Priority: priorityHigh, Ancestry: childAncestry(ctx, sourceURL), Hint: hintSitemap}
+	if !c.queue().Add(ctx, probe) {
+		c.refundBudget(ctx) // Already probed, or listed by a seed
+		return
+	}
+	if c.queue().Enqueue(ctx, []QueuedURL{probe}) == 0 {
+		return // Logged by Enqueue
+	}
+	c.log.Info().Str("url", sitemapURL).Str("source", sourceURL).Msg("Probing sitemap of new domain")
+}
+
+// contentHintKey is the context key for the content_hint of the message being processed
+type contentHintKey struct{}
+
+// withContentHint returns ctx carrying a message's content_hint. Unlike the job_id it is not
+// inherited by the links the message discovers, only kept when the message is requeued.
+func withContentHint(ctx context.Context, hint string) context.Context {
+	return context.WithValue(ctx, contentHintKey{}, hint)
+}
+
+// contentHint returns the content_hint carried by ctx, or "" when there is none
+func contentHint(ctx context.Context) string {
+	hint, _ := ctx.Value(contentHintKey{}).(string)
+	return hint
+}
+
+// extractorFor picks the extractor for a fetched body by its Content-Type (see
+// parser.ExtractorFor). A message hinted as a sitemap is parsed as XML whatever the type, since
+// sitemaps are often served as text/plain or application/octet-stream.
+func (c *Crawler) extractorFor(ctx context.Context, contentType string) parser.Extractor {
+	if contentHint(ctx) == hintSitemap {
+		return parser.ExtractXML
+	}
+	return parser.ExtractorFor(contentType)
+}
+
+// enqueueParsed queues the links of a parsed body. The <loc> entries of a sitemap index are child
+// sitemaps: each gets its own high-priority message hinted as a sitemap, so an index listing
+// thousands of them is expanded a child per invocation, each claimed and deduped like any URL,
+// rather than all inside one that may time out partway. A sitemap's pages, like any page's links,
+// are queued as pages.
+func (c *Crawler) enqueueParsed(ctx context.Context, parsed *parser.Result, depth int, sourceURL string) int {
+	if parsed.Sitemap == parser.SitemapIndex {
+		return c.enqueueLinksAs(ctx, parsed.Links, depth, sourceURL, priorityHigh, hintSitemap)
+	}
+	return c.enqueueLinks(ctx, parsed.Links, depth, sourceURL)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// sitemapProbeDDB allowlists active (already vetted) and existing (added concurrently, so its
+// put loses the race); every other host is new. Conditional puts fail for keys already put.
+func sitemapProbeDDB(active, existing string) *mockDynamoDB {
+	put := map[string]bool{allowedDomainKeyPrefix + existing: true}
+	return &mockDynamoDB{
+		getItemFunc: func(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			if input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value == allowedDomainKeyPrefix+active {
+				return &dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+					"status": &dynamodbtypes.AttributeValueMemberS{Value: domainStatusActive},
+				}}, nil
+			}
+			return &dynamodb.GetItemOutput{}, nil
+		},
+		putItemFunc: func(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			key := input.Item["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+			if put[key] {
+				return nil, errConditionalCheckFailed
+			}
+			put[key] = true
+			return &dynamodb.PutItemOutput{}, nil
+		},
+	}
+}
+
+func TestEnqueueLinksProbesSitemapOfNewDomain(t *testing.T) {
+	var probes []sqstypes.SendMessageBatchRequestEntry
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			for _, e := range input.Entries {
+				if strings.HasSuffix(*e.MessageBody, "/sitemap.xml") {
+					probes = append(probes, e)
+				}
+			}
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(sitemapProbeDDB("example.com", "old.example.org"), sqsClient, &mockS3{})
+	c.autoDiscover = true
+	c.probeSitemap = true
+	c.enqueueLinks(context.Background(), []string{
+		"https://example.com/a",
+		"https://new.example.net/page",
+		"https://new.example.net/other",
+		"https://old.example.org/page",
+	}, 1, "https://example.com/")
+
+	if len(probes) != 1 {
+		t.Fatalf("got %d sitemap probes, want 1 for the one new domain", len(probes))
+	}
+	probe := probes[0]
+	if *probe.MessageBody != "https://new.example.net/sitemap.xml" {
+		t.Errorf("probe URL = %q, want https://new.example.net/sitemap.xml", *probe.MessageBody)
+	}
+	if got := *probe.MessageAttributes["priority"].StringValue; got != priorityHigh {
+		t.Errorf("probe priority = %q, want %q", got, priorityHigh)
+	}
+	if got := *probe.MessageAttributes["depth"].StringValue; got != "1" {
+		t.Errorf("probe depth = %q, want the links' depth 1", got)
+	}
+	if got := *probe.MessageAttributes["content_hint"].StringValue; got != hintSitemap {
+		t.Errorf("probe content_hint = %q, want %q", got, hintSitemap)
+	}
+}
+
+func TestEnqueueLinksDoesNotReprobeSitemap(t *testing.T) {
+	tests := []struct {
+		name         string
+		probeSitemap bool
+		link         string
+	}{
+		{"allowlisted domain", true, "https://example.com/a"},
+		{"domain added concurrently", true, "https://old.example.org/page"},
+		{"probing off", false, "https://new.example.net/page"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := sitemapProbeDDB("example.com", "old.example.org")
+			var sitemapPut bool
+			putItem := ddb.putItemFunc
+			ddb.putItemFunc = func(ctx context.Context, input *dynamodb.PutItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+				if u, ok := input.Item["url"].(*dynamodbtypes.AttributeValueMemberS); ok && strings.HasSuffix(u.Value, "/sitemap.xml") {
+					sitemapPut = true
+				}
+				return putItem(ctx, input, opts...)
+			}
+			sends := 0
+			sqsClient := &mockSQS{
+				sendMessageBatchFunc: func(_ context.Context, input *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+					for _, e := range input.Entries {
+						if strings.HasSuffix(*e.MessageBody, "/sitemap.xml") {
+							sends++
+						}
+					}
+					return &sqs.SendMessageBatchOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, sqsClient, &mockS3{})
+			c.autoDiscover = true
+			c.probeSitemap = tt.probeSitemap
+			c.enqueueLinks(context.Background(), []string{tt.link}, 1, "https://example.com/")
+
+			if sitemapPut || sends != 0 {
+				t.Errorf("sitemap probed (put %v, %d sends), want no probe", sitemapPut, sends)
+			}
+		})
+	}
+}
+
+// crawlSitemap runs processMessage on record, served body with contentType, and returns the
+// messages it queued
+func crawlSitemap(t *testing.T, record *events.SQSMessage, contentType, body string) []sqstypes.SendMessageBatchRequestEntry {
+	t.Helper()
+	var sent []sqstypes.SendMessageBatchRequestEntry
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			sent = append(sent, in.Entries...)
+			return &sqs.SendMessageBatchOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(authItemDDB(nil), sqsClient, &mockS3{})
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = fmt.Fprint(w, body)
+	}))
+	if _, err := c.processMessage(context.Background(), record); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+	return sent
+}
+
+func TestProcessMessageExpandsSitemapIndexIntoChildMessages(t *testing.T) {
+	sent := crawlSitemap(t, &events.SQSMessage{Body: "https://example.com/sitemap.xml"}, "application/xml",
+		`<sitemapindex><sitemap><loc>https://example.com/posts.xml</loc></sitemap><sitemap><loc>https://example.com/tags.xml</loc></sitemap></sitemapindex>`)
+
+	if len(sent) != 2 {
+		t.Fatalf("queued %d messages, want one per child sitemap", len(sent))
+	}
+	for _, e := range sent {
+		if got := *e.MessageAttributes["priority"].StringValue; got != priorityHigh {
+			t.Errorf("%s priority = %q, want %q", *e.MessageBody, got, priorityHigh)
+		}
+		if hint, ok := e.MessageAttributes["content_hint"]; !ok || *hint.StringValue != hintSitemap {
+			t.Errorf("%s content_hint = %v, want %q", *e.MessageBody, hint.StringValue, hintSitemap)
+		}
+	}
+}
+
+func TestProcessMessageExpandsSitemapLocsIntoPageMessages(t *testing.T) {
+	// A child sitemap served as text/plain is still parsed, because its message says it is one
+	record := &events.SQSMessage{
+		Body: "https://example.com/posts.xml",
+		MessageAttributes: map[string]events.SQSMessageAttribute{
+			"content_hint": {StringValue: aws.String(hintSitemap), DataType: "String"},
+		},
+	}
+	sent := crawlSitemap(t, record, "text/plain",
+		`<urlset><url><loc>https://example.com/posts/1</loc></url><url><loc>https://example.com/posts/2</loc></url></urlset>`)
+
+	if len(sent) != 2 {
+		t.Fatalf("queued %d messages, want one per <loc>", len(sent))
+	}
+	for _, e := range sent {
+		if got := *e.MessageAttributes["priority"].StringValue; got != priorityNormal {
+			t.Errorf("%s priority = %q, want %q", *e.MessageBody, got, priorityNormal)
+		}
+		if _, ok := e.MessageAttributes["content_hint"]; ok {
+			t.Errorf("%s has a content_hint, want pages handled by Content-Type", *e.MessageBody)
+		}
+	}
+
+	if sent := crawlSitemap(t, &events.SQSMessage{Body: "https://example.com/posts.xml"}, "text/plain", `<urlset><url><loc>https://example.com/posts/1</loc></url></urlset>`); len(sent) != 0 {
+		t.Errorf("queued %d messages from an unhinted text/plain body, want none", len(sent))
+	}
+}
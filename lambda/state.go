@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"lambda/internal/catalog"
+	"lambda/internal/parser"
+	"lambda/urls"
 	"strconv"
 	"time"
 
@@ -10,31 +14,119 @@ import (
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-// claimURL attempts to transition URL from queued -> processing (returns true if won)
-func (c *Crawler) claimURL(ctx context.Context, urlHash string) bool {
-	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+// updateItem runs UpdateItem under c.ddbRetry, so a throttled write is retried rather than
+// failing the state transition; conditional check failures are returned on the first try
+func (c *Crawler) updateItem(ctx context.Context, input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	var out *dynamodb.UpdateItemOutput
+	err := c.ddbRetry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		out, err = c.ddb.UpdateItem(ctx, input)
+		return err
+	})
+	return out, err
+}
+
+// claim is what claimURL read back from the item it claimed
+type claim struct {
+	attempts int       // Fetch attempts, including this claim
+	rawKey   string    // s3_raw_key saved by an earlier delivery or crawl, "" if none
+	textKey  string    // s3_text_key saved alongside rawKey
+	bodyHash string    // content_sha256 of the body stored under rawKey
+	finished time.Time // finished_at of the previous crawl, zero if none
+}
+
+// Claim attempts to transition URL from queued -> processing. Returns the item as claimed
+// (its attempts count including this claim, and any content already stored), and whether the claim was won.
+// A processing claim older than staleAfter is treated as abandoned and can be reclaimed.
+// Only a failed condition means the claim was lost; any other error is returned so the
+// message is redelivered rather than acknowledged as someone else's.
+func (f sqsFrontier) Claim(ctx context.Context, urlHash string) (claim, bool, error) {
+	c := f.c
+	now := time.Now().UTC()
+	cutoff := now.Add(-c.staleAfter)
+	input := &dynamodb.UpdateItemInput{
 		TableName: &c.tableName,
 		Key: map[string]dynamodbtypes.AttributeValue{
 			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
 		},
 		UpdateExpression:    aws.String("SET #s = :processing, processing_at = :now ADD attempts :one"),
-		ConditionExpression: aws.String("#s = :queued"),
+		ConditionExpression: aws.String("#s = :queued OR (#s = :processing AND processing_at < :cutoff)"),
 		ExpressionAttributeNames: map[string]string{
 			"#s": "status",
 		},
 		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
 			":queued":     &dynamodbtypes.AttributeValueMemberS{Value: stateQueued},
 			":processing": &dynamodbtypes.AttributeValueMemberS{Value: stateProcessing},
-			":now":        &dynamodbtypes.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+			":now":        &dynamodbtypes.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			":cutoff":     &dynamodbtypes.AttributeValueMemberS{Value: cutoff.Format(time.RFC3339)},
 			":one":        &dynamodbtypes.AttributeValueMemberN{Value: "1"},
 		},
-	})
-	return err == nil
+		ReturnValues: dynamodbtypes.ReturnValueAllNew,
+	}
+	// Items created before the job was set (or by a producer without JOB_ID) join it when crawled;
+	// one already in another job keeps its job_id
+	if jobID := c.jobFor(ctx); jobID != "" {
+		input.UpdateExpression = aws.String("SET #s = :processing, processing_at = :now, job_id = if_not_exists(job_id, :job) ADD attempts :one")
+		input.ExpressionAttributeValues[":job"] = &dynamodbtypes.AttributeValueMemberS{Value: jobID}
+	}
+	out, err := c.updateItem(ctx, input)
+	var condErr *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return claim{}, false, nil
+	}
+	if err != nil {
+		return claim{}, false, err
+	}
+
+	claimed := claim{attempts: 1}
+	if n, ok := out.Attributes["attempts"].(*dynamodbtypes.AttributeValueMemberN); ok {
+		if parsed, err := strconv.Atoi(n.Value); err == nil && parsed > 0 {
+			claimed.attempts = parsed
+		}
+	}
+	for name, field := range map[string]*string{"s3_raw_key": &claimed.rawKey, "s3_text_key": &claimed.textKey, "content_sha256": &claimed.bodyHash} {
+		if v, ok := out.Attributes[name].(*dynamodbtypes.AttributeValueMemberS); ok {
+			*field = v.Value
+		}
+	}
+	if v, ok := out.Attributes["finished_at"].(*dynamodbtypes.AttributeValueMemberS); ok {
+		claimed.finished, _ = time.Parse(time.RFC3339, v.Value)
+	}
+	return claimed, true, nil
 }
 
-// markStatus sets a terminal status (robots_blocked, etc.)
-func (c *Crawler) markStatus(ctx context.Context, urlHash, status string) error {
-	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+// Release resets a claimed URL to queued so the next delivery of its message can claim it.
+// countAttempt=false refunds the attempt taken by Claim, for releases that are not failures
+// (rate limiting), so only real fetch attempts drive retry backoff and the give-up limit.
+func (f sqsFrontier) Release(ctx context.Context, urlHash string, countAttempt bool) {
+	c := f.c
+	input := &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
+		},
+		UpdateExpression: aws.String("SET #s = :queued"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":queued": &dynamodbtypes.AttributeValueMemberS{Value: stateQueued},
+		},
+	}
+	if !countAttempt {
+		input.UpdateExpression = aws.String("SET #s = :queued ADD attempts :refund")
+		input.ExpressionAttributeValues[":refund"] = &dynamodbtypes.AttributeValueMemberN{Value: "-1"}
+	}
+
+	if _, err := c.updateItem(ctx, input); err != nil {
+		c.log.Warn().Err(err).Str("url_hash", urlHash).Msg("Failed to release claim")
+	}
+}
+
+// MarkStatus sets a terminal status and finished_at
+func (f sqsFrontier) MarkStatus(ctx context.Context, urlHash, status string) error {
+	c := f.c
+	_, err := c.updateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: &c.tableName,
 		Key: map[string]dynamodbtypes.AttributeValue{
 			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
@@ -51,15 +143,50 @@ func (c *Crawler) markStatus(ctx context.Context, urlHash, status string) error
 	return err
 }
 
-// saveFetchResult persists fetch metadata to DynamoDB
-func (c *Crawler) saveFetchResult(ctx context.Context, urlHash string, result *FetchResult, depth int) error {
-	status := stateDone
-	if !result.Success {
-		status = stateFailed
+// MarkNotModified records a 304 answer to a conditional fetch: the item is done again with a new
+// finished_at and TTL, and keeps the content type, length, S3 keys and hash of the copy already stored
+func (f sqsFrontier) MarkNotModified(ctx context.Context, targetURL, urlHash string, result *FetchResult) error {
+	c := f.c
+	_, err := c.updateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &c.tableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
+		},
+		UpdateExpression: aws.String(
+			"SET #s = :done, finished_at = :now, expires_at = :ttl, http_status = :http_status, " +
+				"fetch_duration_ms = :duration, fetch_error = :error, failure_kind = :failure_kind",
+		),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":done":         &dynamodbtypes.AttributeValueMemberS{Value: stateDone},
+			":now":          &dynamodbtypes.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+			":ttl":          &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(itemTTL).Unix(), 10)},
+			":http_status":  &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(result.StatusCode)},
+			":duration":     &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(result.DurationMs, 10)},
+			":error":        &dynamodbtypes.AttributeValueMemberS{Value: ""},
+			":failure_kind": &dynamodbtypes.AttributeValueMemberS{Value: FailureNone.String()},
+		},
+	})
+	if err != nil {
+		c.log.Error().Err(err).Str("url_hash", urlHash).Msg("Failed to mark not modified")
+		return err
 	}
+	c.recordDomainStats(ctx, urls.GetHost(urls.Canonicalize(targetURL)), stateDone, 0)
+	return nil
+}
 
+// Save persists fetch metadata to DynamoDB, including failure_kind next to the fetch_error text.
+// fetch_error and content_type are cut to MAX_FETCH_ERROR_LENGTH and MAX_CONTENT_TYPE_LENGTH bytes.
+// It also sets domain, which backfills items enqueued before the attribute existed,
+// and redirect_chain (capped at maxStoredRedirectChain hops) when the fetch was redirected.
+// A discovered page also gets parent_url and ancestry from its message (see withAncestry).
+func (f sqsFrontier) Save(ctx context.Context, targetURL, urlHash string, result *FetchResult, depth int) error {
+	c := f.c
+	status := resultStatus(result)
 	ttl := time.Now().Add(itemTTL).Unix()
-	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+	input := &dynamodb.UpdateItemInput{
 		TableName: &c.tableName,
 		Key: map[string]dynamodbtypes.AttributeValue{
 			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
@@ -67,10 +194,11 @@ func (c *Crawler) saveFetchResult(ctx context.Context, urlHash string, result *F
 		UpdateExpression: aws.String(
 			"SET #s = :status, finished_at = :now, expires_at = :ttl, http_status = :http_status, " +
 				"content_length = :content_length, content_type = :content_type, fetch_duration_ms = :duration, " +
-				"fetch_error = :error, crawl_depth = :depth",
+				"fetch_error = :error, failure_kind = :failure_kind, crawl_depth = :depth, truncated = :truncated, #d = :domain",
 		),
 		ExpressionAttributeNames: map[string]string{
 			"#s": "status",
+			"#d": "domain",
 		},
 		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
 			":status":         &dynamodbtypes.AttributeValueMemberS{Value: status},
@@ -78,14 +206,54 @@ func (c *Crawler) saveFetchResult(ctx context.Context, urlHash string, result *F
 			":ttl":            &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(ttl, 10)},
 			":http_status":    &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(result.StatusCode)},
 			":content_length": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(result.ContentLength, 10)},
-			":content_type":   &dynamodbtypes.AttributeValueMemberS{Value: result.ContentType},
+			":content_type":   &dynamodbtypes.AttributeValueMemberS{Value: parser.Truncate(result.ContentType, c.maxCTypeLen)},
 			":duration":       &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(result.DurationMs, 10)},
-			":error":          &dynamodbtypes.AttributeValueMemberS{Value: result.Error},
+			":error":          &dynamodbtypes.AttributeValueMemberS{Value: parser.Truncate(result.Error, c.maxErrorLen)},
+			":failure_kind":   &dynamodbtypes.AttributeValueMemberS{Value: result.FailureKind.String()},
 			":depth":          &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(depth)},
+			":truncated":      &dynamodbtypes.AttributeValueMemberBOOL{Value: result.Truncated},
+			":domain":         &dynamodbtypes.AttributeValueMemberS{Value: catalog.Domain(urls.GetHost(urls.Canonicalize(targetURL)))},
 		},
-	})
+	}
+
+	if ancestry := ancestryFor(ctx); len(ancestry) > 0 {
+		*input.UpdateExpression += ", parent_url = :parent_url, ancestry = :ancestry"
+		input.ExpressionAttributeValues[":parent_url"] = &dynamodbtypes.AttributeValueMemberS{Value: ancestry[0]}
+		input.ExpressionAttributeValues[":ancestry"] = ancestryAttr(ancestry)
+	}
+
+	// A list keeps hop order (a string set would not); a direct fetch clears any chain from a previous crawl
+	if chain := result.RedirectChain; len(chain) > 0 {
+		if len(chain) > maxStoredRedirectChain {
+			chain = chain[:maxStoredRedirectChain]
+		}
+		hops := make([]dynamodbtypes.AttributeValue, len(chain))
+		for i, u := range chain {
+			hops[i] = &dynamodbtypes.AttributeValueMemberS{Value: u}
+		}
+		*input.UpdateExpression += ", redirect_chain = :redirect_chain"
+		input.ExpressionAttributeValues[":redirect_chain"] = &dynamodbtypes.AttributeValueMemberL{Value: hops}
+	} else {
+		*input.UpdateExpression += " REMOVE redirect_chain"
+	}
+
+	_, err := c.updateItem(ctx, input)
 	if err != nil {
 		c.log.Error().Err(err).Str("url_hash", urlHash).Msg("Failed to update status")
+		return err
 	}
-	return err
+	c.recordDomainStats(ctx, urls.GetHost(urls.Canonicalize(targetURL)), status, result.ContentLength)
+	return nil
+}
+
+// resultStatus is the status a fetch result is saved with: done or failed, or skipped for a body
+// declared too large to read
+func resultStatus(result *FetchResult) string {
+	switch {
+	case result.FailureKind == FailureTooLarge:
+		return stateSkipped
+	case !result.Success:
+		return stateFailed
+	}
+	return stateDone
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -20,9 +23,9 @@ func TestClaimURLSuccess(t *testing.T) {
 	}
 
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
-	got := c.claimURL(context.Background(), "abc123")
-	if !got {
-		t.Error("claimURL() = false, want true")
+	_, got, err := c.claimURL(context.Background(), "abc123")
+	if err != nil || !got {
+		t.Errorf("claimURL() = %v, %v, want true, nil", got, err)
 	}
 }
 
@@ -34,10 +37,148 @@ func TestClaimURLLostRace(t *testing.T) {
 	}
 
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
-	got := c.claimURL(context.Background(), "abc123")
+	_, got, err := c.claimURL(context.Background(), "abc123")
 	if got {
 		t.Error("claimURL() = true, want false (race lost)")
 	}
+	if err != nil {
+		t.Errorf("claimURL() error = %v, want nil for a lost race", err)
+	}
+}
+
+func TestClaimURLReturnsOtherErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"service error", fmt.Errorf("ResourceNotFoundException: table not found")},
+		{"throttled after retries", &dynamodbtypes.ProvisionedThroughputExceededException{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					return nil, tt.err
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			_, got, err := c.claimURL(context.Background(), "abc123")
+			if got {
+				t.Error("claimURL() = true, want false")
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("claimURL() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestClaimURLStaleProcessing(t *testing.T) {
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name         string
+		status       string
+		processingAt time.Time
+		want         bool
+	}{
+		{"fresh queued item", stateQueued, time.Time{}, true},
+		{"stale processing item", stateProcessing, now.Add(-10 * time.Minute), true},
+		{"recently claimed processing item", stateProcessing, now.Add(-1 * time.Minute), false},
+		{"done item", stateDone, now.Add(-time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					vals := input.ExpressionAttributeValues
+					queued := vals[":queued"].(*dynamodbtypes.AttributeValueMemberS).Value
+					processing := vals[":processing"].(*dynamodbtypes.AttributeValueMemberS).Value
+					cutoff := vals[":cutoff"].(*dynamodbtypes.AttributeValueMemberS).Value
+
+					if tt.status == queued {
+						return &dynamodb.UpdateItemOutput{}, nil
+					}
+					if tt.status == processing && tt.processingAt.Format(time.RFC3339) < cutoff {
+						return &dynamodb.UpdateItemOutput{}, nil
+					}
+					return nil, errConditionalCheckFailed
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			if _, got, _ := c.claimURL(context.Background(), "abc123"); got != tt.want {
+				t.Errorf("claimURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimURLReturnsAttempts(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs map[string]dynamodbtypes.AttributeValue
+		want  int
+	}{
+		{"third attempt", map[string]dynamodbtypes.AttributeValue{"attempts": &dynamodbtypes.AttributeValueMemberN{Value: "3"}}, 3},
+		{"no attributes returned", nil, 1},
+		{"unparseable count", map[string]dynamodbtypes.AttributeValue{"attempts": &dynamodbtypes.AttributeValueMemberN{Value: "x"}}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if input.ReturnValues != dynamodbtypes.ReturnValueAllNew {
+						t.Errorf("ReturnValues = %q, want ALL_NEW", input.ReturnValues)
+					}
+					return &dynamodb.UpdateItemOutput{Attributes: tt.attrs}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			claimed, won, err := c.claimURL(context.Background(), "abc123")
+			if err != nil || !won || claimed.attempts != tt.want {
+				t.Errorf("claimURL() = (%d, %v, %v), want (%d, true, nil)", claimed.attempts, won, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseClaimRefundsAttempt(t *testing.T) {
+	tests := []struct {
+		name         string
+		countAttempt bool
+		wantExpr     string
+	}{
+		{"failure keeps the attempt", true, "SET #s = :queued"},
+		{"rate limit refunds the attempt", false, "SET #s = :queued ADD attempts :refund"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					input = in
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.releaseClaim(context.Background(), "abc123", tt.countAttempt)
+
+			if *input.UpdateExpression != tt.wantExpr {
+				t.Errorf("UpdateExpression = %q, want %q", *input.UpdateExpression, tt.wantExpr)
+			}
+			if refund, ok := input.ExpressionAttributeValues[":refund"].(*dynamodbtypes.AttributeValueMemberN); ok != !tt.countAttempt || (ok && refund.Value != "-1") {
+				t.Errorf(":refund = %v, want -1 only when refunding", input.ExpressionAttributeValues[":refund"])
+			}
+		})
+	}
 }
 
 func TestMarkStatusSuccess(t *testing.T) {
@@ -79,6 +220,58 @@ func TestMarkStatusError(t *testing.T) {
 	}
 }
 
+func TestMarkStatusRetriesThrottling(t *testing.T) {
+	calls := 0
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			calls++
+			if calls == 1 {
+				return nil, &dynamodbtypes.ProvisionedThroughputExceededException{}
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	if err := c.markStatus(context.Background(), "abc123", stateRobotsBlocked); err != nil {
+		t.Fatalf("markStatus() error = %v, want success after a throttled first try", err)
+	}
+	if calls != 2 {
+		t.Errorf("UpdateItem calls = %d, want 2", calls)
+	}
+}
+
+func TestClaimURLDoesNotRetryLostRace(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"conditional check failed", &dynamodbtypes.ConditionalCheckFailedException{}, 1},
+		{"throttled", &dynamodbtypes.ProvisionedThroughputExceededException{}, defaultDDBRetries},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					calls++
+					return nil, tt.err
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			if _, won, _ := c.claimURL(context.Background(), "abc123"); won {
+				t.Error("claimURL() = true, want false")
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("UpdateItem calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
 func TestSaveFetchResultSuccess(t *testing.T) {
 	ddb := &mockDynamoDB{
 		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
@@ -98,7 +291,7 @@ func TestSaveFetchResultSuccess(t *testing.T) {
 		DurationMs:    100,
 	}
 
-	err := c.saveFetchResult(context.Background(), "abc123", result, 1)
+	err := c.saveFetchResult(context.Background(), "https://example.com/page", "abc123", result, 1)
 	if err != nil {
 		t.Fatalf("saveFetchResult() error = %v", err)
 	}
@@ -126,7 +319,7 @@ func TestSaveFetchResultFailedStatus(t *testing.T) {
 		Error:      "not found",
 	}
 
-	err := c.saveFetchResult(context.Background(), "abc123", result, 0)
+	err := c.saveFetchResult(context.Background(), "https://example.com/page", "abc123", result, 0)
 	if err != nil {
 		t.Fatalf("saveFetchResult() error = %v", err)
 	}
@@ -135,6 +328,29 @@ func TestSaveFetchResultFailedStatus(t *testing.T) {
 	}
 }
 
+func TestSaveFetchResultTooLargeIsSkipped(t *testing.T) {
+	var vals map[string]dynamodbtypes.AttributeValue
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			vals = input.ExpressionAttributeValues
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	result := &FetchResult{StatusCode: 200, ContentLength: 1 << 30, Error: "too big", FailureKind: FailureTooLarge}
+
+	if err := c.saveFetchResult(context.Background(), "https://example.com/huge.iso", "abc123", result, 0); err != nil {
+		t.Fatalf("saveFetchResult() error = %v", err)
+	}
+	if got := vals[":status"].(*dynamodbtypes.AttributeValueMemberS).Value; got != stateSkipped {
+		t.Errorf("status = %q, want %q", got, stateSkipped)
+	}
+	if got := vals[":failure_kind"].(*dynamodbtypes.AttributeValueMemberS).Value; got != "too_large" {
+		t.Errorf("failure_kind = %q, want too_large", got)
+	}
+}
+
 func TestSaveFetchResultDynamoError(t *testing.T) {
 	ddb := &mockDynamoDB{
 		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
@@ -145,8 +361,206 @@ func TestSaveFetchResultDynamoError(t *testing.T) {
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
 	result := &FetchResult{Success: true, StatusCode: 200}
 
-	err := c.saveFetchResult(context.Background(), "abc123", result, 0)
+	err := c.saveFetchResult(context.Background(), "https://example.com/page", "abc123", result, 0)
 	if err == nil {
 		t.Fatal("saveFetchResult() expected error, got nil")
 	}
 }
+
+func TestSaveFetchResultRecordsTruncated(t *testing.T) {
+	var truncated *dynamodbtypes.AttributeValueMemberBOOL
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if v, ok := input.ExpressionAttributeValues[":truncated"].(*dynamodbtypes.AttributeValueMemberBOOL); ok {
+				truncated = v
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	result := &FetchResult{Success: true, StatusCode: 200, Truncated: true}
+
+	if err := c.saveFetchResult(context.Background(), "https://example.com/page", "abc123", result, 0); err != nil {
+		t.Fatalf("saveFetchResult() error = %v", err)
+	}
+	if truncated == nil || !truncated.Value {
+		t.Errorf("expected truncated = true, got %v", truncated)
+	}
+}
+
+func TestSaveFetchResultRecordsFailureKind(t *testing.T) {
+	tests := []struct {
+		name   string
+		result FetchResult
+		want   string
+	}{
+		{"success", FetchResult{Success: true, StatusCode: 200}, "none"},
+		{"server error", FetchResult{StatusCode: 503, Error: "503 Service Unavailable", FailureKind: FailureHTTPStatus}, "http_status"},
+		{"timeout", FetchResult{Error: "context deadline exceeded", FailureKind: FailureTimeout}, "timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var vals map[string]dynamodbtypes.AttributeValue
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if _, ok := input.ExpressionAttributeValues[":failure_kind"]; ok {
+						vals = input.ExpressionAttributeValues
+					}
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			if err := c.saveFetchResult(context.Background(), "https://example.com/page", "abc123", &tt.result, 0); err != nil {
+				t.Fatalf("saveFetchResult() error = %v", err)
+			}
+			if got := vals[":failure_kind"].(*dynamodbtypes.AttributeValueMemberS).Value; got != tt.want {
+				t.Errorf("failure_kind = %q, want %q", got, tt.want)
+			}
+			if got := vals[":error"].(*dynamodbtypes.AttributeValueMemberS).Value; got != tt.result.Error {
+				t.Errorf("fetch_error = %q, want %q", got, tt.result.Error)
+			}
+		})
+	}
+}
+
+func TestSaveFetchResultTruncatesText(t *testing.T) {
+	longError := "dial tcp: " + strings.Repeat("lookup failed; ", 500)
+	longType := "text/html; " + strings.Repeat("x=y; ", 100)
+
+	tests := []struct {
+		name      string
+		result    FetchResult
+		wantError string
+		wantType  string
+	}{
+		{"normal values pass through", FetchResult{StatusCode: 503, ContentType: "text/html; charset=utf-8", Error: "503 Service Unavailable"},
+			"503 Service Unavailable", "text/html; charset=utf-8"},
+		{"oversized error is cut", FetchResult{Error: longError}, longError[:defaultMaxErrorLength], ""},
+		{"oversized content type is cut", FetchResult{StatusCode: 200, Success: true, ContentType: longType}, "", longType[:defaultMaxCTypeLength]},
+		{"multi-byte text is cut on a rune boundary", FetchResult{Error: strings.Repeat("é", defaultMaxErrorLength)},
+			strings.Repeat("é", defaultMaxErrorLength/2), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var vals map[string]dynamodbtypes.AttributeValue
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if _, ok := input.ExpressionAttributeValues[":error"]; ok {
+						vals = input.ExpressionAttributeValues
+					}
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			if err := c.saveFetchResult(context.Background(), "https://example.com/page", "abc123", &tt.result, 0); err != nil {
+				t.Fatalf("saveFetchResult() error = %v", err)
+			}
+			if got := vals[":error"].(*dynamodbtypes.AttributeValueMemberS).Value; got != tt.wantError {
+				t.Errorf("fetch_error = %d bytes %.40q..., want %d bytes", len(got), got, len(tt.wantError))
+			}
+			if got := vals[":content_type"].(*dynamodbtypes.AttributeValueMemberS).Value; got != tt.wantType {
+				t.Errorf("content_type = %d bytes %.40q..., want %d bytes", len(got), got, len(tt.wantType))
+			}
+		})
+	}
+}
+
+func TestSaveFetchResultSetsDomain(t *testing.T) {
+	var input *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			if in.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value == "abc123" { // Not the domain stats update
+				input = in
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	result := &FetchResult{Success: true, StatusCode: 200}
+
+	if err := c.saveFetchResult(context.Background(), "https://WWW.Example.com:8443/page", "abc123", result, 0); err != nil {
+		t.Fatalf("saveFetchResult() error = %v", err)
+	}
+	if input.ExpressionAttributeNames["#d"] != "domain" {
+		t.Errorf("#d = %q, want domain (reserved word must be aliased)", input.ExpressionAttributeNames["#d"])
+	}
+	if got := input.ExpressionAttributeValues[":domain"].(*dynamodbtypes.AttributeValueMemberS).Value; got != "www.example.com:8443" {
+		t.Errorf(":domain = %q, want www.example.com:8443", got)
+	}
+
+	// A default port is dropped, as it is when the item is first recorded
+	if err := c.saveFetchResult(context.Background(), "https://Example.com:443/page", "abc123", result, 0); err != nil {
+		t.Fatalf("saveFetchResult() error = %v", err)
+	}
+	if got := input.ExpressionAttributeValues[":domain"].(*dynamodbtypes.AttributeValueMemberS).Value; got != "example.com" {
+		t.Errorf(":domain = %q, want example.com", got)
+	}
+}
+
+func TestSaveFetchResultRedirectChain(t *testing.T) {
+	longChain := make([]string, maxStoredRedirectChain+3)
+	for i := range longChain {
+		longChain[i] = fmt.Sprintf("https://example.com/hop%d", i)
+	}
+
+	tests := []struct {
+		name       string
+		chain      []string
+		wantStored []string // nil means the attribute is removed
+	}{
+		{"direct fetch removes chain", nil, nil},
+		{"three hops stored in order", []string{"https://example.com/b", "https://example.com/c", "https://example.com/d"}, []string{"https://example.com/b", "https://example.com/c", "https://example.com/d"}},
+		{"long chain capped", longChain, longChain[:maxStoredRedirectChain]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					if in.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value == "abc123" { // Not the domain stats update
+						input = in
+					}
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			result := &FetchResult{Success: true, StatusCode: 200, RedirectChain: tt.chain}
+
+			if err := c.saveFetchResult(context.Background(), "https://example.com/a", "abc123", result, 0); err != nil {
+				t.Fatalf("saveFetchResult() error = %v", err)
+			}
+
+			expr := *input.UpdateExpression
+			stored, hasValue := input.ExpressionAttributeValues[":redirect_chain"]
+			if tt.wantStored == nil {
+				if hasValue || !strings.HasSuffix(expr, " REMOVE redirect_chain") {
+					t.Errorf("expected redirect_chain removed, got expression %q", expr)
+				}
+				return
+			}
+
+			if !strings.Contains(expr, "redirect_chain = :redirect_chain") {
+				t.Errorf("expression %q does not set redirect_chain", expr)
+			}
+			list, ok := stored.(*dynamodbtypes.AttributeValueMemberL)
+			if !ok {
+				t.Fatalf(":redirect_chain = %T, want list", stored)
+			}
+			var got []string
+			for _, v := range list.Value {
+				got = append(got, v.(*dynamodbtypes.AttributeValueMemberS).Value)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.wantStored, " ") {
+				t.Errorf("redirect_chain = %v, want %v", got, tt.wantStored)
+			}
+		})
+	}
+}
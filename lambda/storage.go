@@ -3,7 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"lambda/internal/compress"
+	"lambda/internal/warc"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -15,50 +26,70 @@ import (
 // UploadResult contains S3 keys for uploaded content
 type UploadResult struct {
 	RawKey  string
-	TextKey string
+	TextKey string // Empty when no separate text object was written
 }
 
-// uploadContent uploads raw HTML and extracted text to S3 with gzip compression.
-// Both uploads run concurrently via errgroup.
-func (c *Crawler) uploadContent(ctx context.Context, urlHash string, rawHTML []byte, text string) (*UploadResult, error) {
-	result := &UploadResult{
-		RawKey:  urlHash + "/raw.html.gz",
-		TextKey: urlHash + "/text.txt.gz",
+// uploadContent stores the fetched page in S3 using the configured storage format.
+// The default format uploads raw HTML and, when withText is set, extracted text concurrently via errgroup.
+func (c *Crawler) uploadContent(ctx context.Context, targetURL, urlHash string, fetched *FetchResult, text string, withText bool) (*UploadResult, error) {
+	if c.storageFormat == storageFormatWARC {
+		return c.uploadWARC(ctx, targetURL, urlHash, fetched)
+	}
+	if c.keyScheme == keySchemeContent {
+		return c.uploadDeduped(ctx, fetched, text, withText)
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	prefix := c.objectPrefix(targetURL, urlHash)
+	gzipped := c.compressRaw(fetched.Body)
+	result := &UploadResult{RawKey: prefix + "raw" + rawExt(gzipped)}
+	if withText {
+		result.TextKey = prefix + "text.txt.gz"
+	}
 
-	// Upload raw HTML (gzip compressed) concurrently
+	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
-		rawGz, err := compress.Gzip(rawHTML)
+		input, err := c.rawPut(result.RawKey, fetched.Body, gzipped)
 		if err != nil {
 			return err
 		}
-		_, err = c.s3.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:          &c.contentBucket,
-			Key:             &result.RawKey,
-			Body:            bytes.NewReader(rawGz),
-			ContentType:     aws.String("text/html"),
-			ContentEncoding: aws.String("gzip"),
-		})
+		_, err = c.s3.PutObject(ctx, input)
 		return err
 	})
+	if withText {
+		g.Go(func() error {
+			return c.putGzipped(ctx, result.TextKey, []byte(text), "text/plain")
+		})
+	}
 
-	// Upload extracted text (gzip compressed) concurrently
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// uploadDeduped stores raw HTML and text under keys derived from their SHA-256 (S3_KEY_SCHEME=content),
+// so mirrors and print versions serving identical bytes share one object and each URL's item points
+// at it. The puts are conditional, so a body already stored is not uploaded again.
+func (c *Crawler) uploadDeduped(ctx context.Context, fetched *FetchResult, text string, withText bool) (*UploadResult, error) {
+	gzipped := c.compressRaw(fetched.Body)
+	result := &UploadResult{RawKey: contentKey(fetched.Body, rawExt(gzipped))}
+	if withText {
+		result.TextKey = contentKey([]byte(text), ".txt.gz")
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
-		textGz, err := compress.Gzip([]byte(text))
+		input, err := c.rawPut(result.RawKey, fetched.Body, gzipped)
 		if err != nil {
 			return err
 		}
-		_, err = c.s3.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:          &c.contentBucket,
-			Key:             &result.TextKey,
-			Body:            bytes.NewReader(textGz),
-			ContentType:     aws.String("text/plain"),
-			ContentEncoding: aws.String("gzip"),
-		})
-		return err
+		return c.putOnce(ctx, input)
 	})
+	if withText {
+		g.Go(func() error {
+			return c.putGzippedOnce(ctx, result.TextKey, []byte(text), "text/plain")
+		})
+	}
 
 	if err := g.Wait(); err != nil {
 		return nil, err
@@ -66,23 +97,283 @@ func (c *Crawler) uploadContent(ctx context.Context, urlHash string, rawHTML []b
 	return result, nil
 }
 
-// saveS3Keys updates DynamoDB with S3 content locations
-func (c *Crawler) saveS3Keys(ctx context.Context, targetURL, urlHash string, upload *UploadResult, textLen int) {
-	_, err := c.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+// contentKey returns the content-addressed key for data: content/<hex sha256><ext>
+func contentKey(data []byte, ext string) string {
+	return "content/" + sha256Hex(data) + ext
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// reusableUpload returns the objects already stored for the claimed item when they hold the body
+// hashing to bodyHash, so SQS redelivering a message whose Lambda timed out after the upload (or a
+// recrawl of an unchanged page) does not upload it again. Returns nil when there is nothing to
+// reuse: no keys saved, a changed body, or text wanted but not stored last time.
+func (p claim) reusableUpload(bodyHash string, withText bool) *UploadResult {
+	if p.rawKey == "" || p.bodyHash != bodyHash || (withText && p.textKey == "") {
+		return nil
+	}
+	result := &UploadResult{RawKey: p.rawKey}
+	if withText {
+		result.TextKey = p.textKey
+	}
+	return result
+}
+
+// objectPrefix returns the S3 key prefix, ending in a slash, for a page's objects: "<url_hash>/",
+// or "<host>/<url_hash>/" with S3_KEY_SCHEME=domain so one domain's content can be listed and
+// exported by prefix. A URL without a host falls back to the hash scheme, as do the per-URL objects
+// (WARC records, links.json.gz) under S3_KEY_SCHEME=content.
+func (c *Crawler) objectPrefix(targetURL, urlHash string) string {
+	if c.keyScheme == keySchemeDomain {
+		if parsed, err := url.Parse(targetURL); err == nil && parsed.Host != "" {
+			return strings.ToLower(parsed.Host) + "/" + urlHash + "/"
+		}
+	}
+	return urlHash + "/"
+}
+
+// uploadWARC writes a single gzipped WARC response record containing the HTTP response
+func (c *Crawler) uploadWARC(ctx context.Context, targetURL, urlHash string, fetched *FetchResult) (*UploadResult, error) {
+	var buf bytes.Buffer
+	err := warc.Write(&buf, &warc.Record{
+		Type:        warc.TypeResponse,
+		Date:        time.Now(),
+		TargetURI:   targetURL,
+		ContentType: warc.ContentTypeResponse,
+		Block:       warc.HTTPResponseBlock(fetched.StatusCode, fetched.ContentType, fetched.Body),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UploadResult{RawKey: c.objectPrefix(targetURL, urlHash) + "response.warc.gz"}
+	if err := c.putGzipped(ctx, result.RawKey, buf.Bytes(), "application/warc"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// addOutboundLinks records a page's discovered links in attrs for link-graph analysis (STORE_LINKS).
+// Up to maxLinks links, totalling at most maxStoredLinksBytes, are stored as the outbound_links
+// string set; a longer list would crowd the 400KB item limit, so it is written to S3 as
+// links.json.gz next to the page's content and only outbound_links_key is stored. outbound_links_count is always set.
+func (c *Crawler) addOutboundLinks(ctx context.Context, targetURL, urlHash string, links []string, attrs map[string]dynamodbtypes.AttributeValue) {
+	if !c.storeLinks || len(links) == 0 {
+		return
+	}
+
+	size := 0
+	for _, link := range links {
+		size += len(link)
+	}
+	if len(links) <= c.maxLinks && size <= maxStoredLinksBytes {
+		attrs["outbound_links"] = &dynamodbtypes.AttributeValueMemberSS{Value: links} // Extract already dedups
+	} else {
+		data, err := json.Marshal(links)
+		if err != nil {
+			c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to encode outbound links")
+			return
+		}
+		key := c.objectPrefix(targetURL, urlHash) + "links.json.gz"
+		if err := c.putGzipped(ctx, key, data, "application/json"); err != nil {
+			c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to upload outbound links to S3")
+			return
+		}
+		attrs["outbound_links_key"] = &dynamodbtypes.AttributeValueMemberS{Value: key}
+	}
+	attrs["outbound_links_count"] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(len(links))}
+}
+
+// putGzipped compresses data and uploads it to the content bucket
+func (c *Crawler) putGzipped(ctx context.Context, key string, data []byte, contentType string) error {
+	input, err := c.gzippedPut(key, data, contentType)
+	if err != nil {
+		return err
+	}
+	_, err = c.s3.PutObject(ctx, input)
+	return err
+}
+
+// putGzippedOnce is putGzipped for content-addressed keys: the put is conditional on the key not
+// existing (If-None-Match: *), and an existing object counts as success since it holds the same bytes
+func (c *Crawler) putGzippedOnce(ctx context.Context, key string, data []byte, contentType string) error {
+	input, err := c.gzippedPut(key, data, contentType)
+	if err != nil {
+		return err
+	}
+	return c.putOnce(ctx, input)
+}
+
+// putOnce uploads input only if its key does not exist yet, as putGzippedOnce describes
+func (c *Crawler) putOnce(ctx context.Context, input *s3.PutObjectInput) error {
+	input.IfNoneMatch = aws.String("*")
+	_, err := c.s3.PutObject(ctx, input)
+	if objectExists(err) {
+		c.log.Debug().Str("key", *input.Key).Msg("Content already stored")
+		return nil
+	}
+	return err
+}
+
+// compressRaw reports whether a raw body is gzipped before upload. Bodies under MIN_COMPRESS_BYTES
+// are stored as is, since gzip's header and trailer can make a tiny page larger, not smaller.
+func (c *Crawler) compressRaw(body []byte) bool {
+	return len(body) >= c.minCompress
+}
+
+// rawExt returns the raw object's extension: .html.gz, or .html when stored uncompressed
+func rawExt(gzipped bool) string {
+	if gzipped {
+		return ".html.gz"
+	}
+	return ".html"
+}
+
+// rawPut builds the put for a raw HTML body, gzipped or stored as plain text/html
+func (c *Crawler) rawPut(key string, body []byte, gzipped bool) (*s3.PutObjectInput, error) {
+	if gzipped {
+		return c.gzippedPut(key, body, "text/html")
+	}
+	return &s3.PutObjectInput{
+		Bucket:      &c.contentBucket,
+		Key:         &key,
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("text/html"),
+	}, nil
+}
+
+func (c *Crawler) gzippedPut(key string, data []byte, contentType string) (*s3.PutObjectInput, error) {
+	gz, err := compress.Gzip(data)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectInput{
+		Bucket:          &c.contentBucket,
+		Key:             &key,
+		Body:            bytes.NewReader(gz),
+		ContentType:     aws.String(contentType),
+		ContentEncoding: aws.String("gzip"),
+	}, nil
+}
+
+// objectExists reports whether a conditional PutObject failed because the key is taken:
+// PreconditionFailed once it exists, ConditionalRequestConflict while another put of it is in flight
+func objectExists(err error) bool {
+	var apiErr interface{ ErrorCode() string }
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code := apiErr.ErrorCode()
+	return code == "PreconditionFailed" || code == "ConditionalRequestConflict"
+}
+
+// pageAttrs are the attributes a crawl of a page sets only when they apply to this version of it.
+// saveS3Keys removes each one attrs does not set, so a recrawl does not leave the previous
+// version's values on the item.
+var pageAttrs = []string{"empty_text", "thin_content", "page_title", "meta_description", "h1",
+	"outbound_links", "outbound_links_key", "outbound_links_count", "open_graph", "nofollow", "noindex", "simhash"}
+
+// saveS3Keys updates DynamoDB with S3 content locations.
+// attrs are extra attributes (e.g. language detection results) stored in the same update; each is
+// written through a #name placeholder, as some (language, for one) are DynamoDB reserved words.
+// pageAttrs missing from attrs are removed in the same update.
+// The objects are already uploaded, so a failed update is retried saveKeysAttempts times with
+// doubling backoff; if it still fails the item is flagged s3_orphaned (with just the keys)
+// so the objects can be reconciled later. Returns whether the full update was saved.
+func (c *Crawler) saveS3Keys(ctx context.Context, targetURL, urlHash string, upload *UploadResult, textLen int, attrs map[string]dynamodbtypes.AttributeValue) bool {
+	updateExpr, values := s3KeysUpdate(c.contentBucket, upload)
+	names := make(map[string]string, len(attrs))
+	for _, name := range slices.Sorted(maps.Keys(attrs)) {
+		updateExpr += ", #" + name + " = :" + name
+		names["#"+name] = name
+		values[":"+name] = attrs[name]
+	}
+	// A full update also clears the s3_orphaned flag an earlier crawl's failed update left
+	stale := []string{"s3_orphaned"}
+	for _, name := range pageAttrs {
+		if _, ok := attrs[name]; !ok {
+			stale = append(stale, "#"+name)
+			names["#"+name] = name
+		}
+	}
+	updateExpr += s3KeysRemove(upload, stale...)
+
+	var err error
+	backoff := c.keysBackoff
+	for attempt := 1; attempt <= saveKeysAttempts; attempt++ {
+		if err = c.updateS3Keys(ctx, urlHash, updateExpr, names, values); err == nil {
+			c.log.Info().Str("url", targetURL).Str("raw_key", upload.RawKey).Str("text_key", upload.TextKey).Int("text_len", textLen).Msg("Uploaded content to S3")
+			return true
+		}
+		if attempt == saveKeysAttempts {
+			break
+		}
+		c.log.Warn().Err(err).Str("url", targetURL).Int("attempt", attempt).Msg("Failed to update DynamoDB with S3 keys, retrying")
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	c.log.Error().Err(err).Str("url", targetURL).Int("attempts", saveKeysAttempts).Msg("Failed to update DynamoDB with S3 keys")
+
+	// The full update may be what fails (e.g. an oversized attribute), so the marker carries only the keys
+	updateExpr, values = s3KeysUpdate(c.contentBucket, upload)
+	updateExpr += ", s3_orphaned = :orphaned" + s3KeysRemove(upload)
+	values[":orphaned"] = &dynamodbtypes.AttributeValueMemberBOOL{Value: true}
+	if err := c.updateS3Keys(context.WithoutCancel(ctx), urlHash, updateExpr, nil, values); err != nil {
+		c.log.Error().Err(err).Str("url", targetURL).Str("bucket", c.contentBucket).Str("raw_key", upload.RawKey).Str("text_key", upload.TextKey).Msg("Failed to flag orphaned S3 objects")
+		return false
+	}
+	c.log.Warn().Str("url", targetURL).Str("raw_key", upload.RawKey).Msg("Flagged item s3_orphaned")
+	return false
+}
+
+// s3KeysUpdate returns the SET expression and values recording upload's object locations
+func s3KeysUpdate(bucket string, upload *UploadResult) (string, map[string]dynamodbtypes.AttributeValue) {
+	updateExpr := "SET s3_bucket = :bucket, s3_raw_key = :raw_key"
+	values := map[string]dynamodbtypes.AttributeValue{
+		":bucket":  &dynamodbtypes.AttributeValueMemberS{Value: bucket},
+		":raw_key": &dynamodbtypes.AttributeValueMemberS{Value: upload.RawKey},
+	}
+	if upload.TextKey != "" {
+		updateExpr += ", s3_text_key = :text_key"
+		values[":text_key"] = &dynamodbtypes.AttributeValueMemberS{Value: upload.TextKey}
+	}
+	return updateExpr, values
+}
+
+// s3KeysRemove returns the REMOVE clause that ends a saveS3Keys update, dropping stale and, with no
+// text object this crawl, a text key left by an earlier crawl of the URL rather than keeping it
+// pointing at old text. Empty when there is nothing to remove.
+func s3KeysRemove(upload *UploadResult, stale ...string) string {
+	if upload.TextKey == "" {
+		stale = append([]string{"s3_text_key"}, stale...)
+	}
+	if len(stale) == 0 {
+		return ""
+	}
+	return " REMOVE " + strings.Join(stale, ", ")
+}
+
+// updateS3Keys runs one saveS3Keys update; names may be nil when the expression has no #placeholders
+func (c *Crawler) updateS3Keys(ctx context.Context, urlHash, updateExpr string, names map[string]string, values map[string]dynamodbtypes.AttributeValue) error {
+	input := &dynamodb.UpdateItemInput{
 		TableName: &c.tableName,
 		Key: map[string]dynamodbtypes.AttributeValue{
 			"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: urlHash},
 		},
-		UpdateExpression: aws.String("SET s3_bucket = :bucket, s3_raw_key = :raw_key, s3_text_key = :text_key"),
-		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
-			":bucket":   &dynamodbtypes.AttributeValueMemberS{Value: c.contentBucket},
-			":raw_key":  &dynamodbtypes.AttributeValueMemberS{Value: upload.RawKey},
-			":text_key": &dynamodbtypes.AttributeValueMemberS{Value: upload.TextKey},
-		},
-	})
-	if err != nil {
-		c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to update DynamoDB with S3 keys")
-		return
+		UpdateExpression:          aws.String(updateExpr),
+		ExpressionAttributeValues: values,
+	}
+	// DynamoDB rejects an empty ExpressionAttributeNames map
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
 	}
-	c.log.Info().Str("url", targetURL).Str("raw_key", upload.RawKey).Str("text_key", upload.TextKey).Int("text_len", textLen).Msg("Uploaded content to S3")
+	_, err := c.ddb.UpdateItem(ctx, input)
+	return err
 }
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
@@ -22,7 +32,7 @@ func TestUploadContentSuccess(t *testing.T) {
 	}
 
 	c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
-	result, err := c.uploadContent(context.Background(), "abc123", []byte("<html>test</html>"), "test text")
+	result, err := c.uploadContent(context.Background(), "https://example.com", "abc123", &FetchResult{StatusCode: 200, Body: []byte("<html>test</html>")}, "test text", true)
 	if err != nil {
 		t.Fatalf("uploadContent() error = %v", err)
 	}
@@ -38,6 +48,260 @@ func TestUploadContentSuccess(t *testing.T) {
 	}
 }
 
+func TestUploadContentKeyScheme(t *testing.T) {
+	tests := []struct {
+		name          string
+		scheme        string
+		storageFormat string
+		targetURL     string
+		wantKeys      []string
+	}{
+		{"hash", keySchemeHash, storageFormatRaw, "https://Example.com/page", []string{"abc123/raw.html.gz", "abc123/text.txt.gz"}},
+		{"domain", keySchemeDomain, storageFormatRaw, "https://Example.com/page", []string{"example.com/abc123/raw.html.gz", "example.com/abc123/text.txt.gz"}},
+		{"domain keeps the port", keySchemeDomain, storageFormatRaw, "http://example.com:8080/", []string{"example.com:8080/abc123/raw.html.gz", "example.com:8080/abc123/text.txt.gz"}},
+		{"domain warc", keySchemeDomain, storageFormatWARC, "https://example.com/page", []string{"example.com/abc123/response.warc.gz"}},
+		{"domain without host falls back to hash", keySchemeDomain, storageFormatRaw, "/relative", []string{"abc123/raw.html.gz", "abc123/text.txt.gz"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var uploaded []string
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					uploaded = append(uploaded, *input.Key)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
+			c.keyScheme = tt.scheme
+			c.storageFormat = tt.storageFormat
+
+			fetched := &FetchResult{StatusCode: 200, ContentType: "text/html", Body: []byte("<html>test</html>")}
+			result, err := c.uploadContent(context.Background(), tt.targetURL, "abc123", fetched, "test text", true)
+			if err != nil {
+				t.Fatalf("uploadContent() error = %v", err)
+			}
+
+			got := []string{result.RawKey}
+			if result.TextKey != "" {
+				got = append(got, result.TextKey)
+			}
+			if !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("UploadResult keys = %v, want %v", got, tt.wantKeys)
+			}
+			slices.Sort(uploaded)
+			if !slices.Equal(uploaded, tt.wantKeys) {
+				t.Errorf("uploaded keys = %v, want %v", uploaded, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestUploadContentSkipsGzipForSmallBodies(t *testing.T) {
+	small := []byte("<html>hi</html>")
+	large := []byte("<html>" + strings.Repeat("lorem ipsum ", 200) + "</html>")
+
+	tests := []struct {
+		name         string
+		scheme       string
+		body         []byte
+		wantKey      string
+		wantEncoding string
+	}{
+		{"tiny body stored plain", keySchemeHash, small, "abc123/raw.html", ""},
+		{"large body gzipped", keySchemeHash, large, "abc123/raw.html.gz", "gzip"},
+		{"tiny content-addressed body", keySchemeContent, small, contentKey(small, ".html"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			puts := map[string]*s3.PutObjectInput{}
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					puts[*input.Key] = input
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			var savedKey string
+			ddb := &mockDynamoDB{
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					savedKey = input.ExpressionAttributeValues[":raw_key"].(*dynamodbtypes.AttributeValueMemberS).Value
+					return &dynamodb.UpdateItemOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, s3Client)
+			c.minCompress = 1024
+			c.keyScheme = tt.scheme
+
+			fetched := &FetchResult{StatusCode: 200, ContentType: "text/html", Body: tt.body}
+			upload, err := c.uploadContent(context.Background(), "https://example.com/", "abc123", fetched, "", false)
+			if err != nil {
+				t.Fatalf("uploadContent() error = %v", err)
+			}
+			if upload.RawKey != tt.wantKey {
+				t.Errorf("RawKey = %q, want %q", upload.RawKey, tt.wantKey)
+			}
+			input, ok := puts[tt.wantKey]
+			if !ok {
+				t.Fatalf("uploaded keys = %v, want %s", slices.Collect(maps.Keys(puts)), tt.wantKey)
+			}
+			encoding := ""
+			if input.ContentEncoding != nil {
+				encoding = *input.ContentEncoding
+			}
+			if encoding != tt.wantEncoding {
+				t.Errorf("ContentEncoding = %q, want %q", encoding, tt.wantEncoding)
+			}
+			if *input.ContentType != "text/html" {
+				t.Errorf("ContentType = %q, want text/html", *input.ContentType)
+			}
+			if tt.wantEncoding == "" {
+				if body, _ := io.ReadAll(input.Body); string(body) != string(tt.body) {
+					t.Errorf("stored body = %q, want it unchanged", body)
+				}
+			}
+
+			c.saveS3Keys(context.Background(), "https://example.com/", "abc123", upload, 0, nil)
+			if savedKey != tt.wantKey {
+				t.Errorf("s3_raw_key = %q, want %q", savedKey, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestSaveS3KeysPersistsDomainKeys(t *testing.T) {
+	var capturedUpdate *dynamodb.UpdateItemInput
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			capturedUpdate = input
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.keyScheme = keySchemeDomain
+	upload, err := c.uploadContent(context.Background(), "https://example.com/page", "abc123", &FetchResult{StatusCode: 200, Body: []byte("<html></html>")}, "text", true)
+	if err != nil {
+		t.Fatalf("uploadContent() error = %v", err)
+	}
+	c.saveS3Keys(context.Background(), "https://example.com/page", "abc123", upload, 4, nil)
+
+	for name, want := range map[string]string{":raw_key": "example.com/abc123/raw.html.gz", ":text_key": "example.com/abc123/text.txt.gz"} {
+		if got := capturedUpdate.ExpressionAttributeValues[name].(*dynamodbtypes.AttributeValueMemberS).Value; got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+// s3APIError is an S3 error carrying an API error code, as the SDK's errors do
+type s3APIError struct{ code string }
+
+func (e s3APIError) Error() string     { return "api error " + e.code }
+func (e s3APIError) ErrorCode() string { return e.code }
+
+// conditionalS3 stores objects by key, honouring If-None-Match: * like S3 does
+type conditionalS3 struct {
+	mockS3  // The rest of S3API
+	mu      sync.Mutex
+	objects map[string]int // Successful puts per key
+	puts    int
+}
+
+func (m *conditionalS3) PutObject(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.puts++
+	if input.IfNoneMatch != nil && *input.IfNoneMatch == "*" && m.objects[*input.Key] > 0 {
+		return nil, fmt.Errorf("operation error S3: PutObject: %w", s3APIError{code: "PreconditionFailed"})
+	}
+	m.objects[*input.Key]++
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestUploadContentDedupsIdenticalBodies(t *testing.T) {
+	store := &conditionalS3{objects: map[string]int{}}
+	rawKeys := map[string]string{}
+	ddb := &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			urlHash := input.Key["url_hash"].(*dynamodbtypes.AttributeValueMemberS).Value
+			rawKeys[urlHash] = input.ExpressionAttributeValues[":raw_key"].(*dynamodbtypes.AttributeValueMemberS).Value
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.s3 = store
+	c.keyScheme = keySchemeContent
+
+	body := []byte("<html><body>Same article</body></html>")
+	for _, page := range []struct{ url, hash string }{
+		{"https://example.com/article", "hash-a"},
+		{"https://example.com/article?print=1", "hash-b"},
+	} {
+		fetched := &FetchResult{StatusCode: 200, ContentType: "text/html", Body: body}
+		upload, err := c.uploadContent(context.Background(), page.url, page.hash, fetched, "Same article", true)
+		if err != nil {
+			t.Fatalf("uploadContent(%s) error = %v", page.url, err)
+		}
+		c.saveS3Keys(context.Background(), page.url, page.hash, upload, len("Same article"), nil)
+	}
+
+	wantRaw := contentKey(body, ".html.gz")
+	if !strings.HasPrefix(wantRaw, "content/") || len(wantRaw) != len("content/")+64+len(".html.gz") {
+		t.Errorf("raw key = %q, want content/<sha256>.html.gz", wantRaw)
+	}
+	if len(store.objects) != 2 || store.objects[wantRaw] != 1 || store.objects[contentKey([]byte("Same article"), ".txt.gz")] != 1 {
+		t.Errorf("stored objects = %v, want one raw and one text object", store.objects)
+	}
+	if store.puts != 4 {
+		t.Errorf("PutObject calls = %d, want 4 (the second URL's puts are rejected as existing)", store.puts)
+	}
+	if len(rawKeys) != 2 || rawKeys["hash-a"] != wantRaw || rawKeys["hash-b"] != wantRaw {
+		t.Errorf("s3_raw_key per item = %v, want both items pointing at %s", rawKeys, wantRaw)
+	}
+}
+
+func TestUploadContentDedupDistinctBodies(t *testing.T) {
+	store := &conditionalS3{objects: map[string]int{}}
+	c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, &mockS3{})
+	c.s3 = store
+	c.keyScheme = keySchemeContent
+
+	a, errA := c.uploadContent(context.Background(), "https://example.com/a", "hash-a", &FetchResult{Body: []byte("<p>a</p>")}, "", false)
+	b, errB := c.uploadContent(context.Background(), "https://example.com/b", "hash-b", &FetchResult{Body: []byte("<p>b</p>")}, "", false)
+	if errA != nil || errB != nil {
+		t.Fatalf("uploadContent() errors = %v, %v", errA, errB)
+	}
+	if a.RawKey == b.RawKey {
+		t.Errorf("different bodies share key %s", a.RawKey)
+	}
+	if a.TextKey != "" || len(store.objects) != 2 {
+		t.Errorf("TextKey = %q, stored = %v; want raw objects only", a.TextKey, store.objects)
+	}
+}
+
+func TestUploadContentDedupOtherErrorFails(t *testing.T) {
+	s3Client := &mockS3{
+		putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			return nil, s3APIError{code: "AccessDenied"}
+		},
+	}
+	c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
+	c.keyScheme = keySchemeContent
+
+	if _, err := c.uploadContent(context.Background(), "https://example.com", "abc123", &FetchResult{Body: []byte("x")}, "x", true); err == nil {
+		t.Error("uploadContent() error = nil, want AccessDenied")
+	}
+}
+
 func TestUploadContentS3Error(t *testing.T) {
 	s3Client := &mockS3{
 		putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
@@ -46,12 +310,54 @@ func TestUploadContentS3Error(t *testing.T) {
 	}
 
 	c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
-	_, err := c.uploadContent(context.Background(), "abc123", []byte("<html>test</html>"), "test text")
+	_, err := c.uploadContent(context.Background(), "https://example.com", "abc123", &FetchResult{StatusCode: 200, Body: []byte("<html>test</html>")}, "test text", true)
 	if err == nil {
 		t.Fatal("uploadContent() expected error, got nil")
 	}
 }
 
+func TestUploadContentWARC(t *testing.T) {
+	var uploaded []*s3.PutObjectInput
+	var body []byte
+	s3Client := &mockS3{
+		putObjectFunc: func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			uploaded = append(uploaded, input)
+			gz, err := gzip.NewReader(input.Body)
+			if err != nil {
+				t.Fatalf("uploaded object is not gzip: %v", err)
+			}
+			body, _ = io.ReadAll(gz)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
+	c.storageFormat = storageFormatWARC
+
+	fetched := &FetchResult{StatusCode: 200, ContentType: "text/html", Body: []byte("<html>test</html>")}
+	result, err := c.uploadContent(context.Background(), "https://example.com/page", "abc123", fetched, "test", true)
+	if err != nil {
+		t.Fatalf("uploadContent() error = %v", err)
+	}
+
+	if len(uploaded) != 1 {
+		t.Fatalf("expected 1 S3 upload, got %d", len(uploaded))
+	}
+	if result.RawKey != "abc123/response.warc.gz" || *uploaded[0].Key != result.RawKey {
+		t.Errorf("expected key abc123/response.warc.gz, got result %s upload %s", result.RawKey, *uploaded[0].Key)
+	}
+	if result.TextKey != "" {
+		t.Errorf("expected no text key, got %s", result.TextKey)
+	}
+
+	record := string(body)
+	for _, want := range []string{"WARC/1.1\r\n", "WARC-Type: response\r\n", "WARC-Target-URI: https://example.com/page\r\n", "HTTP/1.1 200 OK\r\n", "<html>test</html>"} {
+		if !strings.Contains(record, want) {
+			t.Errorf("WARC record missing %q", want)
+		}
+	}
+}
+
 func TestSaveS3Keys(t *testing.T) {
 	var capturedUpdate *dynamodb.UpdateItemInput
 	ddb := &mockDynamoDB{
@@ -63,7 +369,7 @@ func TestSaveS3Keys(t *testing.T) {
 
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
 	upload := &UploadResult{RawKey: "hash/raw.html.gz", TextKey: "hash/text.txt.gz"}
-	c.saveS3Keys(context.Background(), "https://example.com", "hash", upload, 100)
+	c.saveS3Keys(context.Background(), "https://example.com", "hash", upload, 100, nil)
 
 	if capturedUpdate == nil {
 		t.Fatal("expected UpdateItem to be called")
@@ -73,16 +379,324 @@ func TestSaveS3Keys(t *testing.T) {
 	}
 }
 
-func TestSaveS3KeysError(t *testing.T) {
+func TestSaveS3KeysWithoutTextKey(t *testing.T) {
+	var capturedUpdate *dynamodb.UpdateItemInput
 	ddb := &mockDynamoDB{
-		updateItemFunc: func(_ context.Context, _ *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
-			return nil, fmt.Errorf("DynamoDB error")
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			capturedUpdate = input
+			return &dynamodb.UpdateItemOutput{}, nil
 		},
 	}
 
 	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.saveS3Keys(context.Background(), "https://example.com", "hash", &UploadResult{RawKey: "hash/response.warc.gz"}, 0, nil)
+
+	if want := " REMOVE s3_text_key"; !strings.Contains(*capturedUpdate.UpdateExpression, want) {
+		t.Errorf("UpdateExpression = %q, want it to contain %q", *capturedUpdate.UpdateExpression, want)
+	}
+	if _, ok := capturedUpdate.ExpressionAttributeValues[":text_key"]; ok {
+		t.Error("expected no :text_key value")
+	}
+}
+
+// TestSaveS3KeysRecrawlDropsTextKey checks that a recrawl writing no text object (the page is now
+// a PDF, say) removes the text key the previous crawl saved instead of leaving it on the item
+func TestSaveS3KeysRecrawlDropsTextKey(t *testing.T) {
+	ddb := newFakeDynamoDB()
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.saveS3Keys(context.Background(), "https://example.com", "hash", &UploadResult{RawKey: "hash/raw.html.gz", TextKey: "hash/text.txt.gz"}, 100, nil)
+	if got := ddb.str("hash", "s3_text_key"); got != "hash/text.txt.gz" {
+		t.Fatalf("first crawl s3_text_key = %q, want it saved", got)
+	}
+
+	if !c.saveS3Keys(context.Background(), "https://example.com", "hash", &UploadResult{RawKey: "hash/response.warc.gz"}, 0, nil) {
+		t.Fatal("saveS3Keys() = false, want the recrawl saved")
+	}
+	if got := ddb.str("hash", "s3_raw_key"); got != "hash/response.warc.gz" {
+		t.Errorf("s3_raw_key = %q, want the recrawl's key", got)
+	}
+	if got, ok := ddb.item("hash")["s3_text_key"]; ok {
+		t.Errorf("s3_text_key = %v, want it removed", got)
+	}
+}
+
+// flakyKeysDDB fails the first failures S3 key updates and records every update it sees
+func flakyKeysDDB(failures int, updates *[]*dynamodb.UpdateItemInput) *mockDynamoDB {
+	return &mockDynamoDB{
+		updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			*updates = append(*updates, input)
+			if len(*updates) <= failures {
+				return nil, fmt.Errorf("ProvisionedThroughputExceededException")
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+}
+
+func TestSaveS3KeysRetries(t *testing.T) {
+	attrs := map[string]dynamodbtypes.AttributeValue{"language": &dynamodbtypes.AttributeValueMemberS{Value: "en"}}
 	upload := &UploadResult{RawKey: "hash/raw.html.gz", TextKey: "hash/text.txt.gz"}
 
-	// Should not panic, just log the error
-	c.saveS3Keys(context.Background(), "https://example.com", "hash", upload, 100)
+	tests := []struct {
+		name         string
+		failures     int
+		wantSaved    bool
+		wantUpdates  int
+		wantOrphaned bool
+	}{
+		{"first try", 0, true, 1, false},
+		{"retry then succeed", saveKeysAttempts - 1, true, saveKeysAttempts, false},
+		{"retry then fail flags orphaned", saveKeysAttempts, false, saveKeysAttempts + 1, true},
+		{"orphaned flag fails too", saveKeysAttempts + 1, false, saveKeysAttempts + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates []*dynamodb.UpdateItemInput
+			c := newTestCrawlerWithMocks(flakyKeysDDB(tt.failures, &updates), &mockSQS{}, &mockS3{})
+
+			if got := c.saveS3Keys(context.Background(), "https://example.com", "hash", upload, 100, attrs); got != tt.wantSaved {
+				t.Errorf("saveS3Keys() = %v, want %v", got, tt.wantSaved)
+			}
+			if len(updates) != tt.wantUpdates {
+				t.Fatalf("UpdateItem calls = %d, want %d", len(updates), tt.wantUpdates)
+			}
+			for _, u := range updates[:min(len(updates), saveKeysAttempts)] {
+				if !strings.Contains(*u.UpdateExpression, "#language = :language") {
+					t.Errorf("attempt UpdateExpression = %q, want the full update", *u.UpdateExpression)
+				}
+			}
+
+			last := updates[len(updates)-1]
+			_, orphaned := last.ExpressionAttributeValues[":orphaned"]
+			if orphaned != tt.wantOrphaned {
+				t.Errorf("last update %q flags orphaned = %v, want %v", *last.UpdateExpression, orphaned, tt.wantOrphaned)
+			}
+			if tt.wantSaved && !strings.Contains(*last.UpdateExpression, "REMOVE s3_orphaned") {
+				t.Errorf("saved UpdateExpression = %q, want it to clear s3_orphaned", *last.UpdateExpression)
+			}
+			if tt.wantOrphaned {
+				want := "SET s3_bucket = :bucket, s3_raw_key = :raw_key, s3_text_key = :text_key, s3_orphaned = :orphaned"
+				if *last.UpdateExpression != want {
+					t.Errorf("orphaned UpdateExpression = %q, want %q", *last.UpdateExpression, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveS3KeysOrphanedWithoutTextKey(t *testing.T) {
+	var updates []*dynamodb.UpdateItemInput
+	c := newTestCrawlerWithMocks(flakyKeysDDB(saveKeysAttempts, &updates), &mockSQS{}, &mockS3{})
+
+	c.saveS3Keys(context.Background(), "https://example.com", "hash", &UploadResult{RawKey: "hash/response.warc.gz"}, 0, nil)
+	want := "SET s3_bucket = :bucket, s3_raw_key = :raw_key, s3_orphaned = :orphaned REMOVE s3_text_key"
+	if got := *updates[len(updates)-1].UpdateExpression; got != want {
+		t.Errorf("orphaned UpdateExpression = %q, want %q", got, want)
+	}
+}
+
+func TestSaveS3KeysClearsOrphaned(t *testing.T) {
+	ddb := newFakeDynamoDB()
+	ddb.items["hash"] = map[string]dynamodbtypes.AttributeValue{
+		"url_hash":    &dynamodbtypes.AttributeValueMemberS{Value: "hash"},
+		"s3_orphaned": &dynamodbtypes.AttributeValueMemberBOOL{Value: true},
+	}
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+
+	if !c.saveS3Keys(context.Background(), "https://example.com", "hash", &UploadResult{RawKey: "hash/raw.html.gz", TextKey: "hash/text.txt.gz"}, 100, nil) {
+		t.Fatal("saveS3Keys() = false, want the update saved")
+	}
+	if got, ok := ddb.item("hash")["s3_orphaned"]; ok {
+		t.Errorf("s3_orphaned = %v after a saved update, want it removed", got)
+	}
+}
+
+// TestSaveS3KeysReservedWordAttrs checks that attrs named after DynamoDB reserved words (language,
+// and others a page may grow) are saved: the fake table rejects them in an expression as DynamoDB does
+func TestSaveS3KeysReservedWordAttrs(t *testing.T) {
+	ddb := newFakeDynamoDB()
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	attrs := map[string]dynamodbtypes.AttributeValue{
+		"language":   &dynamodbtypes.AttributeValueMemberS{Value: "en"},
+		"status":     &dynamodbtypes.AttributeValueMemberS{Value: stateDone},
+		"page_title": &dynamodbtypes.AttributeValueMemberS{Value: "Home"},
+	}
+
+	if !c.saveS3Keys(context.Background(), "https://example.com", "hash", &UploadResult{RawKey: "hash/raw.html.gz"}, 0, attrs) {
+		t.Fatal("saveS3Keys() = false, want the update saved")
+	}
+	for name, want := range map[string]string{"language": "en", "status": stateDone, "page_title": "Home", "s3_raw_key": "hash/raw.html.gz"} {
+		if got := ddb.str("hash", name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if got := ddb.item("hash")["s3_orphaned"]; got != nil {
+		t.Error("item flagged s3_orphaned")
+	}
+}
+
+func TestFakeDynamoDBRejectsReservedWords(t *testing.T) {
+	ddb := newFakeDynamoDB()
+	key := map[string]dynamodbtypes.AttributeValue{"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: "hash"}}
+	values := map[string]dynamodbtypes.AttributeValue{":v": &dynamodbtypes.AttributeValueMemberS{Value: "en"}}
+
+	for _, expr := range []string{"SET language = :v", "SET meta.language = :v", "SET s3_raw_key = :v REMOVE url"} {
+		if _, err := ddb.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{Key: key, UpdateExpression: &expr, ExpressionAttributeValues: values}); err == nil {
+			t.Errorf("UpdateItem(%q) error = nil, want a reserved keyword error", expr)
+		}
+	}
+	expr := "SET #l = :v"
+	if _, err := ddb.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{Key: key, UpdateExpression: &expr, ExpressionAttributeNames: map[string]string{"#l": "language"}, ExpressionAttributeValues: values}); err != nil {
+		t.Errorf("UpdateItem(%q) with a placeholder error = %v", expr, err)
+	}
+}
+
+func TestSaveS3KeysStopsWaitingWhenCancelled(t *testing.T) {
+	var updates []*dynamodb.UpdateItemInput
+	c := newTestCrawlerWithMocks(flakyKeysDDB(saveKeysAttempts, &updates), &mockSQS{}, &mockS3{})
+	c.keysBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	c.saveS3Keys(ctx, "https://example.com", "hash", &UploadResult{RawKey: "hash/raw.html.gz"}, 0, nil)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("saveS3Keys() took %s with a cancelled context", elapsed)
+	}
+	if _, ok := updates[len(updates)-1].ExpressionAttributeValues[":orphaned"]; !ok {
+		t.Error("expected the item to be flagged s3_orphaned after cancellation")
+	}
+}
+
+// linkList returns n distinct links, each padded with pad filler bytes
+func linkList(n, pad int) []string {
+	links := make([]string, n)
+	for i := range links {
+		links[i] = fmt.Sprintf("https://example.com/%d/%s", i, strings.Repeat("x", pad))
+	}
+	return links
+}
+
+func TestAddOutboundLinks(t *testing.T) {
+	tests := []struct {
+		name         string
+		links        []string
+		wantSet      bool
+		wantOverflow bool
+	}{
+		{"under limit", linkList(3, 0), true, false},
+		{"over count limit", linkList(defaultMaxStoredLinks+1, 0), false, true},
+		{"over byte limit", linkList(100, maxStoredLinksBytes/100), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploaded := map[string][]byte{}
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					gz, err := gzip.NewReader(input.Body)
+					if err != nil {
+						t.Fatalf("uploaded object is not gzip: %v", err)
+					}
+					uploaded[*input.Key], _ = io.ReadAll(gz)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
+			c.storeLinks = true
+			attrs := map[string]dynamodbtypes.AttributeValue{}
+			c.addOutboundLinks(context.Background(), "https://example.com", "abc123", tt.links, attrs)
+
+			set, hasSet := attrs["outbound_links"].(*dynamodbtypes.AttributeValueMemberSS)
+			if hasSet != tt.wantSet {
+				t.Fatalf("outbound_links stored = %v, want %v", hasSet, tt.wantSet)
+			}
+			if hasSet && strings.Join(set.Value, " ") != strings.Join(tt.links, " ") {
+				t.Errorf("outbound_links = %v, want %v", set.Value, tt.links)
+			}
+
+			key, hasKey := attrs["outbound_links_key"].(*dynamodbtypes.AttributeValueMemberS)
+			if hasKey != tt.wantOverflow {
+				t.Fatalf("outbound_links_key stored = %v, want %v", hasKey, tt.wantOverflow)
+			}
+			if tt.wantOverflow {
+				if key.Value != "abc123/links.json.gz" {
+					t.Errorf("outbound_links_key = %q, want abc123/links.json.gz", key.Value)
+				}
+				var got []string
+				if err := json.Unmarshal(uploaded[key.Value], &got); err != nil {
+					t.Fatalf("overflow object is not a JSON list: %v", err)
+				}
+				if len(got) != len(tt.links) {
+					t.Errorf("overflow object has %d links, want all %d", len(got), len(tt.links))
+				}
+			} else if len(uploaded) != 0 {
+				t.Errorf("unexpected S3 uploads %v", slices.Collect(maps.Keys(uploaded)))
+			}
+
+			if count := attrs["outbound_links_count"].(*dynamodbtypes.AttributeValueMemberN).Value; count != strconv.Itoa(len(tt.links)) {
+				t.Errorf("outbound_links_count = %s, want %d", count, len(tt.links))
+			}
+		})
+	}
+}
+
+func TestAddOutboundLinksSkipped(t *testing.T) {
+	tests := []struct {
+		name       string
+		storeLinks bool
+		links      []string
+		s3Err      error
+	}{
+		{"disabled", false, linkList(3, 0), nil},
+		{"no links", true, nil, nil},
+		{"overflow upload fails", true, linkList(defaultMaxStoredLinks+1, 0), fmt.Errorf("S3 unavailable")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Client := &mockS3{
+				putObjectFunc: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					return nil, tt.s3Err
+				},
+			}
+			c := newTestCrawlerWithMocks(&mockDynamoDB{}, &mockSQS{}, s3Client)
+			c.storeLinks = tt.storeLinks
+
+			attrs := map[string]dynamodbtypes.AttributeValue{}
+			c.addOutboundLinks(context.Background(), "https://example.com", "abc123", tt.links, attrs)
+			if len(attrs) != 0 {
+				t.Errorf("attrs = %v, want none", slices.Collect(maps.Keys(attrs)))
+			}
+		})
+	}
+}
+
+func TestProcessHTMLContentStoresOutboundLinks(t *testing.T) {
+	var update *dynamodb.UpdateItemInput
+	ddb := authItemDDB(nil)
+	ddb.updateItemFunc = func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		if strings.Contains(*input.UpdateExpression, "s3_raw_key") {
+			update = input
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	c.storeLinks = true
+	c.maxDepth = 0 // stored even when nothing is enqueued
+
+	body := `<html><body><a href="/a">A</a><a href="https://other.com/b">B</a></body></html>`
+	c.processHTMLContent(context.Background(), "https://example.com", "hash", &FetchResult{ContentType: "text/html", Body: []byte(body)}, 0, claim{})
+
+	set, ok := update.ExpressionAttributeValues[":outbound_links"].(*dynamodbtypes.AttributeValueMemberSS)
+	if !ok {
+		t.Fatalf("outbound_links not stored: %q", *update.UpdateExpression)
+	}
+	if want := "https://example.com/a https://other.com/b"; strings.Join(set.Value, " ") != want {
+		t.Errorf("outbound_links = %v, want %s", set.Value, want)
+	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// takeToken consumes one token from the domain's bucket stored on the domain#<domain> item.
+// Returns true if a token was taken, false if rate limited (empty bucket or lost race).
+func (c *Crawler) takeToken(ctx context.Context, domain string) (bool, error) {
+	return c.takeBucketToken(ctx, domainKeyPrefix+domain, c.bucketSize, c.bucketRefill, func(input *dynamodb.UpdateItemInput) {
+		*input.UpdateExpression += ", #d = :domain, expires_at = :ttl"
+		input.ExpressionAttributeNames = map[string]string{"#d": "domain"}
+		input.ExpressionAttributeValues[":domain"] = &dynamodbtypes.AttributeValueMemberS{Value: domain}
+		input.ExpressionAttributeValues[":ttl"] = c.domainExpiry()
+	})
+}
+
+// takeBucketToken consumes one token from the bucket stored on the item at key as tokens and
+// last_refill, holding up to capacity tokens and refilling at refill tokens per second. The
+// refill is computed from the stored values, then written back with a condition on the previous
+// last_refill so concurrent Lambdas cannot spend the same token. A missing item starts full.
+// extra, if not nil, adds attributes to the write. Returns false on an empty bucket or lost race
+// (a failed condition); any other read or write error is returned.
+func (c *Crawler) takeBucketToken(ctx context.Context, key string, capacity, refill float64, extra func(*dynamodb.UpdateItemInput)) (bool, error) {
+	now := time.Now().UnixMilli()
+
+	out, err := c.ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &c.tableName,
+		Key:            map[string]dynamodbtypes.AttributeValue{"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: key}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Str("bucket", key).Msg("Failed to read token bucket")
+		return false, err
+	}
+
+	tokens, lastRefill, exists := parseBucket(out.Item)
+	if !exists {
+		tokens, lastRefill = capacity, now
+	}
+
+	available := refillTokens(tokens, now-lastRefill, capacity, refill)
+	if available < 1 {
+		c.log.Debug().Str("bucket", key).Float64("tokens", available).Msg("Rate limited (bucket empty)")
+		return false, nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:        &c.tableName,
+		Key:              map[string]dynamodbtypes.AttributeValue{"url_hash": &dynamodbtypes.AttributeValueMemberS{Value: key}},
+		UpdateExpression: aws.String("SET tokens = :tokens, last_refill = :now"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":tokens": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatFloat(available-1, 'f', 3, 64)},
+			":now":    &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	}
+	if extra != nil {
+		extra(input)
+	}
+	if exists {
+		input.ConditionExpression = aws.String("last_refill = :prev")
+		input.ExpressionAttributeValues[":prev"] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(lastRefill, 10)}
+	} else {
+		input.ConditionExpression = aws.String("attribute_not_exists(last_refill)")
+	}
+
+	if _, err := c.ddb.UpdateItem(ctx, input); err != nil {
+		var condErr *dynamodbtypes.ConditionalCheckFailedException
+		if !errors.As(err, &condErr) {
+			c.log.Warn().Err(err).Str("bucket", key).Msg("Failed to take token")
+			return false, err
+		}
+		// Condition failed = another Lambda updated the bucket first
+		c.log.Debug().Str("bucket", key).Msg("Rate limited (bucket contention)")
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseBucket reads tokens and last_refill from a bucket item
+func parseBucket(item map[string]dynamodbtypes.AttributeValue) (tokens float64, lastRefill int64, ok bool) {
+	tokensAttr, ok1 := item["tokens"].(*dynamodbtypes.AttributeValueMemberN)
+	refillAttr, ok2 := item["last_refill"].(*dynamodbtypes.AttributeValueMemberN)
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	tokens, err1 := strconv.ParseFloat(tokensAttr.Value, 64)
+	lastRefill, err2 := strconv.ParseInt(refillAttr.Value, 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return tokens, lastRefill, true
+}
+
+// refillTokens adds ratePerSec tokens for each elapsed second, capped at capacity
+func refillTokens(tokens float64, elapsedMs int64, capacity, ratePerSec float64) float64 {
+	if elapsedMs < 0 {
+		elapsedMs = 0
+	}
+	return math.Min(capacity, tokens+float64(elapsedMs)/1000*ratePerSec)
+}
+
+// tokenWaitSeconds is how long until the next token is available, at least 1 second
+func (c *Crawler) tokenWaitSeconds() int {
+	if c.bucketRefill <= 0 {
+		return sqsMaxDelaySeconds
+	}
+	return max(int(math.Ceil(1/c.bucketRefill)), 1)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestRefillTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokens    float64
+		elapsedMs int64
+		capacity  float64
+		rate      float64
+		want      float64
+	}{
+		{"no time elapsed", 2, 0, 5, 1, 2},
+		{"one second at 1/s", 2, 1000, 5, 1, 3},
+		{"half second at 1/s", 0, 500, 5, 1, 0.5},
+		{"refill capped at capacity", 4, 10_000, 5, 1, 5},
+		{"fast refill rate", 0, 1000, 10, 4, 4},
+		{"slow refill rate", 0, 30_000, 10, 0.1, 3},
+		{"clock skew treated as zero", 3, -5000, 5, 1, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := refillTokens(tt.tokens, tt.elapsedMs, tt.capacity, tt.rate)
+			if got != tt.want {
+				t.Errorf("refillTokens() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func bucketItem(tokens float64, lastRefill int64) map[string]dynamodbtypes.AttributeValue {
+	return map[string]dynamodbtypes.AttributeValue{
+		"tokens":      &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatFloat(tokens, 'f', 3, 64)},
+		"last_refill": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(lastRefill, 10)},
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	now := time.Now().UnixMilli()
+
+	tests := []struct {
+		name          string
+		item          map[string]dynamodbtypes.AttributeValue
+		updateErr     error
+		want          bool
+		wantErr       bool
+		wantUpdate    bool
+		wantCondition string
+		wantTokens    string
+	}{
+		{"new domain starts full", nil, nil, true, false, true, "attribute_not_exists(last_refill)", "4.000"},
+		{"tokens available", bucketItem(3, now), nil, true, false, true, "last_refill = :prev", "2.000"},
+		{"empty bucket recently", bucketItem(0, now), nil, false, false, false, "", ""},
+		{"empty bucket refilled after wait", bucketItem(0, now-5000), nil, true, false, true, "last_refill = :prev", "4.000"},
+		{"lost race on update", bucketItem(3, now), errConditionalCheckFailed, false, false, true, "last_refill = :prev", "2.000"},
+		{"update error is not contention", bucketItem(3, now), fmt.Errorf("ProvisionedThroughputExceededException"), false, true, true, "last_refill = :prev", "2.000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var update *dynamodb.UpdateItemInput
+			ddb := &mockDynamoDB{
+				getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					return &dynamodb.GetItemOutput{Item: tt.item}, nil
+				},
+				updateItemFunc: func(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					update = input
+					return &dynamodb.UpdateItemOutput{}, tt.updateErr
+				},
+			}
+
+			c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+			c.rateLimitMode = rateLimitTokenBucket
+			c.bucketSize = 5
+			c.bucketRefill = 1
+
+			allowed, err := c.checkRateLimit(context.Background(), "https://example.com")
+			if allowed != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("checkRateLimit() = %v, %v, want %v (error %v)", allowed, err, tt.want, tt.wantErr)
+			}
+			if (update != nil) != tt.wantUpdate {
+				t.Fatalf("UpdateItem called = %v, want %v", update != nil, tt.wantUpdate)
+			}
+			if update == nil {
+				return
+			}
+			if *update.ConditionExpression != tt.wantCondition {
+				t.Errorf("condition = %q, want %q", *update.ConditionExpression, tt.wantCondition)
+			}
+			// Allow for a few ms of refill between the test's now and takeToken's now
+			tokens := update.ExpressionAttributeValues[":tokens"].(*dynamodbtypes.AttributeValueMemberN).Value
+			got, _ := strconv.ParseFloat(tokens, 64)
+			want, _ := strconv.ParseFloat(tt.wantTokens, 64)
+			if got < want || got > want+0.1 {
+				t.Errorf("stored tokens = %s, want ~%s", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestTakeTokenGetItemError(t *testing.T) {
+	ddb := &mockDynamoDB{
+		getItemFunc: func(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			return nil, fmt.Errorf("DynamoDB error")
+		},
+	}
+
+	c := newTestCrawlerWithMocks(ddb, &mockSQS{}, &mockS3{})
+	if got, err := c.takeToken(context.Background(), "https://example.com"); got || err == nil {
+		t.Errorf("takeToken() = %v, %v on read error, want false and the error", got, err)
+	}
+}
+
+func TestTokenWaitSeconds(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64
+		want int
+	}{
+		{"one per second", 1, 1},
+		{"fast rate floors at 1", 10, 1},
+		{"one per five seconds", 0.2, 5},
+		{"zero rate waits max", 0, sqsMaxDelaySeconds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCrawler()
+			c.bucketRefill = tt.rate
+			if got := c.tokenWaitSeconds(); got != tt.want {
+				t.Errorf("tokenWaitSeconds() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package urls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+func Hash(u string) string {
+	h := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(h[:])
+}
+
+// GetDomain extracts the domain (scheme + host) from a URL
+func GetDomain(urlStr string) string {
+	parsed, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// GetHost extracts just the host from a URL (without scheme)
+func GetHost(urlStr string) string {
+	parsed, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// RegistrableDomain collapses a host to its registrable domain (eTLD+1), so blog.example.co.uk
+// and www.example.co.uk both become example.co.uk. Any port is dropped and the result is
+// lowercase. IP addresses, single-label hosts and bare public suffixes are returned as is.
+func RegistrableDomain(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// allowedSchemes are the URL schemes Normalize keeps. Replaced by SetAllowedSchemes at startup.
+var allowedSchemes = map[string]bool{"http": true, "https": true}
+
+// SetAllowedSchemes replaces the schemes Normalize keeps (ALLOWED_SCHEMES). Names are trimmed
+// and lowercased; an empty list restores the http/https default. Not safe to call concurrently
+// with Normalize, so set it once before crawling starts.
+func SetAllowedSchemes(schemes []string) {
+	set := make(map[string]bool, len(schemes))
+	for _, scheme := range schemes {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			set[scheme] = true
+		}
+	}
+	if len(set) == 0 {
+		set = map[string]bool{"http": true, "https": true}
+	}
+	allowedSchemes = set
+}
+
+// SchemeAllowed reports whether URLs with scheme may be crawled
+func SchemeAllowed(scheme string) bool {
+	return allowedSchemes[strings.ToLower(scheme)]
+}
+
+// defaultAllowedPorts are the ports Normalize keeps unless SetAllowedPorts says otherwise: none
+// given, or the http/https defaults written out
+var defaultAllowedPorts = map[string]bool{"": true, "80": true, "443": true}
+
+// allowedPorts are the URL ports Normalize keeps; nil keeps any port. Replaced by SetAllowedPorts at startup.
+var allowedPorts = defaultAllowedPorts
+
+// SetAllowedPorts replaces the ports Normalize keeps (ALLOWED_PORTS). A URL without a port is
+// always kept; "*" keeps any port, and an empty list restores the 80/443 default. Like
+// SetAllowedSchemes, set it once before crawling starts.
+func SetAllowedPorts(ports []string) {
+	set := map[string]bool{"": true}
+	for _, port := range ports {
+		switch port = strings.TrimSpace(port); port {
+		case "":
+		case "*":
+			allowedPorts = nil
+			return
+		default:
+			set[port] = true
+		}
+	}
+	if len(set) == 1 {
+		set = defaultAllowedPorts
+	}
+	allowedPorts = set
+}
+
+// PortAllowed reports whether URLs with port ("" for none) may be crawled
+func PortAllowed(port string) bool {
+	return allowedPorts == nil || allowedPorts[port]
+}
+
+// rejectUserinfo drops URLs with userinfo in Normalize instead of stripping it. Set by SetRejectUserinfo at startup.
+var rejectUserinfo bool
+
+// SetRejectUserinfo makes Normalize drop links carrying userinfo ("user:pass@host") rather than
+// crawl them with the credentials stripped (REJECT_USERINFO). Like SetAllowedSchemes, set it once
+// before crawling starts.
+func SetRejectUserinfo(reject bool) {
+	rejectUserinfo = reject
+}
+
+// preserveFragments keeps route fragments in Normalize and Canonicalize. Set by SetPreserveFragments at startup.
+var preserveFragments bool
+
+// SetPreserveFragments makes Normalize and Canonicalize keep fragments that look like client-side
+// routes (PRESERVE_FRAGMENTS), so each route of a hash-routed single-page app is its own URL.
+// Like SetAllowedSchemes, set it once before crawling starts.
+func SetPreserveFragments(preserve bool) {
+	preserveFragments = preserve
+}
+
+// IsRouteFragment reports whether a fragment (without the #) looks like a hash route, "/page" or
+// the hashbang form "!/page", rather than an in-page anchor like "top"
+func IsRouteFragment(fragment string) bool {
+	return strings.HasPrefix(fragment, "/") || strings.HasPrefix(fragment, "!/")
+}
+
+// keepFragment reports whether Normalize and Canonicalize keep fragment
+func keepFragment(fragment string) bool {
+	return preserveFragments && IsRouteFragment(fragment)
+}
+
+// normalizeURL converts a potentially relative URL to an absolute URL
+// Returns empty string for URLs we don't want to crawl
+func Normalize(href string, baseURL *url.URL) string {
+	href = strings.TrimSpace(href)
+
+	// Skip empty, fragments, javascript, mailto, tel, etc.
+	// A bare hash route ("#/page") is a link to another page when fragments are preserved.
+	if href == "" ||
+		(strings.HasPrefix(href, "#") && !keepFragment(href[1:])) ||
+		strings.HasPrefix(href, "javascript:") ||
+		strings.HasPrefix(href, "mailto:") ||
+		strings.HasPrefix(href, "tel:") ||
+		strings.HasPrefix(href, "data:") {
+		return ""
+	}
+
+	// Parse the href
+	parsed, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+
+	// Resolve relative URLs against base
+	resolved := baseURL.ResolveReference(parsed)
+
+	// Only keep allowed schemes (http/https unless configured)
+	if !SchemeAllowed(resolved.Scheme) {
+		return ""
+	}
+	if !PortAllowed(resolved.Port()) {
+		return ""
+	}
+
+	// Credentials never end up in a stored or queued URL
+	if resolved.User != nil {
+		if rejectUserinfo {
+			return ""
+		}
+		resolved.User = nil
+	}
+
+	// Remove fragment, unless it is a route to keep
+	if !keepFragment(resolved.Fragment) {
+		resolved.Fragment = ""
+		resolved.RawFragment = ""
+	}
+
+	// Note: Same-domain filter removed - domain allowlist checked in enqueueLinks()
+
+	return resolved.String()
+}
+
+// trackingParams are query parameters that identify a campaign or click, not a page
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"msclkid": true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+}
+
+// Canonicalize reduces an absolute URL to one form for deduplication: lowercase scheme
+// and host, no default port, no fragment (except a route under SetPreserveFragments), a canonical
+// path (see CanonicalPath), and a query with tracking parameters (utm_*, gclid, fbclid, ...)
+// removed and the rest sorted. Returns the input unchanged if it does not parse.
+func Canonicalize(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = u.Hostname()
+	}
+	if !keepFragment(u.Fragment) {
+		u.Fragment = ""
+	}
+	u.RawFragment = "" // A kept fragment is re-escaped one way
+
+	canonical := CanonicalPath(u.EscapedPath())
+	if decoded, err := url.PathUnescape(canonical); err == nil {
+		u.Path = decoded
+		u.RawPath = canonical
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			if trackingParams[strings.ToLower(name)] || strings.HasPrefix(strings.ToLower(name), "utm_") {
+				query.Del(name)
+			}
+		}
+		u.RawQuery = query.Encode() // Encode sorts by key
+	}
+	u.ForceQuery = false
+
+	return u.String()
+}
+
+// TrapLimits are the thresholds LooksLikeTrap applies. A zero field disables that check.
+type TrapLimits struct {
+	MaxSegmentRepeats int // Times any one path segment may appear, anywhere in the path
+	MaxParamRepeats   int // Times any one query parameter may appear
+}
+
+// LooksLikeTrap reports whether u has the shape of a generated, effectively infinite URL space:
+// a path segment repeated beyond the limit (/a/a/a/a, /cal/2024/next/2024/next/...) or a query
+// parameter stacked beyond it (faceted navigation: ?tag=a&tag=b&tag=c&...). Deep paths whose
+// segments are distinct are left alone. Unparseable URLs are not flagged.
+func LooksLikeTrap(u string, limits TrapLimits) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+
+	if limits.MaxSegmentRepeats > 0 {
+		counts := make(map[string]int)
+		for _, seg := range strings.Split(parsed.EscapedPath(), "/") {
+			if seg == "" {
+				continue
+			}
+			if counts[seg]++; counts[seg] > limits.MaxSegmentRepeats {
+				return true
+			}
+		}
+	}
+
+	if limits.MaxParamRepeats > 0 {
+		for _, values := range parsed.Query() {
+			if len(values) > limits.MaxParamRepeats {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Extension returns the lowercased file extension of u's last path segment, with its dot
+// (".zip"), or "" when it has none. The query string and fragment are ignored, so
+// /download?file=a.zip has no extension. Unparseable URLs have none either.
+func Extension(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	last := parsed.Path[strings.LastIndex(parsed.Path, "/")+1:] // Empty for a directory path like /files.d/
+	return strings.ToLower(path.Ext(last))
+}
+
+// HasPathPrefix reports whether u's path starts with one of prefixes, or true when prefixes is
+// empty. An empty path counts as "/". Matching is on the decoded path and case-sensitive, like
+// the paths themselves; a prefix only matches whole characters, so "/docs/" does not match "/docs".
+func HasPathPrefix(u string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	p := parsed.Path
+	if p == "" {
+		p = "/"
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanonicalPath normalizes the percent-encoding of an escaped URL path so equivalent encodings
+// collapse to one form without changing which resource it names: escapes of unreserved characters
+// (RFC 3986: ALPHA, DIGIT, "-", ".", "_", "~") are decoded and the other escapes get uppercase hex.
+// Everything else is left as written: "+", reserved characters (":", "@", ",", ...) and their
+// escapes mean different things to a server, and invalid escapes are not touched.
+func CanonicalPath(escaped string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	sb.Grow(len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '%' || i+2 >= len(escaped) || !isHex(escaped[i+1]) || !isHex(escaped[i+2]) {
+			sb.WriteByte(escaped[i])
+			continue
+		}
+		b := unhex(escaped[i+1])<<4 | unhex(escaped[i+2])
+		if isUnreserved(b) {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteByte(hex[b>>4])
+			sb.WriteByte(hex[b&0x0F])
+		}
+		i += 2
+	}
+	return sb.String()
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+func isUnreserved(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+		b == '-' || b == '.' || b == '_' || b == '~'
+}
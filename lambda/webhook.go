@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// pageCompletedHook is POSTed to COMPLETION_WEBHOOK_URL after a page is saved as done
+type pageCompletedHook struct {
+	URL           string `json:"url"`
+	Status        int    `json:"status"`
+	S3RawKey      string `json:"s3_raw_key,omitempty"`
+	S3TextKey     string `json:"s3_text_key,omitempty"`
+	ContentSHA256 string `json:"content_sha256"`
+}
+
+// notifyWebhook POSTs a pageCompletedHook for targetURL to COMPLETION_WEBHOOK_URL in the
+// background; Handler waits for outstanding POSTs before returning, so none is frozen with the
+// Lambda, and each is bounded by hookTimeout. A no-op unless the URL is set. hookClient dials
+// through the SSRF-safe transport, so the webhook cannot reach private addresses either.
+// Failures are logged, never returned: the page is already saved.
+func (c *Crawler) notifyWebhook(ctx context.Context, targetURL string, result *FetchResult, upload UploadResult) {
+	if c.webhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(pageCompletedHook{
+		URL:           targetURL,
+		Status:        result.StatusCode,
+		S3RawKey:      upload.RawKey,
+		S3TextKey:     upload.TextKey,
+		ContentSHA256: sha256Hex(result.Body),
+	})
+	if err != nil {
+		c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to encode completion webhook")
+		return
+	}
+
+	// Detached from ctx so the POST outlives processMessage, but never hookTimeout
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.hookTimeout)
+	c.webhooks.Go(func() {
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.webhookURL, bytes.NewReader(body))
+		if err != nil {
+			c.log.Error().Err(err).Str("url", targetURL).Msg("Failed to build completion webhook request")
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", c.userAgent)
+
+		resp, err := c.hookClient.Do(req)
+		if err != nil {
+			c.log.Warn().Err(err).Str("url", targetURL).Msg("Failed to deliver completion webhook")
+			return
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			c.log.Warn().Str("url", targetURL).Int("status", resp.StatusCode).Msg("Completion webhook rejected")
+		}
+	})
+}
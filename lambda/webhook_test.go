@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lambda/internal/ssrf"
+	"lambda/urls"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const webhookPageBody = `<html><body><p>Hello from the webhook test</p></body></html>`
+
+// webhookCrawler returns a test crawler that fetches webhookPageBody with the given status and
+// POSTs completions to webhookURL through hookClient
+func webhookCrawler(status int, webhookURL string, hookClient *http.Client) *Crawler {
+	c := newTestCrawlerWithMocks(authItemDDB(nil), &mockSQS{}, &mockS3{})
+	c.httpClient = testHTTPClientWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, webhookPageBody)
+	}))
+	c.crawlDelayMs = 0
+	c.webhookURL = webhookURL
+	c.hookClient = hookClient
+	return c
+}
+
+func TestHandlerPostsCompletionWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var posts []*http.Request
+	var payloads []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]any
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("webhook body is not valid JSON: %v", err)
+		}
+		mu.Lock()
+		posts = append(posts, r)
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	c := webhookCrawler(http.StatusOK, srv.URL+"/done", srv.Client())
+	if _, err := c.Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: "https://example.com/page"}}}); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+
+	// Handler returns only after the POST, so no waiting here
+	if len(posts) != 1 {
+		t.Fatalf("webhook received %d POSTs, want 1", len(posts))
+	}
+	if posts[0].Method != http.MethodPost || posts[0].URL.Path != "/done" || posts[0].Header.Get("Content-Type") != "application/json" {
+		t.Errorf("webhook request = %s %s (%s), want a JSON POST to /done", posts[0].Method, posts[0].URL.Path, posts[0].Header.Get("Content-Type"))
+	}
+	prefix := urls.Hash("https://example.com/page") + "/"
+	want := map[string]any{
+		"url":            "https://example.com/page",
+		"status":         float64(http.StatusOK),
+		"s3_raw_key":     prefix + "raw" + rawExt(c.compressRaw([]byte(webhookPageBody))),
+		"s3_text_key":    prefix + "text.txt.gz",
+		"content_sha256": sha256Hex([]byte(webhookPageBody)),
+	}
+	if !maps.Equal(payloads[0], want) {
+		t.Errorf("payload = %v, want %v", payloads[0], want)
+	}
+}
+
+func TestWebhookOnlyForSuccessfulCrawls(t *testing.T) {
+	var mu sync.Mutex
+	posts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		posts++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	for _, status := range []int{http.StatusNotFound, http.StatusServiceUnavailable} {
+		c := webhookCrawler(status, srv.URL, srv.Client())
+		_, _ = c.Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: "https://example.com/page"}}})
+	}
+	if posts != 0 {
+		t.Errorf("webhook received %d POSTs for failed crawls, want 0", posts)
+	}
+}
+
+func TestWebhookFailureDoesNotFailCrawl(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release) // Before Close, which waits for the handler
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		client *http.Client
+	}{
+		{"server error", failing.URL, failing.Client()},
+		{"timeout", slow.URL, slow.Client()},
+		{"unreachable", "http://127.0.0.1:1/done", http.DefaultClient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := webhookCrawler(http.StatusOK, tt.url, tt.client)
+			c.hookTimeout = 50 * time.Millisecond
+
+			start := time.Now()
+			got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"})
+			if err != nil || got != outcomeSucceeded {
+				t.Errorf("processMessage() = %v, %v, want succeeded", got, err)
+			}
+			c.webhooks.Wait()
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("webhook took %v, want it bounded by hookTimeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestWebhookRefusesPrivateAddress(t *testing.T) {
+	var mu sync.Mutex
+	posts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		posts++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	// The production client: its SSRF-safe dialer refuses the loopback server
+	c := webhookCrawler(http.StatusOK, srv.URL, newHTTPClient(ssrf.Timeouts{}))
+	if got, err := c.processMessage(context.Background(), &events.SQSMessage{Body: "https://example.com/page"}); err != nil || got != outcomeSucceeded {
+		t.Errorf("processMessage() = %v, %v, want succeeded", got, err)
+	}
+	c.webhooks.Wait()
+	if posts != 0 {
+		t.Errorf("webhook on a loopback address received %d POSTs, want 0", posts)
+	}
+}
@@ -2,75 +2,180 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"flag"
 	"fmt"
+	"lambda/urls"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/joho/godotenv"
 )
 
+// hashURL returns the url_hash of u's item: the hash of its canonical form (urls.Canonicalize),
+// the same key the crawler gives the URL when it discovers it as a link
 func hashURL(u string) string {
-	h := sha256.Sum256([]byte(u))
-	return hex.EncodeToString(h[:])
+	return urls.Hash(urls.Canonicalize(u))
 }
 
 func main() {
 	_ = godotenv.Load("../.env")
 
+	manifest := flag.String("manifest", "", "JSON or CSV seed manifest with url, depth, priority and domain_scope per row")
+	s3Manifest := flag.String("s3-manifest", "", "s3://bucket/key of a newline-delimited URL list, optionally gzipped")
+	flag.Parse()
+
 	queueURL := os.Getenv("QUEUE_URL")
 	tableName := os.Getenv("TABLE_NAME")
 
-	if len(os.Args) < 2 {
-		panic("usage: producer <url>")
+	if *manifest == "" && *s3Manifest == "" && flag.NArg() < 1 {
+		panic("usage: producer <url> | producer -manifest seeds.json|seeds.csv | producer -s3-manifest s3://bucket/key")
 	}
-	url := os.Args[1]
 
-	if url == "" || queueURL == "" || tableName == "" {
-		panic("URL, QUEUE_URL, TABLE_NAME must be set")
+	if queueURL == "" || tableName == "" {
+		panic("QUEUE_URL, TABLE_NAME must be set")
 	}
 
+	// Seeds must hash as the crawler hashes them, which depends on its PRESERVE_FRAGMENTS
+	preserveFragments, _ := strconv.ParseBool(os.Getenv("PRESERVE_FRAGMENTS"))
+	urls.SetPreserveFragments(preserveFragments)
+
 	ctx := context.Background()
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		panic(err)
 	}
 
-	dynamo := dynamodb.NewFromConfig(cfg)
-	sqsClient := sqs.NewFromConfig(cfg)
-
-	urlHash := hashURL(url)
-	fmt.Println("URL Hash:", urlHash)
-
-	// 1) Dedup via conditional put
-	_, err = dynamo.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: &tableName,
-		Item: map[string]types.AttributeValue{
-			"url_hash": &types.AttributeValueMemberS{Value: urlHash},
-			"url":      &types.AttributeValueMemberS{Value: url},
-			"status":   &types.AttributeValueMemberS{Value: "queued"},
-		},
-		ConditionExpression: awsString("attribute_not_exists(url_hash)"),
-	})
-	if err != nil {
-		fmt.Println("URL already seen, skipping:", url)
+	target := seedTarget{
+		ddb:          dynamodb.NewFromConfig(cfg),
+		sqs:          sqs.NewFromConfig(cfg),
+		tableName:    tableName,
+		queueURL:     queueURL,
+		highQueueURL: os.Getenv("HIGH_PRIORITY_QUEUE_URL"), // High priority seeds go here when set
+		jobID:        os.Getenv("JOB_ID"),
+		recrawlAfter: envRecrawlAfter(),
+	}
+
+	if *s3Manifest != "" {
+		if err := seedS3Manifest(ctx, target, s3.NewFromConfig(cfg), *s3Manifest); err != nil {
+			fmt.Println("Failed to read S3 manifest:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *manifest == "" {
+		url := flag.Arg(0)
+		if url == "" {
+			panic("URL must be set")
+		}
+		res := processSeed(ctx, target, seed{URL: url, Priority: priorityHigh})
+		fmt.Println("URL Hash:", res.URLHash)
+		switch {
+		case res.Err != nil:
+			panic(res.Err)
+		case res.AlreadySeen:
+			fmt.Println("URL already seen, skipping:", url)
+		case res.Recrawled:
+			fmt.Println("Re-enqueued stale URL:", url)
+		default:
+			fmt.Println("Enqueued URL:", url)
+		}
 		return
 	}
 
-	// 2) Enqueue
-	_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:    &queueURL,
-		MessageBody: &url,
-	})
+	if err := seedManifest(ctx, target, *manifest); err != nil {
+		fmt.Println("Failed to read manifest:", err)
+		os.Exit(1)
+	}
+}
+
+// seedManifest enqueues every valid row of the manifest at path, picking the format from its
+// extension. Malformed rows and per-row failures are reported and skipped.
+func seedManifest(ctx context.Context, target seedTarget, path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	seeds, rowErrs, err := parseManifest(f, strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."))
+	if err != nil {
+		return err
+	}
+	for _, rowErr := range rowErrs {
+		fmt.Println("Skipping malformed row:", rowErr)
 	}
 
-	fmt.Println("Enqueued URL:", url)
+	var enqueued, recrawled, seen, failed, domains int
+	for _, s := range seeds {
+		res := processSeed(ctx, target, s)
+		if res.DomainAdded {
+			domains++
+		}
+		switch {
+		case res.Err != nil:
+			failed++
+			fmt.Printf("Failed %s: %v\n", s.URL, res.Err)
+		case res.AlreadySeen:
+			seen++
+			fmt.Println("URL already seen, skipping:", s.URL)
+		default:
+			enqueued++
+			if res.Recrawled {
+				recrawled++
+			}
+			fmt.Printf("Enqueued %s (depth %d, %s priority)\n", s.URL, s.Depth, s.Priority)
+		}
+	}
+
+	fmt.Printf("✓ Enqueued %d seeds (%d recrawled, %d already seen, %d failed, %d malformed rows, %d domains added to the allowlist)\n",
+		enqueued, recrawled, seen, failed, len(rowErrs), domains)
+	return nil
+}
+
+// seedS3Manifest streams the URL list at uri (s3://bucket/key) through streamSeeds, printing
+// progress as it goes. A read error part way through is returned after the summary, since the
+// URLs before it are already enqueued.
+func seedS3Manifest(ctx context.Context, target seedTarget, client S3API, uri string) error {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return err
+	}
+	obj, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = obj.Body.Close() }()
+
+	stats, err := streamSeeds(ctx, target, obj.Body, os.Stdout)
+	fmt.Println("✓ Streamed", stats)
+	return err
+}
+
+// domainOf returns the domain attribute the crawler gives u's item: the lowercase host of its
+// canonical form, so a default port (example.com:443) is dropped
+func domainOf(u string) string {
+	return strings.ToLower(urls.GetHost(urls.Canonicalize(u)))
 }
 
 func awsString(s string) *string { return &s }
+
+// envRecrawlAfter returns RECRAWL_MAX_AGE (default 24h, as in the crawler) when RECRAWL is true:
+// seeds already in the table but finished longer ago than that are reset and enqueued again.
+// Zero, without RECRAWL, keeps every URL already seen.
+func envRecrawlAfter() time.Duration {
+	if recrawl, _ := strconv.ParseBool(os.Getenv("RECRAWL")); !recrawl {
+		return 0
+	}
+	if maxAge, err := time.ParseDuration(os.Getenv("RECRAWL_MAX_AGE")); err == nil && maxAge > 0 {
+		return maxAge
+	}
+	return defaultRecrawlMaxAge
+}
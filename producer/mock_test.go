@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// mockDynamoDB implements DynamoDBAPI, recording every put and update
+type mockDynamoDB struct {
+	puts           []*dynamodb.PutItemInput
+	updates        []*dynamodb.UpdateItemInput
+	putItemFunc    func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	updateItemFunc func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+func (m *mockDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	m.puts = append(m.puts, params)
+	if m.putItemFunc != nil {
+		return m.putItemFunc(ctx, params, optFns...)
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *mockDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	m.updates = append(m.updates, params)
+	if m.updateItemFunc != nil {
+		return m.updateItemFunc(ctx, params, optFns...)
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// mockSQS implements SQSAPI, recording every message and batch. Batches succeed in full by default.
+type mockSQS struct {
+	sent                 []*sqs.SendMessageInput
+	batches              []*sqs.SendMessageBatchInput
+	sendMessageFunc      func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	sendMessageBatchFunc func(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+}
+
+func (m *mockSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	m.sent = append(m.sent, params)
+	if m.sendMessageFunc != nil {
+		return m.sendMessageFunc(ctx, params, optFns...)
+	}
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (m *mockSQS) SendMessageBatch(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	m.batches = append(m.batches, params)
+	if m.sendMessageBatchFunc != nil {
+		return m.sendMessageBatchFunc(ctx, params, optFns...)
+	}
+	out := &sqs.SendMessageBatchOutput{}
+	for _, e := range params.Entries {
+		out.Successful = append(out.Successful, sqstypes.SendMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+// existingKeys fails the conditional put of every item whose url_hash starts with one of prefixes
+func existingKeys(prefixes ...string) func(context.Context, *dynamodb.PutItemInput, ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return func(_ context.Context, params *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		key := params.Item["url_hash"].(*types.AttributeValueMemberS).Value
+		for _, p := range prefixes {
+			if strings.HasPrefix(key, p) {
+				return nil, &types.ConditionalCheckFailedException{}
+			}
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}
+}
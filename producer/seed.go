@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lambda/urls"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	priorityHigh           = "high"
+	priorityNormal         = "normal"
+	allowedDomainKeyPrefix = "allowed_domain#" // Same allowlist items the crawler reads
+	domainStatusActive     = "active"
+
+	// Item states, as the crawler writes them; the last four are terminal
+	stateQueued        = "queued"
+	stateDone          = "done"
+	stateFailed        = "failed"
+	stateRobotsBlocked = "robots_blocked"
+	stateSkipped       = "skipped"
+
+	defaultRecrawlMaxAge = 24 * time.Hour // RECRAWL_MAX_AGE default, the crawler's
+)
+
+// seed is one manifest row. Depth is the crawl depth the URL starts at, so the crawler follows
+// links MAX_DEPTH - Depth levels below it. DomainScope is the host registered in the allowlist
+// (the URL's host when the manifest leaves it empty); an empty scope registers nothing.
+type seed struct {
+	URL         string `json:"url"`
+	Depth       int    `json:"depth"`
+	Priority    string `json:"priority"`
+	DomainScope string `json:"domain_scope"`
+}
+
+// seedTarget is where seeds are written
+type seedTarget struct {
+	ddb          DynamoDBAPI
+	sqs          SQSAPI
+	tableName    string
+	queueURL     string
+	highQueueURL string        // Optional dedicated queue for high priority seeds
+	jobID        string        // Optional JOB_ID stamped on every item and message, so the crawl can be told apart
+	recrawlAfter time.Duration // RECRAWL_MAX_AGE when RECRAWL is set: seen URLs finished longer ago are reset and enqueued; 0 never does
+}
+
+// seedResult is the outcome of processSeed for one row
+type seedResult struct {
+	URL         string
+	URLHash     string
+	DomainAdded bool  // DomainScope was newly added to the allowlist
+	AlreadySeen bool  // The URL was already in the table, so it was not enqueued again
+	Recrawled   bool  // The URL was in the table but finished over RECRAWL_MAX_AGE ago, so it was reset and enqueued
+	Enqueued    bool  // The URL was sent to SQS
+	Err         error // DynamoDB or SQS failure
+}
+
+// parseManifest reads seeds from a "json" manifest (an array of objects) or a "csv" one (a header
+// row naming the url, depth, priority and domain_scope columns; only url is required).
+// Rows that fail to parse or validate are returned as rowErrs and left out of seeds;
+// err is only set when the manifest as a whole is unreadable.
+func parseManifest(r io.Reader, format string) (seeds []seed, rowErrs []error, err error) {
+	switch format {
+	case "json":
+		return parseJSONManifest(r)
+	case "csv":
+		return parseCSVManifest(r)
+	default:
+		return nil, nil, fmt.Errorf("unknown manifest format %q (want json or csv)", format)
+	}
+}
+
+func parseJSONManifest(r io.Reader) ([]seed, []error, error) {
+	var rows []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, nil, fmt.Errorf("manifest is not a JSON array: %w", err)
+	}
+
+	var seeds []seed
+	var rowErrs []error
+	for i, raw := range rows {
+		var s seed
+		if err := json.Unmarshal(raw, &s); err != nil {
+			rowErrs = append(rowErrs, fmt.Errorf("row %d: %w", i+1, err))
+			continue
+		}
+		if err := s.normalize(); err != nil {
+			rowErrs = append(rowErrs, fmt.Errorf("row %d: %w", i+1, err))
+			continue
+		}
+		seeds = append(seeds, s)
+	}
+	return seeds, rowErrs, nil
+}
+
+func parseCSVManifest(r io.Reader) ([]seed, []error, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // Short rows are reported per row rather than failing the file
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := cols["url"]; !ok {
+		return nil, nil, errors.New("CSV header has no url column")
+	}
+
+	var seeds []seed
+	var rowErrs []error
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rowErrs = append(rowErrs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		s := seed{URL: field("url"), Priority: field("priority"), DomainScope: field("domain_scope")}
+		if d := field("depth"); d != "" {
+			if s.Depth, err = strconv.Atoi(d); err != nil {
+				rowErrs = append(rowErrs, fmt.Errorf("line %d: invalid depth %q", line, d))
+				continue
+			}
+		}
+		if err := s.normalize(); err != nil {
+			rowErrs = append(rowErrs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		seeds = append(seeds, s)
+	}
+	return seeds, rowErrs, nil
+}
+
+// normalize validates a manifest row and fills in its defaults: high priority (seeds have always
+// gone out at high priority) and the URL's host as domain scope
+func (s *seed) normalize() error {
+	parsed, err := neturl.Parse(s.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid url %q", s.URL)
+	}
+	if s.Depth < 0 {
+		return fmt.Errorf("negative depth %d", s.Depth)
+	}
+
+	s.Priority = strings.ToLower(s.Priority)
+	switch s.Priority {
+	case "":
+		s.Priority = priorityHigh
+	case priorityHigh, priorityNormal:
+	default:
+		return fmt.Errorf("invalid priority %q (want high or normal)", s.Priority)
+	}
+
+	s.DomainScope = strings.ToLower(s.DomainScope)
+	if s.DomainScope == "" {
+		s.DomainScope = strings.ToLower(parsed.Host)
+	}
+	return nil
+}
+
+// processSeed registers s.DomainScope in the allowlist, records the URL as queued (skipping URLs
+// the table has already seen) and enqueues it with its depth and priority
+func processSeed(ctx context.Context, t seedTarget, s seed) seedResult {
+	res := seedResult{URL: s.URL, URLHash: hashURL(s.URL)}
+	var condErr *types.ConditionalCheckFailedException
+
+	if s.DomainScope != "" {
+		_, err := t.ddb.PutItem(ctx, t.allowDomainInput(s))
+		switch {
+		case err == nil:
+			res.DomainAdded = true
+		case !errors.As(err, &condErr):
+			res.Err = fmt.Errorf("registering domain %s: %w", s.DomainScope, err)
+			return res
+		}
+	}
+
+	// Dedup via conditional put
+	recorded, reset, err := t.recordQueued(ctx, s, res.URLHash)
+	if err != nil {
+		res.Err = fmt.Errorf("recording URL: %w", err)
+		return res
+	}
+	if !recorded {
+		res.AlreadySeen = true
+		return res
+	}
+	res.Recrawled = reset
+
+	if _, err := t.sqs.SendMessage(ctx, t.enqueueInput(t.queueURLFor(s), s, res.URLHash)); err != nil {
+		res.Err = fmt.Errorf("enqueueing: %w", err)
+		return res
+	}
+	res.Enqueued = true
+	return res
+}
+
+// queueURLFor picks the queue for s: the high priority queue, when there is one, for high priority seeds
+func (t seedTarget) queueURLFor(s seed) string {
+	if s.Priority == priorityHigh && t.highQueueURL != "" {
+		return t.highQueueURL
+	}
+	return t.queueURL
+}
+
+// allowDomainInput adds s.DomainScope to the allowlist unless it already has an item,
+// so an operator's paused or filtered domain is left as it is
+func (t seedTarget) allowDomainInput(s seed) *dynamodb.PutItemInput {
+	item := map[string]types.AttributeValue{
+		"url_hash":        &types.AttributeValueMemberS{Value: allowedDomainKeyPrefix + s.DomainScope},
+		"domain":          &types.AttributeValueMemberS{Value: s.DomainScope},
+		"status":          &types.AttributeValueMemberS{Value: domainStatusActive},
+		"discovered_from": &types.AttributeValueMemberS{Value: "seed:" + s.URL},
+		"created_at":      &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+	}
+	if t.jobID != "" {
+		item["job_id"] = &types.AttributeValueMemberS{Value: t.jobID}
+	}
+	return &dynamodb.PutItemInput{
+		TableName:           &t.tableName,
+		Item:                item,
+		ConditionExpression: awsString("attribute_not_exists(url_hash)"),
+	}
+}
+
+// recordQueued records the seed URL as queued with queuedItemInput, the dedup check. A URL already
+// in the table is not recorded again (recorded is false) unless recrawlAfter is set and its item
+// passes the conditional reset of recrawlInput, when reset is true as well.
+func (t seedTarget) recordQueued(ctx context.Context, s seed, urlHash string) (recorded, reset bool, err error) {
+	var condErr *types.ConditionalCheckFailedException
+	_, err = t.ddb.PutItem(ctx, t.queuedItemInput(s, urlHash))
+	if err == nil || !errors.As(err, &condErr) || t.recrawlAfter <= 0 {
+		return err == nil, false, ignoreConditionFailed(err)
+	}
+	if _, err := t.ddb.UpdateItem(ctx, t.recrawlInput(urlHash, time.Now().Add(-t.recrawlAfter))); err != nil {
+		return false, false, ignoreConditionFailed(err)
+	}
+	return true, true, nil
+}
+
+// ignoreConditionFailed returns err, or nil when it is a failed condition (an expected outcome)
+func ignoreConditionFailed(err error) error {
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	return err
+}
+
+// recrawlInput moves a URL's item back to queued, with a fresh attempt count and no TTL, when it
+// is in a terminal state and was finished before cutoff, as the crawler does for rediscovered
+// links under RECRAWL. finished_at is RFC3339 UTC, so string order matches time order.
+func (t seedTarget) recrawlInput(urlHash string, cutoff time.Time) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName: &t.tableName,
+		Key: map[string]types.AttributeValue{
+			"url_hash": &types.AttributeValueMemberS{Value: urlHash},
+		},
+		UpdateExpression: awsString("SET #s = :queued REMOVE attempts, processing_at, expires_at"),
+		ConditionExpression: awsString("(#s = :done OR #s = :failed OR #s = :robots_blocked OR #s = :skipped) " +
+			"AND finished_at < :cutoff"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":queued":         &types.AttributeValueMemberS{Value: stateQueued},
+			":done":           &types.AttributeValueMemberS{Value: stateDone},
+			":failed":         &types.AttributeValueMemberS{Value: stateFailed},
+			":robots_blocked": &types.AttributeValueMemberS{Value: stateRobotsBlocked},
+			":skipped":        &types.AttributeValueMemberS{Value: stateSkipped},
+			":cutoff":         &types.AttributeValueMemberS{Value: cutoff.UTC().Format(time.RFC3339)},
+		},
+	}
+}
+
+// queuedItemInput records the seed URL as queued unless the table already has it. The item has the
+// canonical_url the crawler stores on the links it discovers, which urlHash is the hash of.
+func (t seedTarget) queuedItemInput(s seed, urlHash string) *dynamodb.PutItemInput {
+	item := map[string]types.AttributeValue{
+		"url_hash":      &types.AttributeValueMemberS{Value: urlHash},
+		"url":           &types.AttributeValueMemberS{Value: s.URL},
+		"canonical_url": &types.AttributeValueMemberS{Value: urls.Canonicalize(s.URL)},
+		"domain":        &types.AttributeValueMemberS{Value: domainOf(s.URL)},
+		"status":        &types.AttributeValueMemberS{Value: stateQueued},
+	}
+	if t.jobID != "" {
+		item["job_id"] = &types.AttributeValueMemberS{Value: t.jobID}
+	}
+	return &dynamodb.PutItemInput{
+		TableName:           &t.tableName,
+		Item:                item,
+		ConditionExpression: awsString("attribute_not_exists(url_hash)"),
+	}
+}
+
+// enqueueInput builds the SQS message for a seed with the attributes the crawler reads
+func (t seedTarget) enqueueInput(queueURL string, s seed, urlHash string) *sqs.SendMessageInput {
+	attrs := map[string]sqstypes.MessageAttributeValue{
+		"depth": {
+			DataType:    awsString("Number"),
+			StringValue: awsString(strconv.Itoa(s.Depth)),
+		},
+		"priority": {
+			DataType:    awsString("String"),
+			StringValue: awsString(s.Priority),
+		},
+		// The crawler claims this item by url_hash rather than re-hashing the body
+		"url_hash": {
+			DataType:    awsString("String"),
+			StringValue: awsString(urlHash),
+		},
+	}
+	// The crawler copies job_id onto every link it discovers from this seed
+	if t.jobID != "" {
+		attrs["job_id"] = sqstypes.MessageAttributeValue{
+			DataType:    awsString("String"),
+			StringValue: awsString(t.jobID),
+		}
+	}
+	return &sqs.SendMessageInput{
+		QueueUrl:          &queueURL,
+		MessageBody:       awsString(s.URL),
+		MessageAttributes: attrs,
+	}
+}
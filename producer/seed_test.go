@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lambda/urls"
+	neturl "net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestParseManifestJSON(t *testing.T) {
+	manifest := `[
+		{"url": "https://example.com/", "depth": 1, "priority": "normal", "domain_scope": "Example.com"},
+		{"url": "https://blog.example.org/start"},
+		{"url": "ftp://example.com/file"},
+		{"url": "https://example.net/", "depth": -1},
+		{"url": "https://example.net/", "priority": "urgent"},
+		{"url": "https://example.net/", "depth": "two"},
+		"https://example.net/"
+	]`
+
+	seeds, rowErrs, err := parseManifest(strings.NewReader(manifest), "json")
+	if err != nil {
+		t.Fatalf("parseManifest() error = %v", err)
+	}
+
+	want := []seed{
+		{URL: "https://example.com/", Depth: 1, Priority: priorityNormal, DomainScope: "example.com"},
+		{URL: "https://blog.example.org/start", Priority: priorityHigh, DomainScope: "blog.example.org"},
+	}
+	if !reflect.DeepEqual(seeds, want) {
+		t.Errorf("seeds = %+v, want %+v", seeds, want)
+	}
+	if len(rowErrs) != 5 {
+		t.Fatalf("rowErrs = %v, want 5", rowErrs)
+	}
+	if !strings.HasPrefix(rowErrs[0].Error(), "row 3:") {
+		t.Errorf("rowErrs[0] = %v, want it to name row 3", rowErrs[0])
+	}
+}
+
+func TestParseManifestCSV(t *testing.T) {
+	manifest := "priority,url,depth,domain_scope\n" +
+		"normal,https://example.com/,2,\n" +
+		"high,https://docs.example.org/a,,example.org\n" +
+		",https://example.net/\n" +
+		"high,not a url,0,\n" +
+		"high,https://example.net/,deep,\n" +
+		"\"unterminated,https://example.net/,0,\n"
+
+	seeds, rowErrs, err := parseManifest(strings.NewReader(manifest), "csv")
+	if err != nil {
+		t.Fatalf("parseManifest() error = %v", err)
+	}
+
+	want := []seed{
+		{URL: "https://example.com/", Depth: 2, Priority: priorityNormal, DomainScope: "example.com"},
+		{URL: "https://docs.example.org/a", Priority: priorityHigh, DomainScope: "example.org"},
+		{URL: "https://example.net/", Priority: priorityHigh, DomainScope: "example.net"},
+	}
+	if !reflect.DeepEqual(seeds, want) {
+		t.Errorf("seeds = %+v, want %+v", seeds, want)
+	}
+	if len(rowErrs) != 3 {
+		t.Fatalf("rowErrs = %v, want 3", rowErrs)
+	}
+	if !strings.HasPrefix(rowErrs[0].Error(), "line 5:") {
+		t.Errorf("rowErrs[0] = %v, want it to name line 5", rowErrs[0])
+	}
+}
+
+func TestParseManifestUnreadable(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		format   string
+	}{
+		{"json object instead of array", `{"url": "https://example.com/"}`, "json"},
+		{"truncated json", `[{"url": "https://example.com/"`, "json"},
+		{"csv without url column", "link,depth\nhttps://example.com/,0\n", "csv"},
+		{"empty csv", "", "csv"},
+		{"unknown format", "https://example.com/\n", "txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := parseManifest(strings.NewReader(tt.manifest), tt.format); err == nil {
+				t.Error("parseManifest() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestProcessSeedEnqueues(t *testing.T) {
+	tests := []struct {
+		name      string
+		seed      seed
+		wantQueue string
+	}{
+		{"high priority uses the high queue", seed{URL: "https://example.com/", Depth: 0, Priority: priorityHigh, DomainScope: "example.com"}, "high-queue"},
+		{"normal priority uses the main queue", seed{URL: "https://example.com/docs", Depth: 2, Priority: priorityNormal, DomainScope: "example.com"}, "main-queue"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb, sqsClient := &mockDynamoDB{}, &mockSQS{}
+			target := seedTarget{ddb: ddb, sqs: sqsClient, tableName: "table", queueURL: "main-queue", highQueueURL: "high-queue"}
+
+			res := processSeed(context.Background(), target, tt.seed)
+			if res.Err != nil || !res.Enqueued || !res.DomainAdded || res.AlreadySeen {
+				t.Fatalf("processSeed() = %+v", res)
+			}
+			if len(sqsClient.sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(sqsClient.sent))
+			}
+
+			msg := sqsClient.sent[0]
+			if *msg.QueueUrl != tt.wantQueue {
+				t.Errorf("queue = %s, want %s", *msg.QueueUrl, tt.wantQueue)
+			}
+			if *msg.MessageBody != tt.seed.URL {
+				t.Errorf("body = %s, want %s", *msg.MessageBody, tt.seed.URL)
+			}
+			attrs := map[string]string{}
+			for name, v := range msg.MessageAttributes {
+				attrs[name] = *v.StringValue
+			}
+			want := map[string]string{"depth": strconv.Itoa(tt.seed.Depth), "priority": tt.seed.Priority, "url_hash": hashURL(tt.seed.URL)}
+			if !reflect.DeepEqual(attrs, want) {
+				t.Errorf("attributes = %v, want %v", attrs, want)
+			}
+			if dt := *msg.MessageAttributes["depth"].DataType; dt != "Number" {
+				t.Errorf("depth DataType = %s, want Number", dt)
+			}
+		})
+	}
+}
+
+// TestSeedHashMatchesCrawler checks that a seed's item is the one the crawler finds when it
+// discovers the same URL as a link, however the seed was written, so the URL is crawled once
+func TestSeedHashMatchesCrawler(t *testing.T) {
+	base, _ := neturl.Parse("https://example.com/about")
+
+	tests := []struct {
+		seed string
+		href string // The same page as a link on the crawled site
+	}{
+		{"https://example.com/", "/"},
+		{"HTTPS://Example.COM/docs", "https://example.com/docs"},
+		{"https://example.com:443/docs", "/docs"},
+		{"https://example.com/search?utm_source=news&q=go&a=1", "/search?a=1&q=go"},
+		{"https://example.com/%7Euser/", "/~user/"},
+		{"https://example.com/page#section", "/page"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.seed, func(t *testing.T) {
+			ddb := &mockDynamoDB{}
+			res := processSeed(context.Background(), seedTarget{ddb: ddb, sqs: &mockSQS{}, tableName: "table", queueURL: "q"}, seed{URL: tt.seed})
+
+			// As enqueueLinks keys a discovered link
+			canonical := urls.Canonicalize(urls.Normalize(tt.href, base))
+			if want := urls.Hash(canonical); res.URLHash != want {
+				t.Errorf("seed url_hash = %s, want the crawler's %s for %s", res.URLHash, want, canonical)
+			}
+			item := ddb.puts[len(ddb.puts)-1].Item
+			if got := item["canonical_url"].(*types.AttributeValueMemberS).Value; got != canonical {
+				t.Errorf("canonical_url = %q, want %q", got, canonical)
+			}
+			if got := item["url"].(*types.AttributeValueMemberS).Value; got != tt.seed {
+				t.Errorf("url = %q, want the seed as written", got)
+			}
+			// As sqsFrontier.Add stores it: catalog.Domain of the canonical URL's host
+			if got := item["domain"].(*types.AttributeValueMemberS).Value; got != "example.com" {
+				t.Errorf("domain = %q, want example.com", got)
+			}
+		})
+	}
+}
+
+func TestProcessSeedRegistersDomain(t *testing.T) {
+	ddb := &mockDynamoDB{}
+	target := seedTarget{ddb: ddb, sqs: &mockSQS{}, tableName: "table", queueURL: "main-queue"}
+
+	processSeed(context.Background(), target, seed{URL: "https://docs.example.org/", Priority: priorityHigh, DomainScope: "example.org"})
+
+	if len(ddb.puts) != 2 {
+		t.Fatalf("PutItem calls = %d, want 2", len(ddb.puts))
+	}
+	item := ddb.puts[0].Item
+	if key := item["url_hash"].(*types.AttributeValueMemberS).Value; key != "allowed_domain#example.org" {
+		t.Errorf("allowlist key = %s", key)
+	}
+	if status := item["status"].(*types.AttributeValueMemberS).Value; status != domainStatusActive {
+		t.Errorf("status = %s, want active", status)
+	}
+	if cond := *ddb.puts[0].ConditionExpression; cond != "attribute_not_exists(url_hash)" {
+		t.Errorf("ConditionExpression = %s; an existing allowlist item must not be overwritten", cond)
+	}
+}
+
+func TestProcessSeedStampsJobID(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobID string
+	}{
+		{"with JOB_ID", "2024-06-crawl"},
+		{"without JOB_ID", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb, sqsClient := &mockDynamoDB{}, &mockSQS{}
+			target := seedTarget{ddb: ddb, sqs: sqsClient, tableName: "table", queueURL: "main-queue", jobID: tt.jobID}
+
+			processSeed(context.Background(), target, seed{URL: "https://example.com/", Priority: priorityHigh, DomainScope: "example.com"})
+
+			for _, put := range ddb.puts {
+				key := put.Item["url_hash"].(*types.AttributeValueMemberS).Value
+				got, ok := put.Item["job_id"].(*types.AttributeValueMemberS)
+				switch {
+				case tt.jobID == "" && ok:
+					t.Errorf("%s has job_id %q, want none", key, got.Value)
+				case tt.jobID != "" && (!ok || got.Value != tt.jobID):
+					t.Errorf("%s job_id = %v, want %q", key, put.Item["job_id"], tt.jobID)
+				}
+			}
+			attr, ok := sqsClient.sent[0].MessageAttributes["job_id"]
+			if ok != (tt.jobID != "") || (ok && *attr.StringValue != tt.jobID) {
+				t.Errorf("job_id attribute = %+v, want %q", attr, tt.jobID)
+			}
+		})
+	}
+}
+
+func TestProcessSeedWithoutScopeSkipsAllowlist(t *testing.T) {
+	ddb := &mockDynamoDB{}
+	target := seedTarget{ddb: ddb, sqs: &mockSQS{}, tableName: "table", queueURL: "main-queue"}
+
+	res := processSeed(context.Background(), target, seed{URL: "https://example.com/", Priority: priorityHigh})
+	if res.DomainAdded || !res.Enqueued {
+		t.Errorf("processSeed() = %+v", res)
+	}
+	if len(ddb.puts) != 1 {
+		t.Errorf("PutItem calls = %d, want 1 (the URL item only)", len(ddb.puts))
+	}
+}
+
+func TestProcessSeedExistingDomainStillEnqueues(t *testing.T) {
+	ddb := &mockDynamoDB{putItemFunc: existingKeys(allowedDomainKeyPrefix)}
+	sqsClient := &mockSQS{}
+	target := seedTarget{ddb: ddb, sqs: sqsClient, tableName: "table", queueURL: "main-queue"}
+
+	res := processSeed(context.Background(), target, seed{URL: "https://example.com/", Priority: priorityHigh, DomainScope: "example.com"})
+	if res.Err != nil || res.DomainAdded || !res.Enqueued {
+		t.Errorf("processSeed() = %+v", res)
+	}
+	if len(sqsClient.sent) != 1 {
+		t.Errorf("sent %d messages, want 1", len(sqsClient.sent))
+	}
+}
+
+func TestProcessSeedAlreadySeen(t *testing.T) {
+	s := seed{URL: "https://example.com/", Priority: priorityHigh, DomainScope: "example.com"}
+	ddb := &mockDynamoDB{putItemFunc: existingKeys(hashURL(s.URL))}
+	sqsClient := &mockSQS{}
+	target := seedTarget{ddb: ddb, sqs: sqsClient, tableName: "table", queueURL: "main-queue"}
+
+	res := processSeed(context.Background(), target, s)
+	if !res.AlreadySeen || res.Enqueued || res.Err != nil {
+		t.Errorf("processSeed() = %+v", res)
+	}
+	if len(sqsClient.sent) != 0 {
+		t.Errorf("sent %d messages for a URL already in the table", len(sqsClient.sent))
+	}
+}
+
+// staleKeys passes the recrawl reset of every item whose url_hash starts with one of prefixes and
+// fails it, as a fresh or unfinished item does, for the rest
+func staleKeys(prefixes ...string) func(context.Context, *dynamodb.UpdateItemInput, ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return func(_ context.Context, params *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+		key := params.Key["url_hash"].(*types.AttributeValueMemberS).Value
+		for _, p := range prefixes {
+			if strings.HasPrefix(key, p) {
+				return &dynamodb.UpdateItemOutput{}, nil
+			}
+		}
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+}
+
+func TestProcessSeedRecrawl(t *testing.T) {
+	s := seed{URL: "https://example.com/", Priority: priorityNormal}
+	hash := hashURL(s.URL)
+
+	tests := []struct {
+		name          string
+		existing      bool // The URL is already in the table
+		stale         bool // Its item is terminal and finished before the cutoff
+		recrawl       bool
+		wantEnqueued  bool
+		wantRecrawled bool
+		wantUpdates   int
+	}{
+		{"first seen", false, false, false, true, false, 0},
+		{"first seen (recrawl)", false, false, true, true, false, 0},
+		{"fresh", true, false, false, false, false, 0},
+		{"fresh (recrawl)", true, false, true, false, false, 1},
+		{"stale", true, true, false, false, false, 0},
+		{"stale (recrawl)", true, true, true, true, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := &mockDynamoDB{}
+			if tt.existing {
+				ddb.putItemFunc = existingKeys(hash)
+			}
+			if tt.stale {
+				ddb.updateItemFunc = staleKeys(hash)
+			} else {
+				ddb.updateItemFunc = staleKeys()
+			}
+			sqsClient := &mockSQS{}
+			target := seedTarget{ddb: ddb, sqs: sqsClient, tableName: "table", queueURL: "main-queue"}
+			if tt.recrawl {
+				target.recrawlAfter = time.Hour
+			}
+
+			res := processSeed(context.Background(), target, s)
+			if res.Err != nil || res.Enqueued != tt.wantEnqueued || res.Recrawled != tt.wantRecrawled || res.AlreadySeen == tt.wantEnqueued {
+				t.Errorf("processSeed() = %+v, want enqueued %v, recrawled %v", res, tt.wantEnqueued, tt.wantRecrawled)
+			}
+			if len(ddb.updates) != tt.wantUpdates {
+				t.Errorf("UpdateItem calls = %d, want %d", len(ddb.updates), tt.wantUpdates)
+			}
+			if tt.wantEnqueued != (len(sqsClient.sent) == 1) {
+				t.Errorf("sent %d messages, want enqueued = %v", len(sqsClient.sent), tt.wantEnqueued)
+			}
+		})
+	}
+}
+
+func TestRecrawlInput(t *testing.T) {
+	target := seedTarget{tableName: "table"}
+	cutoff := time.Date(2026, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	in := target.recrawlInput("abc", cutoff)
+
+	if key := in.Key["url_hash"].(*types.AttributeValueMemberS); key.Value != "abc" {
+		t.Errorf("key = %q, want abc", key.Value)
+	}
+	if *in.UpdateExpression != "SET #s = :queued REMOVE attempts, processing_at, expires_at" {
+		t.Errorf("UpdateExpression = %q, want status queued with attempts and TTL cleared", *in.UpdateExpression)
+	}
+	want := "(#s = :done OR #s = :failed OR #s = :robots_blocked OR #s = :skipped) AND finished_at < :cutoff"
+	if *in.ConditionExpression != want {
+		t.Errorf("ConditionExpression = %q, want %q", *in.ConditionExpression, want)
+	}
+	// finished_at is RFC3339 UTC, so the cutoff must be too for the string comparison
+	if v := in.ExpressionAttributeValues[":cutoff"].(*types.AttributeValueMemberS); v.Value != "2026-01-02T02:04:05Z" {
+		t.Errorf(":cutoff = %q, want 2026-01-02T02:04:05Z", v.Value)
+	}
+}
+
+func TestProcessSeedErrors(t *testing.T) {
+	s := seed{URL: "https://example.com/", Priority: priorityHigh, DomainScope: "example.com"}
+	throttled := errors.New("ProvisionedThroughputExceededException")
+
+	t.Run("dynamodb", func(t *testing.T) {
+		ddb := &mockDynamoDB{putItemFunc: func(_ context.Context, _ *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			return nil, throttled
+		}}
+		sqsClient := &mockSQS{}
+		res := processSeed(context.Background(), seedTarget{ddb: ddb, sqs: sqsClient, queueURL: "q"}, s)
+		if !errors.Is(res.Err, throttled) || res.AlreadySeen || len(sqsClient.sent) != 0 {
+			t.Errorf("processSeed() = %+v, sent %d", res, len(sqsClient.sent))
+		}
+	})
+
+	t.Run("sqs", func(t *testing.T) {
+		sqsClient := &mockSQS{sendMessageFunc: func(_ context.Context, _ *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			return nil, throttled
+		}}
+		res := processSeed(context.Background(), seedTarget{ddb: &mockDynamoDB{}, sqs: sqsClient, queueURL: "q"}, s)
+		if !errors.Is(res.Err, throttled) || res.Enqueued {
+			t.Errorf("processSeed() = %+v", res)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	sqsBatchSize     = 10      // SendMessageBatch entry limit
+	progressInterval = 10000   // Lines between progress reports
+	maxManifestLine  = 1 << 20 // Longest line streamSeeds accepts
+)
+
+// streamStats counts what streamSeeds did with each line of a manifest
+type streamStats struct {
+	Lines       int // Non-blank lines read
+	Enqueued    int // Sent to SQS
+	AlreadySeen int // Already in the table, so not enqueued again
+	Recrawled   int // Already in the table but stale under RECRAWL, so reset and enqueued (also counted as enqueued once sent)
+	Invalid     int // Not an http(s) URL
+	Failed      int // DynamoDB or SQS failure
+	Domains     int // Hosts newly added to the allowlist
+}
+
+func (s streamStats) String() string {
+	return fmt.Sprintf("%d lines: %d enqueued (%d recrawled), %d already seen, %d invalid, %d failed, %d domains added to the allowlist",
+		s.Lines, s.Enqueued, s.Recrawled, s.AlreadySeen, s.Invalid, s.Failed, s.Domains)
+}
+
+// streamSeeds enqueues a newline-delimited list of URLs read from r, gzipped or not (detected from
+// the gzip magic bytes). Lines are processed as they are read, so manifests larger than memory
+// work. Each URL is a high priority seed at depth 0 whose host is added to the allowlist, like a
+// -manifest row without the optional columns. New URLs are recorded with the same conditional
+// put as processSeed and sent in SendMessageBatch calls of sqsBatchSize. Invalid lines and
+// per-URL failures are reported to progress and skipped, along with a summary every
+// progressInterval lines; the error is only set when r cannot be read to the end.
+func streamSeeds(ctx context.Context, t seedTarget, r io.Reader, progress io.Writer) (streamStats, error) {
+	var stats streamStats
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return stats, fmt.Errorf("opening gzip stream: %w", err)
+		}
+		defer func() { _ = gz.Close() }()
+		r = gz
+	} else {
+		r = br
+	}
+
+	batches := make(map[string][]sqstypes.SendMessageBatchRequestEntry) // By queue URL
+	flush := func(queueURL string) {
+		entries := batches[queueURL]
+		if len(entries) == 0 {
+			return
+		}
+		delete(batches, queueURL)
+
+		out, err := t.sqs.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{QueueUrl: &queueURL, Entries: entries})
+		if err != nil {
+			stats.Failed += len(entries)
+			_, _ = fmt.Fprintf(progress, "Failed to enqueue %d URLs: %v\n", len(entries), err)
+			return
+		}
+		stats.Enqueued += len(out.Successful)
+		stats.Failed += len(out.Failed)
+		for _, f := range out.Failed {
+			_, _ = fmt.Fprintf(progress, "Failed to enqueue entry %s: %s\n", awsValue(f.Id), awsValue(f.Message))
+		}
+	}
+
+	registered := make(map[string]bool) // Domain scopes already put, so each host costs one write
+	var condErr *types.ConditionalCheckFailedException
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxManifestLine)
+	for line := 1; scanner.Scan(); line++ {
+		s := seed{URL: strings.TrimSpace(scanner.Text())}
+		if s.URL == "" {
+			continue
+		}
+		stats.Lines++
+		if stats.Lines%progressInterval == 0 {
+			_, _ = fmt.Fprintln(progress, "Progress:", stats)
+		}
+
+		if err := s.normalize(); err != nil {
+			stats.Invalid++
+			_, _ = fmt.Fprintf(progress, "Skipping line %d: %v\n", line, err)
+			continue
+		}
+
+		if !registered[s.DomainScope] {
+			_, err := t.ddb.PutItem(ctx, t.allowDomainInput(s))
+			switch {
+			case err == nil:
+				stats.Domains++
+			case !errors.As(err, &condErr):
+				stats.Failed++
+				_, _ = fmt.Fprintf(progress, "Failed %s: registering domain %s: %v\n", s.URL, s.DomainScope, err)
+				continue
+			}
+			registered[s.DomainScope] = true
+		}
+
+		urlHash := hashURL(s.URL)
+		recorded, reset, err := t.recordQueued(ctx, s, urlHash)
+		switch {
+		case err != nil:
+			stats.Failed++
+			_, _ = fmt.Fprintf(progress, "Failed %s: recording URL: %v\n", s.URL, err)
+			continue
+		case !recorded:
+			stats.AlreadySeen++
+			continue
+		case reset:
+			stats.Recrawled++
+		}
+
+		queueURL := t.queueURLFor(s)
+		msg := t.enqueueInput(queueURL, s, urlHash)
+		batches[queueURL] = append(batches[queueURL], sqstypes.SendMessageBatchRequestEntry{
+			Id:                awsString(strconv.Itoa(len(batches[queueURL]))),
+			MessageBody:       msg.MessageBody,
+			MessageAttributes: msg.MessageAttributes,
+		})
+		if len(batches[queueURL]) == sqsBatchSize {
+			flush(queueURL)
+		}
+	}
+	for queueURL := range batches {
+		flush(queueURL)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return stats, fmt.Errorf("reading manifest: %w", err)
+	}
+	return stats, nil
+}
+
+// parseS3URI splits an s3://bucket/key URI
+func parseS3URI(uri string) (bucket, key string, err error) {
+	parsed, err := neturl.Parse(uri)
+	if err != nil || parsed.Scheme != "s3" || parsed.Host == "" || strings.TrimPrefix(parsed.Path, "/") == "" {
+		return "", "", fmt.Errorf("invalid S3 URI %q (want s3://bucket/key)", uri)
+	}
+	return parsed.Host, strings.TrimPrefix(parsed.Path, "/"), nil
+}
+
+func awsValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const streamManifest = "https://example.com/a\n" +
+	"\n" +
+	"  https://example.com/b  \n" +
+	"not a url\n" +
+	"https://seen.example.org/\n" +
+	"https://example.net/c"
+
+func gzipped(t *testing.T, s string) io.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestStreamSeeds(t *testing.T) {
+	tests := []struct {
+		name string
+		r    func(t *testing.T) io.Reader
+	}{
+		{"plain", func(*testing.T) io.Reader { return strings.NewReader(streamManifest) }},
+		{"gzipped", func(t *testing.T) io.Reader { return gzipped(t, streamManifest) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ddb := &mockDynamoDB{putItemFunc: existingKeys(hashURL("https://seen.example.org/"))}
+			sqsClient := &mockSQS{}
+			target := seedTarget{ddb: ddb, sqs: sqsClient, tableName: "urls", queueURL: "normal-queue"}
+
+			var progress bytes.Buffer
+			stats, err := streamSeeds(context.Background(), target, tt.r(t), &progress)
+			if err != nil {
+				t.Fatalf("streamSeeds() error = %v", err)
+			}
+
+			want := streamStats{Lines: 5, Enqueued: 3, AlreadySeen: 1, Invalid: 1, Domains: 3}
+			if stats != want {
+				t.Errorf("stats = %+v, want %+v", stats, want)
+			}
+			if !strings.Contains(progress.String(), "Skipping line 4") {
+				t.Errorf("progress = %q, want the invalid line reported", progress.String())
+			}
+
+			if len(sqsClient.batches) != 1 {
+				t.Fatalf("batches = %d, want 1", len(sqsClient.batches))
+			}
+			var bodies []string
+			for _, e := range sqsClient.batches[0].Entries {
+				bodies = append(bodies, *e.MessageBody)
+				if got := *e.MessageAttributes["url_hash"].StringValue; got != hashURL(*e.MessageBody) {
+					t.Errorf("url_hash attribute = %q, want the hash of %s", got, *e.MessageBody)
+				}
+			}
+			wantBodies := []string{"https://example.com/a", "https://example.com/b", "https://example.net/c"}
+			if !reflect.DeepEqual(bodies, wantBodies) {
+				t.Errorf("enqueued %v, want %v", bodies, wantBodies)
+			}
+			if len(sqsClient.sent) != 0 {
+				t.Errorf("SendMessage calls = %d, want batches only", len(sqsClient.sent))
+			}
+		})
+	}
+}
+
+func TestStreamSeedsRecrawl(t *testing.T) {
+	tests := []struct {
+		name    string
+		recrawl bool
+		want    streamStats
+	}{
+		{"seen URL skipped", false, streamStats{Lines: 5, Enqueued: 3, AlreadySeen: 1, Invalid: 1, Domains: 3}},
+		{"stale URL reset", true, streamStats{Lines: 5, Enqueued: 4, Recrawled: 1, Invalid: 1, Domains: 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := hashURL("https://seen.example.org/")
+			ddb := &mockDynamoDB{putItemFunc: existingKeys(seen), updateItemFunc: staleKeys(seen)}
+			target := seedTarget{ddb: ddb, sqs: &mockSQS{}, tableName: "urls", queueURL: "normal-queue"}
+			if tt.recrawl {
+				target.recrawlAfter = time.Hour
+			}
+
+			stats, err := streamSeeds(context.Background(), target, strings.NewReader(streamManifest), io.Discard)
+			if err != nil {
+				t.Fatalf("streamSeeds() error = %v", err)
+			}
+			if stats != tt.want {
+				t.Errorf("stats = %+v, want %+v", stats, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamSeedsBatchBoundaries(t *testing.T) {
+	tests := []struct {
+		urls        int
+		wantBatches []int
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{9, []int{9}},
+		{10, []int{10}},
+		{11, []int{10, 1}},
+		{20, []int{10, 10}},
+		{25, []int{10, 10, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d urls", tt.urls), func(t *testing.T) {
+			var manifest strings.Builder
+			for i := range tt.urls {
+				fmt.Fprintf(&manifest, "https://example.com/page/%d\n", i)
+			}
+			sqsClient := &mockSQS{}
+			target := seedTarget{ddb: &mockDynamoDB{}, sqs: sqsClient, tableName: "urls", queueURL: "normal-queue"}
+
+			stats, err := streamSeeds(context.Background(), target, strings.NewReader(manifest.String()), io.Discard)
+			if err != nil {
+				t.Fatalf("streamSeeds() error = %v", err)
+			}
+			if stats.Enqueued != tt.urls {
+				t.Errorf("Enqueued = %d, want %d", stats.Enqueued, tt.urls)
+			}
+
+			var sizes []int
+			for _, b := range sqsClient.batches {
+				sizes = append(sizes, len(b.Entries))
+				seen := make(map[string]bool)
+				for _, e := range b.Entries {
+					if seen[*e.Id] {
+						t.Errorf("duplicate entry Id %q in one batch", *e.Id)
+					}
+					seen[*e.Id] = true
+				}
+			}
+			if !reflect.DeepEqual(sizes, tt.wantBatches) {
+				t.Errorf("batch sizes = %v, want %v", sizes, tt.wantBatches)
+			}
+		})
+	}
+}
+
+func TestStreamSeedsCountsBatchFailures(t *testing.T) {
+	sqsClient := &mockSQS{
+		sendMessageBatchFunc: func(_ context.Context, params *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+			out := &sqs.SendMessageBatchOutput{}
+			for i, e := range params.Entries {
+				if i == 0 {
+					out.Failed = append(out.Failed, sqstypes.BatchResultErrorEntry{Id: e.Id, Message: awsString("throttled")})
+					continue
+				}
+				out.Successful = append(out.Successful, sqstypes.SendMessageBatchResultEntry{Id: e.Id})
+			}
+			return out, nil
+		},
+	}
+	target := seedTarget{ddb: &mockDynamoDB{}, sqs: sqsClient, tableName: "urls", queueURL: "normal-queue"}
+
+	manifest := "https://example.com/1\nhttps://example.com/2\nhttps://example.com/3\n"
+	stats, err := streamSeeds(context.Background(), target, strings.NewReader(manifest), io.Discard)
+	if err != nil {
+		t.Fatalf("streamSeeds() error = %v", err)
+	}
+	if stats.Enqueued != 2 || stats.Failed != 1 {
+		t.Errorf("stats = %+v, want 2 enqueued and 1 failed", stats)
+	}
+}
+
+func TestStreamSeedsRegistersEachDomainOnce(t *testing.T) {
+	ddb := &mockDynamoDB{}
+	target := seedTarget{ddb: ddb, sqs: &mockSQS{}, tableName: "urls", queueURL: "normal-queue"}
+
+	manifest := "https://example.com/1\nhttps://example.com/2\nhttps://example.org/\n"
+	stats, err := streamSeeds(context.Background(), target, strings.NewReader(manifest), io.Discard)
+	if err != nil {
+		t.Fatalf("streamSeeds() error = %v", err)
+	}
+	if stats.Domains != 2 {
+		t.Errorf("Domains = %d, want 2", stats.Domains)
+	}
+	if len(ddb.puts) != 5 {
+		t.Errorf("PutItem calls = %d, want 5 (2 domains, 3 URLs)", len(ddb.puts))
+	}
+}
+
+func TestParseS3URI(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantBucket string
+		wantKey    string
+		wantErr    bool
+	}{
+		{"s3://seeds/batch/urls.txt.gz", "seeds", "batch/urls.txt.gz", false},
+		{"s3://seeds/urls.txt", "seeds", "urls.txt", false},
+		{"s3://seeds/", "", "", true},
+		{"s3://seeds", "", "", true},
+		{"https://seeds.s3.amazonaws.com/urls.txt", "", "", true},
+		{"urls.txt", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			bucket, key, err := parseS3URI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseS3URI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if bucket != tt.wantBucket || key != tt.wantKey {
+				t.Errorf("parseS3URI() = %q, %q, want %q, %q", bucket, key, tt.wantBucket, tt.wantKey)
+			}
+		})
+	}
+}
@@ -70,6 +70,16 @@ func NewCdkTestStack(scope constructs.Construct, id string, props *CdkTestStackP
 		},
 	})
 
+	// High-priority queue for seeds and sitemaps. SQS has no native priorities, so the Lambda
+	// gets a second event source; these messages are never stuck behind discovered links.
+	highPriorityQueue := awssqs.NewQueue(stack, jsii.String("UrlFrontierHighPriorityQueue"), &awssqs.QueueProps{
+		VisibilityTimeout: awscdk.Duration_Seconds(jsii.Number(60)), // Must be >= Lambda timeout
+		DeadLetterQueue: &awssqs.DeadLetterQueue{
+			Queue:           dlq,
+			MaxReceiveCount: jsii.Number(5),
+		},
+	})
+
 	// URL state / dedup table
 	table := awsdynamodb.NewTable(stack, jsii.String("UrlStateTable"), &awsdynamodb.TableProps{
 		PartitionKey: &awsdynamodb.Attribute{
@@ -81,6 +91,38 @@ func NewCdkTestStack(scope constructs.Construct, id string, props *CdkTestStackP
 		TimeToLiveAttribute: jsii.String("expires_at"),
 	})
 
+	// Status index for tools/recrawl: finds done items by age without a table scan.
+	// Sparse: items are only indexed once they have a finished_at.
+	table.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+		IndexName: jsii.String("status-index"),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("status"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("finished_at"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		ProjectionType:   awsdynamodb.ProjectionType_INCLUDE,
+		NonKeyAttributes: jsii.Strings("url", "crawl_depth", "job_id"),
+	})
+
+	// Domain index: list pages crawled for a host (catalog.QueryByDomain), newest first.
+	// Sparse: items written before the domain attribute existed are indexed once re-fetched.
+	table.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+		IndexName: jsii.String("domain-index"),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("domain"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("finished_at"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		ProjectionType:   awsdynamodb.ProjectionType_INCLUDE,
+		NonKeyAttributes: jsii.Strings("url", "status", "http_status"),
+	})
+
 	// Lambda function for crawling
 	crawlerLambda := awslambda.NewFunction(stack, jsii.String("CrawlerLambda"), &awslambda.FunctionProps{
 		Runtime:      awslambda.Runtime_PROVIDED_AL2023(),
@@ -94,29 +136,39 @@ func NewCdkTestStack(scope constructs.Construct, id string, props *CdkTestStackP
 		// Allow recursive loop: Lambda → SQS → Lambda is intentional for crawling
 		RecursiveLoop: awslambda.RecursiveLoop_ALLOW,
 		Environment: &map[string]*string{
-			"TABLE_NAME":     table.TableName(),
-			"QUEUE_URL":      queue.QueueUrl(),
-			"CONTENT_BUCKET": contentBucket.BucketName(),
-			"MAX_DEPTH":      jsii.String("3"),    // Limit crawl depth to prevent runaway costs
-			"CRAWL_DELAY_MS": jsii.String("1000"), // 1 second delay between requests to same domain
+			"TABLE_NAME":              table.TableName(),
+			"QUEUE_URL":               queue.QueueUrl(),
+			"HIGH_PRIORITY_QUEUE_URL": highPriorityQueue.QueueUrl(),
+			"CONTENT_BUCKET":          contentBucket.BucketName(),
+			"MAX_DEPTH":               jsii.String("3"),    // Limit crawl depth to prevent runaway costs
+			"CRAWL_DELAY_MS":          jsii.String("1000"), // 1 second delay between requests to same domain
 		},
 	})
 
 	// Grant Lambda permissions
 	table.GrantReadWriteData(crawlerLambda)
-	queue.GrantSendMessages(crawlerLambda)     // Allow Lambda to enqueue discovered links
+	queue.GrantSendMessages(crawlerLambda) // Allow Lambda to enqueue discovered links
+	highPriorityQueue.GrantSendMessages(crawlerLambda)
 	contentBucket.GrantPut(crawlerLambda, "*") // Allow Lambda to upload content to S3
 
 	// Add SQS trigger
 	crawlerLambda.AddEventSource(awslambdaeventsources.NewSqsEventSource(queue, &awslambdaeventsources.SqsEventSourceProps{
-		BatchSize:         jsii.Number(10),
-		MaxBatchingWindow: awscdk.Duration_Seconds(jsii.Number(5)),
+		BatchSize:               jsii.Number(10),
+		MaxBatchingWindow:       awscdk.Duration_Seconds(jsii.Number(5)),
+		ReportBatchItemFailures: jsii.Bool(true), // Handler returns failed message IDs; only those are retried
+	}))
+	crawlerLambda.AddEventSource(awslambdaeventsources.NewSqsEventSource(highPriorityQueue, &awslambdaeventsources.SqsEventSourceProps{
+		BatchSize:               jsii.Number(10),
+		ReportBatchItemFailures: jsii.Bool(true),
 	}))
 
 	// Tags
 	awscdk.Tags_Of(queue).Add(jsii.String("Component"), jsii.String("crawler-frontier"), nil)
 	awscdk.Tags_Of(queue).Add(jsii.String("Purpose"), jsii.String("url-ingestion"), nil)
 
+	awscdk.Tags_Of(highPriorityQueue).Add(jsii.String("Component"), jsii.String("crawler-frontier"), nil)
+	awscdk.Tags_Of(highPriorityQueue).Add(jsii.String("Purpose"), jsii.String("priority-ingestion"), nil)
+
 	awscdk.Tags_Of(dlq).Add(jsii.String("Component"), jsii.String("crawler-frontier"), nil)
 	awscdk.Tags_Of(dlq).Add(jsii.String("Purpose"), jsii.String("poison-messages"), nil)
 
@@ -307,6 +359,10 @@ func NewCdkTestStack(scope constructs.Construct, id string, props *CdkTestStackP
 		Value: queue.QueueUrl(),
 	})
 
+	awscdk.NewCfnOutput(stack, jsii.String("UrlFrontierHighPriorityQueueUrl"), &awscdk.CfnOutputProps{
+		Value: highPriorityQueue.QueueUrl(),
+	})
+
 	awscdk.NewCfnOutput(stack, jsii.String("UrlFrontierDLQUrl"), &awscdk.CfnOutputProps{
 		Value: dlq.QueueUrl(),
 	})
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/joho/godotenv"
+)
+
+// controlKey is the item the crawler reads its paused flag from (cached for 15s per Lambda)
+const controlKey = "crawl#control"
+
+func main() {
+	_ = godotenv.Load("../../.env")
+
+	if len(os.Args) != 2 || (os.Args[1] != "pause" && os.Args[1] != "resume" && os.Args[1] != "status") {
+		fmt.Println("Usage: control pause|resume|status")
+		fmt.Println("  pause   Stop fetching; claimed URLs are requeued until resumed")
+		fmt.Println("  resume  Start fetching again")
+		fmt.Println("  status  Show whether the crawl is paused")
+		os.Exit(1)
+	}
+
+	tableName := os.Getenv("TABLE_NAME")
+	if tableName == "" {
+		fmt.Println("TABLE_NAME must be set")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Println("Failed to load AWS config:", err)
+		os.Exit(1)
+	}
+	dynamo := dynamodb.NewFromConfig(cfg)
+
+	switch os.Args[1] {
+	case "status":
+		out, err := dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: &tableName,
+			Key: map[string]types.AttributeValue{
+				"url_hash": &types.AttributeValueMemberS{Value: controlKey},
+			},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			fmt.Println("Failed to read control item:", err)
+			os.Exit(1)
+		}
+		fmt.Println(describeControl(out.Item))
+	default:
+		paused := os.Args[1] == "pause"
+		if _, err := dynamo.UpdateItem(ctx, setPausedInput(tableName, paused, time.Now())); err != nil {
+			fmt.Println("Failed to update control item:", err)
+			os.Exit(1)
+		}
+		if paused {
+			fmt.Println("✓ Crawl paused (takes effect within 15s)")
+		} else {
+			fmt.Println("✓ Crawl resumed (takes effect within 15s)")
+		}
+	}
+}
+
+// setPausedInput sets the paused flag on the control item, creating it if needed
+func setPausedInput(tableName string, paused bool, now time.Time) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName: &tableName,
+		Key: map[string]types.AttributeValue{
+			"url_hash": &types.AttributeValueMemberS{Value: controlKey},
+		},
+		UpdateExpression: aws.String("SET paused = :paused, paused_updated_at = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":paused": &types.AttributeValueMemberBOOL{Value: paused},
+			":now":    &types.AttributeValueMemberS{Value: now.UTC().Format(time.RFC3339)},
+		},
+	}
+}
+
+// describeControl summarises the control item for the status subcommand.
+// A missing item or flag means the crawl is running.
+func describeControl(item map[string]types.AttributeValue) string {
+	flag, ok := item["paused"].(*types.AttributeValueMemberBOOL)
+	state := "running"
+	if ok && flag.Value {
+		state = "paused"
+	}
+	if since, ok := item["paused_updated_at"].(*types.AttributeValueMemberS); ok {
+		return fmt.Sprintf("Crawl %s (since %s)", state, since.Value)
+	}
+	return "Crawl " + state
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestSetPausedInput(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, paused := range []bool{true, false} {
+		in := setPausedInput("urls", paused, now)
+		if got := in.Key["url_hash"].(*types.AttributeValueMemberS).Value; got != controlKey {
+			t.Errorf("key = %q, want %q", got, controlKey)
+		}
+		if got := in.ExpressionAttributeValues[":paused"].(*types.AttributeValueMemberBOOL).Value; got != paused {
+			t.Errorf(":paused = %v, want %v", got, paused)
+		}
+		if got := in.ExpressionAttributeValues[":now"].(*types.AttributeValueMemberS).Value; got != "2024-06-01T12:00:00Z" {
+			t.Errorf(":now = %q", got)
+		}
+	}
+}
+
+func TestDescribeControl(t *testing.T) {
+	tests := []struct {
+		name string
+		item map[string]types.AttributeValue
+		want string
+	}{
+		{"no item", nil, "Crawl running"},
+		{"paused", map[string]types.AttributeValue{
+			"paused":            &types.AttributeValueMemberBOOL{Value: true},
+			"paused_updated_at": &types.AttributeValueMemberS{Value: "2024-06-01T12:00:00Z"},
+		}, "Crawl paused (since 2024-06-01T12:00:00Z)"},
+		{"resumed", map[string]types.AttributeValue{
+			"paused": &types.AttributeValueMemberBOOL{Value: false},
+		}, "Crawl running"},
+		{"wrong type", map[string]types.AttributeValue{
+			"paused": &types.AttributeValueMemberS{Value: "true"},
+		}, "Crawl running"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeControl(tt.item); got != tt.want {
+				t.Errorf("describeControl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/joho/godotenv"
+)
+
+const (
+	stateQueued     = "queued"
+	stateProcessing = "processing"
+	stateDone       = "done"
+
+	priorityHigh = "high"
+
+	// defaultProcessingTimeout matches the crawler's: a processing claim older than this is abandoned
+	defaultProcessingTimeout = 5 * time.Minute
+
+	// peekVisibility hides each received message for this many seconds so one run sees it once;
+	// messages that are not requeued are made visible again before the tool exits
+	peekVisibility = 60
+)
+
+// receiveAPI is the SQS call peek makes, so it can be tested without a queue
+type receiveAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+}
+
+// decision is what to do with a dead-lettered message under -requeue
+type decision struct {
+	Requeue bool
+	Reason  string // Why the message is skipped; empty when it is requeued
+}
+
+func main() {
+	_ = godotenv.Load("../../.env")
+
+	requeue := flag.Bool("requeue", false, "Move requeueable messages back to QUEUE_URL, resetting their items to queued")
+	limit := flag.Int("limit", 100, "Maximum number of messages to inspect (0 = no limit)")
+	dryRun := flag.Bool("dry-run", false, "With --requeue, show what would be requeued without changing anything")
+	flag.Parse()
+
+	dlqURL := os.Getenv("DLQ_URL")
+	queueURL := os.Getenv("QUEUE_URL")
+	highQueueURL := os.Getenv("HIGH_PRIORITY_QUEUE_URL") // priority=high messages go back here when set
+	staleAfter := defaultProcessingTimeout
+	if timeoutStr := os.Getenv("PROCESSING_TIMEOUT"); timeoutStr != "" {
+		if parsed, err := time.ParseDuration(timeoutStr); err == nil && parsed > 0 {
+			staleAfter = parsed
+		}
+	}
+	tableName := os.Getenv("TABLE_NAME")
+	if dlqURL == "" || (*requeue && !*dryRun && (queueURL == "" || tableName == "")) {
+		fmt.Println("DLQ_URL must be set (and QUEUE_URL and TABLE_NAME with --requeue)")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Println("Failed to load AWS config:", err)
+		os.Exit(1)
+	}
+
+	dynamo := dynamodb.NewFromConfig(cfg)
+	sqsClient := sqs.NewFromConfig(cfg)
+
+	messages, err := peek(ctx, sqsClient, dlqURL, *limit)
+	if err != nil {
+		fmt.Println("Failed to receive from the DLQ:", err)
+	}
+
+	var release []sqstypes.Message
+	requeued := 0
+	for _, m := range messages {
+		printMessage(m)
+		if !*requeue {
+			release = append(release, m)
+			continue
+		}
+
+		d := decide(m)
+		switch {
+		case !d.Requeue:
+			fmt.Printf("  skip: %s\n", d.Reason)
+			release = append(release, m)
+			continue
+		case *dryRun:
+			fmt.Println("  would requeue")
+			release = append(release, m)
+			continue
+		}
+
+		// Conditional reset: an item crawled since the message died stays done, one being crawled stays claimed
+		if _, err := dynamo.UpdateItem(ctx, resetInput(tableName, attr(m, "url_hash"), time.Now().Add(-staleAfter))); err != nil {
+			var failed *types.ConditionalCheckFailedException
+			if errors.As(err, &failed) {
+				fmt.Println("  skip: item is done, being crawled or missing")
+			} else {
+				fmt.Printf("  skip: %v\n", err)
+			}
+			release = append(release, m)
+			continue
+		}
+		if _, err := sqsClient.SendMessage(ctx, requeueInput(queueURL, highQueueURL, m)); err != nil {
+			fmt.Printf("  Warning: reset the item but failed to requeue: %v\n", err)
+			release = append(release, m)
+			continue
+		}
+		if _, err := sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: &dlqURL, ReceiptHandle: m.ReceiptHandle}); err != nil {
+			fmt.Printf("  Warning: requeued but failed to delete from the DLQ: %v\n", err)
+			continue
+		}
+		fmt.Println("  requeued")
+		requeued++
+	}
+
+	// Peeked messages stay in the DLQ and are visible again right away
+	for _, m := range release {
+		_, _ = sqsClient.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          &dlqURL,
+			ReceiptHandle:     m.ReceiptHandle,
+			VisibilityTimeout: 0,
+		})
+	}
+
+	switch {
+	case !*requeue:
+		fmt.Printf("%d messages in the DLQ (inspected only, nothing changed)\n", len(messages))
+	case *dryRun:
+		fmt.Printf("%d messages inspected (dry run, nothing changed)\n", len(messages))
+	default:
+		fmt.Printf("✓ Requeued %d of %d messages\n", requeued, len(messages))
+	}
+}
+
+// peek receives up to limit messages from the DLQ, hiding each for peekVisibility seconds so
+// none is returned twice. It stops when a receive comes back empty or holds only messages already
+// seen (those whose visibility ran out during a long run), which is what ends a -limit 0 run.
+func peek(ctx context.Context, client receiveAPI, dlqURL string, limit int) ([]sqstypes.Message, error) {
+	var messages []sqstypes.Message
+	seen := make(map[string]bool)
+	for limit <= 0 || len(messages) < limit {
+		batch := int32(10)
+		if limit > 0 {
+			batch = int32(min(10, limit-len(messages)))
+		}
+		out, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    &dlqURL,
+			MaxNumberOfMessages:         batch,
+			VisibilityTimeout:           peekVisibility,
+			WaitTimeSeconds:             1,
+			MessageAttributeNames:       []string{"All"},
+			MessageSystemAttributeNames: []sqstypes.MessageSystemAttributeName{sqstypes.MessageSystemAttributeNameApproximateReceiveCount},
+		})
+		if err != nil {
+			return messages, err
+		}
+		if len(out.Messages) == 0 {
+			return messages, nil
+		}
+		unseen := 0
+		for _, m := range out.Messages {
+			if !seen[aws.ToString(m.MessageId)] {
+				seen[aws.ToString(m.MessageId)] = true
+				messages = append(messages, m)
+				unseen++
+			}
+		}
+		if unseen == 0 {
+			return messages, nil
+		}
+	}
+	return messages, nil
+}
+
+// printMessage writes a message's URL, receive count and attributes, sorted by name
+func printMessage(m sqstypes.Message) {
+	fmt.Printf("%s  (received %s times)\n", aws.ToString(m.Body), m.Attributes[string(sqstypes.MessageSystemAttributeNameApproximateReceiveCount)])
+	names := make([]string, 0, len(m.MessageAttributes))
+	for name := range m.MessageAttributes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Printf("  %s = %s\n", name, strings.ReplaceAll(attr(m, name), "\n", " <- "))
+	}
+}
+
+// attr returns a message attribute's string value, or "" when it is absent
+func attr(m sqstypes.Message, name string) string {
+	return aws.ToString(m.MessageAttributes[name].StringValue)
+}
+
+// decide reports whether a dead-lettered message can be requeued: it needs an http(s) URL as its
+// body and the url_hash of the item to reset, which every message the crawler or producer
+// sends carries
+func decide(m sqstypes.Message) decision {
+	u, err := url.Parse(aws.ToString(m.Body))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return decision{Reason: "body is not an http(s) URL"}
+	}
+	if attr(m, "url_hash") == "" {
+		return decision{Reason: "no url_hash attribute"}
+	}
+	return decision{Requeue: true}
+}
+
+// resetInput moves an item back to queued with a fresh attempt count and no TTL, so the crawler
+// claims it again instead of giving up on it at once, and the table's TTL cannot delete it first.
+// Items that are done (crawled since the message died), missing, or processing under a claim
+// taken since cutoff are left alone. processing_at is RFC3339 UTC, so string order is time order.
+func resetInput(tableName, urlHash string, cutoff time.Time) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName: &tableName,
+		Key: map[string]types.AttributeValue{
+			"url_hash": &types.AttributeValueMemberS{Value: urlHash},
+		},
+		UpdateExpression: aws.String("SET #s = :queued REMOVE attempts, processing_at, expires_at"),
+		ConditionExpression: aws.String("attribute_exists(url_hash) AND #s <> :done " +
+			"AND (#s <> :processing OR processing_at < :cutoff)"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":queued":     &types.AttributeValueMemberS{Value: stateQueued},
+			":done":       &types.AttributeValueMemberS{Value: stateDone},
+			":processing": &types.AttributeValueMemberS{Value: stateProcessing},
+			":cutoff":     &types.AttributeValueMemberS{Value: cutoff.UTC().Format(time.RFC3339)},
+		},
+	}
+}
+
+// requeueInput builds the main-queue message for a dead-lettered one: the same URL and message
+// attributes (depth, priority, url_hash, job_id, ancestry and any overrides), so the crawler
+// treats it as the original. A priority=high message goes to highQueueURL when it is set, the
+// queue the crawler and producer send high-priority URLs to.
+func requeueInput(queueURL, highQueueURL string, m sqstypes.Message) *sqs.SendMessageInput {
+	attrs := make(map[string]sqstypes.MessageAttributeValue, len(m.MessageAttributes))
+	for name, a := range m.MessageAttributes {
+		attrs[name] = sqstypes.MessageAttributeValue{
+			DataType:    a.DataType,
+			StringValue: a.StringValue,
+			BinaryValue: a.BinaryValue,
+		}
+	}
+	if attr(m, "priority") == priorityHigh && highQueueURL != "" {
+		queueURL = highQueueURL
+	}
+	return &sqs.SendMessageInput{
+		QueueUrl:          &queueURL,
+		MessageBody:       m.Body,
+		MessageAttributes: attrs,
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+func stringAttr(dataType, value string) sqstypes.MessageAttributeValue {
+	return sqstypes.MessageAttributeValue{DataType: aws.String(dataType), StringValue: aws.String(value)}
+}
+
+func TestDecide(t *testing.T) {
+	withHash := map[string]sqstypes.MessageAttributeValue{"url_hash": stringAttr("String", "abc")}
+
+	tests := []struct {
+		name  string
+		body  string
+		attrs map[string]sqstypes.MessageAttributeValue
+		want  decision
+	}{
+		{"crawler message", "https://example.com/page", withHash, decision{Requeue: true}},
+		{"http url", "http://example.com/", withHash, decision{Requeue: true}},
+		{"no url_hash", "https://example.com/page", nil, decision{Reason: "no url_hash attribute"}},
+		{"empty url_hash", "https://example.com/page", map[string]sqstypes.MessageAttributeValue{"url_hash": stringAttr("String", "")}, decision{Reason: "no url_hash attribute"}},
+		{"not a url", "hello", withHash, decision{Reason: "body is not an http(s) URL"}},
+		{"other scheme", "ftp://example.com/file", withHash, decision{Reason: "body is not an http(s) URL"}},
+		{"empty body", "", withHash, decision{Reason: "body is not an http(s) URL"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := sqstypes.Message{Body: aws.String(tt.body), MessageAttributes: tt.attrs}
+			if got := decide(m); got != tt.want {
+				t.Errorf("decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequeueInputKeepsMessage(t *testing.T) {
+	m := sqstypes.Message{
+		Body:          aws.String("https://example.com/page"),
+		ReceiptHandle: aws.String("receipt"),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"depth":          stringAttr("Number", "2"),
+			"priority":       stringAttr("String", "normal"),
+			"url_hash":       stringAttr("String", "abc"),
+			"job_id":         stringAttr("String", "june-crawl"),
+			"crawl_delay_ms": stringAttr("Number", "3000"),
+		},
+	}
+
+	in := requeueInput("https://sqs.example.com/main", "https://sqs.example.com/high", m)
+	if *in.QueueUrl != "https://sqs.example.com/main" {
+		t.Errorf("QueueUrl = %q, want the main queue", *in.QueueUrl)
+	}
+	if *in.MessageBody != "https://example.com/page" {
+		t.Errorf("MessageBody = %q, want the URL", *in.MessageBody)
+	}
+	if len(in.MessageAttributes) != len(m.MessageAttributes) {
+		t.Errorf("%d attributes, want %d", len(in.MessageAttributes), len(m.MessageAttributes))
+	}
+	for name, want := range m.MessageAttributes {
+		got := in.MessageAttributes[name]
+		if aws.ToString(got.DataType) != *want.DataType || aws.ToString(got.StringValue) != *want.StringValue {
+			t.Errorf("%s = %s %s, want %s %s", name, aws.ToString(got.DataType), aws.ToString(got.StringValue), *want.DataType, *want.StringValue)
+		}
+	}
+	if in.DelaySeconds != 0 {
+		t.Errorf("DelaySeconds = %d, want the message visible at once", in.DelaySeconds)
+	}
+}
+
+func TestRequeueInputRoutesHighPriority(t *testing.T) {
+	const mainQueue, highQueue = "https://sqs.example.com/main", "https://sqs.example.com/high"
+	tests := []struct {
+		name     string
+		priority string
+		highURL  string
+		want     string
+	}{
+		{"high with a high queue", "high", highQueue, highQueue},
+		{"high without a high queue", "high", "", mainQueue},
+		{"normal", "normal", highQueue, mainQueue},
+		{"no priority", "", highQueue, mainQueue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := sqstypes.Message{Body: aws.String("https://example.com/sitemap.xml"), MessageAttributes: map[string]sqstypes.MessageAttributeValue{}}
+			if tt.priority != "" {
+				m.MessageAttributes["priority"] = stringAttr("String", tt.priority)
+			}
+			if got := *requeueInput(mainQueue, tt.highURL, m).QueueUrl; got != tt.want {
+				t.Errorf("QueueUrl = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// redeliveringDLQ returns the same messages on every receive, as a DLQ does once their
+// visibility runs out during a long peek
+type redeliveringDLQ struct {
+	messages []sqstypes.Message
+	receives int
+}
+
+func (q *redeliveringDLQ) ReceiveMessage(_ context.Context, _ *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	q.receives++
+	return &sqs.ReceiveMessageOutput{Messages: q.messages}, nil
+}
+
+func TestPeekNoLimitStopsOnRedelivery(t *testing.T) {
+	q := &redeliveringDLQ{messages: []sqstypes.Message{
+		{MessageId: aws.String("m1"), Body: aws.String("https://example.com/a")},
+		{MessageId: aws.String("m2"), Body: aws.String("https://example.com/b")},
+	}}
+
+	messages, err := peek(context.Background(), q, "https://sqs.example.com/dlq", 0)
+	if err != nil {
+		t.Fatalf("peek() error = %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("peek() returned %d messages, want each once", len(messages))
+	}
+	if q.receives != 2 {
+		t.Errorf("receives = %d, want a stop at the first batch of seen messages", q.receives)
+	}
+}
+
+func TestResetInput(t *testing.T) {
+	cutoff := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	in := resetInput("urls", "abc", cutoff)
+
+	if key := in.Key["url_hash"].(*types.AttributeValueMemberS); key.Value != "abc" {
+		t.Errorf("key = %q, want abc", key.Value)
+	}
+	if *in.UpdateExpression != "SET #s = :queued REMOVE attempts, processing_at, expires_at" {
+		t.Errorf("UpdateExpression = %q, want status queued with attempts and TTL cleared", *in.UpdateExpression)
+	}
+	if *in.ConditionExpression != "attribute_exists(url_hash) AND #s <> :done AND (#s <> :processing OR processing_at < :cutoff)" {
+		t.Errorf("ConditionExpression = %q, want done, missing and freshly claimed items left alone", *in.ConditionExpression)
+	}
+	values := map[string]string{":queued": stateQueued, ":done": stateDone, ":processing": stateProcessing, ":cutoff": "2024-05-01T12:00:00Z"}
+	for name, want := range values {
+		if v := in.ExpressionAttributeValues[name].(*types.AttributeValueMemberS); v.Value != want {
+			t.Errorf("%s = %q, want %q", name, v.Value, want)
+		}
+	}
+}
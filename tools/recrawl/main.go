@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/joho/godotenv"
+)
+
+const (
+	statusIndexName = "status-index" // GSI: status (PK), finished_at (SK)
+	stateDone       = "done"
+	stateQueued     = "queued"
+
+	// defaultMaxAge is below the crawler's 7-day item TTL: older done items are already due for
+	// TTL deletion, so by default the tool stops short of them
+	defaultMaxAge = 24 * time.Hour
+)
+
+// staleItem is a done URL whose content is older than the max age
+type staleItem struct {
+	URLHash    string
+	URL        string
+	Depth      int
+	FinishedAt string
+	JobID      string // Empty when the item belongs to no job
+}
+
+func main() {
+	_ = godotenv.Load("../../.env")
+
+	maxAge := flag.Duration("max-age", defaultMaxAge, "Re-crawl done items whose finished_at is older than this")
+	limit := flag.Int("limit", 100, "Maximum number of items to re-crawl (0 = no limit)")
+	dryRun := flag.Bool("dry-run", false, "List stale items without resetting or enqueueing them")
+	jobID := flag.String("job", "", "Only re-crawl items whose job_id is this (empty = all jobs)")
+	flag.Parse()
+
+	queueURL := os.Getenv("QUEUE_URL")
+	tableName := os.Getenv("TABLE_NAME")
+	if tableName == "" || (queueURL == "" && !*dryRun) {
+		fmt.Println("TABLE_NAME and QUEUE_URL must be set (QUEUE_URL is optional with --dry-run)")
+		os.Exit(1)
+	}
+	if *maxAge <= 0 {
+		fmt.Println("--max-age must be positive")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Println("Failed to load AWS config:", err)
+		os.Exit(1)
+	}
+
+	dynamo := dynamodb.NewFromConfig(cfg)
+	sqsClient := sqs.NewFromConfig(cfg)
+
+	cutoff := time.Now().UTC().Add(-*maxAge)
+	items, err := findStale(ctx, dynamo, tableName, cutoff, *jobID, *limit)
+	if err != nil {
+		fmt.Println("Failed to query stale items:", err)
+		os.Exit(1)
+	}
+
+	if *dryRun {
+		for _, it := range items {
+			fmt.Printf("%s  %s\n", it.FinishedAt, it.URL)
+		}
+		fmt.Printf("%d items older than %s (dry run, nothing changed)\n", len(items), cutoff.Format(time.RFC3339))
+		return
+	}
+
+	requeued := 0
+	for _, it := range items {
+		// Conditional reset: skip items another process already re-crawled or claimed
+		if _, err := dynamo.UpdateItem(ctx, resetInput(tableName, it)); err != nil {
+			fmt.Printf("Skipping %s: %v\n", it.URL, err)
+			continue
+		}
+		if _, err := sqsClient.SendMessage(ctx, enqueueInput(queueURL, it)); err != nil {
+			fmt.Printf("Warning: reset %s but failed to enqueue: %v\n", it.URL, err)
+			continue
+		}
+		requeued++
+	}
+
+	fmt.Printf("✓ Re-enqueued %d of %d stale items\n", requeued, len(items))
+}
+
+// findStale queries the status index for done items finished before cutoff, oldest first,
+// limited to one job when jobID is set
+func findStale(ctx context.Context, client *dynamodb.Client, tableName string, cutoff time.Time, jobID string, limit int) ([]staleItem, error) {
+	var items []staleItem
+	var lastKey map[string]types.AttributeValue
+
+	for {
+		out, err := client.Query(ctx, staleQueryInput(tableName, cutoff, jobID, lastKey))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, raw := range out.Items {
+			it, ok := parseStaleItem(raw)
+			if !ok || !isStale(it.FinishedAt, cutoff) {
+				continue
+			}
+			items = append(items, it)
+			if limit > 0 && len(items) >= limit {
+				return items, nil
+			}
+		}
+
+		if out.LastEvaluatedKey == nil {
+			return items, nil
+		}
+		lastKey = out.LastEvaluatedKey
+	}
+}
+
+// staleQueryInput builds the status index query for done items finished before cutoff,
+// filtered to job_id = jobID when jobID is set.
+// finished_at is RFC3339 UTC, so string order matches time order.
+func staleQueryInput(tableName string, cutoff time.Time, jobID string, startKey map[string]types.AttributeValue) *dynamodb.QueryInput {
+	in := &dynamodb.QueryInput{
+		TableName:              &tableName,
+		IndexName:              aws.String(statusIndexName),
+		KeyConditionExpression: aws.String("#s = :done AND finished_at < :cutoff"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":done":   &types.AttributeValueMemberS{Value: stateDone},
+			":cutoff": &types.AttributeValueMemberS{Value: cutoff.UTC().Format(time.RFC3339)},
+		},
+		ExclusiveStartKey: startKey,
+	}
+	if jobID != "" {
+		in.FilterExpression = aws.String("job_id = :job")
+		in.ExpressionAttributeValues[":job"] = &types.AttributeValueMemberS{Value: jobID}
+	}
+	return in
+}
+
+// isStale reports whether an RFC3339 finished_at timestamp is before cutoff.
+// Unparseable timestamps are never considered stale.
+func isStale(finishedAt string, cutoff time.Time) bool {
+	t, err := time.Parse(time.RFC3339, finishedAt)
+	if err != nil {
+		return false
+	}
+	return t.Before(cutoff)
+}
+
+// parseStaleItem extracts the fields needed to re-crawl an item.
+// Returns false if the item has no url_hash, url or finished_at.
+func parseStaleItem(item map[string]types.AttributeValue) (staleItem, bool) {
+	hash, ok1 := item["url_hash"].(*types.AttributeValueMemberS)
+	u, ok2 := item["url"].(*types.AttributeValueMemberS)
+	finished, ok3 := item["finished_at"].(*types.AttributeValueMemberS)
+	if !ok1 || !ok2 || !ok3 {
+		return staleItem{}, false
+	}
+
+	it := staleItem{URLHash: hash.Value, URL: u.Value, FinishedAt: finished.Value}
+	if depth, ok := item["crawl_depth"].(*types.AttributeValueMemberN); ok {
+		if parsed, err := strconv.Atoi(depth.Value); err == nil && parsed >= 0 {
+			it.Depth = parsed
+		}
+	}
+	if job, ok := item["job_id"].(*types.AttributeValueMemberS); ok {
+		it.JobID = job.Value
+	}
+	return it, true
+}
+
+// resetInput moves a done item back to queued so the crawler can claim it again, with a fresh
+// attempt count and no TTL, as the crawler's own RECRAWL reset does. The condition on finished_at
+// makes the reset a no-op if the item changed since the query.
+func resetInput(tableName string, it staleItem) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName: &tableName,
+		Key: map[string]types.AttributeValue{
+			"url_hash": &types.AttributeValueMemberS{Value: it.URLHash},
+		},
+		UpdateExpression:    aws.String("SET #s = :queued REMOVE attempts, processing_at, expires_at"),
+		ConditionExpression: aws.String("#s = :done AND finished_at = :finished"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":queued":   &types.AttributeValueMemberS{Value: stateQueued},
+			":done":     &types.AttributeValueMemberS{Value: stateDone},
+			":finished": &types.AttributeValueMemberS{Value: it.FinishedAt},
+		},
+	}
+}
+
+// enqueueInput builds the SQS message for a reset item, keeping its original depth, url_hash and job_id
+func enqueueInput(queueURL string, it staleItem) *sqs.SendMessageInput {
+	attrs := map[string]sqstypes.MessageAttributeValue{
+		"depth": {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(it.Depth)),
+		},
+		"priority": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("normal"),
+		},
+		"url_hash": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(it.URLHash),
+		},
+	}
+	if it.JobID != "" {
+		attrs["job_id"] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(it.JobID),
+		}
+	}
+	return &sqs.SendMessageInput{
+		QueueUrl:          &queueURL,
+		MessageBody:       aws.String(it.URL),
+		MessageAttributes: attrs,
+	}
+}
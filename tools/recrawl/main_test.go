@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestIsStale(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		finishedAt string
+		want       bool
+	}{
+		{"well before cutoff", "2024-05-01T00:00:00Z", true},
+		{"one second before", "2024-05-31T23:59:59Z", true},
+		{"exactly at cutoff", "2024-06-01T00:00:00Z", false},
+		{"after cutoff", "2024-06-02T00:00:00Z", false},
+		{"other timezone before cutoff", "2024-06-01T01:00:00+02:00", true},
+		{"empty", "", false},
+		{"garbage", "yesterday", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStale(tt.finishedAt, cutoff); got != tt.want {
+				t.Errorf("isStale(%q) = %v, want %v", tt.finishedAt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStaleItem(t *testing.T) {
+	tests := []struct {
+		name   string
+		item   map[string]types.AttributeValue
+		want   staleItem
+		wantOK bool
+	}{
+		{
+			name: "complete item",
+			item: map[string]types.AttributeValue{
+				"url_hash":    &types.AttributeValueMemberS{Value: "abc"},
+				"url":         &types.AttributeValueMemberS{Value: "https://example.com/"},
+				"finished_at": &types.AttributeValueMemberS{Value: "2024-05-01T00:00:00Z"},
+				"crawl_depth": &types.AttributeValueMemberN{Value: "2"},
+				"job_id":      &types.AttributeValueMemberS{Value: "june-crawl"},
+			},
+			want:   staleItem{URLHash: "abc", URL: "https://example.com/", Depth: 2, FinishedAt: "2024-05-01T00:00:00Z", JobID: "june-crawl"},
+			wantOK: true,
+		},
+		{
+			name: "missing depth defaults to zero",
+			item: map[string]types.AttributeValue{
+				"url_hash":    &types.AttributeValueMemberS{Value: "abc"},
+				"url":         &types.AttributeValueMemberS{Value: "https://example.com/"},
+				"finished_at": &types.AttributeValueMemberS{Value: "2024-05-01T00:00:00Z"},
+			},
+			want:   staleItem{URLHash: "abc", URL: "https://example.com/", FinishedAt: "2024-05-01T00:00:00Z"},
+			wantOK: true,
+		},
+		{
+			name: "missing url",
+			item: map[string]types.AttributeValue{
+				"url_hash":    &types.AttributeValueMemberS{Value: "abc"},
+				"finished_at": &types.AttributeValueMemberS{Value: "2024-05-01T00:00:00Z"},
+			},
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseStaleItem(tt.item)
+			if ok != tt.wantOK {
+				t.Fatalf("parseStaleItem() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if got != tt.want {
+				t.Errorf("parseStaleItem() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResetInput(t *testing.T) {
+	it := staleItem{URLHash: "abc", URL: "https://example.com/", Depth: 1, FinishedAt: "2024-05-01T00:00:00Z"}
+	in := resetInput("test-table", it)
+
+	if *in.TableName != "test-table" {
+		t.Errorf("TableName = %q, want test-table", *in.TableName)
+	}
+	if key := in.Key["url_hash"].(*types.AttributeValueMemberS).Value; key != "abc" {
+		t.Errorf("url_hash key = %q, want abc", key)
+	}
+	if *in.UpdateExpression != "SET #s = :queued REMOVE attempts, processing_at, expires_at" {
+		t.Errorf("UpdateExpression = %q, want status queued with attempts and TTL cleared", *in.UpdateExpression)
+	}
+	if *in.ConditionExpression != "#s = :done AND finished_at = :finished" {
+		t.Errorf("ConditionExpression = %q", *in.ConditionExpression)
+	}
+
+	values := map[string]string{":queued": "queued", ":done": "done", ":finished": "2024-05-01T00:00:00Z"}
+	for name, want := range values {
+		if got := in.ExpressionAttributeValues[name].(*types.AttributeValueMemberS).Value; got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestEnqueueInputKeepsDepth(t *testing.T) {
+	in := enqueueInput("queue-url", staleItem{URLHash: "h1", URL: "https://example.com/a", Depth: 2})
+
+	if *in.MessageBody != "https://example.com/a" {
+		t.Errorf("MessageBody = %q", *in.MessageBody)
+	}
+	if got := *in.MessageAttributes["depth"].StringValue; got != "2" {
+		t.Errorf("depth attribute = %q, want 2", got)
+	}
+	if got := *in.MessageAttributes["priority"].StringValue; got != "normal" {
+		t.Errorf("priority attribute = %q, want normal", got)
+	}
+	if got := *in.MessageAttributes["url_hash"].StringValue; got != "h1" {
+		t.Errorf("url_hash attribute = %q, want h1", got)
+	}
+}
+
+func TestStaleQueryInput(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	startKey := map[string]types.AttributeValue{"url_hash": &types.AttributeValueMemberS{Value: "last"}}
+
+	in := staleQueryInput("test-table", cutoff, "", startKey)
+
+	if *in.IndexName != statusIndexName {
+		t.Errorf("IndexName = %q, want %q", *in.IndexName, statusIndexName)
+	}
+	if got := in.ExpressionAttributeValues[":cutoff"].(*types.AttributeValueMemberS).Value; got != "2024-06-01T10:00:00Z" {
+		t.Errorf(":cutoff = %q, want UTC 2024-06-01T10:00:00Z", got)
+	}
+	if in.ExclusiveStartKey["url_hash"].(*types.AttributeValueMemberS).Value != "last" {
+		t.Error("ExclusiveStartKey not passed through for pagination")
+	}
+	if in.FilterExpression != nil {
+		t.Errorf("FilterExpression = %q without -job, want none", *in.FilterExpression)
+	}
+}
+
+func TestStaleQueryInputFiltersByJob(t *testing.T) {
+	in := staleQueryInput("test-table", time.Now(), "june-crawl", nil)
+
+	if in.FilterExpression == nil || *in.FilterExpression != "job_id = :job" {
+		t.Fatalf("FilterExpression = %v, want job_id = :job", in.FilterExpression)
+	}
+	if got := in.ExpressionAttributeValues[":job"].(*types.AttributeValueMemberS).Value; got != "june-crawl" {
+		t.Errorf(":job = %q, want june-crawl", got)
+	}
+}
+
+func TestEnqueueInputKeepsJobID(t *testing.T) {
+	in := enqueueInput("queue-url", staleItem{URLHash: "h1", URL: "https://example.com/a", JobID: "june-crawl"})
+	if got := in.MessageAttributes["job_id"]; got.StringValue == nil || *got.StringValue != "june-crawl" {
+		t.Errorf("job_id attribute = %+v, want june-crawl", got)
+	}
+
+	in = enqueueInput("queue-url", staleItem{URLHash: "h1", URL: "https://example.com/a"})
+	if _, ok := in.MessageAttributes["job_id"]; ok {
+		t.Error("job_id attribute set for an item without a job")
+	}
+}